@@ -41,9 +41,10 @@ type stateId struct {
 }
 
 type dbRoom struct { // always lock in the same order as below
-	id        types.RoomId
-	stateLock sync.RWMutex
-	states    map[stateId]*matrixTypes.State
+	id         types.RoomId
+	stateLock  sync.RWMutex
+	states     map[stateId]*matrixTypes.State
+	visibility matrixTypes.Visibility
 }
 
 func (db *roomDb) CreateRoom(id types.RoomId) (exists bool, err matrixTypes.Error) {
@@ -95,6 +96,22 @@ func (db *roomDb) SetRoomState(roomId types.RoomId, userId types.UserId, content
 	return state, nil
 }
 
+func (db *roomDb) RedactRoomState(roomId types.RoomId, redacted *matrixTypes.State) matrixTypes.Error {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	room := db.rooms[roomId]
+	if room == nil {
+		return matrixTypes.NotFoundError("room '" + roomId.String() + "' doesn't exist")
+	}
+	room.stateLock.Lock()
+	defer room.stateLock.Unlock()
+	stateId := stateId{redacted.EventType, redacted.StateKey}
+	if current := room.states[stateId]; current != nil && current.EventId == redacted.EventId {
+		room.states[stateId] = redacted
+	}
+	return nil
+}
+
 func (db *roomDb) RoomState(roomId types.RoomId, eventType, stateKey string) (*matrixTypes.State, matrixTypes.Error) {
 	db.roomsLock.RLock()
 	defer db.roomsLock.RUnlock()
@@ -123,3 +140,42 @@ func (db *roomDb) EntireRoomState(roomId types.RoomId) ([]*matrixTypes.State, ma
 	}
 	return states, nil
 }
+
+func (db *roomDb) SetRoomVisibility(roomId types.RoomId, visibility matrixTypes.Visibility) matrixTypes.Error {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	room := db.rooms[roomId]
+	if room == nil {
+		return matrixTypes.NotFoundError("room '" + roomId.String() + "' doesn't exist")
+	}
+	room.stateLock.Lock()
+	defer room.stateLock.Unlock()
+	room.visibility = visibility
+	return nil
+}
+
+func (db *roomDb) RoomVisibility(roomId types.RoomId) (matrixTypes.Visibility, matrixTypes.Error) {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	room := db.rooms[roomId]
+	if room == nil {
+		return matrixTypes.VisibilityPrivate, matrixTypes.NotFoundError("room '" + roomId.String() + "' doesn't exist")
+	}
+	room.stateLock.RLock()
+	defer room.stateLock.RUnlock()
+	return room.visibility, nil
+}
+
+func (db *roomDb) PublicRooms() ([]types.RoomId, matrixTypes.Error) {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	rooms := []types.RoomId{}
+	for id, room := range db.rooms {
+		room.stateLock.RLock()
+		if room.visibility == matrixTypes.VisibilityPublic {
+			rooms = append(rooms, id)
+		}
+		room.stateLock.RUnlock()
+	}
+	return rooms, nil
+}
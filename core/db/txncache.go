@@ -0,0 +1,98 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/bullettime/core/interfaces"
+)
+
+type transactionCache struct {
+	sync.Mutex
+	expiry    time.Duration
+	now       func() time.Time
+	entries   map[string]*transaction
+	lastSweep time.Time
+}
+
+type transaction struct {
+	sync.Mutex
+	// all fields below are guarded by the cache lock
+	waiting int
+	result  interface{}
+	done    bool
+	expires time.Time
+}
+
+func NewTransactionCache(expiry time.Duration, now func() time.Time) (interfaces.TransactionCache, error) {
+	return &transactionCache{
+		expiry:    expiry,
+		now:       now,
+		entries:   map[string]*transaction{},
+		lastSweep: now(),
+	}, nil
+}
+
+func (c *transactionCache) Do(key string, fn func() (interface{}, bool)) interface{} {
+	c.Lock()
+	if now := c.now(); now.Sub(c.lastSweep) > c.expiry {
+		c.sweep(now)
+	}
+	txn := c.entries[key]
+	if txn == nil {
+		txn = &transaction{}
+		c.entries[key] = txn
+	}
+	txn.waiting += 1
+	c.Unlock()
+
+	txn.Lock()
+	defer txn.Unlock()
+	defer func() {
+		c.Lock()
+		txn.waiting -= 1
+		c.Unlock()
+	}()
+
+	c.Lock()
+	done := txn.done && c.now().Before(txn.expires)
+	result := txn.result
+	c.Unlock()
+	if done {
+		return result
+	}
+
+	result, keep := fn()
+	if keep {
+		c.Lock()
+		txn.result = result
+		txn.done = true
+		txn.expires = c.now().Add(c.expiry)
+		c.Unlock()
+	}
+	return result
+}
+
+// must be called with the lock held
+func (c *transactionCache) sweep(now time.Time) {
+	for key, txn := range c.entries {
+		if txn.waiting == 0 && (!txn.done || !now.Before(txn.expires)) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
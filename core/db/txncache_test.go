@@ -0,0 +1,55 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionCache(t *testing.T) {
+	now := time.Now()
+	cache, err := NewTransactionCache(time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	send := func(keep bool) func() (interface{}, bool) {
+		return func() (interface{}, bool) {
+			calls += 1
+			return calls, keep
+		}
+	}
+	if result := cache.Do("a", send(false)); result != 1 {
+		t.Error("expected first call to run, got", result)
+	}
+	if result := cache.Do("a", send(true)); result != 2 {
+		t.Error("expected call to run again after a result that wasn't kept, got", result)
+	}
+	if result := cache.Do("a", send(true)); result != 2 {
+		t.Error("expected kept result to be replayed, got", result)
+	}
+	if result := cache.Do("b", send(true)); result != 3 {
+		t.Error("expected other key to run, got", result)
+	}
+	now = now.Add(59 * time.Second)
+	if result := cache.Do("a", send(true)); result != 2 {
+		t.Error("expected kept result to be replayed until it expires, got", result)
+	}
+	now = now.Add(time.Second)
+	if result := cache.Do("a", send(true)); result != 4 {
+		t.Error("expected call to run again after expiry, got", result)
+	}
+}
@@ -43,9 +43,14 @@ type messageStream struct {
 	list           *list.List
 	byId           map[types.Id]indexedEvent
 	byIndex        []*indexedEvent
+	roomStates     map[types.RoomId][]*indexedEvent
+	redacted       map[types.Id]*indexedEvent
+	relations      map[types.Id][]*relation
+	threads        map[types.RoomId][]types.Id
 	max            uint64
 	members        interfaces.MembershipStore
 	asyncEventSink interfaces.AsyncEventSink
+	indexers       []interfaces.EventIndexer
 }
 
 func NewMessageStream(
@@ -56,6 +61,10 @@ func NewMessageStream(
 		list:           list.New(),
 		byId:           map[types.Id]indexedEvent{},
 		byIndex:        []*indexedEvent{},
+		roomStates:     map[types.RoomId][]*indexedEvent{},
+		redacted:       map[types.Id]*indexedEvent{},
+		relations:      map[types.Id][]*relation{},
+		threads:        map[types.RoomId][]types.Id{},
 		members:        members,
 		asyncEventSink: asyncEventSink,
 	}, nil
@@ -73,6 +82,21 @@ func (s *messageStream) Send(event types.Event) (uint64, matrixTypes.Error) {
 	}
 	s.byIndex = append(s.byIndex, &indexed)
 	s.byId[event.GetEventKey()] = indexed
+	if _, ok := event.(*matrixTypes.State); ok {
+		room := *event.GetRoomId()
+		s.roomStates[room] = append(s.roomStates[room], &indexed)
+	}
+	if redaction, ok := event.(*matrixTypes.Redaction); ok {
+		s.redact(redaction)
+	}
+	if message, ok := event.(*matrixTypes.Message); ok {
+		s.relate(message, &indexed)
+	}
+	for _, indexer := range s.indexers {
+		if err := indexer.Index(&indexed); err != nil {
+			log.Println("failed to index event:", err)
+		}
+	}
 
 	users, err := s.members.Users(*event.GetRoomId())
 	if err != nil {
@@ -89,6 +113,37 @@ func (s *messageStream) Send(event types.Event) (uint64, matrixTypes.Error) {
 	return index, nil
 }
 
+// must be called with the write lock held
+func (s *messageStream) redact(redaction *matrixTypes.Redaction) {
+	target, ok := s.byId[types.Id(redaction.Redacts)]
+	if !ok {
+		log.Println("tried to redact unknown event:", redaction.Redacts)
+		return
+	}
+	if *target.event.GetRoomId() != redaction.RoomId {
+		log.Println("tried to redact event in another room:", redaction.Redacts)
+		return
+	}
+	redacted := matrixTypes.RedactEvent(target.event, redaction)
+	if redacted == nil {
+		log.Println("event can't be redacted:", redaction.Redacts)
+		return
+	}
+	s.redacted[types.Id(redaction.Redacts)] = &indexedEvent{redacted, target.index}
+}
+
+// must be called with the read lock held
+func (s *messageStream) served(indexed *indexedEvent) *indexedEvent {
+	key := indexed.event.GetEventKey()
+	if redacted, ok := s.redacted[key]; ok {
+		return redacted
+	}
+	if relations := s.aggregate(key); relations != nil {
+		return &indexedEvent{bundle(indexed.event, relations), indexed.index}
+	}
+	return indexed
+}
+
 func extraUserForEvent(event types.Event) *types.UserId {
 	if event.GetEventType() == matrixTypes.EventTypeMembership {
 		membership := event.GetContent().(*matrixTypes.MembershipEventContent).Membership
@@ -117,7 +172,12 @@ func (s *messageStream) Event(
 	eventId types.EventId,
 ) (types.Event, matrixTypes.Error) {
 	s.lock.RLock()
-	indexed := s.byId[types.Id(eventId)]
+	stored, ok := s.byId[types.Id(eventId)]
+	if !ok {
+		s.lock.RUnlock()
+		return nil, nil
+	}
+	indexed := s.served(&stored)
 	s.lock.RUnlock()
 	extraUser := extraUserForEvent(indexed.event)
 	if extraUser != nil && *extraUser == user {
@@ -166,13 +226,14 @@ func (s *messageStream) Range(
 	for uint(len(result)) < limit && i < max {
 		indexed := s.byIndex[i]
 		if indexed != nil {
-			_, ok := roomSet[*indexed.Event().GetRoomId()]
+			// relations are only bundled into events that are returned
+			_, ok := roomSet[*indexed.event.GetRoomId()]
 			if ok {
-				result = append(result, indexed)
+				result = append(result, s.served(indexed))
 			} else if user != nil {
 				extra := extraUserForEvent(indexed.event)
 				if extra != nil && *extra == *user {
-					result = append(result, indexed)
+					result = append(result, s.served(indexed))
 				}
 			}
 		}
@@ -191,6 +252,88 @@ func (s *messageStream) Range(
 	return result, nil
 }
 
+func (s *messageStream) AddIndexer(indexer interfaces.EventIndexer) matrixTypes.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, indexed := range s.byIndex {
+		if indexed == nil {
+			continue
+		}
+		if err := indexer.Index(indexed); err != nil {
+			return err
+		}
+	}
+	s.indexers = append(s.indexers, indexer)
+	return nil
+}
+
+func (s *messageStream) EventIndex(eventId types.EventId) (uint64, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	indexed, ok := s.byId[types.Id(eventId)]
+	return indexed.index, ok
+}
+
+func (s *messageStream) IndexedEvent(eventId types.EventId) (types.IndexedEvent, matrixTypes.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	indexed, ok := s.byId[types.Id(eventId)]
+	if !ok {
+		return nil, nil
+	}
+	return s.served(&indexed), nil
+}
+
+// returns the state of the room as it was directly after the event at the given index
+func (s *messageStream) StateAt(room types.RoomId, index uint64) ([]*matrixTypes.State, matrixTypes.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	type stateId struct {
+		eventType string
+		stateKey  string
+	}
+	byStateId := map[stateId]*matrixTypes.State{}
+	var order []stateId
+	for _, indexed := range s.roomStates[room] {
+		if indexed.index > index {
+			break
+		}
+		state := s.served(indexed).event.(*matrixTypes.State)
+		id := stateId{state.EventType, state.StateKey}
+		if _, ok := byStateId[id]; !ok {
+			order = append(order, id)
+		}
+		byStateId[id] = state
+	}
+	states := make([]*matrixTypes.State, len(order))
+	for i, id := range order {
+		states[i] = byStateId[id]
+	}
+	return states, nil
+}
+
+func (s *messageStream) StateEventAt(
+	room types.RoomId,
+	index uint64,
+	eventType string,
+	stateKey string,
+) (*matrixTypes.State, matrixTypes.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	states := s.roomStates[room]
+	for i := len(states) - 1; i >= 0; i-- {
+		indexed := states[i]
+		if indexed.index > index {
+			continue
+		}
+		state := s.served(indexed).event.(*matrixTypes.State)
+		if state.EventType == eventType && state.StateKey == stateKey {
+			return state, nil
+		}
+	}
+	return nil, nil
+}
+
 func (s *messageStream) Max() uint64 {
 	return atomic.LoadUint64(&s.max)
 }
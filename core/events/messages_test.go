@@ -107,7 +107,7 @@ func (es MessageStreamTest) check(from, to uint64, limit uint, expect ...string)
 func message(eventId, userId string) *matrixTypes.Message {
 	event := matrixTypes.Message{}
 	event.EventType = "m.room.create"
-	event.Content = matrixTypes.CreateEventContent{types.NewUserId(userId, "test")}
+	event.Content = matrixTypes.CreateEventContent{Creator: types.NewUserId(userId, "test")}
 	event.RoomId = types.NewRoomId("room", "test")
 	event.Timestamp = types.Timestamp{time.Now()}
 	event.EventId = types.NewEventId(eventId, "test")
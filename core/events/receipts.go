@@ -0,0 +1,104 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"sync"
+
+	"github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	matrixTypes "github.com/matrix-org/bullettime/matrix/types"
+)
+
+// keeps every receipt update, so that clients can be sent the receipts that changed since their last sync
+type receiptStream struct {
+	lock           sync.RWMutex
+	updates        []*indexedReceiptEvent
+	members        interfaces.MembershipStore
+	asyncEventSink interfaces.AsyncEventSink
+}
+
+type indexedReceiptEvent struct {
+	event *matrixTypes.ReceiptEvent
+	index uint64
+}
+
+func (e *indexedReceiptEvent) Event() types.Event {
+	return e.event
+}
+
+func (e *indexedReceiptEvent) Index() uint64 {
+	return e.index
+}
+
+func NewReceiptStream(
+	members interfaces.MembershipStore,
+	asyncEventSink interfaces.AsyncEventSink,
+) (interfaces.ReceiptStream, error) {
+	return &receiptStream{
+		members:        members,
+		asyncEventSink: asyncEventSink,
+	}, nil
+}
+
+func (s *receiptStream) SendReceipt(room types.RoomId, receipt matrixTypes.Receipt) matrixTypes.Error {
+	roomMembers, err := s.members.Users(room)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	update := &indexedReceiptEvent{
+		event: matrixTypes.NewReceiptEvent(room, []matrixTypes.Receipt{receipt}),
+		index: uint64(len(s.updates)),
+	}
+	s.updates = append(s.updates, update)
+	s.lock.Unlock()
+	s.asyncEventSink.Send(roomMembers, update)
+	return nil
+}
+
+func (s *receiptStream) Max() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return uint64(len(s.updates))
+}
+
+// ignores user and userSet
+func (s *receiptStream) Range(
+	_ *types.UserId,
+	userSet map[types.UserId]struct{},
+	roomSet map[types.RoomId]struct{},
+	from, to uint64,
+	limit uint,
+) ([]types.IndexedEvent, matrixTypes.Error) {
+	var result []types.IndexedEvent
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if to > uint64(len(s.updates)) {
+		to = uint64(len(s.updates))
+	}
+	if len(roomSet) == 0 || from >= to {
+		return result, nil
+	}
+	for _, update := range s.updates[from:to] {
+		if uint(len(result)) >= limit {
+			break
+		}
+		if _, ok := roomSet[update.event.RoomId]; ok {
+			result = append(result, update)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"log"
+	"sort"
+
+	"github.com/matrix-org/bullettime/core/types"
+	matrixTypes "github.com/matrix-org/bullettime/matrix/types"
+)
+
+type relation struct {
+	*indexedEvent
+	relatesTo *matrixTypes.RelatesTo
+}
+
+// must be called with the write lock held
+func (s *messageStream) relate(message *matrixTypes.Message, indexed *indexedEvent) {
+	relatesTo, err := matrixTypes.ParseRelatesTo(message.Content)
+	if err != nil {
+		log.Println("ignoring invalid relation:", err)
+		return
+	}
+	if relatesTo == nil || relatesTo.RelType == "" {
+		return
+	}
+	target := types.Id(relatesTo.EventId)
+	if relatesTo.RelType == matrixTypes.RelationThread && !s.isThreadRoot(target) {
+		s.threads[message.RoomId] = append(s.threads[message.RoomId], target)
+	}
+	s.relations[target] = append(s.relations[target], &relation{indexed, relatesTo})
+}
+
+// must be called with the read lock held
+func (s *messageStream) isThreadRoot(target types.Id) bool {
+	for _, rel := range s.relations[target] {
+		if rel.relatesTo.RelType == matrixTypes.RelationThread {
+			return true
+		}
+	}
+	return false
+}
+
+type annotationCounts []matrixTypes.AnnotationCount
+
+func (a annotationCounts) Len() int           { return len(a) }
+func (a annotationCounts) Less(i, j int) bool { return a[i].Count > a[j].Count }
+func (a annotationCounts) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// must be called with the read lock held
+func (s *messageStream) aggregate(target types.Id) *matrixTypes.BundledRelations {
+	relations := s.relations[target]
+	if len(relations) == 0 {
+		return nil
+	}
+	original, ok := s.byId[target]
+	if !ok {
+		return nil
+	}
+	var annotations annotationCounts
+	annotationPositions := map[matrixTypes.AnnotationCount]int{}
+	var replace *matrixTypes.ReplaceAggregation
+	var references []matrixTypes.ReferencedEvent
+	var thread *matrixTypes.ThreadSummary
+	var latestInThread *indexedEvent
+	participants := map[types.UserId]struct{}{}
+	for _, rel := range relations {
+		if _, ok := s.redacted[rel.event.GetEventKey()]; ok {
+			continue
+		}
+		message := rel.event.(*matrixTypes.Message)
+		switch rel.relatesTo.RelType {
+		case matrixTypes.RelationAnnotation:
+			key := matrixTypes.AnnotationCount{message.EventType, rel.relatesTo.Key, 0}
+			if position, ok := annotationPositions[key]; ok {
+				annotations[position].Count += 1
+			} else {
+				annotationPositions[key] = len(annotations)
+				key.Count = 1
+				annotations = append(annotations, key)
+			}
+		case matrixTypes.RelationReplace:
+			if sender := original.event.GetUserId(); sender != nil && *sender == message.UserId {
+				replace = &matrixTypes.ReplaceAggregation{message.EventId, message.UserId, message.Timestamp}
+			}
+		case matrixTypes.RelationReference:
+			references = append(references, matrixTypes.ReferencedEvent{message.EventId})
+		case matrixTypes.RelationThread:
+			if thread == nil {
+				thread = new(matrixTypes.ThreadSummary)
+				if sender := original.event.GetUserId(); sender != nil {
+					participants[*sender] = struct{}{}
+				}
+			}
+			thread.Count += 1
+			latestInThread = rel.indexedEvent
+			participants[message.UserId] = struct{}{}
+		}
+	}
+	if thread != nil {
+		thread.LatestEvent = s.served(latestInThread).event
+		for user := range participants {
+			thread.Participants = append(thread.Participants, user)
+		}
+	}
+	if annotations == nil && replace == nil && references == nil && thread == nil {
+		return nil
+	}
+	bundled := new(matrixTypes.BundledRelations)
+	if annotations != nil {
+		sort.Stable(annotations)
+		bundled.Annotation = &matrixTypes.AnnotationAggregation{annotations}
+	}
+	bundled.Replace = replace
+	bundled.Thread = thread
+	if references != nil {
+		bundled.Reference = &matrixTypes.ReferenceAggregation{references}
+	}
+	return bundled
+}
+
+func bundle(event types.Event, relations *matrixTypes.BundledRelations) types.Event {
+	withUnsigned := func(unsigned *matrixTypes.Unsigned) *matrixTypes.Unsigned {
+		bundled := matrixTypes.Unsigned{}
+		if unsigned != nil {
+			bundled = *unsigned
+		}
+		bundled.Relations = relations
+		return &bundled
+	}
+	switch event := event.(type) {
+	case *matrixTypes.State:
+		bundled := *event
+		bundled.Unsigned = withUnsigned(event.Unsigned)
+		return &bundled
+	case *matrixTypes.Message:
+		bundled := *event
+		bundled.Unsigned = withUnsigned(event.Unsigned)
+		return &bundled
+	}
+	return event
+}
+
+// returns events that relate to the given event with an index below from, newest first
+func (s *messageStream) Relations(
+	target types.EventId,
+	relType string,
+	eventType string,
+	from uint64,
+	limit uint,
+) ([]types.IndexedEvent, matrixTypes.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	relations := s.relations[types.Id(target)]
+	result := []types.IndexedEvent{}
+	for i := len(relations) - 1; i >= 0 && uint(len(result)) < limit; i-- {
+		rel := relations[i]
+		if rel.index >= from {
+			continue
+		}
+		if _, ok := s.redacted[rel.event.GetEventKey()]; ok {
+			continue
+		}
+		if relType != "" && rel.relatesTo.RelType != relType {
+			continue
+		}
+		if eventType != "" && rel.event.GetEventType() != eventType {
+			continue
+		}
+		result = append(result, s.served(rel.indexedEvent))
+	}
+	return result, nil
+}
+
+type threadRoots []matrixTypes.ThreadRoot
+
+func (t threadRoots) Len() int           { return len(t) }
+func (t threadRoots) Less(i, j int) bool { return t[i].Latest.Index() > t[j].Latest.Index() }
+func (t threadRoots) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// returns the roots of threads in the room with their latest event below from, most recently active first
+func (s *messageStream) Threads(
+	room types.RoomId,
+	participant *types.UserId,
+	from uint64,
+	limit uint,
+) ([]matrixTypes.ThreadRoot, matrixTypes.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var roots threadRoots
+	for _, rootId := range s.threads[room] {
+		root, ok := s.byId[rootId]
+		if !ok {
+			continue
+		}
+		participated := participant == nil
+		if sender := root.event.GetUserId(); sender != nil && participant != nil && *sender == *participant {
+			participated = true
+		}
+		var latest *indexedEvent
+		for _, rel := range s.relations[rootId] {
+			if rel.relatesTo.RelType != matrixTypes.RelationThread {
+				continue
+			}
+			if _, ok := s.redacted[rel.event.GetEventKey()]; ok {
+				continue
+			}
+			latest = rel.indexedEvent
+			if participant != nil && *rel.event.GetUserId() == *participant {
+				participated = true
+			}
+		}
+		if latest == nil || !participated || latest.index >= from {
+			continue
+		}
+		roots = append(roots, matrixTypes.ThreadRoot{s.served(&root), s.served(latest)})
+	}
+	sort.Sort(roots)
+	if uint(len(roots)) > limit {
+		roots = roots[:limit]
+	}
+	return roots, nil
+}
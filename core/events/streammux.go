@@ -24,12 +24,15 @@ import (
 func NewStreamMux() (*streamMux, matrixTypes.Error) {
 	return &streamMux{
 		channels: map[types.UserId]userChannels{},
+		rooms:    map[types.RoomId]userChannels{},
 	}, nil
 }
 
 type streamMux struct {
 	lock     sync.Mutex
 	channels map[types.UserId]userChannels
+	// listeners that want any event in a room, regardless of who it is sent to
+	rooms map[types.RoomId]userChannels
 }
 
 type userChannels []chan types.IndexedEvent
@@ -84,6 +87,29 @@ func (s *streamMux) Listen(userId types.UserId, cancel chan struct{}) (chan type
 	return channel, nil
 }
 
+// like Listen, but receives the next event in the room, for users that aren't members of it
+func (s *streamMux) ListenRoom(roomId types.RoomId, cancel chan struct{}) (chan types.IndexedEvent, matrixTypes.Error) {
+	s.lock.Lock()
+	chs := s.rooms[roomId]
+	channel := chs.make()
+	s.rooms[roomId] = chs
+	s.lock.Unlock()
+	go func() {
+		<-cancel
+		s.lock.Lock()
+		if chs2, ok := s.rooms[roomId]; ok {
+			chs2.close(channel)
+			if len(chs2) == 0 {
+				delete(s.rooms, roomId)
+			} else {
+				s.rooms[roomId] = chs2
+			}
+		}
+		s.lock.Unlock()
+	}()
+	return channel, nil
+}
+
 func (s *streamMux) Send(userIds []types.UserId, event types.IndexedEvent) matrixTypes.Error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -95,5 +121,13 @@ func (s *streamMux) Send(userIds []types.UserId, event types.IndexedEvent) matri
 			delete(s.channels, userId)
 		}
 	}
+	if roomId := event.Event().GetRoomId(); roomId != nil {
+		if chs, ok := s.rooms[*roomId]; ok {
+			if err := chs.send(event); err != nil {
+				return err
+			}
+			delete(s.rooms, *roomId)
+		}
+	}
 	return nil
 }
@@ -61,3 +61,10 @@ type StateStore interface {
 	State(id types.Id, key string) (value []byte, err types.Error)
 	States(id types.Id) ([]State, types.Error)
 }
+
+type TransactionCache interface {
+	// Calls fn and returns its result, unless fn already returned a result for the key that
+	// was kept and hasn't expired, in which case that result is returned instead.
+	// Concurrent calls with the same key are serialized.
+	Do(key string, fn func() (result interface{}, keep bool)) interface{}
+}
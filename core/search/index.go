@@ -0,0 +1,203 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	matrixTypes "github.com/matrix-org/bullettime/matrix/types"
+)
+
+type document struct {
+	eventId ct.EventId
+	roomId  ct.RoomId
+	index   uint64
+	key     string
+	length  int
+	terms   map[string]int
+}
+
+type searchIndex struct { // always lock in the same order as below
+	lock      sync.RWMutex
+	documents map[ct.EventId]*document
+	postings  map[string]map[ct.EventId]struct{}
+}
+
+func NewSearchIndex() (interfaces.SearchIndex, error) {
+	return &searchIndex{
+		documents: map[ct.EventId]*document{},
+		postings:  map[string]map[ct.EventId]struct{}{},
+	}, nil
+}
+
+func (i *searchIndex) Index(indexed ct.IndexedEvent) matrixTypes.Error {
+	event := indexed.Event()
+	if redaction, ok := event.(*matrixTypes.Redaction); ok {
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		i.remove(redaction.Redacts)
+		return nil
+	}
+	key, text := searchableText(event)
+	if key == "" {
+		return nil
+	}
+	words := Tokenize(text)
+	doc := &document{
+		eventId: ct.EventId(event.GetEventKey()),
+		roomId:  *event.GetRoomId(),
+		index:   indexed.Index(),
+		key:     key,
+		length:  len(words),
+		terms:   map[string]int{},
+	}
+	for _, word := range words {
+		doc.terms[word] += 1
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.remove(doc.eventId)
+	i.documents[doc.eventId] = doc
+	for term := range doc.terms {
+		posting := i.postings[term]
+		if posting == nil {
+			posting = map[ct.EventId]struct{}{}
+			i.postings[term] = posting
+		}
+		posting[doc.eventId] = struct{}{}
+	}
+	return nil
+}
+
+func (i *searchIndex) remove(eventId ct.EventId) {
+	doc := i.documents[eventId]
+	if doc == nil {
+		return
+	}
+	for term := range doc.terms {
+		posting := i.postings[term]
+		delete(posting, eventId)
+		if len(posting) == 0 {
+			delete(i.postings, term)
+		}
+	}
+	delete(i.documents, eventId)
+}
+
+// Returns all documents that contain every term in the query, ranked using tf-idf
+func (i *searchIndex) Search(
+	query string,
+	keys map[string]struct{},
+	roomSet map[ct.RoomId]struct{},
+) ([]matrixTypes.SearchHit, matrixTypes.Error) {
+	terms := uniqueTerms(Tokenize(query))
+	hits := []matrixTypes.SearchHit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	rarest := i.postings[terms[0]]
+	for _, term := range terms[1:] {
+		if len(i.postings[term]) < len(rarest) {
+			rarest = i.postings[term]
+		}
+	}
+	documentCount := float64(len(i.documents))
+
+	for eventId := range rarest {
+		doc := i.documents[eventId]
+		if _, ok := roomSet[doc.roomId]; !ok {
+			continue
+		}
+		if _, ok := keys[doc.key]; !ok {
+			continue
+		}
+		rank := 0.0
+		for _, term := range terms {
+			count, ok := doc.terms[term]
+			if !ok {
+				rank = -1
+				break
+			}
+			idf := math.Log(1 + documentCount/float64(len(i.postings[term])))
+			rank += float64(count) / float64(doc.length) * idf
+		}
+		if rank < 0 {
+			continue
+		}
+		hits = append(hits, matrixTypes.SearchHit{
+			EventId:    doc.eventId,
+			RoomId:     doc.roomId,
+			Index:      doc.index,
+			Rank:       rank,
+			Highlights: terms,
+		})
+	}
+	return hits, nil
+}
+
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func uniqueTerms(words []string) []string {
+	seen := map[string]struct{}{}
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if _, ok := seen[word]; !ok {
+			seen[word] = struct{}{}
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func searchableText(event ct.Event) (key string, text string) {
+	switch event.GetEventType() {
+	case matrixTypes.EventTypeMessage:
+		return matrixTypes.SearchKeyBody, stringField(event.GetContent(), "body")
+	case matrixTypes.EventTypeName:
+		if content, ok := event.GetContent().(*matrixTypes.NameEventContent); ok {
+			return matrixTypes.SearchKeyName, content.Name
+		}
+		return matrixTypes.SearchKeyName, stringField(event.GetContent(), "name")
+	case matrixTypes.EventTypeTopic:
+		if content, ok := event.GetContent().(*matrixTypes.TopicEventContent); ok {
+			return matrixTypes.SearchKeyTopic, content.Topic
+		}
+		return matrixTypes.SearchKeyTopic, stringField(event.GetContent(), "topic")
+	}
+	return "", ""
+}
+
+func stringField(content interface{}, field string) string {
+	generic, ok := content.(*matrixTypes.GenericContent)
+	if !ok || generic == nil {
+		return ""
+	}
+	str, _ := generic.Content[field].(string)
+	return str
+}
@@ -0,0 +1,94 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"testing"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type indexedEvent struct {
+	event ct.Event
+	index uint64
+}
+
+func (e indexedEvent) Event() ct.Event { return e.event }
+func (e indexedEvent) Index() uint64   { return e.index }
+
+func TestSearchIndex(t *testing.T) {
+	index, err := NewSearchIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	room1 := ct.NewRoomId("room1", "test")
+	room2 := ct.NewRoomId("room2", "test")
+	events := []*types.Message{
+		message("event1", room1, "Cheese is great"),
+		message("event2", room1, "cheese, cheese and more CHEESE!"),
+		message("event3", room1, "nothing to see here"),
+		message("event4", room2, "secret cheese"),
+	}
+	for i, event := range events {
+		if err := index.Index(indexedEvent{event, uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := map[string]struct{}{types.SearchKeyBody: struct{}{}}
+	rooms := map[ct.RoomId]struct{}{room1: struct{}{}}
+
+	hits, err := index.Search("cheese", keys, rooms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Fatal("expected 2 hits, got", hits)
+	}
+	var ranks = map[string]float64{}
+	for _, hit := range hits {
+		ranks[hit.EventId.Id] = hit.Rank
+	}
+	if ranks["event2"] <= ranks["event1"] {
+		t.Error("expected event2 to rank higher than event1, got", ranks)
+	}
+
+	hits, err = index.Search("Cheese GREAT", keys, rooms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].EventId.Id != "event1" {
+		t.Error("expected only event1 to contain all terms, got", hits)
+	}
+
+	hits, err = index.Search("cheese", map[string]struct{}{types.SearchKeyName: struct{}{}}, rooms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Error("expected no hits when searching names, got", hits)
+	}
+}
+
+func message(eventId string, room ct.RoomId, body string) *types.Message {
+	event := types.Message{}
+	event.EventType = types.EventTypeMessage
+	event.Content = types.NewGenericContent(map[string]interface{}{"body": body}, types.EventTypeMessage)
+	event.RoomId = room
+	event.Timestamp = ct.Timestamp{time.Now()}
+	event.EventId = ct.NewEventId(eventId, "test")
+	return &event
+}
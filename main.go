@@ -16,12 +16,21 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/matrix-org/bullettime/core/db"
 	"github.com/matrix-org/bullettime/core/events"
+	"github.com/matrix-org/bullettime/core/search"
 	"github.com/matrix-org/bullettime/matrix/api"
+	"github.com/matrix-org/bullettime/matrix/idp"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/mailer"
 	"github.com/matrix-org/bullettime/matrix/service"
 	"github.com/matrix-org/bullettime/matrix/stores"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -29,7 +38,28 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func setupApiEndpoint() http.Handler {
+// how long responses to requests with a transaction id are kept for replaying retries,
+// unless BULLETTIME_TRANSACTION_EXPIRY is set
+const defaultTransactionExpiry = 30 * time.Minute
+
+// how long access tokens are valid for clients that support refresh tokens
+const accessTokenLifetime = 5 * time.Minute
+
+// how long a session can go without being refreshed before the client has to log in again
+const refreshTokenLifetime = 7 * 24 * time.Hour
+
+// how often expired access and refresh tokens are removed
+const tokenSweepInterval = time.Minute
+
+// single sign-on is only enabled if an identity provider is given, and shared secret registration if a secret is
+func setupApiEndpoint(
+	publicUrl string,
+	registration types.RegistrationConfig,
+	registrationSharedSecret string,
+	transactionExpiry time.Duration,
+	mailSender interfaces.Mailer,
+	identityProvider interfaces.IdentityProvider,
+) http.Handler {
 	stateStore, err := db.NewStateStore()
 	if err != nil {
 		panic(err)
@@ -46,7 +76,59 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
-	aliasStore, err := stores.NewAliasStore(aliasCache)
+	aliasCreatorCache, err := db.NewIdMap()
+	if err != nil {
+		panic(err)
+	}
+	aliasStore, err := stores.NewAliasStore(aliasCache, aliasCreatorCache)
+	if err != nil {
+		panic(err)
+	}
+	receiptStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	receiptStore, err := stores.NewReceiptStore(receiptStateStore)
+	if err != nil {
+		panic(err)
+	}
+	tokenStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	tokenStore, err := stores.NewTokenStore(tokenStateStore)
+	if err != nil {
+		panic(err)
+	}
+	deviceStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	deviceStore, err := stores.NewDeviceStore(deviceStateStore)
+	if err != nil {
+		panic(err)
+	}
+	threepidStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	threepidStore, err := stores.NewThreepidStore(threepidStateStore)
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenStore, err := stores.NewRegistrationTokenStore(registrationTokenStateStore)
+	if err != nil {
+		panic(err)
+	}
+	externalIdStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	externalIdStore, err := stores.NewExternalIdStore(externalIdStateStore)
 	if err != nil {
 		panic(err)
 	}
@@ -58,6 +140,14 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
+	inviteCache, err := db.NewIdMultiMap()
+	if err != nil {
+		panic(err)
+	}
+	inviteStore, err := stores.NewMembershipStore(inviteCache)
+	if err != nil {
+		panic(err)
+	}
 	streamMux, err := events.NewStreamMux()
 	if err != nil {
 		panic(err)
@@ -74,11 +164,27 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
+	receiptStream, err := events.NewReceiptStream(memberStore, streamMux)
+	if err != nil {
+		panic(err)
+	}
+	searchIndex, err := search.NewSearchIndex()
+	if err != nil {
+		panic(err)
+	}
+	if err := messageStream.AddIndexer(searchIndex); err != nil {
+		panic(err)
+	}
 
 	roomService, err := service.CreateRoomService(
 		roomStore,
+		userStore,
 		aliasStore,
 		memberStore,
+		inviteStore,
+		messageStream,
+		messageStream,
+		messageStream,
 		messageStream,
 		presenceStream,
 		typingStream,
@@ -87,10 +193,6 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
-	userService, err := service.CreateUserService(userStore)
-	if err != nil {
-		panic(err)
-	}
 	profileService, err := service.NewProfileService(
 		presenceStream,
 		presenceStream,
@@ -105,38 +207,124 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
-	tokenService, err := service.CreateTokenService()
+	tokenService, err := service.CreateTokenService(tokenStore, accessTokenLifetime, refreshTokenLifetime, time.Now)
 	if err != nil {
 		panic(err)
 	}
+	go sweepTokens(tokenService)
+	threepidService, err := service.CreateThreepidService(threepidStore, mailSender)
+	if err != nil {
+		panic(err)
+	}
+	userService, err := service.CreateUserService(
+		userStore,
+		deviceStore,
+		tokenService,
+		threepidService,
+		roomService,
+		profileService,
+		registration,
+	)
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenService, err := service.CreateRegistrationTokenService(registrationTokenStore)
+	if err != nil {
+		panic(err)
+	}
+	uiaService, err := service.CreateUiaService(
+		service.NewDummyStage(),
+		service.NewPasswordStage(userService),
+		service.NewEmailStage(threepidService),
+		service.NewRegistrationTokenStage(registrationTokenService),
+		service.NewSsoStage(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	var ssoService interfaces.SsoService
+	if identityProvider != nil {
+		ssoService, err = service.CreateSsoService(identityProvider, externalIdStore, userService, profileService, registration)
+		if err != nil {
+			panic(err)
+		}
+	}
+	var sharedSecretService interfaces.SharedSecretService
+	if registrationSharedSecret != "" {
+		sharedSecretService, err = service.CreateSharedSecretService(registrationSharedSecret, userService, userStore, profileService)
+		if err != nil {
+			panic(err)
+		}
+	}
 	eventService, err := service.NewEventService(
 		messageStream,
 		presenceStream,
 		typingStream,
+		receiptStream,
 		streamMux,
 		messageStream,
+		messageStream,
+		messageStream,
 		memberStore,
 	)
 	if err != nil {
 		panic(err)
 	}
+	directoryService, err := service.NewDirectoryService(roomStore, aliasStore, memberStore)
+	if err != nil {
+		panic(err)
+	}
+	searchService, err := service.NewSearchService(searchIndex, messageStream, memberStore)
+	if err != nil {
+		panic(err)
+	}
 	syncService, err := service.NewSyncService(
 		messageStream,
 		presenceStream,
 		typingStream,
+		receiptStream,
 		roomStore,
 		memberStore,
+		receiptStore,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
 	}
+	receiptService, err := service.NewReceiptService(receiptStore, receiptStream, messageStream)
+	if err != nil {
+		panic(err)
+	}
+
+	txns, err := db.NewTransactionCache(transactionExpiry, time.Now)
+	if err != nil {
+		panic(err)
+	}
 
 	mux := httprouter.New()
-	api.NewAuthEndpoint(userService, tokenService).Register(mux)
+	api.NewAuthEndpoint(
+		userService,
+		tokenService,
+		uiaService,
+		threepidService,
+		ssoService,
+		registrationTokenService,
+		publicUrl,
+		registration,
+	).Register(mux)
 	api.NewProfileEndpoint(userService, tokenService, profileService).Register(mux)
 	api.NewPresenceEndpoint(userService, tokenService, presenceService).Register(mux)
-	api.NewRoomsEndpoint(userService, tokenService, roomService, syncService, eventService).Register(mux)
+	api.NewRoomsEndpoint(userService, tokenService, roomService, syncService, eventService, txns).Register(mux)
 	api.NewEventsEndpoint(userService, tokenService, eventService, syncService).Register(mux)
+	api.NewDirectoryEndpoint(userService, tokenService, roomService, directoryService).Register(mux)
+	api.NewSearchEndpoint(userService, tokenService, searchService).Register(mux)
+	api.NewReceiptsEndpoint(userService, tokenService, receiptService).Register(mux)
+	api.NewCapabilitiesEndpoint(userService, tokenService).Register(mux)
+	api.NewDevicesEndpoint(userService, tokenService, uiaService, ssoService).Register(mux)
+	api.NewAccountEndpoint(userService, tokenService, uiaService, threepidService, ssoService).Register(mux)
+	api.NewThreepidEndpoint(userService, tokenService, threepidService, publicUrl).Register(mux)
+	api.NewRegistrationTokensEndpoint(userService, tokenService, registrationTokenService).Register(mux)
+	api.NewAdminEndpoint(userService, tokenService, sharedSecretService).Register(mux)
 
 	mux.NotFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		api.WriteJsonResponseWithStatus(rw, types.DefaultUnrecognizedError)
@@ -149,22 +337,113 @@ func setupApiEndpoint() http.Handler {
 	corsHandler.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		rw.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE")
-		rw.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding")
+		rw.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Content-Length, Accept-Encoding")
 		mux.ServeHTTP(rw, req)
 	})
 
 	return corsHandler
 }
 
-func main() {
-	mux := http.NewServeMux()
-	mux.Handle("/_matrix/client/api/v1/", http.StripPrefix("/_matrix/client/api/v1", setupApiEndpoint()))
+func sweepTokens(tokens interfaces.TokenService) {
+	for range time.Tick(tokenSweepInterval) {
+		if err := tokens.Sweep(); err != nil {
+			log.Println("failed to sweep tokens:", err)
+		}
+	}
+}
+
+// BULLETTIME_REGISTRATION is open, token or disabled, and BULLETTIME_RESERVED_USERNAMES is a comma
+// separated list of regular expressions
+func setupRegistration() types.RegistrationConfig {
+	var config types.RegistrationConfig
+	switch mode := os.Getenv("BULLETTIME_REGISTRATION"); mode {
+	case "", "open":
+		config.Mode = types.RegistrationOpen
+	case "token":
+		config.Mode = types.RegistrationTokenRequired
+	case "disabled":
+		config.Mode = types.RegistrationDisabled
+	default:
+		panic("invalid registration mode: " + mode)
+	}
+	for _, pattern := range strings.Split(os.Getenv("BULLETTIME_RESERVED_USERNAMES"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			config.ReservedUsernames = append(config.ReservedUsernames, regexp.MustCompile(pattern))
+		}
+	}
+	return config
+}
 
+// BULLETTIME_TRANSACTION_EXPIRY is a duration such as 10m
+func setupTransactionExpiry() time.Duration {
+	value := os.Getenv("BULLETTIME_TRANSACTION_EXPIRY")
+	if value == "" {
+		return defaultTransactionExpiry
+	}
+	expiry, err := time.ParseDuration(value)
+	if err != nil || expiry <= 0 {
+		panic("invalid transaction expiry: " + value)
+	}
+	return expiry
+}
+
+// emails are only sent if BULLETTIME_SMTP_ADDR is set, otherwise email validation is disabled
+func setupMailer() interfaces.Mailer {
+	addr := os.Getenv("BULLETTIME_SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	var auth smtp.Auth
+	if username := os.Getenv("BULLETTIME_SMTP_USERNAME"); username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			panic(err)
+		}
+		auth = smtp.PlainAuth("", username, os.Getenv("BULLETTIME_SMTP_PASSWORD"), host)
+	}
+	m, err := mailer.NewSmtpMailer(addr, os.Getenv("BULLETTIME_SMTP_FROM"), auth)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// users can log in through an OpenID Connect provider if BULLETTIME_OIDC_ISSUER is set
+func setupIdentityProvider() interfaces.IdentityProvider {
+	issuer := os.Getenv("BULLETTIME_OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	provider, err := idp.NewOidcProvider(issuer, os.Getenv("BULLETTIME_OIDC_CLIENT_ID"), os.Getenv("BULLETTIME_OIDC_CLIENT_SECRET"))
+	if err != nil {
+		panic(err)
+	}
+	return provider
+}
+
+func main() {
 	port := "4080"
 	if len(os.Args) > 1 {
 		port = os.Args[1]
 	}
 
+	publicUrl := os.Getenv("BULLETTIME_PUBLIC_URL")
+	if publicUrl == "" {
+		publicUrl = "http://localhost:" + port
+	}
+	publicUrl = strings.TrimSuffix(publicUrl, "/") + "/_matrix/client/api/v1"
+
+	mux := http.NewServeMux()
+	apiEndpoint := setupApiEndpoint(
+		publicUrl,
+		setupRegistration(),
+		os.Getenv("BULLETTIME_REGISTRATION_SHARED_SECRET"),
+		setupTransactionExpiry(),
+		setupMailer(),
+		setupIdentityProvider(),
+	)
+	mux.Handle("/_matrix/client/api/v1/", http.StripPrefix("/_matrix/client/api/v1", apiEndpoint))
+
 	server := &http.Server{
 		Addr:    ":" + port,
 		Handler: mux,
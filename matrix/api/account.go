@@ -0,0 +1,146 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type passwordRequest struct {
+	NewPassword string `json:"new_password"`
+	// defaults to true
+	LogoutDevices *bool           `json:"logout_devices"`
+	Auth          *types.AuthData `json:"auth"`
+}
+
+type deactivateRequest struct {
+	Auth *types.AuthData `json:"auth"`
+}
+
+type deactivateResponse struct {
+	IdServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// Changes the password of the logged in user. Requests without an access token reset the password
+// of the user that the email address, which is validated during authentication, is bound to.
+func (e accountEndpoint) postPassword(req *http.Request, body *passwordRequest) interface{} {
+	if body.NewPassword == "" {
+		return types.BadJsonError("Missing or invalid new_password")
+	}
+	auth, authenticated := authInfoOf(req)
+	flows := reauthFlows(e.sso)
+	if !authenticated {
+		if !e.threepids.EmailSupported() {
+			return types.DefaultMissingTokenError
+		}
+		flows = []types.AuthFlow{emailFlow}
+	}
+	completed, err := e.uia.Authenticate(uiaOperation(req), auth.user, flows, body.Auth)
+	if err != nil {
+		return err
+	}
+	user := auth.user
+	var creds types.ThreepidCredentials
+	if !authenticated {
+		creds = *completed[types.AuthTypeEmail].ThreepidCreds
+		threepid, err := e.threepids.ValidatedThreepid(creds)
+		if err != nil {
+			return err
+		}
+		owner, err := e.threepids.ThreepidUser(threepid.Medium, threepid.Address)
+		if err != nil {
+			return err
+		}
+		if owner == nil {
+			return types.ThreepidNotFoundError("'" + threepid.Address + "' isn't bound to any account")
+		}
+		user = *owner
+	}
+	if err := e.users.SetPassword(user, user, body.NewPassword); err != nil {
+		return err
+	}
+	if !authenticated {
+		// the validated address must not be usable for resetting the password again
+		if err := e.threepids.EndSession(creds); err != nil {
+			return err
+		}
+	}
+	if body.LogoutDevices != nil && !*body.LogoutDevices {
+		return struct{}{}
+	}
+	devices, err := e.users.Devices(user)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.DeviceId == auth.deviceId {
+			continue
+		}
+		if err := e.tokens.RevokeDeviceTokens(user, device.DeviceId); err != nil {
+			return err
+		}
+		if err := e.users.DeleteDevice(user, device.DeviceId); err != nil {
+			return err
+		}
+	}
+	return struct{}{}
+}
+
+func (e accountEndpoint) postDeactivate(auth authInfo, req *http.Request, body *deactivateRequest) interface{} {
+	user := auth.user
+	if _, err := e.uia.Authenticate(uiaOperation(req), user, reauthFlows(e.sso), body.Auth); err != nil {
+		return err
+	}
+	if err := e.users.Deactivate(user, user); err != nil {
+		return err
+	}
+	return deactivateResponse{"no-support"}
+}
+
+func (e accountEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	mux.POST("/account/password", access.optional(jsonHandler(e.postPassword)))
+	mux.POST("/account/deactivate", access.user(jsonHandler(e.postDeactivate)))
+}
+
+type accountEndpoint struct {
+	users     interfaces.UserService
+	tokens    interfaces.TokenService
+	uia       interfaces.UiaService
+	threepids interfaces.ThreepidService
+	sso       interfaces.SsoService
+}
+
+// The sso service may be nil if single sign-on isn't set up
+func NewAccountEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	uia interfaces.UiaService,
+	threepids interfaces.ThreepidService,
+	sso interfaces.SsoService,
+) Endpoint {
+	return accountEndpoint{
+		users,
+		tokens,
+		uia,
+		threepids,
+		sso,
+	}
+}
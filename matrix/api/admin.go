@@ -0,0 +1,127 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type nonceResponse struct {
+	Nonce string `json:"nonce"`
+}
+
+type sharedSecretRegisterRequest struct {
+	Nonce       string `json:"nonce"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	DisplayName string `json:"displayname"`
+	Admin       bool   `json:"admin"`
+	Mac         string `json:"mac"`
+}
+
+type adminRequest struct {
+	Admin *bool `json:"admin"`
+}
+
+type adminResponse struct {
+	Admin bool `json:"admin"`
+}
+
+func (e adminEndpoint) getNonce() interface{} {
+	nonce, err := e.sharedSecret.NewNonce()
+	if err != nil {
+		return err
+	}
+	return nonceResponse{nonce}
+}
+
+func (e adminEndpoint) postSharedSecretRegister(req *http.Request, body *sharedSecretRegisterRequest) interface{} {
+	if body.Nonce == "" || body.Mac == "" {
+		return types.BadJsonError("Missing nonce or mac")
+	}
+	if body.Password == "" {
+		return types.BadJsonError("Missing or invalid password")
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	user, err := parseUsername(hostname, body.Username)
+	if err != nil {
+		return err
+	}
+	if err := e.sharedSecret.Register(body.Nonce, user, body.Password, body.DisplayName, body.Admin, body.Mac); err != nil {
+		return err
+	}
+	return newSession(e.users, e.tokens, user, "", nil, false)
+}
+
+func (e adminEndpoint) getAdmin(params httprouter.Params) interface{} {
+	user, err := urlParams{params}.user(0, e.users)
+	if err != nil {
+		return err
+	}
+	admin, err := e.users.IsAdmin(user)
+	if err != nil {
+		return err
+	}
+	return adminResponse{admin}
+}
+
+func (e adminEndpoint) putAdmin(auth authInfo, params httprouter.Params, body *adminRequest) interface{} {
+	user, err := urlParams{params}.user(0, e.users)
+	if err != nil {
+		return err
+	}
+	if body.Admin == nil {
+		return types.BadJsonError("Missing admin")
+	}
+	if err := e.users.SetAdmin(user, auth.user, *body.Admin); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	if e.sharedSecret != nil {
+		mux.GET("/admin/register", jsonHandler(e.getNonce))
+		mux.POST("/admin/register", jsonHandler(e.postSharedSecretRegister))
+	}
+	mux.GET("/admin/users/:userId/admin", access.admin(jsonHandler(e.getAdmin)))
+	mux.PUT("/admin/users/:userId/admin", access.admin(jsonHandler(e.putAdmin)))
+}
+
+type adminEndpoint struct {
+	users        interfaces.UserService
+	tokens       interfaces.TokenService
+	sharedSecret interfaces.SharedSecretService
+}
+
+// The shared secret service may be nil, in which case shared secret registration is disabled
+func NewAdminEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	sharedSecret interfaces.SharedSecretService,
+) Endpoint {
+	return adminEndpoint{
+		users,
+		tokens,
+		sharedSecret,
+	}
+}
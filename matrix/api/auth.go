@@ -16,7 +16,12 @@ package api
 
 import (
 	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	ct "github.com/matrix-org/bullettime/core/types"
@@ -31,7 +36,8 @@ type LoginType string
 
 const (
 	LoginTypePassword LoginType = "m.login.password"
-	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeToken    LoginType = "m.login.token"
+	LoginTypeSso      LoginType = "m.login.sso"
 )
 
 type AuthFlow struct {
@@ -47,64 +53,326 @@ type authRequest struct {
 	Type     LoginType `json:"type"`
 	Username string    `json:"user"`
 	Password string    `json:"password"`
+	// the login token of m.login.token
+	Token    string `json:"token"`
+	DeviceId string `json:"device_id"`
+	// only used if the device doesn't already exist
+	InitialDeviceDisplayName *string `json:"initial_device_display_name"`
+	// whether the client supports refresh tokens, in which case the access token expires
+	RefreshToken bool `json:"refresh_token"`
 }
 
 type authResponse struct {
-	UserId      ct.UserId `json:"user_id"`
-	AccessToken string    `json:"access_token"`
+	UserId       ct.UserId `json:"user_id"`
+	AccessToken  string    `json:"access_token"`
+	DeviceId     string    `json:"device_id"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresInMs  int64     `json:"expires_in_ms,omitempty"`
 }
 
-var defaultRegisterFlows = AuthFlows{
-	Flows: []AuthFlow{
-		{
-			Stages: []LoginType{ // not implemented
-				LoginTypeEmail,
-				LoginTypePassword,
-			},
-			Type: LoginTypeEmail,
-		},
-		{Type: LoginTypePassword},
-	},
+type registerRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DeviceId string `json:"device_id"`
+	// only used if the device doesn't already exist
+	InitialDeviceDisplayName *string `json:"initial_device_display_name"`
+	RefreshToken             bool    `json:"refresh_token"`
+	// user-interactive authentication, not used by guests
+	Auth *types.AuthData `json:"auth"`
+}
+
+type registerFlowsResponse struct {
+	Flows []types.AuthFlow `json:"flows"`
+}
+
+type availableResponse struct {
+	Available bool `json:"available"`
+}
+
+type registrationTokenValidityResponse struct {
+	Valid bool `json:"valid"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMs  int64  `json:"expires_in_ms"`
+}
+
+var defaultRegisterFlows = []types.AuthFlow{
+	{Stages: []string{types.AuthTypeDummy}},
+}
+
+var emailFlow = types.AuthFlow{Stages: []string{types.AuthTypeEmail}}
+
+var registrationTokenFlow = types.AuthFlow{Stages: []string{types.AuthTypeRegistrationToken}}
+
+var errRegistrationDisabled = types.ForbiddenError("Registration is disabled")
+
+// the grammar of user id localparts, upper case letters are only allowed in historical user ids
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._=/-]+$`)
+
+// flows for confirming sensitive operations of users that are already logged in
+var defaultReauthFlows = []types.AuthFlow{
+	{Stages: []string{types.AuthTypePassword}},
+}
+
+var ssoReauthFlow = types.AuthFlow{Stages: []string{types.AuthTypeSso}}
+
+// users that were created through single sign-on don't have a password, so they re-authenticate
+// with the identity provider if single sign-on is set up
+func reauthFlows(ssoService interfaces.SsoService) []types.AuthFlow {
+	if ssoService == nil {
+		return defaultReauthFlows
+	}
+	return append(defaultReauthFlows[:len(defaultReauthFlows):len(defaultReauthFlows)], ssoReauthFlow)
 }
 
 var defaultLoginFlows = AuthFlows{
 	Flows: []AuthFlow{
 		{Type: LoginTypePassword},
+		{Type: LoginTypeToken},
 	},
 }
 
-func (e authEndpoint) registerWithPassword(hostname string, body *authRequest) interface{} {
+var ssoLoginFlow = AuthFlow{Type: LoginTypeSso}
+
+// shown before sending the login token to the client, so that users can't be tricked into
+// logging in to a client that they didn't start the login from
+var ssoConfirmTemplate = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Continue to your client</title></head>
+<body>
+<p>You are about to log in to {{.Host}} as {{.User}}.</p>
+<p><a href="{{.Url}}">Continue</a></p>
+<p>If you didn't start this login, close this page.</p>
+</body>
+</html>
+`))
+
+// shown once the user has re-authenticated through the single sign-on fallback, tells the client
+// to retry the request as described by the spec
+var ssoFallbackDoneTemplate = template.Must(template.New("done").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authentication complete</title></head>
+<body>
+<p>Thank you, you can now return to your client.</p>
+<script>
+if (window.onAuthDone) {
+	window.onAuthDone();
+} else if (window.opener && window.opener.postMessage) {
+	window.opener.postMessage("authDone", "*");
+}
+</script>
+</body>
+</html>
+`))
+
+// creates a device and an access token for a newly registered or logged in user, generating a device id if none was given
+func newSession(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	user ct.UserId,
+	deviceId string,
+	displayName *string,
+	refreshable bool,
+) interface{} {
+	if deviceId == "" {
+		deviceId = utils.RandomString(10)
+	}
+	if err := users.CreateDevice(user, deviceId, displayName); err != nil {
+		return err
+	}
+	var token interfaces.Token
+	var err types.Error
+	if refreshable {
+		token, err = tokens.NewRefreshableAccessToken(user, deviceId)
+	} else {
+		token, err = tokens.NewAccessToken(user, deviceId)
+	}
+	if err != nil {
+		return err
+	}
+	return authResponse{
+		UserId:       user,
+		AccessToken:  token.String(),
+		DeviceId:     deviceId,
+		RefreshToken: token.RefreshToken(),
+		ExpiresInMs:  expiresInMs(token),
+	}
+}
+
+func expiresInMs(token interfaces.Token) int64 {
+	if token.Expires().IsZero() {
+		return 0
+	}
+	return int64(token.Expires().Sub(time.Now()) / time.Millisecond)
+}
+
+// checks that the username follows the grammar of new user ids
+func parseUsername(hostname, username string) (ct.UserId, types.Error) {
+	if !usernamePattern.MatchString(username) {
+		return ct.UserId{}, types.InvalidUsernameError("usernames can only contain the characters a-z, 0-9, . _ = - and /")
+	}
+	userId := ct.NewUserId(username, hostname)
+	if len(userId.String()) > 255 {
+		return ct.UserId{}, types.InvalidUsernameError("user id '" + userId.String() + "' is too long")
+	}
+	return userId, nil
+}
+
+// checks that the username can be registered, and returns the user id that it would get
+func (e authEndpoint) checkUsername(hostname, username string) (ct.UserId, types.Error) {
+	userId, err := parseUsername(hostname, username)
+	if err != nil {
+		return ct.UserId{}, err
+	}
+	if e.registration.Reserved(username) {
+		return ct.UserId{}, types.ExclusiveError("user id '" + userId.String() + "' is reserved")
+	}
+	exists, err := e.userService.UserExists(userId, userId)
+	if err != nil {
+		return ct.UserId{}, err
+	}
+	if exists {
+		return ct.UserId{}, types.UserInUseError("user id '" + userId.String() + "' is already taken")
+	}
+	return userId, nil
+}
+
+func (e authEndpoint) registerWithPassword(req *http.Request, hostname string, body *registerRequest) interface{} {
+	if e.registration.Mode == types.RegistrationDisabled {
+		return errRegistrationDisabled
+	}
 	if body.Username == "" {
-		body.Username = utils.RandomString(24)
+		return types.BadJsonError("Missing or invalid username")
 	}
 	if body.Password == "" {
 		return types.BadJsonError("Missing or invalid password")
 	}
-	userId := ct.NewUserId(body.Username, hostname)
-	err := e.userService.CreateUser(userId)
+	userId, err := e.checkUsername(hostname, body.Username)
 	if err != nil {
 		return err
 	}
+	completed, err := e.uiaService.Authenticate(uiaOperation(req), ct.UserId{}, e.registerFlows(), body.Auth)
+	if err != nil {
+		return err
+	}
+	email, hasEmail := completed[types.AuthTypeEmail]
+	if hasEmail {
+		threepid, err := e.threepidService.ValidatedThreepid(*email.ThreepidCreds)
+		if err != nil {
+			return err
+		}
+		owner, err := e.threepidService.ThreepidUser(threepid.Medium, threepid.Address)
+		if err != nil {
+			return err
+		}
+		if owner != nil {
+			return types.ThreepidInUseError("'" + threepid.Address + "' is already in use")
+		}
+	}
+	// the use is counted before the user is created so that concurrent registrations can't
+	// exceed the allowed uses, and released again if the registration fails
+	token, hasToken := completed[types.AuthTypeRegistrationToken]
+	if hasToken {
+		if err := e.registrationTokenService.UseRegistrationToken(token.Token); err != nil {
+			return err
+		}
+	}
+	releaseToken := func() {
+		if !hasToken {
+			return
+		}
+		if err := e.registrationTokenService.ReleaseRegistrationToken(token.Token); err != nil {
+			log.Println("failed to release registration token after a failed registration:", err)
+		}
+	}
+	if err := e.userService.CreateUser(userId); err != nil {
+		releaseToken()
+		return err
+	}
 	if err := e.userService.SetPassword(userId, userId, body.Password); err != nil {
+		releaseToken()
 		return err
 	}
-	accessToken, err := e.tokenService.NewAccessToken(userId)
+	if hasEmail {
+		if err := e.threepidService.AddThreepid(userId, *email.ThreepidCreds); err != nil {
+			return err
+		}
+	}
+	return newSession(e.userService, e.tokenService, userId, body.DeviceId, body.InitialDeviceDisplayName, body.RefreshToken)
+}
+
+func (e authEndpoint) registerGuest(hostname string, body *registerRequest) interface{} {
+	userId, err := e.userService.CreateGuest(hostname)
 	if err != nil {
 		return err
 	}
-	return authResponse{
-		UserId:      userId,
-		AccessToken: accessToken.String(),
+	return newSession(e.userService, e.tokenService, userId, body.DeviceId, body.InitialDeviceDisplayName, body.RefreshToken)
+}
+
+func (e authEndpoint) postRegister(req *http.Request, body *registerRequest) interface{} {
+	hostname := strings.Split(req.Host, ":")[0]
+	if req.URL.Query().Get("kind") == "guest" {
+		return e.registerGuest(hostname, body)
 	}
+	return e.registerWithPassword(req, hostname, body)
 }
 
-func (e authEndpoint) postRegister(req *http.Request, body *authRequest) interface{} {
-	switch body.Type {
-	case LoginTypePassword:
-		hostname := strings.Split(req.Host, ":")[0]
-		return e.registerWithPassword(hostname, body)
+func (e authEndpoint) registerFlows() []types.AuthFlow {
+	switch e.registration.Mode {
+	case types.RegistrationTokenRequired:
+		return []types.AuthFlow{registrationTokenFlow}
+	case types.RegistrationDisabled:
+		return nil
 	}
-	return types.BadJsonError(fmt.Sprintf("Missing or invalid login type: '%s'", body.Type))
+	if e.threepidService.EmailSupported() {
+		return append(defaultRegisterFlows[:len(defaultRegisterFlows):len(defaultRegisterFlows)], emailFlow)
+	}
+	return defaultRegisterFlows
+}
+
+func (e authEndpoint) getRegisterFlows() interface{} {
+	if e.registration.Mode == types.RegistrationDisabled {
+		return errRegistrationDisabled
+	}
+	return registerFlowsResponse{e.registerFlows()}
+}
+
+func (e authEndpoint) getUsernameAvailable(req *http.Request) interface{} {
+	if e.registration.Mode == types.RegistrationDisabled {
+		return errRegistrationDisabled
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	if _, err := e.checkUsername(hostname, req.URL.Query().Get("username")); err != nil {
+		return err
+	}
+	return availableResponse{true}
+}
+
+func (e authEndpoint) getRegistrationTokenValidity(req *http.Request) interface{} {
+	if e.registration.Mode == types.RegistrationDisabled {
+		return errRegistrationDisabled
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return types.BadQueryError("Missing token")
+	}
+	valid, err := e.registrationTokenService.RegistrationTokenValid(token)
+	if err != nil {
+		return err
+	}
+	return registrationTokenValidityResponse{valid}
+}
+
+// identifies the request that a user-interactive authentication session was started for
+func uiaOperation(req *http.Request) string {
+	return req.Method + " " + req.URL.Path
 }
 
 func (e authEndpoint) loginWithPassword(hostname string, body *authRequest) interface{} {
@@ -129,14 +397,33 @@ func (e authEndpoint) loginWithPassword(hostname string, body *authRequest) inte
 	if !verified {
 		return types.ForbiddenError("invalid credentials")
 	}
-	accessToken, err := e.tokenService.NewAccessToken(user)
+	// only checked once the password is verified, so it doesn't reveal which accounts are deactivated
+	deactivated, err := e.userService.IsDeactivated(user)
 	if err != nil {
 		return err
 	}
-	return authResponse{
-		UserId:      user,
-		AccessToken: accessToken.String(),
+	if deactivated {
+		return types.DefaultUserDeactivatedError
 	}
+	return newSession(e.userService, e.tokenService, user, body.DeviceId, body.InitialDeviceDisplayName, body.RefreshToken)
+}
+
+func (e authEndpoint) loginWithToken(body *authRequest) interface{} {
+	if body.Token == "" {
+		return types.BadJsonError("Missing or invalid token")
+	}
+	user, err := e.tokenService.ConsumeLoginToken(body.Token)
+	if err != nil {
+		return err
+	}
+	deactivated, err := e.userService.IsDeactivated(user)
+	if err != nil {
+		return err
+	}
+	if deactivated {
+		return types.DefaultUserDeactivatedError
+	}
+	return newSession(e.userService, e.tokenService, user, body.DeviceId, body.InitialDeviceDisplayName, body.RefreshToken)
 }
 
 func (e authEndpoint) postLogin(req *http.Request, body *authRequest) interface{} {
@@ -144,32 +431,220 @@ func (e authEndpoint) postLogin(req *http.Request, body *authRequest) interface{
 	case LoginTypePassword:
 		hostname := strings.Split(req.Host, ":")[0]
 		return e.loginWithPassword(hostname, body)
+	case LoginTypeToken:
+		return e.loginWithToken(body)
 	}
 	return types.BadJsonError(fmt.Sprintf("Missing or invalid login type: '%s'", body.Type))
 }
 
+func (e authEndpoint) loginFlows() *AuthFlows {
+	if e.ssoService == nil {
+		return &defaultLoginFlows
+	}
+	flows := append([]AuthFlow{ssoLoginFlow}, defaultLoginFlows.Flows...)
+	return &AuthFlows{flows}
+}
+
+// sends the user to the identity provider, which sends them back to the callback
+func (e authEndpoint) handleSsoRedirect(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	redirectUrl := req.URL.Query().Get("redirectUrl")
+	parsed, parseErr := url.Parse(redirectUrl)
+	if parseErr != nil || !parsed.IsAbs() {
+		WriteJsonResponseWithStatus(rw, types.BadQueryError("Missing or invalid redirectUrl"))
+		return
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "javascript", "data", "vbscript":
+		WriteJsonResponseWithStatus(rw, types.BadQueryError("Missing or invalid redirectUrl"))
+		return
+	}
+	authorizationUrl, err := e.ssoService.StartLogin(redirectUrl, e.publicUrl+"/login/sso/callback")
+	if err != nil {
+		WriteJsonResponseWithStatus(rw, err)
+		return
+	}
+	http.Redirect(rw, req, authorizationUrl, http.StatusFound)
+}
+
+// where the identity provider sends the user once they've authenticated, the login is passed on to
+// the client as a login token
+func (e authEndpoint) handleSsoCallback(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	query := req.URL.Query()
+	if query.Get("error") != "" {
+		writeSsoFailure(rw, types.ForbiddenError("the identity provider refused the login: "+query.Get("error")))
+		return
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	user, redirectUrl, err := e.ssoService.CompleteLogin(hostname, query.Get("state"), query.Get("code"))
+	if err != nil {
+		writeSsoFailure(rw, err)
+		return
+	}
+	loginToken, err := e.tokenService.NewLoginToken(user)
+	if err != nil {
+		writeSsoFailure(rw, err)
+		return
+	}
+	redirect, _ := url.Parse(redirectUrl)
+	redirectQuery := redirect.Query()
+	redirectQuery.Set("loginToken", loginToken)
+	redirect.RawQuery = redirectQuery.Encode()
+	host := redirect.Host
+	if host == "" {
+		host = redirect.Scheme
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ssoConfirmTemplate.Execute(rw, map[string]interface{}{
+		"Host": host,
+		"User": user.String(),
+		// the scheme was checked when the login was started, and clients may use custom schemes
+		"Url": template.URL(redirect.String()),
+	})
+}
+
+// the fallback page of the single sign-on stage of user-interactive authentication, which sends the user
+// to the identity provider
+func (e authEndpoint) handleSsoFallback(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	session := req.URL.Query().Get("session")
+	if session == "" {
+		writeSsoFailure(rw, types.BadQueryError("Missing session"))
+		return
+	}
+	// the redirect url is never followed, it only keeps track of the session until the callback
+	redirectUrl := e.publicUrl + "/auth/" + types.AuthTypeSso + "/fallback/web?session=" + url.QueryEscape(session)
+	authorizationUrl, err := e.ssoService.StartLogin(redirectUrl, e.publicUrl+"/auth/"+types.AuthTypeSso+"/fallback/callback")
+	if err != nil {
+		writeSsoFailure(rw, err)
+		return
+	}
+	http.Redirect(rw, req, authorizationUrl, http.StatusFound)
+}
+
+// completes the single sign-on stage if the user that authenticated is the one that started the session
+func (e authEndpoint) handleSsoFallbackCallback(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	query := req.URL.Query()
+	if query.Get("error") != "" {
+		writeSsoFailure(rw, types.ForbiddenError("the identity provider refused the login: "+query.Get("error")))
+		return
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	user, redirectUrl, err := e.ssoService.CompleteLogin(hostname, query.Get("state"), query.Get("code"))
+	if err != nil {
+		writeSsoFailure(rw, err)
+		return
+	}
+	redirect, _ := url.Parse(redirectUrl)
+	if err := e.uiaService.CompleteStage(redirect.Query().Get("session"), user, types.AuthTypeSso); err != nil {
+		writeSsoFailure(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ssoFallbackDoneTemplate.Execute(rw, nil)
+}
+
+// the callback is opened in a browser, so errors are shown as text
+func writeSsoFailure(rw http.ResponseWriter, err types.Error) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(err.Status())
+	fmt.Fprintln(rw, "Failed to log in: "+err.Error())
+}
+
+func (e authEndpoint) postRefresh(body *refreshRequest) interface{} {
+	if body.RefreshToken == "" {
+		return types.BadJsonError("Missing refresh_token")
+	}
+	token, err := e.tokenService.Refresh(body.RefreshToken)
+	if err != nil {
+		return err
+	}
+	return refreshResponse{
+		AccessToken:  token.String(),
+		RefreshToken: token.RefreshToken(),
+		ExpiresInMs:  expiresInMs(token),
+	}
+}
+
+func (e authEndpoint) postLogout(auth authInfo) interface{} {
+	if err := e.tokenService.RevokeAccessToken(auth.token); err != nil {
+		return err
+	}
+	if auth.deviceId != "" {
+		if err := e.userService.DeleteDevice(auth.user, auth.deviceId); err != nil {
+			return err
+		}
+	}
+	return struct{}{}
+}
+
+func (e authEndpoint) postLogoutAll(auth authInfo) interface{} {
+	user := auth.user
+	if err := e.tokenService.RevokeUserTokens(user); err != nil {
+		return err
+	}
+	devices, err := e.userService.Devices(user)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := e.userService.DeleteDevice(user, device.DeviceId); err != nil {
+			return err
+		}
+	}
+	return struct{}{}
+}
+
 func (e authEndpoint) Register(mux *httprouter.Router) {
-	mux.GET("/register", jsonHandler(func() interface{} {
-		return &defaultRegisterFlows
-	}))
+	access := accessFilter{e.userService, e.tokenService}
+	mux.GET("/register", jsonHandler(e.getRegisterFlows))
+	mux.GET("/register/available", jsonHandler(e.getUsernameAvailable))
+	mux.GET("/register/m.login.registration_token/validity", jsonHandler(e.getRegistrationTokenValidity))
 	mux.GET("/login", jsonHandler(func() interface{} {
-		return &defaultLoginFlows
+		return e.loginFlows()
 	}))
 	mux.POST("/register", jsonHandler(e.postRegister))
 	mux.POST("/login", jsonHandler(e.postLogin))
+	mux.POST("/refresh", jsonHandler(e.postRefresh))
+	if e.ssoService != nil {
+		mux.GET("/login/sso/redirect", e.handleSsoRedirect)
+		mux.GET("/login/sso/callback", e.handleSsoCallback)
+		mux.GET("/auth/"+types.AuthTypeSso+"/fallback/web", e.handleSsoFallback)
+		mux.GET("/auth/"+types.AuthTypeSso+"/fallback/callback", e.handleSsoFallbackCallback)
+	}
+	mux.POST("/logout", access.guest(jsonHandler(e.postLogout)))
+	mux.POST("/logout/all", access.guest(jsonHandler(e.postLogoutAll)))
 }
 
 type authEndpoint struct {
-	userService  interfaces.UserService
-	tokenService interfaces.TokenService
+	userService              interfaces.UserService
+	tokenService             interfaces.TokenService
+	uiaService               interfaces.UiaService
+	threepidService          interfaces.ThreepidService
+	ssoService               interfaces.SsoService
+	registrationTokenService interfaces.RegistrationTokenService
+	publicUrl                string
+	registration             types.RegistrationConfig
 }
 
+// The sso service may be nil if single sign-on isn't set up. The public url is the base url
+// of the client api, which the identity provider sends users back to.
 func NewAuthEndpoint(
 	userService interfaces.UserService,
 	tokenService interfaces.TokenService,
+	uiaService interfaces.UiaService,
+	threepidService interfaces.ThreepidService,
+	ssoService interfaces.SsoService,
+	registrationTokenService interfaces.RegistrationTokenService,
+	publicUrl string,
+	registration types.RegistrationConfig,
 ) Endpoint {
 	return authEndpoint{
-		userService:  userService,
-		tokenService: tokenService,
+		userService:              userService,
+		tokenService:             tokenService,
+		uiaService:               uiaService,
+		threepidService:          threepidService,
+		ssoService:               ssoService,
+		registrationTokenService: registrationTokenService,
+		publicUrl:                publicUrl,
+		registration:             registration,
 	}
 }
@@ -0,0 +1,67 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type roomVersionsCapability struct {
+	Default   string                                `json:"default"`
+	Available map[string]types.RoomVersionStability `json:"available"`
+}
+
+type booleanCapability struct {
+	Enabled bool `json:"enabled"`
+}
+
+type capabilities struct {
+	RoomVersions   roomVersionsCapability `json:"m.room_versions"`
+	ChangePassword booleanCapability      `json:"m.change_password"`
+}
+
+type capabilitiesResponse struct {
+	Capabilities capabilities `json:"capabilities"`
+}
+
+func (e capabilitiesEndpoint) getCapabilities() interface{} {
+	return capabilitiesResponse{capabilities{
+		RoomVersions:   roomVersionsCapability{types.DefaultRoomVersion, types.RoomVersions},
+		ChangePassword: booleanCapability{true},
+	}}
+}
+
+func (e capabilitiesEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	mux.GET("/capabilities", access.guest(jsonHandler(e.getCapabilities)))
+}
+
+type capabilitiesEndpoint struct {
+	users  interfaces.UserService
+	tokens interfaces.TokenService
+}
+
+func NewCapabilitiesEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+) Endpoint {
+	return capabilitiesEndpoint{
+		users,
+		tokens,
+	}
+}
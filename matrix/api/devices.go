@@ -0,0 +1,120 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type devicesResponse struct {
+	Devices []types.Device `json:"devices"`
+}
+
+type deviceRequest struct {
+	DisplayName *string `json:"display_name"`
+}
+
+type deleteDeviceRequest struct {
+	Auth *types.AuthData `json:"auth"`
+}
+
+func (e devicesEndpoint) getDevices(auth authInfo) interface{} {
+	user := auth.user
+	devices, err := e.users.Devices(user)
+	if err != nil {
+		return err
+	}
+	return devicesResponse{devices}
+}
+
+func (e devicesEndpoint) getDevice(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	device, err := e.users.Device(user, params[0].Value)
+	if err != nil {
+		return err
+	}
+	return device
+}
+
+func (e devicesEndpoint) putDevice(auth authInfo, params httprouter.Params, body *deviceRequest) interface{} {
+	user := auth.user
+	if body.DisplayName == nil {
+		if _, err := e.users.Device(user, params[0].Value); err != nil {
+			return err
+		}
+		return struct{}{}
+	}
+	if err := e.users.SetDeviceDisplayName(user, params[0].Value, *body.DisplayName); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e devicesEndpoint) deleteDevice(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	deviceId := params[0].Value
+	var body deleteDeviceRequest
+	if err := readOptionalJsonBody(req, &body); err != nil {
+		return err
+	}
+	if _, err := e.users.Device(user, deviceId); err != nil {
+		return err
+	}
+	if _, err := e.uia.Authenticate(uiaOperation(req), user, reauthFlows(e.sso), body.Auth); err != nil {
+		return err
+	}
+	if err := e.tokens.RevokeDeviceTokens(user, deviceId); err != nil {
+		return err
+	}
+	if err := e.users.DeleteDevice(user, deviceId); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e devicesEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	mux.GET("/devices", access.user(jsonHandler(e.getDevices)))
+	mux.GET("/devices/:deviceId", access.user(jsonHandler(e.getDevice)))
+	mux.PUT("/devices/:deviceId", access.user(jsonHandler(e.putDevice)))
+	mux.DELETE("/devices/:deviceId", access.user(jsonHandler(e.deleteDevice)))
+}
+
+type devicesEndpoint struct {
+	users  interfaces.UserService
+	tokens interfaces.TokenService
+	uia    interfaces.UiaService
+	sso    interfaces.SsoService
+}
+
+// The sso service may be nil if single sign-on isn't set up
+func NewDevicesEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	uia interfaces.UiaService,
+	sso interfaces.SsoService,
+) Endpoint {
+	return devicesEndpoint{
+		users,
+		tokens,
+		uia,
+		sso,
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type visibilityRequest struct {
+	Visibility *types.Visibility `json:"visibility"`
+}
+
+type visibilityResponse struct {
+	Visibility types.Visibility `json:"visibility"`
+}
+
+type aliasRequest struct {
+	RoomId *ct.RoomId `json:"room_id"`
+}
+
+type aliasResponse struct {
+	RoomId  ct.RoomId `json:"room_id"`
+	Servers []string  `json:"servers"`
+}
+
+type publicRoomsFilter struct {
+	SearchTerm string `json:"generic_search_term"`
+}
+
+type publicRoomsRequest struct {
+	Limit  uint              `json:"limit"`
+	Since  string            `json:"since"`
+	Filter publicRoomsFilter `json:"filter"`
+}
+
+func (e directoryEndpoint) getAlias(params httprouter.Params) interface{} {
+	alias, err := urlParams{params}.alias(0)
+	if err != nil {
+		return err
+	}
+	room, err := e.roomService.LookupAlias(alias)
+	if err != nil {
+		return err
+	}
+	return aliasResponse{room, []string{ct.Id(alias).Domain()}}
+}
+
+func (e directoryEndpoint) putAlias(auth authInfo, req *http.Request, params httprouter.Params, body *aliasRequest) interface{} {
+	user := auth.user
+	alias, err := urlParams{params}.alias(0)
+	if err != nil {
+		return err
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	if ct.Id(alias).Domain() != hostname {
+		return types.ForbiddenError("can only create aliases on '" + hostname + "'")
+	}
+	if body.RoomId == nil {
+		return types.BadJsonError("missing 'room_id'")
+	}
+	if err := e.roomService.AddAlias(alias, *body.RoomId, user); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e directoryEndpoint) deleteAlias(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	alias, err := urlParams{params}.alias(0)
+	if err != nil {
+		return err
+	}
+	if err := e.roomService.RemoveAlias(alias, user); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e directoryEndpoint) getRoomVisibility(params httprouter.Params) interface{} {
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	visibility, err := e.roomService.Visibility(room)
+	if err != nil {
+		return err
+	}
+	return visibilityResponse{visibility}
+}
+
+func (e directoryEndpoint) setRoomVisibility(auth authInfo, params httprouter.Params, body *visibilityRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	if body.Visibility == nil {
+		return types.BadJsonError("missing 'visibility'")
+	}
+	if err := e.roomService.SetVisibility(room, user, *body.Visibility); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e directoryEndpoint) getPublicRooms(req *http.Request) interface{} {
+	query := urlQuery{req.URL.Query()}
+	limit, err := query.parseUint("limit", 0)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+	rooms, err := e.directoryService.PublicRooms("", query.Get("since"), uint(limit))
+	if err != nil {
+		return err
+	}
+	return rooms
+}
+
+func (e directoryEndpoint) searchPublicRooms(body *publicRoomsRequest) interface{} {
+	limit := body.Limit
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+	rooms, err := e.directoryService.PublicRooms(body.Filter.SearchTerm, body.Since, limit)
+	if err != nil {
+		return err
+	}
+	return rooms
+}
+
+func (e directoryEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.userService, e.tokenService}
+	mux.GET("/directory/room/:roomAlias", jsonHandler(e.getAlias))
+	mux.PUT("/directory/room/:roomAlias", access.user(jsonHandler(e.putAlias)))
+	mux.DELETE("/directory/room/:roomAlias", access.user(jsonHandler(e.deleteAlias)))
+	mux.GET("/directory/list/room/:roomId", jsonHandler(e.getRoomVisibility))
+	mux.PUT("/directory/list/room/:roomId", access.user(jsonHandler(e.setRoomVisibility)))
+	mux.GET("/publicRooms", jsonHandler(e.getPublicRooms))
+	mux.POST("/publicRooms", access.user(jsonHandler(e.searchPublicRooms)))
+}
+
+type directoryEndpoint struct {
+	userService      interfaces.UserService
+	tokenService     interfaces.TokenService
+	roomService      interfaces.RoomService
+	directoryService interfaces.DirectoryService
+}
+
+func NewDirectoryEndpoint(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	roomService interfaces.RoomService,
+	directoryService interfaces.DirectoryService,
+) Endpoint {
+	return directoryEndpoint{
+		userService,
+		tokenService,
+		roomService,
+		directoryService,
+	}
+}
@@ -25,11 +25,8 @@ import (
 	"github.com/matrix-org/bullettime/matrix/types"
 )
 
-func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e eventsEndpoint) getEvents(auth authInfo, req *http.Request) interface{} {
+	authedUser := auth.user
 
 	query := urlQuery{req.URL.Query()}
 
@@ -64,7 +61,7 @@ func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
 
 	dir := query.Get("dir")
 	if dir == "b" {
-		token := types.NewStreamToken(0, 0, 0)
+		token := types.NewStreamToken(0, 0, 0, 0)
 		to = &token
 	}
 
@@ -75,7 +72,16 @@ func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
 		close(cancel)
 	}(time.Millisecond * time.Duration(timeout))
 
-	chunk, err := e.eventService.Range(authedUser, from, to, uint(limit), cancel)
+	var chunk *types.EventStreamRange
+	if roomId := query.Get("room_id"); roomId != "" {
+		room, parseErr := ct.ParseRoomId(roomId)
+		if parseErr != nil {
+			return types.BadQueryError(parseErr.Error())
+		}
+		chunk, err = e.eventService.PeekRange(authedUser, room, from, to, uint(limit), cancel)
+	} else {
+		chunk, err = e.eventService.Range(authedUser, from, to, uint(limit), cancel)
+	}
 	if err != nil {
 		return err
 	}
@@ -83,11 +89,8 @@ func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
 	return chunk
 }
 
-func (e eventsEndpoint) getSingleEvent(req *http.Request, params httprouter.Params) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e eventsEndpoint) getSingleEvent(auth authInfo, params httprouter.Params) interface{} {
+	authedUser := auth.user
 	eventId, parseErr := ct.ParseEventId(params[0].Value)
 	if parseErr != nil {
 		return types.BadJsonError(parseErr.Error())
@@ -99,11 +102,8 @@ func (e eventsEndpoint) getSingleEvent(req *http.Request, params httprouter.Para
 	return event
 }
 
-func (e eventsEndpoint) getInitialSync(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e eventsEndpoint) getInitialSync(auth authInfo, req *http.Request) interface{} {
+	authedUser := auth.user
 
 	query := urlQuery{req.URL.Query()}
 
@@ -122,19 +122,11 @@ func (e eventsEndpoint) getInitialSync(req *http.Request) interface{} {
 	return initialSync
 }
 
-func (e eventsEndpoint) getPublicRooms(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
-	return authedUser
-}
-
 func (e eventsEndpoint) Register(mux *httprouter.Router) {
-	mux.GET("/events", jsonHandler(e.getEvents))
-	mux.PUT("/events/:eventId", jsonHandler(e.getSingleEvent))
-	mux.GET("/initialSync", jsonHandler(e.getInitialSync))
-	mux.PUT("/publicRooms", jsonHandler(e.getPublicRooms))
+	access := accessFilter{e.userService, e.tokenService}
+	mux.GET("/events", access.guest(jsonHandler(e.getEvents)))
+	mux.PUT("/events/:eventId", access.guest(jsonHandler(e.getSingleEvent)))
+	mux.GET("/initialSync", access.guest(jsonHandler(e.getInitialSync)))
 }
 
 type eventsEndpoint struct {
@@ -15,14 +15,20 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 
+	ci "github.com/matrix-org/bullettime/core/interfaces"
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -47,6 +53,15 @@ func (s *OkStatus) Status() int {
 type JsonHandler func(req *http.Request, params httprouter.Params) interface{}
 type JsonBodyHandler func(req *http.Request, params httprouter.Params, body interface{}) interface{}
 
+var (
+	paramsType   = reflect.TypeOf(httprouter.Params{})
+	requestType  = reflect.TypeOf(&http.Request{})
+	authInfoType = reflect.TypeOf(authInfo{})
+)
+
+// Wraps a function that returns a json response in a httprouter.Handle. The function
+// can take the url params, the request and the authInfo of the caller as arguments,
+// in any order, followed by a pointer to a type that the request body is decoded into.
 func jsonHandler(i interface{}) httprouter.Handle {
 	t := reflect.TypeOf(i)
 	if reflect.Func != t.Kind() {
@@ -58,84 +73,47 @@ func jsonHandler(i interface{}) httprouter.Handle {
 	argCount := t.NumIn()
 
 	var jsonType reflect.Type
-	firstParamIsParams := false
-	if argCount > 0 {
-		firstParamIsParams = t.In(0).String() == "httprouter.Params"
-		lastParamIsParams := t.In(argCount-1).String() == "httprouter.Params"
-		lastParamIsRequest := t.In(argCount-1).String() == "*http.Request"
-		if !lastParamIsParams && !lastParamIsRequest {
-			typ := t.In(argCount - 1)
+	for n := 0; n < argCount; n++ {
+		switch typ := t.In(n); typ {
+		case paramsType, requestType, authInfoType:
+		default:
+			if n != argCount-1 {
+				panic("jsonHandler: body argument must be the last argument, was " + typ.String())
+			}
 			if typ.Kind() != reflect.Ptr {
 				panic("jsonHandler: body argument must be a pointer type, was " + typ.String())
 			}
 			jsonType = typ.Elem()
 		}
 	}
-	if jsonType == nil {
-		if t.NumIn() > 2 {
-			panic("jsonHandler: arity must be at most 2 if no body argument is preset")
-		}
-	} else {
-		if t.NumIn() > 3 {
-			panic("jsonHandler: arity must be at most 3 if body argument is preset")
-		}
-	}
 	handlerFunc := reflect.ValueOf(i)
 
 	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		var returnValue reflect.Value
-		var args []reflect.Value
-		if jsonType == nil {
-			switch argCount {
-			case 0:
-				args = []reflect.Value{}
-			case 1:
-				if firstParamIsParams {
-					args = []reflect.Value{reflect.ValueOf(params)}
-				} else {
-					args = []reflect.Value{reflect.ValueOf(req)}
-				}
-			case 2:
-				if firstParamIsParams {
-					args = []reflect.Value{reflect.ValueOf(params), reflect.ValueOf(req)}
-				} else {
-					args = []reflect.Value{reflect.ValueOf(req), reflect.ValueOf(params)}
+		args := make([]reflect.Value, argCount)
+		for n := range args {
+			switch t.In(n) {
+			case paramsType:
+				args[n] = reflect.ValueOf(params)
+			case requestType:
+				args[n] = reflect.ValueOf(req)
+			case authInfoType:
+				auth, ok := authInfoOf(req)
+				if !ok {
+					log.Println("jsonHandler: handler requires authentication but route has no access filter: ", req.URL.Path)
+					WriteJsonResponseWithStatus(rw, types.ServerError("missing authentication"))
+					return
 				}
-			}
-		} else {
-			body := reflect.New(jsonType)
-			if err := json.NewDecoder(req.Body).Decode(body.Interface()); err != nil {
-				switch err := err.(type) {
-				case *json.SyntaxError:
-					msg := fmt.Sprintf("error at [%d]: %s", err.Offset, err.Error())
-					WriteJsonResponseWithStatus(rw, types.NotJsonError(msg))
-				case *json.UnmarshalTypeError:
-					msg := fmt.Sprintf("error at [%d]: expected type %s but got %s", err.Offset, err.Type, err.Value)
-					WriteJsonResponseWithStatus(rw, types.BadJsonError(msg))
-				default:
-					WriteJsonResponseWithStatus(rw, types.BadJsonError(err.Error()))
-				}
-				return
-			}
-			switch argCount {
-			case 1:
-				args = []reflect.Value{body}
-			case 2:
-				if firstParamIsParams {
-					args = []reflect.Value{reflect.ValueOf(params), body}
-				} else {
-					args = []reflect.Value{reflect.ValueOf(req), body}
-				}
-			case 3:
-				if firstParamIsParams {
-					args = []reflect.Value{reflect.ValueOf(params), reflect.ValueOf(req), body}
-				} else {
-					args = []reflect.Value{reflect.ValueOf(req), reflect.ValueOf(params), body}
+				args[n] = reflect.ValueOf(auth)
+			default:
+				body := reflect.New(jsonType)
+				if err := json.NewDecoder(req.Body).Decode(body.Interface()); err != nil {
+					WriteJsonResponseWithStatus(rw, jsonDecodeError(err))
+					return
 				}
+				args[n] = body
 			}
 		}
-		returnValue = handlerFunc.Call(args)[0]
-		res := returnValue.Interface()
+		res := handlerFunc.Call(args)[0].Interface()
 
 		withStatus, ok := res.(WithStatus)
 		if ok {
@@ -146,6 +124,73 @@ func jsonHandler(i interface{}) httprouter.Handle {
 	}
 }
 
+func jsonDecodeError(err error) types.Error {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		msg := fmt.Sprintf("error at [%d]: %s", err.Offset, err.Error())
+		return types.NotJsonError(msg)
+	case *json.UnmarshalTypeError:
+		msg := fmt.Sprintf("error at [%d]: expected type %s but got %s", err.Offset, err.Type, err.Value)
+		return types.BadJsonError(msg)
+	default:
+		return types.BadJsonError(err.Error())
+	}
+}
+
+// like the body argument of jsonHandler, but leaves the body untouched if the request doesn't have one
+func readOptionalJsonBody(req *http.Request, body interface{}) types.Error {
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil && err != io.EOF {
+		return jsonDecodeError(err)
+	}
+	return nil
+}
+
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(bytes []byte) (int, error) {
+	return r.body.Write(bytes)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+// Responds to requests that are retried by the same device with the same path, which
+// includes the transaction id, with the response to the original request. Must be
+// wrapped by an access filter.
+func transactionHandler(txns ci.TransactionCache, handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		auth, ok := authInfoOf(req)
+		if !ok {
+			handle(rw, req, params)
+			return
+		}
+		scope := auth.deviceId
+		if scope == "" {
+			scope = auth.token
+		}
+		key := auth.user.String() + " " + scope + " " + req.Method + " " + req.URL.Path
+		response := txns.Do(key, func() (interface{}, bool) {
+			recorder := &responseRecorder{header: http.Header{}, status: 200}
+			handle(recorder, req, params)
+			return recorder, recorder.status == 200
+		}).(*responseRecorder)
+		for key, values := range response.header {
+			rw.Header()[key] = values
+		}
+		rw.WriteHeader(response.status)
+		rw.Write(response.body.Bytes())
+	}
+}
+
 func WriteJsonResponse(rw http.ResponseWriter, status int, body interface{}) {
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 	res, err := json.Marshal(body)
@@ -163,27 +208,136 @@ func WriteJsonResponseWithStatus(rw http.ResponseWriter, body WithStatus) {
 	WriteJsonResponse(rw, body.Status(), body)
 }
 
-func readAccessToken(
-	userService interfaces.UserService,
-	tokenService interfaces.TokenService,
-	req *http.Request,
-) (ct.UserId, types.Error) {
-	token := req.URL.Query().Get("access_token")
+// the authenticated caller of a request, passed to handlers by the access filters
+type authInfo struct {
+	user     ct.UserId
+	deviceId string
+	token    string
+}
+
+type authInfoKey struct{}
+
+func authInfoOf(req *http.Request) (authInfo, bool) {
+	auth, ok := req.Context().Value(authInfoKey{}).(authInfo)
+	return auth, ok
+}
+
+type accessLevel int
+
+const (
+	accessGuest accessLevel = iota // registered users and guests
+	accessUser                     // registered users only
+	accessAdmin                    // server admins only
+)
+
+// Wraps the handlers of routes that require an access token. The caller is
+// authenticated before the request is passed on, and handlers registered with
+// jsonHandler can receive it by taking an authInfo argument. Routes that aren't
+// wrapped are unauthenticated.
+type accessFilter struct {
+	users  interfaces.UserService
+	tokens interfaces.TokenService
+}
+
+func (f accessFilter) guest(handle httprouter.Handle) httprouter.Handle {
+	return f.filter(accessGuest, handle)
+}
+
+func (f accessFilter) user(handle httprouter.Handle) httprouter.Handle {
+	return f.filter(accessUser, handle)
+}
+
+func (f accessFilter) admin(handle httprouter.Handle) httprouter.Handle {
+	return f.filter(accessAdmin, handle)
+}
+
+// authenticates registered users if the request has an access token, and passes it on without an
+// authInfo otherwise, so handlers have to use authInfoOf instead of taking an authInfo argument
+func (f accessFilter) optional(handle httprouter.Handle) httprouter.Handle {
+	authenticated := f.filter(accessUser, handle)
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if accessToken(req) == "" {
+			handle(rw, req, params)
+		} else {
+			authenticated(rw, req, params)
+		}
+	}
+}
+
+func (f accessFilter) filter(level accessLevel, handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		auth, err := f.authenticate(req, level)
+		if err != nil {
+			WriteJsonResponseWithStatus(rw, err)
+			return
+		}
+		ctx := context.WithValue(req.Context(), authInfoKey{}, auth)
+		handle(rw, req.WithContext(ctx), params)
+	}
+}
+
+func (f accessFilter) authenticate(req *http.Request, level accessLevel) (authInfo, types.Error) {
+	token := accessToken(req)
 	if token == "" {
-		return ct.UserId{}, types.DefaultMissingTokenError
+		return authInfo{}, types.DefaultMissingTokenError
 	}
-	info, err := tokenService.ParseAccessToken(token)
+	info, err := f.tokens.ParseAccessToken(token)
 	if err != nil {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return authInfo{}, err
 	}
-	exists, err := userService.UserExists(info.UserId(), info.UserId())
+	user := info.UserId()
+	exists, err := f.users.UserExists(user, user)
 	if err != nil {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return authInfo{}, types.DefaultUnknownTokenError
 	}
 	if !exists {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return authInfo{}, types.DefaultUnknownTokenError
+	}
+	if level != accessGuest {
+		isGuest, err := f.users.IsGuest(user)
+		if err != nil {
+			return authInfo{}, err
+		}
+		if isGuest {
+			return authInfo{}, types.DefaultGuestAccessForbiddenError
+		}
+	}
+	if level == accessAdmin {
+		isAdmin, err := f.users.IsAdmin(user)
+		if err != nil {
+			return authInfo{}, err
+		}
+		if !isAdmin {
+			return authInfo{}, types.ForbiddenError("only server admins can do this")
+		}
+	}
+	if info.DeviceId() != "" {
+		if err := f.users.DeviceSeen(user, info.DeviceId(), remoteIp(req)); err != nil {
+			return authInfo{}, err
+		}
+	}
+	return authInfo{user, info.DeviceId(), token}, nil
+}
+
+// reads the access token from the Authorization header, falling back to the
+// deprecated access_token query parameter
+func accessToken(req *http.Request) string {
+	if header := req.Header.Get("Authorization"); header != "" {
+		const prefix = "Bearer "
+		if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+			return strings.TrimSpace(header[len(prefix):])
+		}
+		return ""
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+func remoteIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
 	}
-	return info.UserId(), nil
+	return host
 }
 
 type urlParams struct {
@@ -215,6 +369,14 @@ func (p urlParams) room(paramPosition int) (ct.RoomId, types.Error) {
 	return room, nil
 }
 
+func (p urlParams) alias(paramPosition int) (ct.Alias, types.Error) {
+	alias, parseErr := ct.ParseAlias(p.params[paramPosition].Value)
+	if parseErr != nil {
+		return ct.Alias{}, types.BadParamError(parseErr.Error())
+	}
+	return alias, nil
+}
+
 type urlQuery struct {
 	url.Values
 }
@@ -244,3 +406,16 @@ func (q urlQuery) parseStreamToken(name string) (*types.StreamToken, types.Error
 	}
 	return &token, nil
 }
+
+func (q urlQuery) parseMembership(name string) (types.Membership, types.Error) {
+	str := q.Get(name)
+	if str == "" {
+		return types.MembershipNone, nil
+	}
+
+	membership, err := types.ParseMembership(str)
+	if err != nil {
+		return types.MembershipNone, types.BadQueryError(err.Error())
+	}
+	return membership, nil
+}
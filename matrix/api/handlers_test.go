@@ -0,0 +1,82 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+)
+
+func TestAccessToken(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		query    string
+		expected string
+	}{
+		{"Bearer abc", "", "abc"},
+		{"bearer abc", "", "abc"},
+		{"BEARER  abc ", "", "abc"},
+		{"Bearer abc", "def", "abc"},
+		{"", "def", "def"},
+		{"", "", ""},
+		{"Basic abc", "", ""},
+		{"Basic abc", "def", ""},
+		{"Bearer ", "", ""},
+		{"Bearerabc", "", ""},
+	} {
+		req := httptest.NewRequest("GET", "http://matrix.org/sync?access_token="+test.query, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if token := accessToken(req); token != test.expected {
+			t.Errorf("expected header '%s' and query '%s' to give '%s', got '%s'", test.header, test.query, test.expected, token)
+		}
+	}
+}
+
+func TestJsonHandlerAuthentication(t *testing.T) {
+	var called bool
+	handle := jsonHandler(func(auth authInfo) interface{} {
+		called = true
+		return map[string]string{"user_id": auth.user.String()}
+	})
+
+	rw := httptest.NewRecorder()
+	handle(rw, httptest.NewRequest("GET", "http://matrix.org/whoami", nil), nil)
+	var response map[string]string
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if called || rw.Code != 500 || response["errcode"] != "M_SERVER_ERROR" {
+		t.Error("expected a handler that requires authentication to fail without an access filter, got", rw.Code, response)
+	}
+
+	alice := ct.NewUserId("alice", "matrix.org")
+	req := httptest.NewRequest("GET", "http://matrix.org/whoami", nil)
+	req = req.WithContext(context.WithValue(req.Context(), authInfoKey{}, authInfo{user: alice}))
+	rw = httptest.NewRecorder()
+	handle(rw, req, nil)
+	response = nil
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !called || rw.Code != 200 || response["user_id"] != alice.String() {
+		t.Error("expected the handler to receive the authenticated user, got", rw.Code, response)
+	}
+}
@@ -15,8 +15,6 @@
 package api
 
 import (
-	"net/http"
-
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
 
@@ -28,11 +26,8 @@ type statusRequest struct {
 	StatusMessage *string         `json:"status_msg"`
 }
 
-func (e presenceEndpoint) getStatus(req *http.Request, params httprouter.Params) interface{} {
-	authedUser, err := readAccessToken(e.users, e.tokens, req)
-	if err != nil {
-		return err
-	}
+func (e presenceEndpoint) getStatus(auth authInfo, params httprouter.Params) interface{} {
+	authedUser := auth.user
 	user, err := urlParams{params}.user(0, e.users)
 	if err != nil {
 		return err
@@ -44,11 +39,8 @@ func (e presenceEndpoint) getStatus(req *http.Request, params httprouter.Params)
 	return status
 }
 
-func (e presenceEndpoint) setStatus(req *http.Request, params httprouter.Params, body *statusRequest) interface{} {
-	authedUser, err := readAccessToken(e.users, e.tokens, req)
-	if err != nil {
-		return err
-	}
+func (e presenceEndpoint) setStatus(auth authInfo, params httprouter.Params, body *statusRequest) interface{} {
+	authedUser := auth.user
 	user, err := urlParams{params}.user(0, e.users)
 	if err != nil {
 		return err
@@ -64,8 +56,9 @@ func (e presenceEndpoint) setStatus(req *http.Request, params httprouter.Params,
 }
 
 func (e presenceEndpoint) Register(mux *httprouter.Router) {
-	mux.GET("/presence/:userId/status", jsonHandler(e.getStatus))
-	mux.PUT("/presence/:userId/status", jsonHandler(e.setStatus))
+	access := accessFilter{e.users, e.tokens}
+	mux.GET("/presence/:userId/status", access.guest(jsonHandler(e.getStatus)))
+	mux.PUT("/presence/:userId/status", access.guest(jsonHandler(e.setStatus)))
 }
 
 type presenceEndpoint struct {
@@ -15,8 +15,6 @@
 package api
 
 import (
-	"net/http"
-
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
 
@@ -48,11 +46,8 @@ func (e profileEndpoint) getDisplayName(params httprouter.Params) interface{} {
 	return displayNameResponse{profile.DisplayName}
 }
 
-func (e profileEndpoint) setDisplayName(req *http.Request, params httprouter.Params, body *displayNameRequest) interface{} {
-	authedUser, err := readAccessToken(e.users, e.tokens, req)
-	if err != nil {
-		return err
-	}
+func (e profileEndpoint) setDisplayName(auth authInfo, params httprouter.Params, body *displayNameRequest) interface{} {
+	authedUser := auth.user
 	user, err := urlParams{params}.user(0, e.users)
 	if err != nil {
 		return err
@@ -78,11 +73,8 @@ func (e profileEndpoint) getAvatarUrl(params httprouter.Params) interface{} {
 	return avatarUrlResponse{profile.AvatarUrl}
 }
 
-func (e profileEndpoint) setAvatarUrl(req *http.Request, params httprouter.Params, body *avatarUrlRequest) interface{} {
-	authedUser, err := readAccessToken(e.users, e.tokens, req)
-	if err != nil {
-		return err
-	}
+func (e profileEndpoint) setAvatarUrl(auth authInfo, params httprouter.Params, body *avatarUrlRequest) interface{} {
+	authedUser := auth.user
 	user, err := urlParams{params}.user(0, e.users)
 	if err != nil {
 		return err
@@ -109,10 +101,11 @@ func (e profileEndpoint) getProfile(params httprouter.Params) interface{} {
 }
 
 func (e profileEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
 	mux.GET("/profile/:userId/displayname", jsonHandler(e.getDisplayName))
-	mux.PUT("/profile/:userId/displayname", jsonHandler(e.setDisplayName))
+	mux.PUT("/profile/:userId/displayname", access.guest(jsonHandler(e.setDisplayName)))
 	mux.GET("/profile/:userId/avatar_url", jsonHandler(e.getAvatarUrl))
-	mux.PUT("/profile/:userId/avatar_url", jsonHandler(e.setAvatarUrl))
+	mux.PUT("/profile/:userId/avatar_url", access.user(jsonHandler(e.setAvatarUrl)))
 	mux.GET("/profile/:userId", jsonHandler(e.getProfile))
 }
 
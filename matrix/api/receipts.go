@@ -0,0 +1,66 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type receiptRequest struct {
+	ThreadId string `json:"thread_id"`
+}
+
+func (e receiptsEndpoint) postReceipt(auth authInfo, params httprouter.Params, body *receiptRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	receiptType := params[1].Value
+	eventId, parseErr := ct.ParseEventId(params[2].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	if err := e.receiptService.SetReceipt(room, user, receiptType, eventId, body.ThreadId); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e receiptsEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.userService, e.tokenService}
+	mux.POST("/rooms/:roomId/receipt/:receiptType/:eventId", access.guest(jsonHandler(e.postReceipt)))
+}
+
+type receiptsEndpoint struct {
+	userService    interfaces.UserService
+	tokenService   interfaces.TokenService
+	receiptService interfaces.ReceiptService
+}
+
+func NewReceiptsEndpoint(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	receiptService interfaces.ReceiptService,
+) Endpoint {
+	return receiptsEndpoint{
+		userService,
+		tokenService,
+		receiptService,
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type newRegistrationTokenRequest struct {
+	// generated if empty
+	Token       string `json:"token"`
+	UsesAllowed *int   `json:"uses_allowed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+type registrationTokensResponse struct {
+	RegistrationTokens []types.RegistrationToken `json:"registration_tokens"`
+}
+
+func (e registrationTokensEndpoint) getRegistrationTokens() interface{} {
+	tokens, err := e.registrationTokens.RegistrationTokens()
+	if err != nil {
+		return err
+	}
+	return registrationTokensResponse{tokens}
+}
+
+func (e registrationTokensEndpoint) postRegistrationToken(body *newRegistrationTokenRequest) interface{} {
+	token, err := e.registrationTokens.CreateRegistrationToken(body.Token, body.UsesAllowed, body.ExpiryTime)
+	if err != nil {
+		return err
+	}
+	return token
+}
+
+func (e registrationTokensEndpoint) getRegistrationToken(params httprouter.Params) interface{} {
+	token, err := e.registrationTokens.RegistrationToken(params[0].Value)
+	if err != nil {
+		return err
+	}
+	return token
+}
+
+func (e registrationTokensEndpoint) deleteRegistrationToken(params httprouter.Params) interface{} {
+	if err := e.registrationTokens.RemoveRegistrationToken(params[0].Value); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e registrationTokensEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	mux.GET("/admin/registration_tokens", access.admin(jsonHandler(e.getRegistrationTokens)))
+	mux.POST("/admin/registration_tokens/new", access.admin(jsonHandler(e.postRegistrationToken)))
+	mux.GET("/admin/registration_tokens/:token", access.admin(jsonHandler(e.getRegistrationToken)))
+	mux.DELETE("/admin/registration_tokens/:token", access.admin(jsonHandler(e.deleteRegistrationToken)))
+}
+
+type registrationTokensEndpoint struct {
+	users              interfaces.UserService
+	tokens             interfaces.TokenService
+	registrationTokens interfaces.RegistrationTokenService
+}
+
+func NewRegistrationTokensEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	registrationTokens interfaces.RegistrationTokenService,
+) Endpoint {
+	return registrationTokensEndpoint{
+		users,
+		tokens,
+		registrationTokens,
+	}
+}
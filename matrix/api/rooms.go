@@ -16,13 +16,13 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	ci "github.com/matrix-org/bullettime/core/interfaces"
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -41,15 +41,41 @@ type eventIdResponse struct {
 	EventId ct.EventId `json:"event_id"`
 }
 
+type membersResponse struct {
+	Chunk []*types.State `json:"chunk"`
+}
+
+type joinedMember struct {
+	DisplayName string `json:"display_name"`
+	AvatarUrl   string `json:"avatar_url"`
+}
+
+type joinedMembersResponse struct {
+	Joined map[string]joinedMember `json:"joined"`
+}
+
+type aliasesResponse struct {
+	Aliases []ct.Alias `json:"aliases"`
+}
+
+type redactRequest struct {
+	Reason string `json:"reason"`
+}
+
+type upgradeRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeResponse struct {
+	ReplacementRoom ct.RoomId `json:"replacement_room"`
+}
+
 type userRequest struct {
 	UserId ct.UserId `json:"user_id"`
 }
 
-func (e roomsEndpoint) createRoom(req *http.Request, body *types.RoomDescription) interface{} {
-	creator, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e roomsEndpoint) createRoom(auth authInfo, req *http.Request, body *types.RoomDescription) interface{} {
+	creator := auth.user
 	hostname := strings.Split(req.Host, ":")[0]
 	room, alias, err := e.roomService.CreateRoom(hostname, creator, body)
 	if err != nil {
@@ -58,11 +84,8 @@ func (e roomsEndpoint) createRoom(req *http.Request, body *types.RoomDescription
 	return CreateRoomResponse{room, alias}
 }
 
-func (e roomsEndpoint) doWildcardJoin(req *http.Request, params httprouter.Params) interface{} {
-	user, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e roomsEndpoint) doWildcardJoin(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
 	roomIdOrAlias := params[0].Value
 	room, parseErr := ct.ParseRoomId(roomIdOrAlias)
 	if parseErr != nil {
@@ -70,6 +93,7 @@ func (e roomsEndpoint) doWildcardJoin(req *http.Request, params httprouter.Param
 		if parseErr != nil {
 			return types.BadParamError("invalid room id or alias: " + roomIdOrAlias)
 		}
+		var err types.Error
 		room, err = e.roomService.LookupAlias(alias)
 		if err != nil {
 			return err
@@ -77,18 +101,14 @@ func (e roomsEndpoint) doWildcardJoin(req *http.Request, params httprouter.Param
 	}
 	content := types.MembershipEventContent{}
 	content.Membership = types.MembershipMember
-	_, err = e.roomService.SetState(room, user, &content, user.String())
-	if err != nil {
+	if _, err := e.roomService.SetState(room, user, &content, user.String()); err != nil {
 		return err
 	}
 	return struct{}{}
 }
 
-func (e roomsEndpoint) sendMessage(req *http.Request, params httprouter.Params, content *map[string]interface{}) interface{} {
-	user, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return err
-	}
+func (e roomsEndpoint) sendMessage(auth authInfo, params httprouter.Params, content *map[string]interface{}) interface{} {
+	user := auth.user
 	room, parseErr := ct.ParseRoomId(params[0].Value)
 	if parseErr != nil {
 		return types.BadParamError(parseErr.Error())
@@ -102,8 +122,26 @@ func (e roomsEndpoint) sendMessage(req *http.Request, params httprouter.Params,
 	return eventIdResponse{message.EventId}
 }
 
-func (e roomsEndpoint) doInvite(req *http.Request, params httprouter.Params, body *userRequest) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) redact(auth authInfo, params httprouter.Params, body *redactRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	eventId, parseErr := ct.ParseEventId(params[1].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	redaction, err := e.roomService.Redact(room, user, eventId, body.Reason)
+	if err != nil {
+		return err
+	}
+	return eventIdResponse{redaction.EventId}
+}
+
+func (e roomsEndpoint) doInvite(auth authInfo, params httprouter.Params, body *userRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -116,8 +154,9 @@ func (e roomsEndpoint) doInvite(req *http.Request, params httprouter.Params, bod
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doKick(req *http.Request, params httprouter.Params, body *userRequest) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doKick(auth authInfo, params httprouter.Params, body *userRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -130,8 +169,9 @@ func (e roomsEndpoint) doKick(req *http.Request, params httprouter.Params, body
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doBan(req *http.Request, params httprouter.Params, body *userRequest) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doBan(auth authInfo, params httprouter.Params, body *userRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -144,8 +184,9 @@ func (e roomsEndpoint) doBan(req *http.Request, params httprouter.Params, body *
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doJoin(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doJoin(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -158,8 +199,9 @@ func (e roomsEndpoint) doJoin(req *http.Request, params httprouter.Params) inter
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doKnock(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doKnock(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -172,8 +214,9 @@ func (e roomsEndpoint) doKnock(req *http.Request, params httprouter.Params) inte
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doLeave(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doLeave(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -186,8 +229,9 @@ func (e roomsEndpoint) doLeave(req *http.Request, params httprouter.Params) inte
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doInitialSync(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) doInitialSync(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -217,7 +261,9 @@ func (e roomsEndpoint) doInitialSync(req *http.Request, params httprouter.Params
 }
 
 func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	room, user, err := e.getRoomAndUser(req, params)
+	auth, _ := authInfoOf(req)
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		WriteJsonResponseWithStatus(rw, err)
 		return
@@ -240,6 +286,14 @@ func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request,
 		content = &types.PowerLevelsEventContent{}
 	case types.EventTypeJoinRules:
 		content = &types.JoinRulesEventContent{}
+	case types.EventTypeCanonicalAlias:
+		content = &types.CanonicalAliasEventContent{}
+	case types.EventTypeHistoryVisibility:
+		content = &types.HistoryVisibilityEventContent{}
+	case types.EventTypeGuestAccess:
+		content = &types.GuestAccessEventContent{}
+	case types.EventTypeTombstone:
+		content = &types.TombstoneEventContent{}
 	}
 	var jsonErr error
 	if content != nil {
@@ -250,16 +304,7 @@ func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request,
 		jsonErr = json.NewDecoder(req.Body).Decode(&genericContent.Content)
 	}
 	if jsonErr != nil {
-		switch err := jsonErr.(type) {
-		case *json.SyntaxError:
-			msg := fmt.Sprintf("error at [%d]: %s", err.Offset, err.Error())
-			WriteJsonResponseWithStatus(rw, types.NotJsonError(msg))
-		case *json.UnmarshalTypeError:
-			msg := fmt.Sprintf("error at [%d]: expected type %s but got %s", err.Offset, err.Type, err.Value)
-			WriteJsonResponseWithStatus(rw, types.BadJsonError(msg))
-		default:
-			WriteJsonResponseWithStatus(rw, types.BadJsonError(err.Error()))
-		}
+		WriteJsonResponseWithStatus(rw, jsonDecodeError(jsonErr))
 		return
 	}
 	state, err := e.roomService.SetState(room, user, content, stateKey)
@@ -271,8 +316,207 @@ func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request,
 	WriteJsonResponse(rw, 200, res)
 }
 
-func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+func (e roomsEndpoint) getState(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	eventType := params[1].Value
+	stateKey := ""
+	if len(params) > 2 {
+		stateKey = params[2].Value
+	}
+	state, err := e.roomService.State(room, user, eventType, stateKey)
+	if err != nil {
+		return err
+	}
+	return state.Content
+}
+
+func (e roomsEndpoint) getEntireState(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	states, err := e.roomService.EntireState(room, user)
+	if err != nil {
+		return err
+	}
+	return states
+}
+
+func (e roomsEndpoint) getMembers(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	query := urlQuery{req.URL.Query()}
+	at, err := query.parseStreamToken("at")
+	if err != nil {
+		return err
+	}
+	membership, err := query.parseMembership("membership")
+	if err != nil {
+		return err
+	}
+	notMembership, err := query.parseMembership("not_membership")
+	if err != nil {
+		return err
+	}
+	members, err := e.roomService.Members(room, user, at, membership, notMembership)
+	if err != nil {
+		return err
+	}
+	return membersResponse{members}
+}
+
+func (e roomsEndpoint) getJoinedMembers(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	members, err := e.roomService.JoinedMembers(room, user)
+	if err != nil {
+		return err
+	}
+	joined := make(map[string]joinedMember, len(members))
+	for member, profile := range members {
+		joined[member.String()] = joinedMember{profile.DisplayName, profile.AvatarUrl}
+	}
+	return joinedMembersResponse{joined}
+}
+
+func (e roomsEndpoint) upgradeRoom(auth authInfo, req *http.Request, params httprouter.Params, body *upgradeRequest) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	if body.NewVersion == "" {
+		return types.BadJsonError("missing new_version")
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	replacement, err := e.roomService.UpgradeRoom(hostname, room, user, body.NewVersion)
+	if err != nil {
+		return err
+	}
+	return upgradeResponse{replacement}
+}
+
+func (e roomsEndpoint) getAliases(auth authInfo, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	aliases, err := e.roomService.Aliases(room, user)
+	if err != nil {
+		return err
+	}
+	return aliasesResponse{aliases}
+}
+
+func (e roomsEndpoint) getContext(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	eventId, parseErr := ct.ParseEventId(params[1].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	query := urlQuery{req.URL.Query()}
+	limit, err := query.parseUint("limit", 10)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+	context, err := e.eventService.Context(user, room, eventId, uint(limit))
+	if err != nil {
+		return err
+	}
+	return context
+}
+
+func (e roomsEndpoint) getRelations(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	eventId, parseErr := ct.ParseEventId(params[1].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	var relType, eventType string
+	if len(params) > 2 {
+		relType = params[2].Value
+	}
+	if len(params) > 3 {
+		eventType = params[3].Value
+	}
+	query := urlQuery{req.URL.Query()}
+	var from *uint64
+	if query.Get("from") != "" {
+		index, err := query.parseUint("from", 0)
+		if err != nil {
+			return err
+		}
+		from = &index
+	}
+	limit, err := query.parseUint("limit", 50)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+	relations, err := e.eventService.Relations(user, room, eventId, relType, eventType, from, uint(limit))
+	if err != nil {
+		return err
+	}
+	return relations
+}
+
+func (e roomsEndpoint) getThreads(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return err
+	}
+	query := urlQuery{req.URL.Query()}
+	var from *uint64
+	if query.Get("from") != "" {
+		index, err := query.parseUint("from", 0)
+		if err != nil {
+			return err
+		}
+		from = &index
+	}
+	limit, err := query.parseUint("limit", 50)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+	threads, err := e.eventService.Threads(user, room, query.Get("include"), from, uint(limit))
+	if err != nil {
+		return err
+	}
+	return threads
+}
+
+func (e roomsEndpoint) getMessages(auth authInfo, req *http.Request, params httprouter.Params) interface{} {
+	user := auth.user
+	room, err := urlParams{params}.room(0)
 	if err != nil {
 		return err
 	}
@@ -303,7 +547,7 @@ func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params)
 	}
 
 	if dir == "b" {
-		token := types.NewStreamToken(0, 0, 0)
+		token := types.NewStreamToken(0, 0, 0, 0)
 		to = &token
 	}
 
@@ -330,38 +574,36 @@ func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params)
 	return eventRange
 }
 
-func (e roomsEndpoint) getRoomAndUser(req *http.Request, params httprouter.Params) (ct.RoomId, ct.UserId, types.Error) {
-	user, err := readAccessToken(e.userService, e.tokenService, req)
-	if err != nil {
-		return ct.RoomId{}, ct.UserId{}, err
-	}
-	room, err := urlParams{params}.room(0)
-	if err != nil {
-		return ct.RoomId{}, ct.UserId{}, err
-	}
-	return room, user, nil
-}
-
 func (e roomsEndpoint) Register(mux *httprouter.Router) {
-	mux.POST("/rooms/:roomId/send/:eventType", jsonHandler(e.sendMessage))
-	mux.PUT("/rooms/:roomId/send/:eventType/:txn", jsonHandler(e.sendMessage))
-	mux.PUT("/rooms/:roomId/state/:eventType", e.handlePutState)
-	mux.PUT("/rooms/:roomId/state/:eventType/:stateKey", e.handlePutState)
-	// mux.GET("/rooms/:roomId/state/:eventType", jsonHandler(dummy))
-	// mux.GET("/rooms/:roomId/state/:eventType/:stateKey", jsonHandler(dummy))
-	mux.POST("/rooms/:roomId/invite", jsonHandler(e.doInvite))
-	mux.POST("/rooms/:roomId/kick", jsonHandler(e.doKick))
-	mux.POST("/rooms/:roomId/ban", jsonHandler(e.doBan))
-	mux.POST("/rooms/:roomId/join", jsonHandler(e.doJoin))
-	mux.POST("/rooms/:roomId/knock", jsonHandler(e.doKnock))
-	mux.POST("/rooms/:roomId/leave", jsonHandler(e.doLeave))
-	mux.GET("/rooms/:roomId/messages", jsonHandler(e.getMessages))
-	// mux.GET("/rooms/:roomId/members", jsonHandler(dummy))
-	// mux.GET("/rooms/:roomId/state", jsonHandler(dummy))
+	access := accessFilter{e.userService, e.tokenService}
+	mux.POST("/rooms/:roomId/send/:eventType", access.guest(jsonHandler(e.sendMessage)))
+	mux.PUT("/rooms/:roomId/send/:eventType/:txn", access.guest(transactionHandler(e.txns, jsonHandler(e.sendMessage))))
+	mux.PUT("/rooms/:roomId/redact/:eventId/:txn", access.user(transactionHandler(e.txns, jsonHandler(e.redact))))
+	mux.PUT("/rooms/:roomId/state/:eventType", access.user(e.handlePutState))
+	mux.PUT("/rooms/:roomId/state/:eventType/:stateKey", access.user(e.handlePutState))
+	mux.GET("/rooms/:roomId/state/:eventType", access.guest(jsonHandler(e.getState)))
+	mux.GET("/rooms/:roomId/state/:eventType/:stateKey", access.guest(jsonHandler(e.getState)))
+	mux.POST("/rooms/:roomId/invite", access.user(jsonHandler(e.doInvite)))
+	mux.POST("/rooms/:roomId/kick", access.user(jsonHandler(e.doKick)))
+	mux.POST("/rooms/:roomId/ban", access.user(jsonHandler(e.doBan)))
+	mux.POST("/rooms/:roomId/join", access.guest(jsonHandler(e.doJoin)))
+	mux.POST("/rooms/:roomId/knock", access.user(jsonHandler(e.doKnock)))
+	mux.POST("/rooms/:roomId/leave", access.guest(jsonHandler(e.doLeave)))
+	mux.GET("/rooms/:roomId/messages", access.guest(jsonHandler(e.getMessages)))
+	mux.GET("/rooms/:roomId/context/:eventId", access.guest(jsonHandler(e.getContext)))
+	mux.GET("/rooms/:roomId/relations/:eventId", access.guest(jsonHandler(e.getRelations)))
+	mux.GET("/rooms/:roomId/relations/:eventId/:relType", access.guest(jsonHandler(e.getRelations)))
+	mux.GET("/rooms/:roomId/relations/:eventId/:relType/:eventType", access.guest(jsonHandler(e.getRelations)))
+	mux.GET("/rooms/:roomId/threads", access.guest(jsonHandler(e.getThreads)))
+	mux.GET("/rooms/:roomId/members", access.guest(jsonHandler(e.getMembers)))
+	mux.GET("/rooms/:roomId/joined_members", access.guest(jsonHandler(e.getJoinedMembers)))
+	mux.GET("/rooms/:roomId/aliases", access.user(jsonHandler(e.getAliases)))
+	mux.POST("/rooms/:roomId/upgrade", access.user(jsonHandler(e.upgradeRoom)))
+	mux.GET("/rooms/:roomId/state", access.guest(jsonHandler(e.getEntireState)))
 	// mux.PUT("/rooms/:roomId/typing/:userId", jsonHandler(dummy))
-	mux.GET("/rooms/:roomId/initialSync", jsonHandler(e.doInitialSync))
-	mux.POST("/join/:roomAliasOrId", jsonHandler(e.doWildcardJoin))
-	mux.POST("/createRoom", jsonHandler(e.createRoom))
+	mux.GET("/rooms/:roomId/initialSync", access.guest(jsonHandler(e.doInitialSync)))
+	mux.POST("/join/:roomAliasOrId", access.guest(jsonHandler(e.doWildcardJoin)))
+	mux.POST("/createRoom", access.user(jsonHandler(e.createRoom)))
 }
 
 type roomsEndpoint struct {
@@ -370,6 +612,7 @@ type roomsEndpoint struct {
 	roomService  interfaces.RoomService
 	syncService  interfaces.SyncService
 	eventService interfaces.EventService
+	txns         ci.TransactionCache
 }
 
 func NewRoomsEndpoint(
@@ -378,6 +621,7 @@ func NewRoomsEndpoint(
 	roomService interfaces.RoomService,
 	syncService interfaces.SyncService,
 	eventService interfaces.EventService,
+	txns ci.TransactionCache,
 ) Endpoint {
 	return roomsEndpoint{
 		userService,
@@ -385,5 +629,6 @@ func NewRoomsEndpoint(
 		roomService,
 		syncService,
 		eventService,
+		txns,
 	}
 }
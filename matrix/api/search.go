@@ -0,0 +1,101 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type searchFilter struct {
+	Rooms []ct.RoomId `json:"rooms"`
+	Limit uint        `json:"limit"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm string            `json:"search_term"`
+	Keys       []string          `json:"keys"`
+	Filter     *searchFilter     `json:"filter"`
+	OrderBy    types.SearchOrder `json:"order_by"`
+}
+
+type searchCategories struct {
+	RoomEvents *roomEventsCriteria `json:"room_events"`
+}
+
+type searchRequest struct {
+	SearchCategories searchCategories `json:"search_categories"`
+}
+
+type searchResultCategories struct {
+	RoomEvents *types.SearchResults `json:"room_events,omitempty"`
+}
+
+type searchResponse struct {
+	SearchCategories searchResultCategories `json:"search_categories"`
+}
+
+func (e searchEndpoint) search(auth authInfo, req *http.Request, body *searchRequest) interface{} {
+	user := auth.user
+	criteria := body.SearchCategories.RoomEvents
+	if criteria == nil {
+		return types.BadJsonError("missing 'room_events' search category")
+	}
+	query := &types.SearchQuery{
+		SearchTerm: criteria.SearchTerm,
+		Keys:       criteria.Keys,
+		OrderBy:    criteria.OrderBy,
+		NextBatch:  req.URL.Query().Get("next_batch"),
+	}
+	if criteria.Filter != nil {
+		query.Rooms = criteria.Filter.Rooms
+		query.Limit = criteria.Filter.Limit
+	}
+	if query.Limit > 100 {
+		query.Limit = 100 //TODO: make configurable
+	}
+	results, err := e.searchService.Search(user, query)
+	if err != nil {
+		return err
+	}
+	return searchResponse{searchResultCategories{results}}
+}
+
+func (e searchEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.userService, e.tokenService}
+	mux.POST("/search", access.user(jsonHandler(e.search)))
+}
+
+type searchEndpoint struct {
+	userService   interfaces.UserService
+	tokenService  interfaces.TokenService
+	searchService interfaces.SearchService
+}
+
+func NewSearchEndpoint(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	searchService interfaces.SearchService,
+) Endpoint {
+	return searchEndpoint{
+		userService,
+		tokenService,
+		searchService,
+	}
+}
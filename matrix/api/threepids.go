@@ -0,0 +1,187 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type emailTokenRequest struct {
+	ClientSecret string `json:"client_secret"`
+	Email        string `json:"email"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link"`
+}
+
+type emailTokenResponse struct {
+	Sid       string `json:"sid"`
+	SubmitUrl string `json:"submit_url"`
+}
+
+type submitTokenRequest struct {
+	Sid          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+type submitTokenResponse struct {
+	Success bool `json:"success"`
+}
+
+type threepidsResponse struct {
+	Threepids []types.Threepid `json:"threepids"`
+}
+
+type addThreepidRequest struct {
+	ThreepidCreds *types.ThreepidCredentials `json:"three_pid_creds"`
+}
+
+type deleteThreepidRequest struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+type unbindResponse struct {
+	IdServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// requests a token for an address that will be bound to an account, so it must not be in use
+func (e threepidEndpoint) requestUnusedEmailToken(body *emailTokenRequest) interface{} {
+	owner, err := e.threepids.ThreepidUser(types.ThreepidMediumEmail, body.Email)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		return types.ThreepidInUseError("'" + body.Email + "' is already in use")
+	}
+	return e.requestEmailToken(body)
+}
+
+// requests a token for resetting the password of the account that the address is bound to
+func (e threepidEndpoint) requestPasswordEmailToken(body *emailTokenRequest) interface{} {
+	owner, err := e.threepids.ThreepidUser(types.ThreepidMediumEmail, body.Email)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		return types.ThreepidNotFoundError("'" + body.Email + "' isn't bound to any account")
+	}
+	return e.requestEmailToken(body)
+}
+
+func (e threepidEndpoint) requestEmailToken(body *emailTokenRequest) interface{} {
+	if body.NextLink != "" {
+		link, err := url.Parse(body.NextLink)
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") {
+			return types.BadJsonError("next_link must be a http or https url")
+		}
+	}
+	submitUrl := e.publicUrl + "/validate/email/submitToken"
+	sid, err := e.threepids.RequestEmailToken(body.ClientSecret, body.Email, body.SendAttempt, body.NextLink, submitUrl)
+	if err != nil {
+		return err
+	}
+	return emailTokenResponse{sid, submitUrl}
+}
+
+func (e threepidEndpoint) postSubmitToken(body *submitTokenRequest) interface{} {
+	if _, err := e.threepids.SubmitToken(body.Sid, body.ClientSecret, body.Token); err != nil {
+		return err
+	}
+	return submitTokenResponse{true}
+}
+
+// the link in validation emails, which is opened in a browser rather than a client
+func (e threepidEndpoint) handleSubmitTokenLink(rw http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	query := req.URL.Query()
+	nextLink, err := e.threepids.SubmitToken(query.Get("sid"), query.Get("client_secret"), query.Get("token"))
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		rw.WriteHeader(err.Status())
+		fmt.Fprintln(rw, "Failed to validate your email address: "+err.Error())
+		return
+	}
+	if nextLink != "" {
+		http.Redirect(rw, req, nextLink, http.StatusFound)
+		return
+	}
+	fmt.Fprintln(rw, "Your email address has been validated, you can now return to your client.")
+}
+
+func (e threepidEndpoint) getThreepids(auth authInfo) interface{} {
+	threepids, err := e.threepids.Threepids(auth.user)
+	if err != nil {
+		return err
+	}
+	return threepidsResponse{threepids}
+}
+
+func (e threepidEndpoint) postThreepid(auth authInfo, body *addThreepidRequest) interface{} {
+	if body.ThreepidCreds == nil {
+		return types.BadJsonError("Missing three_pid_creds")
+	}
+	if err := e.threepids.AddThreepid(auth.user, *body.ThreepidCreds); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e threepidEndpoint) deleteThreepid(auth authInfo, body *deleteThreepidRequest) interface{} {
+	if err := e.threepids.RemoveThreepid(auth.user, body.Medium, body.Address); err != nil {
+		return err
+	}
+	return unbindResponse{"no-support"}
+}
+
+func (e threepidEndpoint) Register(mux *httprouter.Router) {
+	access := accessFilter{e.users, e.tokens}
+	mux.POST("/register/email/requestToken", jsonHandler(e.requestUnusedEmailToken))
+	mux.POST("/account/3pid/email/requestToken", jsonHandler(e.requestUnusedEmailToken))
+	mux.POST("/account/password/email/requestToken", jsonHandler(e.requestPasswordEmailToken))
+	mux.GET("/validate/email/submitToken", e.handleSubmitTokenLink)
+	mux.POST("/validate/email/submitToken", jsonHandler(e.postSubmitToken))
+	mux.GET("/account/3pid", access.user(jsonHandler(e.getThreepids)))
+	mux.POST("/account/3pid", access.user(jsonHandler(e.postThreepid)))
+	mux.POST("/account/3pid/delete", access.user(jsonHandler(e.deleteThreepid)))
+}
+
+type threepidEndpoint struct {
+	users     interfaces.UserService
+	tokens    interfaces.TokenService
+	threepids interfaces.ThreepidService
+	publicUrl string
+}
+
+// The public url is the base url of the client api, which is used in the links of validation emails
+func NewThreepidEndpoint(
+	users interfaces.UserService,
+	tokens interfaces.TokenService,
+	threepids interfaces.ThreepidService,
+	publicUrl string,
+) Endpoint {
+	return threepidEndpoint{
+		users,
+		tokens,
+		threepids,
+		publicUrl,
+	}
+}
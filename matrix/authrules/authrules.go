@@ -0,0 +1,339 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authrules decides whether an event may be added to a room, given the event
+// and the parts of the room state that are relevant for authorization. The rules don't
+// have any side effects or dependencies on stores, so they can be used both for events
+// that are created locally and for events that are received from other servers.
+package authrules
+
+import (
+	"fmt"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+// an event that is about to be added to a room
+type Event struct {
+	Sender    ct.UserId
+	EventType string
+	StateKey  *string // nil for message events
+	Content   ct.TypedContent
+	// the sender of the event that is being redacted, only used for redactions
+	RedactedSender *ct.UserId
+	// whether the server sets the state on behalf of the sender, like the aliases of the room
+	Server bool
+}
+
+// the room state that an event is authorized against, as it was before the event
+type State struct {
+	Create           *types.CreateEventContent
+	PowerLevels      *types.PowerLevelsEventContent
+	JoinRules        *types.JoinRulesEventContent
+	GuestAccess      types.GuestAccess
+	SenderMembership types.Membership
+	TargetMembership types.Membership // membership of the state key user, only used for membership events
+	TargetIsGuest    bool
+	StateExists      bool // whether there already is a state event with the same type and state key
+}
+
+var messageTypesReservedForState = map[string]struct{}{
+	types.EventTypeName:              struct{}{},
+	types.EventTypeTopic:             struct{}{},
+	types.EventTypeJoinRules:         struct{}{},
+	types.EventTypePowerLevels:       struct{}{},
+	types.EventTypeCreate:            struct{}{},
+	types.EventTypeAliases:           struct{}{},
+	types.EventTypeMembership:        struct{}{},
+	types.EventTypeCanonicalAlias:    struct{}{},
+	types.EventTypeHistoryVisibility: struct{}{},
+	types.EventTypeGuestAccess:       struct{}{},
+	types.EventTypeTombstone:         struct{}{},
+}
+
+var stateTypesWithEmptyStateKey = map[string]struct{}{
+	types.EventTypeName:              struct{}{},
+	types.EventTypeTopic:             struct{}{},
+	types.EventTypeJoinRules:         struct{}{},
+	types.EventTypePowerLevels:       struct{}{},
+	types.EventTypeCreate:            struct{}{},
+	types.EventTypeAliases:           struct{}{},
+	types.EventTypeCanonicalAlias:    struct{}{},
+	types.EventTypeHistoryVisibility: struct{}{},
+	types.EventTypeGuestAccess:       struct{}{},
+	types.EventTypeTombstone:         struct{}{},
+}
+
+// Returns nil if the event is allowed, or an error describing why it was rejected.
+func Check(event *Event, state *State) types.Error {
+	if event.StateKey == nil {
+		return checkMessage(event, state)
+	}
+	return checkState(event, state)
+}
+
+func checkMessage(event *Event, state *State) types.Error {
+	if _, ok := messageTypesReservedForState[event.EventType]; ok {
+		return types.ForbiddenError("sending a message event of the type " + event.EventType + " is not permitted")
+	}
+	if state.Create == nil {
+		return types.ForbiddenError("room has not been created")
+	}
+	if event.EventType == types.EventTypeRedaction {
+		if event.RedactedSender == nil {
+			return types.ForbiddenError("sending a message event of the type " + event.EventType + " is not permitted")
+		}
+		if state.SenderMembership != types.MembershipMember {
+			return types.ForbiddenError("cannot redact events without being a member of the room")
+		}
+		if *event.RedactedSender != event.Sender {
+			return requireLevel(event.Sender, state, powerLevels(state).Redact)
+		}
+		return nil
+	}
+	if state.SenderMembership != types.MembershipMember {
+		return types.ForbiddenError("cannot send messages to a room without being a member")
+	}
+	return requireLevel(event.Sender, state, eventLevel(state, event.EventType))
+}
+
+func checkState(event *Event, state *State) types.Error {
+	eventType := event.EventType
+	stateKey := *event.StateKey
+	if _, ok := stateTypesWithEmptyStateKey[eventType]; ok && stateKey != "" {
+		return types.ForbiddenError("state key must be empty for state " + eventType)
+	}
+	switch eventType {
+	case types.EventTypeCreate:
+		if state.Create != nil {
+			return types.ForbiddenError("cannot set state " + eventType)
+		}
+		return nil
+	case types.EventTypeAliases:
+		if !event.Server {
+			return types.ForbiddenError("cannot set state " + eventType)
+		}
+	}
+	if state.Create == nil {
+		return types.ForbiddenError("room has not been created")
+	}
+	if eventType == types.EventTypeMembership {
+		return checkMembership(event, state)
+	}
+
+	if state.SenderMembership != types.MembershipMember {
+		return types.ForbiddenError("cannot set room state without being a member")
+	}
+	if userId, err := ct.ParseUserId(stateKey); err == nil && userId != event.Sender {
+		return types.ForbiddenError("cannot set the state of another user")
+	}
+	// the aliases are shared by everyone that created one, so changing them is like replacing state
+	if state.StateExists || eventType == types.EventTypeAliases {
+		if err := requireLevel(event.Sender, state, powerLevels(state).CreateState); err != nil {
+			return err
+		}
+	}
+	if err := requireLevel(event.Sender, state, eventLevel(state, eventType)); err != nil {
+		return err
+	}
+	if eventType == types.EventTypePowerLevels {
+		newLevels, ok := event.Content.(*types.PowerLevelsEventContent)
+		if !ok {
+			return types.BadJsonError("invalid power levels content")
+		}
+		return checkPowerLevelChange(event.Sender, userLevel(state, event.Sender), powerLevels(state), newLevels)
+	}
+	return nil
+}
+
+func checkMembership(event *Event, state *State) types.Error {
+	user, parseErr := ct.ParseUserId(*event.StateKey)
+	if parseErr != nil {
+		return types.ForbiddenError("state key must be a user id for state " + event.EventType)
+	}
+	content, ok := event.Content.(*types.MembershipEventContent)
+	if !ok || content == nil {
+		return types.BadJsonError("invalid membership content")
+	}
+	sender := event.Sender
+	current := state.TargetMembership
+
+	// the creator joining right after the room was created
+	if state.PowerLevels == nil && content.Membership == types.MembershipMember &&
+		user == sender && sender == state.Create.Creator && current == types.MembershipNone {
+		return nil
+	}
+	if current == content.Membership {
+		return types.ForbiddenError("membership change was a no-op")
+	}
+
+	switch content.Membership {
+	case types.MembershipNone:
+		if current != types.MembershipBanned {
+			return types.BadJsonError("invalid or missing membership in membership change")
+		}
+		if user == sender {
+			return types.ForbiddenError("cannot remove a ban from self")
+		}
+		if err := requireMember(state, "unban users"); err != nil {
+			return err
+		}
+		return requireLevel(sender, state, powerLevels(state).Ban)
+
+	case types.MembershipInvited:
+		if current != types.MembershipNone {
+			return types.ForbiddenError("could not invite user to room, already have membership '" + current.String() + "'")
+		}
+		if err := requireJoinRule(state, types.JoinRuleInvite); err != nil {
+			return err
+		}
+		if err := requireMember(state, "invite users"); err != nil {
+			return err
+		}
+		return requireLevel(sender, state, powerLevels(state).Invite)
+
+	case types.MembershipMember:
+		if state.TargetIsGuest && state.GuestAccess != types.GuestAccessCanJoin {
+			return types.GuestAccessForbiddenError("room does not allow guests to join")
+		}
+		switch current {
+		case types.MembershipNone, types.MembershipLeaving:
+			if user != sender {
+				return types.ForbiddenError("cannot force other users to join the room")
+			}
+			return requireJoinRule(state, types.JoinRulePublic)
+		case types.MembershipInvited:
+			if user != sender {
+				return types.ForbiddenError("cannot force other users to join the room")
+			}
+			return nil
+		case types.MembershipKnocking:
+			if user == sender {
+				return types.ForbiddenError("cannot let yourself in after knocking")
+			}
+			if err := requireMember(state, "accept knocks"); err != nil {
+				return err
+			}
+			return requireLevel(sender, state, powerLevels(state).Invite)
+		case types.MembershipBanned:
+			if user == sender {
+				return types.ForbiddenError("you are banned from that room")
+			}
+			return types.ForbiddenError("that user is banned from this room")
+		}
+		return nil
+
+	case types.MembershipKnocking:
+		if user != sender {
+			return types.ForbiddenError("cannot force other users to knock")
+		}
+		if current != types.MembershipNone && current != types.MembershipLeaving {
+			return types.ForbiddenError("could not knock on room, already have membership '" + current.String() + "'")
+		}
+		return requireJoinRule(state, types.JoinRuleKnock)
+
+	case types.MembershipLeaving:
+		if current == types.MembershipNone {
+			return types.ForbiddenError("tried to leave a room without current membership")
+		}
+		if current == types.MembershipBanned {
+			return types.ForbiddenError("tried to leave room with current membership '" + types.MembershipBanned.String() + "'")
+		}
+		if user == sender {
+			return nil
+		}
+		if err := requireMember(state, "kick users"); err != nil {
+			return err
+		}
+		if err := requireLevel(sender, state, powerLevels(state).Kick); err != nil {
+			return err
+		}
+		return requireHigherLevel(state, sender, user, "kick")
+
+	case types.MembershipBanned:
+		if user == sender {
+			return types.ForbiddenError("cannot ban self")
+		}
+		if err := requireMember(state, "ban users"); err != nil {
+			return err
+		}
+		if err := requireLevel(sender, state, powerLevels(state).Ban); err != nil {
+			return err
+		}
+		return requireHigherLevel(state, sender, user, "ban")
+	}
+	return types.BadJsonError("invalid or missing membership in membership change")
+}
+
+func requireMember(state *State, action string) types.Error {
+	if state.SenderMembership != types.MembershipMember {
+		return types.ForbiddenError("cannot " + action + " without being a member of the room")
+	}
+	return nil
+}
+
+func requireJoinRule(state *State, joinRule types.JoinRule) types.Error {
+	current := types.JoinRuleInvite
+	if state.JoinRules != nil {
+		current = state.JoinRules.JoinRule
+	}
+	if current != joinRule {
+		return types.ForbiddenError("room does not allow join method: " + joinRule.String())
+	}
+	return nil
+}
+
+func requireLevel(user ct.UserId, state *State, required int) types.Error {
+	level := userLevel(state, user)
+	if level < required {
+		msg := fmt.Sprintf("not enough power level to perform action (%d < %d)", level, required)
+		return types.ForbiddenError(msg)
+	}
+	return nil
+}
+
+func requireHigherLevel(state *State, sender, target ct.UserId, action string) types.Error {
+	senderLevel := userLevel(state, sender)
+	targetLevel := userLevel(state, target)
+	if targetLevel >= senderLevel {
+		msg := fmt.Sprintf("cannot %s a user with the same or higher power level (%d >= %d)", action, targetLevel, senderLevel)
+		return types.ForbiddenError(msg)
+	}
+	return nil
+}
+
+// falls back to the default power levels of the creator if the room doesn't have any yet
+func powerLevels(state *State) *types.PowerLevelsEventContent {
+	if state.PowerLevels != nil {
+		return state.PowerLevels
+	}
+	return types.DefaultPowerLevels(state.Create.Creator)
+}
+
+func userLevel(state *State, user ct.UserId) int {
+	powerLevels := powerLevels(state)
+	if level, ok := powerLevels.Users[user.String()]; ok {
+		return level
+	}
+	return powerLevels.UserDefault
+}
+
+func eventLevel(state *State, eventType string) int {
+	powerLevels := powerLevels(state)
+	if level, ok := powerLevels.Events[eventType]; ok {
+		return level
+	}
+	return powerLevels.EventDefault
+}
@@ -0,0 +1,233 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authrules
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+var (
+	alice = ct.NewUserId("alice", "matrix.org")
+	bob   = ct.NewUserId("bob", "matrix.org")
+	carol = ct.NewUserId("carol", "matrix.org")
+)
+
+// alice created the room and has power level 100, bob has 50 and carol has the default of 0
+func roomState(joinRule types.JoinRule, sender, target types.Membership) *State {
+	powerLevels := types.DefaultPowerLevels(alice)
+	powerLevels.Users[bob.String()] = 50
+	return &State{
+		Create:           &types.CreateEventContent{alice, "1", nil},
+		PowerLevels:      powerLevels,
+		JoinRules:        &types.JoinRulesEventContent{joinRule},
+		GuestAccess:      types.GuestAccessForbidden,
+		SenderMembership: sender,
+		TargetMembership: target,
+	}
+}
+
+func membership(sender, target ct.UserId, membership types.Membership) *Event {
+	stateKey := target.String()
+	return &Event{
+		Sender:    sender,
+		EventType: types.EventTypeMembership,
+		StateKey:  &stateKey,
+		Content:   &types.MembershipEventContent{nil, membership},
+	}
+}
+
+func state(sender ct.UserId, content ct.TypedContent, stateKey string) *Event {
+	return &Event{
+		Sender:    sender,
+		EventType: content.GetEventType(),
+		StateKey:  &stateKey,
+		Content:   content,
+	}
+}
+
+func serverState(sender ct.UserId, content ct.TypedContent) *Event {
+	event := state(sender, content, "")
+	event.Server = true
+	return event
+}
+
+func message(sender ct.UserId, eventType string) *Event {
+	return &Event{
+		Sender:    sender,
+		EventType: eventType,
+		Content:   types.NewGenericContent(map[string]interface{}{"body": "hello"}, eventType),
+	}
+}
+
+func redaction(sender, redactedSender ct.UserId) *Event {
+	return &Event{
+		Sender:         sender,
+		EventType:      types.EventTypeRedaction,
+		Content:        &types.RedactionEventContent{},
+		RedactedSender: &redactedSender,
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const (
+		none    = types.MembershipNone
+		invited = types.MembershipInvited
+		member  = types.MembershipMember
+		knock   = types.MembershipKnocking
+		leave   = types.MembershipLeaving
+		ban     = types.MembershipBanned
+		public  = types.JoinRulePublic
+		private = types.JoinRuleInvite
+	)
+	guest := roomState(public, none, none)
+	guest.TargetIsGuest = true
+	guestAllowed := roomState(public, none, none)
+	guestAllowed.TargetIsGuest = true
+	guestAllowed.GuestAccess = types.GuestAccessCanJoin
+	existing := roomState(public, member, none)
+	existing.StateExists = true
+	uncreated := roomState(public, none, none)
+	uncreated.Create = nil
+	bootstrapping := roomState(public, none, none)
+	bootstrapping.PowerLevels = nil
+	bootstrapping.JoinRules = nil
+
+	tests := []struct {
+		name    string
+		event   *Event
+		state   *State
+		allowed bool
+	}{
+		{"create room", state(alice, &types.CreateEventContent{alice, "1", nil}, ""), uncreated, true},
+		{"create existing room", state(alice, &types.CreateEventContent{alice, "1", nil}, ""), roomState(public, member, none), false},
+		{"message before create", message(alice, "m.room.message"), uncreated, false},
+		{"creator joins new room", membership(alice, alice, member), bootstrapping, true},
+		{"other user joins new room", membership(bob, bob, member), bootstrapping, false},
+
+		{"join public room", membership(carol, carol, member), roomState(public, none, none), true},
+		{"join private room", membership(carol, carol, member), roomState(private, none, none), false},
+		{"rejoin public room", membership(carol, carol, member), roomState(public, leave, leave), true},
+		{"join on behalf of other", membership(alice, carol, member), roomState(public, member, none), false},
+		{"join when invited", membership(carol, carol, member), roomState(private, invited, invited), true},
+		{"join when banned", membership(carol, carol, member), roomState(public, ban, ban), false},
+		{"join as guest", membership(carol, carol, member), guest, false},
+		{"join as guest when allowed", membership(carol, carol, member), guestAllowed, true},
+		{"join when already joined", membership(carol, carol, member), roomState(public, member, member), false},
+
+		{"invite", membership(carol, bob, invited), roomState(private, member, none), true},
+		{"invite without membership", membership(carol, bob, invited), roomState(private, none, none), false},
+		{"invite to public room", membership(carol, bob, invited), roomState(public, member, none), false},
+		{"invite joined user", membership(carol, bob, invited), roomState(private, member, member), false},
+
+		{"knock", membership(carol, carol, knock), roomState(types.JoinRuleKnock, none, none), true},
+		{"knock on public room", membership(carol, carol, knock), roomState(public, none, none), false},
+		{"knock for other", membership(alice, carol, knock), roomState(types.JoinRuleKnock, member, none), false},
+		{"accept knock", membership(bob, carol, member), roomState(types.JoinRuleKnock, member, knock), true},
+		{"accept own knock", membership(carol, carol, member), roomState(types.JoinRuleKnock, knock, knock), false},
+
+		{"leave", membership(carol, carol, leave), roomState(public, member, member), true},
+		{"leave without membership", membership(carol, carol, leave), roomState(public, none, none), false},
+		{"leave when banned", membership(carol, carol, leave), roomState(public, ban, ban), false},
+		{"kick", membership(bob, carol, leave), roomState(public, member, member), true},
+		{"kick without power", membership(carol, bob, leave), roomState(public, member, member), false},
+		{"kick higher level", membership(bob, alice, leave), roomState(public, member, member), false},
+		{"kick without membership", membership(bob, carol, leave), roomState(public, leave, member), false},
+
+		{"ban", membership(bob, carol, ban), roomState(public, member, member), true},
+		{"ban self", membership(alice, alice, ban), roomState(public, member, member), false},
+		{"ban without power", membership(carol, bob, ban), roomState(public, member, member), false},
+		{"ban higher level", membership(bob, alice, ban), roomState(public, member, member), false},
+		{"unban", membership(bob, carol, none), roomState(public, member, ban), true},
+		{"unban self", membership(carol, carol, none), roomState(public, ban, ban), false},
+		{"unban without power", membership(carol, bob, none), roomState(public, member, ban), false},
+		{"remove membership without ban", membership(alice, carol, none), roomState(public, member, member), false},
+		{"membership with invalid state key", state(alice, &types.MembershipEventContent{nil, member}, "carol"), roomState(public, member, none), false},
+
+		{"message", message(carol, "m.room.message"), roomState(public, member, none), true},
+		{"message without membership", message(carol, "m.room.message"), roomState(public, leave, none), false},
+		{"message with state type", message(alice, types.EventTypeName), roomState(public, member, none), false},
+		{"redact own event", redaction(carol, carol), roomState(public, member, none), true},
+		{"redact other event", redaction(bob, carol), roomState(public, member, none), true},
+		{"redact other event without power", redaction(carol, bob), roomState(public, member, none), false},
+		{"redact without membership", redaction(carol, carol), roomState(public, leave, none), false},
+		{"redaction without target", message(alice, types.EventTypeRedaction), roomState(public, member, none), false},
+
+		{"set name", state(alice, &types.NameEventContent{"room"}, ""), roomState(public, member, none), true},
+		{"set name without power", state(bob, &types.NameEventContent{"room"}, ""), roomState(public, member, none), false},
+		{"set name with state key", state(alice, &types.NameEventContent{"room"}, "name"), roomState(public, member, none), false},
+		{"set state without membership", state(alice, &types.NameEventContent{"room"}, ""), roomState(public, leave, none), false},
+		{"set aliases", state(alice, &types.AliasesEventContent{}, ""), roomState(public, member, none), false},
+		{"set aliases by server", serverState(alice, &types.AliasesEventContent{}), roomState(public, member, none), true},
+		{"set aliases by server without power", serverState(carol, &types.AliasesEventContent{}), roomState(public, member, none), false},
+		{"set aliases by server without membership", serverState(alice, &types.AliasesEventContent{}), roomState(public, leave, none), false},
+		{"set new custom state", state(carol, &types.TopicEventContent{"topic"}, ""), roomState(public, member, none), true},
+		{"replace custom state without power", state(carol, &types.TopicEventContent{"topic"}, ""), existing, false},
+		{"replace custom state", state(bob, &types.TopicEventContent{"topic"}, ""), existing, true},
+		{"set state of other user", state(carol, types.NewGenericContent(nil, "m.custom"), bob.String()), roomState(public, member, none), false},
+		{"set own user state", state(carol, types.NewGenericContent(nil, "m.custom"), carol.String()), roomState(public, member, none), true},
+		{"set invalid power levels", state(alice, types.NewGenericContent(nil, types.EventTypePowerLevels), ""), roomState(public, member, none), false},
+		{"set power levels", state(alice, types.DefaultPowerLevels(alice), ""), roomState(public, member, none), true},
+	}
+	for _, test := range tests {
+		err := Check(test.event, test.state)
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected event to be allowed, got %s", test.name, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s: expected event to be rejected", test.name)
+		}
+	}
+}
+
+func TestPowerLevelChange(t *testing.T) {
+	levels := func(modify func(*types.PowerLevelsEventContent)) *types.PowerLevelsEventContent {
+		powerLevels := types.DefaultPowerLevels(alice)
+		powerLevels.Users[bob.String()] = 50
+		powerLevels.Users[carol.String()] = 50
+		modify(powerLevels)
+		return powerLevels
+	}
+	tests := []struct {
+		name    string
+		modify  func(*types.PowerLevelsEventContent)
+		allowed bool
+	}{
+		{"no change", func(pl *types.PowerLevelsEventContent) {}, true},
+		{"promote to own level", func(pl *types.PowerLevelsEventContent) { pl.Users["@dave:matrix.org"] = 50 }, true},
+		{"promote above own level", func(pl *types.PowerLevelsEventContent) { pl.Users["@dave:matrix.org"] = 51 }, false},
+		{"demote self", func(pl *types.PowerLevelsEventContent) { pl.Users[bob.String()] = 0 }, true},
+		{"demote user with same level", func(pl *types.PowerLevelsEventContent) { pl.Users[carol.String()] = 0 }, false},
+		{"remove user with same level", func(pl *types.PowerLevelsEventContent) { delete(pl.Users, carol.String()) }, false},
+		{"lower threshold at own level", func(pl *types.PowerLevelsEventContent) { pl.Kick = 0 }, true},
+		{"raise threshold above own level", func(pl *types.PowerLevelsEventContent) { pl.Kick = 60 }, false},
+		{"lower threshold above own level", func(pl *types.PowerLevelsEventContent) { pl.Events[types.EventTypeName] = 0 }, false},
+		{"add event threshold", func(pl *types.PowerLevelsEventContent) { pl.Events["m.custom"] = 50 }, true},
+		{"add event threshold above own level", func(pl *types.PowerLevelsEventContent) { pl.Events["m.custom"] = 60 }, false},
+		{"raise notification level above own level", func(pl *types.PowerLevelsEventContent) { pl.Notifications.Room = 60 }, false},
+	}
+	old := levels(func(pl *types.PowerLevelsEventContent) {})
+	for _, test := range tests {
+		err := checkPowerLevelChange(bob, 50, old, levels(test.modify))
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected change to be allowed, got %s", test.name, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s: expected change to be rejected", test.name)
+		}
+	}
+}
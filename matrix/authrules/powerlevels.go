@@ -0,0 +1,121 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authrules
+
+import (
+	"fmt"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+// Checks that a user with the given power level is allowed to replace the old power levels with the new ones.
+// Any level that is changed must be at most the level of the user, both before and after the change,
+// and the levels of other users can only be changed if they are below the level of the user.
+func checkPowerLevelChange(
+	caller ct.UserId,
+	callerLevel int,
+	old, new *types.PowerLevelsEventContent,
+) types.Error {
+	checkLevel := func(name string, oldLevel, newLevel int) types.Error {
+		if oldLevel == newLevel {
+			return nil
+		}
+		if oldLevel > callerLevel {
+			msg := fmt.Sprintf("cannot change %s, its current level is above your own (%d > %d)", name, oldLevel, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		if newLevel > callerLevel {
+			msg := fmt.Sprintf("cannot set %s above your own level (%d > %d)", name, newLevel, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		return nil
+	}
+	checks := []struct {
+		name     string
+		old, new int
+	}{
+		{"ban", old.Ban, new.Ban},
+		{"kick", old.Kick, new.Kick},
+		{"invite", old.Invite, new.Invite},
+		{"redact", old.Redact, new.Redact},
+		{"users_default", old.UserDefault, new.UserDefault},
+		{"state_default", old.CreateState, new.CreateState},
+		{"events_default", old.EventDefault, new.EventDefault},
+		{"notifications.room", notificationLevel(old), notificationLevel(new)},
+	}
+	for _, check := range checks {
+		if err := checkLevel(check.name, check.old, check.new); err != nil {
+			return err
+		}
+	}
+
+	for eventType := range unionKeys(old.Events, new.Events) {
+		oldLevel, hadOld := old.Events[eventType]
+		newLevel, hasNew := new.Events[eventType]
+		if !hadOld {
+			oldLevel = old.EventDefault
+		}
+		if !hasNew {
+			newLevel = new.EventDefault
+		}
+		if hadOld != hasNew || oldLevel != newLevel {
+			if err := checkLevel("the level of event type "+eventType, oldLevel, newLevel); err != nil {
+				return err
+			}
+		}
+	}
+
+	for user := range unionKeys(old.Users, new.Users) {
+		oldLevel, hadOld := old.Users[user]
+		newLevel, hasNew := new.Users[user]
+		if hadOld == hasNew && oldLevel == newLevel {
+			continue
+		}
+		if !hadOld {
+			oldLevel = old.UserDefault
+		}
+		if !hasNew {
+			newLevel = new.UserDefault
+		}
+		if hasNew && newLevel > callerLevel {
+			msg := fmt.Sprintf("cannot give %s a level above your own (%d > %d)", user, newLevel, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		if user != caller.String() && oldLevel >= callerLevel {
+			msg := fmt.Sprintf("cannot change the level of %s, it is not below your own (%d >= %d)", user, oldLevel, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+	}
+	return nil
+}
+
+func notificationLevel(powerLevels *types.PowerLevelsEventContent) int {
+	if powerLevels.Notifications == nil {
+		return 50
+	}
+	return powerLevels.Notifications.Room
+}
+
+func unionKeys(a, b map[string]int) map[string]struct{} {
+	keys := map[string]struct{}{}
+	for key := range a {
+		keys[key] = struct{}{}
+	}
+	for key := range b {
+		keys[key] = struct{}{}
+	}
+	return keys
+}
@@ -0,0 +1,235 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+// the scopes that are requested for the claims used to name new users
+const oidcScopes = "openid profile email"
+
+type oidcProvider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	client       *http.Client
+
+	lock      sync.Mutex
+	discovery *oidcDiscovery // fetched on first use, so that the provider doesn't have to be up at startup
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	Expires           int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Name              string          `json:"name"`
+	Email             string          `json:"email"`
+}
+
+// Authenticates users with the authorization code flow of the OpenID Connect provider at the issuer url,
+// as a client that has been registered with the provider.
+func NewOidcProvider(issuer, clientId, clientSecret string) (interfaces.IdentityProvider, error) {
+	if issuer == "" {
+		return nil, errors.New("missing oidc issuer")
+	}
+	if clientId == "" {
+		return nil, errors.New("missing oidc client id")
+	}
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *oidcProvider) Id() string {
+	return p.issuer
+}
+
+func (p *oidcProvider) discover() (*oidcDiscovery, types.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	res, err := p.client.Get(p.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, types.ServerError("failed to reach the identity provider: " + err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, types.ServerError("failed to discover the identity provider: " + res.Status)
+	}
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return nil, types.ServerError("invalid identity provider configuration: " + err.Error())
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, types.ServerError("identity provider issuer mismatch: '" + discovery.Issuer + "'")
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, types.ServerError("identity provider configuration is missing endpoints")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) AuthorizationUrl(redirectUri, state, nonce string) (string, types.Error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientId},
+		"redirect_uri":  {redirectUri},
+		"scope":         {oidcScopes},
+		"state":         {state},
+		"nonce":         {nonce},
+	}.Encode()
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		return discovery.AuthorizationEndpoint + "&" + query, nil
+	}
+	return discovery.AuthorizationEndpoint + "?" + query, nil
+}
+
+// The id token is received directly from the token endpoint, so its signature isn't checked, as the
+// connection to the provider is trusted to be secure (OpenID Connect Core 1.0, section 3.1.3.7).
+func (p *oidcProvider) Identity(redirectUri, code, nonce string) (*types.ExternalIdentity, types.Error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectUri},
+	}
+	req, reqErr := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if reqErr != nil {
+		return nil, types.ServerError(reqErr.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	res, reqErr := p.client.Do(req)
+	if reqErr != nil {
+		return nil, types.ServerError("failed to reach the identity provider: " + reqErr.Error())
+	}
+	defer res.Body.Close()
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, types.ServerError("invalid response from the identity provider: " + res.Status)
+	}
+	if res.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, types.ForbiddenError(strings.TrimSpace("the identity provider rejected the login: " + tokens.Error + " " + tokens.ErrorDescription))
+	}
+	claims, err := p.verifyIdToken(tokens.IdToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &types.ExternalIdentity{
+		Subject:           claims.Subject,
+		PreferredUsername: claims.PreferredUsername,
+		DisplayName:       claims.Name,
+		Email:             claims.Email,
+	}, nil
+}
+
+func (p *oidcProvider) verifyIdToken(idToken, nonce string) (*oidcClaims, types.Error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, types.ForbiddenError("invalid id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, types.ForbiddenError("invalid id token: " + err.Error())
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, types.ForbiddenError("invalid id token: " + err.Error())
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, types.ForbiddenError("id token was issued by '" + claims.Issuer + "'")
+	}
+	audience, ok := audience(claims.Audience)
+	if !ok || !contains(audience, p.clientId) {
+		return nil, types.ForbiddenError("id token wasn't issued for this server")
+	}
+	if len(audience) > 1 && claims.AuthorizedParty != p.clientId {
+		return nil, types.ForbiddenError("id token wasn't issued for this server")
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, types.ForbiddenError("id token has expired")
+	}
+	if claims.Nonce != nonce {
+		return nil, types.ForbiddenError("id token wasn't issued for this login")
+	}
+	if claims.Subject == "" {
+		return nil, types.ForbiddenError("id token is missing a subject")
+	}
+	return &claims, nil
+}
+
+// the audience claim is either a single string or a list of strings
+func audience(raw json.RawMessage) ([]string, bool) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, true
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, true
+	}
+	return nil, false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a stand-in OpenID Connect provider that issues id tokens with the given claims for the code "good-code"
+func fakeOidcProvider(t *testing.T, claims map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		clientId, clientSecret, _ := req.BasicAuth()
+		if clientId != "bullettime" || clientSecret != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if req.PostFormValue("code") != "good-code" || req.PostFormValue("redirect_uri") != "https://hs.example/callback" {
+			rw.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idToken := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+		json.NewEncoder(rw).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	return server
+}
+
+func TestOidcProvider(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":                "248289761001",
+		"aud":                "bullettime",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              "n-0S6_WzA2Mj",
+		"preferred_username": "alice",
+		"name":               "Alice Liddell",
+		"email":              "alice@example.com",
+	}
+	server := fakeOidcProvider(t, claims)
+	defer server.Close()
+	claims["iss"] = server.URL
+
+	provider, err := NewOidcProvider(server.URL+"/", "bullettime", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Id() != server.URL {
+		t.Error("expected the provider to be identified by its issuer, got", provider.Id())
+	}
+	authorizationUrl, apiErr := provider.AuthorizationUrl("https://hs.example/callback", "af0ifjsldkj", "n-0S6_WzA2Mj")
+	if apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	parsed, parseErr := url.Parse(authorizationUrl)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	query := parsed.Query()
+	if !strings.HasPrefix(authorizationUrl, server.URL+"/authorize?") || query.Get("response_type") != "code" ||
+		query.Get("client_id") != "bullettime" || query.Get("state") != "af0ifjsldkj" ||
+		query.Get("nonce") != "n-0S6_WzA2Mj" || query.Get("redirect_uri") != "https://hs.example/callback" {
+		t.Fatal("unexpected authorization url:", authorizationUrl)
+	}
+
+	identity, apiErr := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj")
+	if apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	if identity.Subject != "248289761001" || identity.PreferredUsername != "alice" ||
+		identity.DisplayName != "Alice Liddell" || identity.Email != "alice@example.com" {
+		t.Fatal("unexpected identity:", identity)
+	}
+
+	if _, err := provider.Identity("https://hs.example/callback", "bad-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected an invalid code to be rejected")
+	}
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "other-nonce"); err == nil {
+		t.Error("expected an id token for another nonce to be rejected")
+	}
+	claims["aud"] = []string{"bullettime", "other"}
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected an id token with several audiences and no authorized party to be rejected")
+	}
+	claims["azp"] = "bullettime"
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err != nil {
+		t.Error("expected the authorized party to be accepted, got", err)
+	}
+	claims["aud"] = "other"
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected an id token for another client to be rejected")
+	}
+	claims["aud"] = "bullettime"
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected an expired id token to be rejected")
+	}
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["iss"] = "https://evil.example"
+	if _, err := provider.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected an id token from another issuer to be rejected")
+	}
+
+	wrongSecret, err := NewOidcProvider(server.URL, "bullettime", "guess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongSecret.Identity("https://hs.example/callback", "good-code", "n-0S6_WzA2Mj"); err == nil {
+		t.Error("expected the provider to reject the wrong client secret")
+	}
+}
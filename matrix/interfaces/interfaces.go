@@ -16,6 +16,7 @@ package interfaces
 
 import (
 	"fmt"
+	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -29,6 +30,9 @@ type RoomService interface {
 	) (ct.RoomId, *ct.Alias, types.Error)
 	RoomExists(room ct.RoomId, caller ct.UserId) types.Error
 	LookupAlias(alias ct.Alias) (ct.RoomId, types.Error)
+	AddAlias(alias ct.Alias, room ct.RoomId, caller ct.UserId) types.Error
+	RemoveAlias(alias ct.Alias, caller ct.UserId) types.Error
+	Aliases(room ct.RoomId, caller ct.UserId) ([]ct.Alias, types.Error)
 	AddMessage(
 		room ct.RoomId,
 		caller ct.UserId,
@@ -39,12 +43,43 @@ type RoomService interface {
 		caller ct.UserId,
 		eventType, stateKey string,
 	) (*types.State, types.Error)
+	EntireState(room ct.RoomId, caller ct.UserId) ([]*types.State, types.Error)
+	// Membership filters are ignored if they're set to MembershipNone
+	Members(
+		room ct.RoomId,
+		caller ct.UserId,
+		at *types.StreamToken,
+		membership, notMembership types.Membership,
+	) ([]*types.State, types.Error)
+	JoinedMembers(room ct.RoomId, caller ct.UserId) (map[ct.UserId]types.UserProfile, types.Error)
+	JoinedRooms(caller ct.UserId) ([]ct.RoomId, types.Error)
+	// Rooms that the caller has been invited to, but hasn't joined or rejected
+	InvitedRooms(caller ct.UserId) ([]ct.RoomId, types.Error)
+	Visibility(room ct.RoomId) (types.Visibility, types.Error)
+	SetVisibility(room ct.RoomId, caller ct.UserId, visibility types.Visibility) types.Error
 	SetState(
 		room ct.RoomId,
 		caller ct.UserId,
 		content ct.TypedContent,
 		stateKey string,
 	) (*types.State, types.Error)
+	Redact(
+		room ct.RoomId,
+		caller ct.UserId,
+		eventId ct.EventId,
+		reason string,
+	) (*types.Redaction, types.Error)
+	// Replaces the room with a new room of the given version, returning the id of the new room
+	UpgradeRoom(
+		hostname string,
+		room ct.RoomId,
+		caller ct.UserId,
+		roomVersion string,
+	) (ct.RoomId, types.Error)
+}
+
+type DirectoryService interface {
+	PublicRooms(searchTerm string, since string, limit uint) (*types.PublicRooms, types.Error)
 }
 
 type SyncService interface {
@@ -57,6 +92,26 @@ type UserService interface {
 	UserExists(user, caller ct.UserId) (bool, types.Error)
 	VerifyPassword(user ct.UserId, password string) (bool, types.Error)
 	SetPassword(user, caller ct.UserId, password string) types.Error
+	// Creates a guest user with a generated id on the given server, fails unless registration is open
+	CreateGuest(hostname string) (ct.UserId, types.Error)
+	IsGuest(ct.UserId) (bool, types.Error)
+	IsAdmin(ct.UserId) (bool, types.Error)
+	// Only admins can make other users admins, or revoke it
+	SetAdmin(user, caller ct.UserId, admin bool) types.Error
+	// Removes the password, devices, access tokens, third party identifiers and profile of the user, makes
+	// them leave all their rooms, and prevents them from logging in again. Users can deactivate themselves,
+	// and admins can deactivate anyone.
+	Deactivate(user, caller ct.UserId) types.Error
+	IsDeactivated(ct.UserId) (bool, types.Error)
+	// Creates the device if it doesn't exist, and sets the display name if one is given
+	CreateDevice(user ct.UserId, deviceId string, displayName *string) types.Error
+	Devices(user ct.UserId) ([]types.Device, types.Error)
+	Device(user ct.UserId, deviceId string) (*types.Device, types.Error)
+	SetDeviceDisplayName(user ct.UserId, deviceId string, displayName string) types.Error
+	// Only removes the device, its access tokens have to be revoked through the TokenService
+	DeleteDevice(user ct.UserId, deviceId string) types.Error
+	// Records that the device was used from the given address
+	DeviceSeen(user ct.UserId, deviceId string, ip string) types.Error
 }
 
 type ProfileService interface {
@@ -77,13 +132,126 @@ type PresenceService interface {
 }
 
 type TokenService interface {
-	NewAccessToken(ct.UserId) (Token, types.Error)
+	// Creates an access token that never expires
+	NewAccessToken(user ct.UserId, deviceId string) (Token, types.Error)
+	// Creates a short lived access token, together with a refresh token that can be used to replace it
+	NewRefreshableAccessToken(user ct.UserId, deviceId string) (Token, types.Error)
+	// Fails unless the token was created by the token service, hasn't been revoked and hasn't expired
 	ParseAccessToken(token string) (Token, types.Error)
+	// Revokes the refresh token and the access token it was issued with, and creates new ones.
+	// Fails if the refresh token has expired, even if its access token is still valid.
+	Refresh(refreshToken string) (Token, types.Error)
+	// Also revokes the refresh token that was issued with the access token
+	RevokeAccessToken(token string) types.Error
+	RevokeUserTokens(user ct.UserId) types.Error
+	RevokeDeviceTokens(user ct.UserId, deviceId string) types.Error
+	// Creates a short lived token that can be exchanged for an access token once, through m.login.token
+	NewLoginToken(user ct.UserId) (string, types.Error)
+	// Returns the user that the login token was created for, and revokes it
+	ConsumeLoginToken(token string) (ct.UserId, types.Error)
+	// Removes expired refresh tokens, and access tokens that expired more than a lifetime ago.
+	// Refresh tokens are kept when their access token is removed, so the session can still be refreshed.
+	Sweep() types.Error
+}
+
+type UiaService interface {
+	// Attempts the stage in the auth dict, and once its session has completed one of the flows, returns
+	// the auth dicts of the completed stages by type, without any passwords. Otherwise an AuthRequiredError
+	// is returned, with a new session if the auth dict didn't have one. Sessions are bound to the operation
+	// and the user, which is the zero value for unauthenticated requests, e.g. during registration.
+	Authenticate(
+		operation string,
+		user ct.UserId,
+		flows []types.AuthFlow,
+		auth *types.AuthData,
+	) (map[string]types.AuthData, types.Error)
+	// Completes a stage of the session outside of the request, e.g. through a fallback page, after which
+	// the client retries the request with only the session. Fails unless the session is for the user.
+	CompleteStage(sessionId string, user ct.UserId, stageType string) types.Error
+}
+
+// A stage of user-interactive authentication
+type AuthStage interface {
+	Type() string
+	// Parameters that clients need to complete the stage, or nil
+	Params() interface{}
+	Complete(user ct.UserId, auth *types.AuthData) types.Error
+}
+
+type ThreepidService interface {
+	// Whether email addresses can be validated, which requires a mailer
+	EmailSupported() bool
+	// Starts a session for validating the email address, and mails a token for it that can be submitted
+	// directly or through a link to the submit url. Repeated requests with the same client secret and
+	// address continue the session, and only send another mail if the send attempt has been increased.
+	RequestEmailToken(clientSecret, address string, sendAttempt int, nextLink, submitUrl string) (sid string, err types.Error)
+	// Validates the session, returns the link that the user should be sent to next, if any
+	SubmitToken(sid, clientSecret, token string) (nextLink string, err types.Error)
+	// Fails unless the session has been validated
+	ValidatedThreepid(creds types.ThreepidCredentials) (*types.Threepid, types.Error)
+	// Binds the third party identifier that was validated in the session to the user, and ends the session
+	AddThreepid(user ct.UserId, creds types.ThreepidCredentials) types.Error
+	// Ends the session once it has been used, so that it can't be used again
+	EndSession(creds types.ThreepidCredentials) types.Error
+	RemoveThreepid(user ct.UserId, medium, address string) types.Error
+	Threepids(user ct.UserId) ([]types.Threepid, types.Error)
+	// Returns nil if the third party identifier isn't bound to any user
+	ThreepidUser(medium, address string) (*ct.UserId, types.Error)
+}
+
+type Mailer interface {
+	SendMail(to, subject, body string) types.Error
+}
+
+type RegistrationTokenService interface {
+	// Generates a token if none is given. Uses are unlimited and the token never expires unless limited.
+	CreateRegistrationToken(token string, usesAllowed *int, expiryTime *int64) (*types.RegistrationToken, types.Error)
+	RegistrationToken(token string) (*types.RegistrationToken, types.Error)
+	RegistrationTokens() ([]types.RegistrationToken, types.Error)
+	RemoveRegistrationToken(token string) types.Error
+	// Whether the token exists, hasn't expired and has uses left
+	RegistrationTokenValid(token string) (bool, types.Error)
+	// Counts a completed registration with the token, fails if the token isn't valid
+	UseRegistrationToken(token string) types.Error
+	// Undoes a use of the token by a registration that failed after using it
+	ReleaseRegistrationToken(token string) types.Error
+}
+
+// Lets scripts that know the shared secret register users, including admins. The secret isn't sent
+// with registrations, they're authenticated with an HMAC of their contents and a single use nonce.
+type SharedSecretService interface {
+	// Creates a nonce for a single registration, which expires after a minute
+	NewNonce() (string, types.Error)
+	Register(nonce string, user ct.UserId, password, displayName string, admin bool, mac string) types.Error
+}
+
+type SsoService interface {
+	// Starts a login through the identity provider, and returns the url that the user should be sent to.
+	// Once the user has authenticated, the identity provider sends them to the callback url.
+	StartLogin(redirectUrl, callbackUrl string) (string, types.Error)
+	// Completes a login with the state and code that the identity provider passed to the callback url, creating
+	// an account on the given server for users that haven't logged in before. Returns the user, and the
+	// redirect url that the login was started with.
+	CompleteLogin(hostname, state, code string) (ct.UserId, string, types.Error)
+}
+
+// An external identity provider that users can log in with, e.g. through OpenID Connect
+type IdentityProvider interface {
+	// Identifies the provider in the mapping from its subjects to users
+	Id() string
+	// The url that users are sent to for authenticating, which sends them back to the redirect uri with
+	// the state and a code
+	AuthorizationUrl(redirectUri, state, nonce string) (string, types.Error)
+	// Exchanges the code for the identity of the user, which must have been issued for the nonce
+	Identity(redirectUri, code, nonce string) (*types.ExternalIdentity, types.Error)
 }
 
 type Token interface {
 	fmt.Stringer
 	UserId() ct.UserId
+	DeviceId() string
+	Expires() time.Time // zero if the token never expires
+	RefreshToken() string
 }
 
 type EventService interface {
@@ -94,12 +262,79 @@ type EventService interface {
 		limit uint,
 		cancel chan struct{},
 	) (*types.EventStreamRange, types.Error)
+	// Like Range, but only returns the events of a single room, which the caller doesn't have to be a member of
+	PeekRange(
+		caller ct.UserId,
+		room ct.RoomId,
+		from, to *types.StreamToken,
+		limit uint,
+		cancel chan struct{},
+	) (*types.EventStreamRange, types.Error)
 	Messages(
 		user ct.UserId,
 		room ct.RoomId,
 		from, to *types.StreamToken,
 		limit uint,
 	) (*types.EventStreamRange, types.Error)
+	Context(
+		user ct.UserId,
+		room ct.RoomId,
+		eventId ct.EventId,
+		limit uint,
+	) (*types.EventContext, types.Error)
+	Relations(
+		user ct.UserId,
+		room ct.RoomId,
+		eventId ct.EventId,
+		relType string,
+		eventType string,
+		from *uint64,
+		limit uint,
+	) (*types.RelationsChunk, types.Error)
+	Threads(
+		user ct.UserId,
+		room ct.RoomId,
+		include string,
+		from *uint64,
+		limit uint,
+	) (*types.ThreadsChunk, types.Error)
+}
+
+type ReceiptService interface {
+	SetReceipt(
+		room ct.RoomId,
+		caller ct.UserId,
+		receiptType string,
+		eventId ct.EventId,
+		threadId string,
+	) types.Error
+}
+
+type SearchService interface {
+	Search(user ct.UserId, query *types.SearchQuery) (*types.SearchResults, types.Error)
+}
+
+type ThreepidStore interface {
+	// Fails if the third party identifier is already bound to another user
+	AddThreepid(user ct.UserId, threepid types.Threepid) types.Error
+	RemoveThreepid(user ct.UserId, medium, address string) types.Error
+	Threepids(user ct.UserId) ([]types.Threepid, types.Error)
+	// Returns nil if the third party identifier isn't bound to any user
+	ThreepidUser(medium, address string) (*ct.UserId, types.Error)
+}
+
+type RegistrationTokenStore interface {
+	SetRegistrationToken(token types.RegistrationToken) types.Error
+	// Returns nil if the token doesn't exist
+	RegistrationToken(token string) (*types.RegistrationToken, types.Error)
+	RegistrationTokens() ([]types.RegistrationToken, types.Error)
+	RemoveRegistrationToken(token string) types.Error
+}
+
+type ExternalIdStore interface {
+	SetExternalIdUser(provider, subject string, user ct.UserId) types.Error
+	// Returns nil if the subject isn't mapped to any user
+	ExternalIdUser(provider, subject string) (*ct.UserId, types.Error)
 }
 
 type UserStore interface {
@@ -107,6 +342,42 @@ type UserStore interface {
 	UserExists(ct.UserId) (exists bool, err types.Error)
 	SetUserPasswordHash(id ct.UserId, hash string) types.Error
 	UserPasswordHash(ct.UserId) (string, types.Error)
+	SetUserGuest(ct.UserId) types.Error
+	UserIsGuest(ct.UserId) (bool, types.Error)
+	SetUserAdmin(id ct.UserId, admin bool) types.Error
+	UserIsAdmin(ct.UserId) (bool, types.Error)
+	SetUserDeactivated(ct.UserId) types.Error
+	UserIsDeactivated(ct.UserId) (bool, types.Error)
+}
+
+// Tokens are stored by their hash, so that the tokens themselves can't be read from the store
+type TokenStore interface {
+	AddToken(hash string, info types.TokenInfo) types.Error
+	// Returns nil if the token doesn't exist
+	Token(user ct.UserId, hash string) (*types.TokenInfo, types.Error)
+	RemoveToken(user ct.UserId, hash string) types.Error
+	// Returns all access tokens of the user by their hash
+	Tokens(user ct.UserId) (map[string]types.TokenInfo, types.Error)
+	AddRefreshToken(hash string, info types.RefreshTokenInfo) types.Error
+	// Returns nil if the refresh token doesn't exist
+	RefreshToken(user ct.UserId, hash string) (*types.RefreshTokenInfo, types.Error)
+	// Returns all refresh tokens of the user by their hash
+	RefreshTokens(user ct.UserId) (map[string]types.RefreshTokenInfo, types.Error)
+	RemoveRefreshToken(user ct.UserId, hash string) types.Error
+	// Removes both the access tokens and the refresh tokens of the user
+	RemoveUserTokens(user ct.UserId) types.Error
+	// Removes both the access tokens and the refresh tokens of the device
+	RemoveDeviceTokens(user ct.UserId, deviceId string) types.Error
+}
+
+type DeviceStore interface {
+	// Only sets the display name, last seen is set with SetDeviceLastSeen
+	SetDevice(user ct.UserId, device types.Device) types.Error
+	SetDeviceLastSeen(user ct.UserId, deviceId string, ip string, timestamp int64) types.Error
+	// Returns nil if the device doesn't exist
+	Device(user ct.UserId, deviceId string) (*types.Device, types.Error)
+	Devices(user ct.UserId) ([]types.Device, types.Error)
+	RemoveDevice(user ct.UserId, deviceId string) types.Error
 }
 
 type RoomStore interface {
@@ -114,14 +385,26 @@ type RoomStore interface {
 	RoomExists(ct.RoomId) (bool, types.Error)
 	SetRoomState(roomId ct.RoomId, userId ct.UserId, content ct.TypedContent, stateKey string) (*types.State, types.Error)
 	RoomState(roomId ct.RoomId, eventType, stateKey string) (*types.State, types.Error)
+	// Replaces the current state with the redacted copy, does nothing if it's not the current state
+	RedactRoomState(roomId ct.RoomId, redacted *types.State) types.Error
 	EntireRoomState(roomId ct.RoomId) ([]*types.State, types.Error)
+	SetRoomVisibility(ct.RoomId, types.Visibility) types.Error
+	RoomVisibility(ct.RoomId) (types.Visibility, types.Error)
+	PublicRooms() ([]ct.RoomId, types.Error)
 }
 
 type AliasStore interface {
-	AddAlias(ct.Alias, ct.RoomId) types.Error
+	AddAlias(alias ct.Alias, room ct.RoomId, creator ct.UserId) types.Error
 	RemoveAlias(ct.Alias, ct.RoomId) types.Error
 	Aliases(ct.RoomId) ([]ct.Alias, types.Error)
 	Room(ct.Alias) (*ct.RoomId, types.Error)
+	Creator(ct.Alias) (*ct.UserId, types.Error)
+}
+
+type ReceiptStore interface {
+	// Replaces the user's previous receipt of the same type in the same thread
+	SetReceipt(room ct.RoomId, receipt types.Receipt) types.Error
+	Receipts(room ct.RoomId) ([]types.Receipt, types.Error)
 }
 
 type MembershipStore interface {
@@ -138,6 +421,7 @@ type AsyncEventSink interface {
 
 type AsyncEventSource interface {
 	Listen(user ct.UserId, cancel chan struct{}) (chan ct.IndexedEvent, types.Error)
+	ListenRoom(room ct.RoomId, cancel chan struct{}) (chan ct.IndexedEvent, types.Error)
 }
 
 type IndexedEventSource interface {
@@ -151,6 +435,24 @@ type IndexedEventSource interface {
 	) ([]ct.IndexedEvent, types.Error)
 }
 
+type EventIndexer interface {
+	Index(event ct.IndexedEvent) types.Error
+}
+
+type IndexedEventStore interface {
+	// Replays all existing events into the indexer, and then keeps it updated with new events
+	AddIndexer(EventIndexer) types.Error
+}
+
+type SearchIndex interface {
+	EventIndexer
+	Search(
+		query string,
+		keys map[string]struct{},
+		roomSet map[ct.RoomId]struct{},
+	) ([]types.SearchHit, types.Error)
+}
+
 type EventSink interface {
 	Send(event ct.Event) (uint64, types.Error)
 }
@@ -159,6 +461,38 @@ type EventProvider interface {
 	Event(ct.UserId, ct.EventId) (ct.Event, types.Error)
 }
 
+type StateHistoryProvider interface {
+	EventIndex(ct.EventId) (index uint64, exists bool)
+	// Returns the event without checking if any user is allowed to see it, or nil if it doesn't exist
+	IndexedEvent(ct.EventId) (ct.IndexedEvent, types.Error)
+	StateAt(room ct.RoomId, index uint64) ([]*types.State, types.Error)
+	// Returns a single state event as it was directly after the event at the given index, or nil if it wasn't set
+	StateEventAt(room ct.RoomId, index uint64, eventType, stateKey string) (*types.State, types.Error)
+}
+
+type RelationProvider interface {
+	// Returns the events relating to the target with an index below from, newest first.
+	// Empty relType or eventType matches any relation or event type.
+	Relations(
+		target ct.EventId,
+		relType string,
+		eventType string,
+		from uint64,
+		limit uint,
+	) ([]ct.IndexedEvent, types.Error)
+}
+
+type ThreadProvider interface {
+	// Returns the roots of the threads in the room whose latest event has an index below from,
+	// most recently active first. A non-nil participant limits the result to threads they took part in.
+	Threads(
+		room ct.RoomId,
+		participant *ct.UserId,
+		from uint64,
+		limit uint,
+	) ([]types.ThreadRoot, types.Error)
+}
+
 type ProfileEventSink interface {
 	SetUserProfile(ct.UserId, types.UserProfile) (ct.IndexedEvent, types.Error)
 }
@@ -183,10 +517,18 @@ type TypingProvider interface {
 	Typing(room ct.RoomId) ([]ct.UserId, types.Error)
 }
 
+type ReceiptEventSink interface {
+	SendReceipt(room ct.RoomId, receipt types.Receipt) types.Error
+}
+
 type EventStream interface {
 	EventSink
 	EventProvider
 	IndexedEventSource
+	IndexedEventStore
+	StateHistoryProvider
+	RelationProvider
+	ThreadProvider
 }
 
 type PresenceStream interface {
@@ -202,3 +544,8 @@ type TypingStream interface {
 	TypingProvider
 	IndexedEventSource
 }
+
+type ReceiptStream interface {
+	ReceiptEventSink
+	IndexedEventSource
+}
@@ -0,0 +1,81 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+type smtpMailer struct {
+	addr string
+	from mail.Address
+	auth smtp.Auth
+}
+
+// Sends plain text mails through the SMTP server at addr, auth may be nil if the server doesn't require it
+func NewSmtpMailer(addr, from string, auth smtp.Auth) (interfaces.Mailer, error) {
+	if addr == "" {
+		return nil, errors.New("missing smtp server address")
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	return smtpMailer{addr, *fromAddress, auth}, nil
+}
+
+func (m smtpMailer) SendMail(to, subject, body string) types.Error {
+	toAddress, err := mail.ParseAddress(to)
+	if err != nil {
+		return types.BadParamError("invalid email address: " + err.Error())
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return types.ServerError("mail subject must be a single line")
+	}
+	var msg bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, value)
+	}
+	header("From", m.from.String())
+	header("To", toAddress.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+utils.RandomString(24)+"@"+domain(m.from.Address)+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from.Address, []string{toAddress.Address}, msg.Bytes()); err != nil {
+		return types.ServerError("failed to send mail: " + err.Error())
+	}
+	return nil
+}
+
+func domain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
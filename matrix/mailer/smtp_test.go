@@ -0,0 +1,118 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailer
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type receivedMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// accepts a single smtp session, and passes on the mail that was sent in it
+func fakeSmtpServer(t *testing.T) (string, chan receivedMail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := make(chan receivedMail, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		text := textproto.NewConn(conn)
+		defer text.Close()
+		var mail receivedMail
+		text.PrintfLine("220 localhost fake smtp")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "MAIL":
+				mail.from = strings.TrimPrefix(line, "MAIL FROM:")
+				text.PrintfLine("250 ok")
+			case "RCPT":
+				mail.to = append(mail.to, strings.TrimPrefix(line, "RCPT TO:"))
+				text.PrintfLine("250 ok")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mail.data = string(data)
+				mails <- mail
+				text.PrintfLine("250 ok")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func TestSmtpMailer(t *testing.T) {
+	addr, mails := fakeSmtpServer(t)
+	mailer, err := NewSmtpMailer(addr, "Bullettime <noreply@example.com>", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.SendMail("alice@example.com", "Validate your address", "first line\nsecond line\n.\n"); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	if mail.from != "<noreply@example.com>" {
+		t.Error("expected the mail to be sent from noreply@example.com, got", mail.from)
+	}
+	if len(mail.to) != 1 || mail.to[0] != "<alice@example.com>" {
+		t.Error("expected the mail to be sent to alice@example.com, got", mail.to)
+	}
+	for _, header := range []string{
+		"From: \"Bullettime\" <noreply@example.com>\n",
+		"To: <alice@example.com>\n",
+		"Subject: Validate your address\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+	} {
+		if !strings.Contains(mail.data, header) {
+			t.Errorf("expected header %q in mail %q", header, mail.data)
+		}
+	}
+	if !strings.HasSuffix(mail.data, "\n\nfirst line\nsecond line\n.\n") {
+		t.Errorf("expected the body to follow the headers, got %q", mail.data)
+	}
+
+	if err := mailer.SendMail("alice@example.com", "Injected\r\nBcc: eve@example.com", "body"); err == nil {
+		t.Error("expected a subject with line breaks to be rejected")
+	}
+	if err := mailer.SendMail("not an address", "Subject", "body"); err == nil {
+		t.Error("expected an invalid address to be rejected")
+	}
+}
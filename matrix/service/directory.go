@@ -0,0 +1,171 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func NewDirectoryService(
+	rooms interfaces.RoomStore,
+	aliases interfaces.AliasStore,
+	members interfaces.MembershipStore,
+) (interfaces.DirectoryService, error) {
+	return directoryService{
+		rooms,
+		aliases,
+		members,
+	}, nil
+}
+
+type directoryService struct {
+	rooms   interfaces.RoomStore
+	aliases interfaces.AliasStore
+	members interfaces.MembershipStore
+}
+
+type publicRoomList []types.PublicRoom
+
+func (l publicRoomList) Len() int      { return len(l) }
+func (l publicRoomList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l publicRoomList) Less(i, j int) bool {
+	if l[i].NumJoinedMembers != l[j].NumJoinedMembers {
+		return l[i].NumJoinedMembers > l[j].NumJoinedMembers
+	}
+	return l[i].RoomId.String() < l[j].RoomId.String()
+}
+
+func (s directoryService) PublicRooms(searchTerm string, since string, limit uint) (*types.PublicRooms, types.Error) {
+	offset := 0
+	if since != "" {
+		if _, err := fmt.Sscanf(since, "p%d", &offset); err != nil || offset < 0 {
+			return nil, types.BadParamError("invalid pagination token: " + since)
+		}
+	}
+	ids, err := s.rooms.PublicRooms()
+	if err != nil {
+		return nil, err
+	}
+	searchTerm = strings.ToLower(searchTerm)
+	rooms := make(publicRoomList, 0, len(ids))
+	for _, id := range ids {
+		room, err := s.publicRoom(id)
+		if err != nil {
+			return nil, err
+		}
+		if searchTerm == "" || matchesSearchTerm(room, searchTerm) {
+			rooms = append(rooms, *room)
+		}
+	}
+	sort.Sort(rooms)
+
+	result := &types.PublicRooms{
+		Chunk:                  []types.PublicRoom{},
+		TotalRoomCountEstimate: len(rooms),
+	}
+	if offset >= len(rooms) {
+		return result, nil
+	}
+	end := len(rooms)
+	if limit > 0 && offset+int(limit) < end {
+		end = offset + int(limit)
+		result.NextBatch = fmt.Sprintf("p%d", end)
+	}
+	if offset > 0 {
+		prev := 0
+		if limit > 0 && offset > int(limit) {
+			prev = offset - int(limit)
+		}
+		result.PrevBatch = fmt.Sprintf("p%d", prev)
+	}
+	result.Chunk = rooms[offset:end]
+	return result, nil
+}
+
+func (s directoryService) publicRoom(room ct.RoomId) (*types.PublicRoom, types.Error) {
+	result := &types.PublicRoom{RoomId: room}
+	nameState, err := s.rooms.RoomState(room, types.EventTypeName, "")
+	if err != nil {
+		return nil, err
+	}
+	if nameState != nil {
+		if content, ok := nameState.Content.(*types.NameEventContent); ok {
+			result.Name = content.Name
+		}
+	}
+	topicState, err := s.rooms.RoomState(room, types.EventTypeTopic, "")
+	if err != nil {
+		return nil, err
+	}
+	if topicState != nil {
+		if content, ok := topicState.Content.(*types.TopicEventContent); ok {
+			result.Topic = content.Topic
+		}
+	}
+	aliases, err := s.aliases.Aliases(room)
+	if err != nil {
+		return nil, err
+	}
+	result.Aliases = aliases
+	canonicalState, err := s.rooms.RoomState(room, types.EventTypeCanonicalAlias, "")
+	if err != nil {
+		return nil, err
+	}
+	if canonicalState != nil {
+		if content, ok := canonicalState.Content.(*types.CanonicalAliasEventContent); ok {
+			result.CanonicalAlias = content.Alias
+		}
+	}
+	visibilityState, err := s.rooms.RoomState(room, types.EventTypeHistoryVisibility, "")
+	if err != nil {
+		return nil, err
+	}
+	result.WorldReadable = historyVisibilityOf(visibilityState) == types.HistoryVisibilityWorldReadable
+	guestAccessState, err := s.rooms.RoomState(room, types.EventTypeGuestAccess, "")
+	if err != nil {
+		return nil, err
+	}
+	result.GuestCanJoin = guestAccessOf(guestAccessState) == types.GuestAccessCanJoin
+	users, err := s.members.Users(room)
+	if err != nil {
+		return nil, err
+	}
+	result.NumJoinedMembers = len(users)
+	return result, nil
+}
+
+func matchesSearchTerm(room *types.PublicRoom, searchTerm string) bool {
+	if strings.Contains(strings.ToLower(room.Name), searchTerm) {
+		return true
+	}
+	if strings.Contains(strings.ToLower(room.Topic), searchTerm) {
+		return true
+	}
+	if room.CanonicalAlias != nil && strings.Contains(strings.ToLower(room.CanonicalAlias.String()), searchTerm) {
+		return true
+	}
+	for _, alias := range room.Aliases {
+		if strings.Contains(strings.ToLower(alias.String()), searchTerm) {
+			return true
+		}
+	}
+	return false
+}
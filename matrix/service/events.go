@@ -16,6 +16,7 @@ package service
 
 import (
 	"log"
+	"strconv"
 
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
@@ -26,17 +27,24 @@ func NewEventService(
 	messageSource interfaces.IndexedEventSource,
 	presenceSource interfaces.IndexedEventSource,
 	typingSource interfaces.IndexedEventSource,
+	receiptSource interfaces.IndexedEventSource,
 	asyncEventSource interfaces.AsyncEventSource,
-	eventProvider interfaces.EventProvider,
+	stateHistory interfaces.StateHistoryProvider,
+	relations interfaces.RelationProvider,
+	threads interfaces.ThreadProvider,
 	membershipStore interfaces.MembershipStore,
 ) (interfaces.EventService, error) {
 	return &eventService{
 		messageSource,
 		presenceSource,
 		typingSource,
+		receiptSource,
 		asyncEventSource,
-		eventProvider,
+		stateHistory,
+		relations,
+		threads,
 		membershipStore,
+		historyVisibility{stateHistory},
 	}, nil
 }
 
@@ -44,19 +52,32 @@ type eventService struct {
 	messageSource    interfaces.IndexedEventSource
 	presenceSource   interfaces.IndexedEventSource
 	typingSource     interfaces.IndexedEventSource
+	receiptSource    interfaces.IndexedEventSource
 	asyncEventSource interfaces.AsyncEventSource
-	eventProvider    interfaces.EventProvider
+	stateHistory     interfaces.StateHistoryProvider
+	relations        interfaces.RelationProvider
+	threads          interfaces.ThreadProvider
 	membershipStore  interfaces.MembershipStore
+	visibility       historyVisibility
 }
 
 func (s eventService) Event(user ct.UserId, eventId ct.EventId) (ct.Event, types.Error) {
-	event, err := s.eventProvider.Event(user, eventId)
+	indexed, err := s.stateHistory.IndexedEvent(eventId)
 	if err != nil {
 		return nil, err
 	}
-	if event == nil {
-		return nil, types.NotFoundError("event not found: " + event.GetEventKey().String())
+	if indexed == nil {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
 	}
+	visible, err := s.visibility.visible(user, indexed)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
+	}
+	event := indexed.Event()
+	markThreadParticipation(user, event)
 	return event, nil
 }
 
@@ -78,10 +99,12 @@ func (s eventService) Range(
 	maxMessage := s.messageSource.Max()
 	maxPresence := s.presenceSource.Max()
 	maxTyping := s.typingSource.Max()
+	maxReceipt := s.receiptSource.Max()
 
 	var fromMessage uint64
 	var fromPresence uint64
 	var fromTyping uint64
+	var fromReceipt uint64
 
 	if from != nil {
 		fromMessage = from.MessageIndex
@@ -96,24 +119,32 @@ func (s eventService) Range(
 		if fromTyping > maxTyping {
 			fromTyping = maxTyping
 		}
+		fromReceipt = from.ReceiptIndex
+		if fromReceipt > maxReceipt {
+			fromReceipt = maxReceipt
+		}
 	} else {
 		fromMessage = maxMessage
 		fromPresence = maxPresence
 		fromTyping = maxTyping
+		fromReceipt = maxReceipt
 	}
 
 	var toMessage uint64
 	var toPresence uint64
 	var toTyping uint64
+	var toReceipt uint64
 
 	if to != nil {
 		toMessage = to.MessageIndex
 		toPresence = to.PresenceIndex
 		toTyping = to.TypingIndex
+		toReceipt = to.ReceiptIndex
 	} else {
 		toMessage = maxMessage
 		toPresence = maxPresence
 		toTyping = maxTyping
+		toReceipt = maxReceipt
 	}
 
 	userSet, err := s.membershipStore.Peers(user)
@@ -142,18 +173,22 @@ func (s eventService) Range(
 	if err != nil {
 		return nil, err
 	}
+	receipts, err := s.receiptSource.Range(&user, userSet, roomSet, fromReceipt, toReceipt, limit)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("getting events from %d to %d, max %d, %#v", fromMessage, toMessage, maxMessage, eventCh)
 
 	if eventCh != nil {
 		blocking := true
-		if to != nil && toMessage <= maxMessage && toPresence <= maxPresence && toTyping <= maxTyping {
+		if to != nil && toMessage <= maxMessage && toPresence <= maxPresence && toTyping <= maxTyping && toReceipt <= maxReceipt {
 			blocking = false
 		}
 
 		gotEvent := false
 		var event ct.IndexedEvent
-		if blocking && len(messages)+len(presences)+len(typings) == 0 {
+		if blocking && len(messages)+len(presences)+len(typings)+len(receipts) == 0 {
 			event, gotEvent = <-eventCh
 		} else {
 			select {
@@ -161,7 +196,7 @@ func (s eventService) Range(
 			default:
 			}
 		}
-		log.Printf("async event: %#v blocking: %#v len: %#v", event, blocking, len(messages)+len(presences)+len(typings))
+		log.Printf("async event: %#v blocking: %#v len: %#v", event, blocking, len(messages)+len(presences)+len(typings)+len(receipts))
 
 		if gotEvent && uint(len(messages)) < limit {
 			eventType := event.Event().GetEventType()
@@ -177,6 +212,12 @@ func (s eventService) Range(
 						typings = append(typings, event)
 					}
 				}
+			} else if eventType == types.EventTypeReceipt {
+				if len(receipts) == 0 || receipts[len(receipts)-1].Index() < event.Index() {
+					if to == nil || event.Index() < toReceipt {
+						receipts = append(receipts, event)
+					}
+				}
 			} else {
 				if len(messages) == 0 || messages[len(messages)-1].Index() < event.Index() {
 					if to == nil || event.Index() < toMessage {
@@ -190,6 +231,7 @@ func (s eventService) Range(
 	messageIndex := fromMessage
 	presenceIndex := fromPresence
 	typingIndex := fromTyping
+	receiptIndex := fromReceipt
 
 	if len(messages) > 0 {
 		messageIndex = messages[len(messages)-1].Index() + 1
@@ -200,11 +242,19 @@ func (s eventService) Range(
 	if len(typings) > 0 {
 		typingIndex = typings[len(typings)-1].Index() + 1
 	}
+	if len(receipts) > 0 {
+		receiptIndex = receipts[len(receipts)-1].Index() + 1
+	}
+
+	start := types.NewStreamToken(fromMessage, fromPresence, fromTyping, fromReceipt)
+	end := types.NewStreamToken(messageIndex, presenceIndex, typingIndex, receiptIndex)
 
-	start := types.NewStreamToken(fromMessage, fromPresence, fromTyping)
-	end := types.NewStreamToken(messageIndex, presenceIndex, typingIndex)
+	messages, err = s.visibility.filter(user, messages)
+	if err != nil {
+		return nil, err
+	}
 
-	events := make([]ct.Event, len(messages)+len(presences)+len(typings))
+	events := make([]ct.Event, len(messages)+len(presences)+len(typings)+len(receipts))
 
 	for i, _ := range events {
 		if i < len(messages) {
@@ -215,10 +265,16 @@ func (s eventService) Range(
 				events[len(messages)+i] = presences[i].Event()
 			} else {
 				i -= len(presences)
-				events[len(messages)+len(presences)+i] = typings[i].Event()
+				if i < len(typings) {
+					events[len(messages)+len(presences)+i] = typings[i].Event()
+				} else {
+					i -= len(typings)
+					events[len(messages)+len(presences)+len(typings)+i] = receipts[i].Event()
+				}
 			}
 		}
 	}
+	markThreadParticipation(user, events...)
 	log.Printf("got events from %d to %d: %#v", fromMessage, messageIndex, events)
 
 	chunk = types.NewEventStreamRange(events, start, end)
@@ -252,6 +308,88 @@ func (s eventService) Range(
 	//	}
 }
 
+func (s eventService) PeekRange(
+	user ct.UserId,
+	room ct.RoomId,
+	from, to *types.StreamToken,
+	limit uint,
+	cancel chan struct{},
+) (*types.EventStreamRange, types.Error) {
+	membership, err := s.visibility.membershipAt(room, user, ^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	if membership == types.MembershipNone {
+		visibility, err := s.visibility.visibilityAt(room, ^uint64(0))
+		if err != nil {
+			return nil, err
+		}
+		if visibility != types.HistoryVisibilityWorldReadable {
+			return nil, types.ForbiddenError("room '" + room.String() + "' is not world readable")
+		}
+	}
+
+	presenceIndex := s.presenceSource.Max()
+	typingIndex := s.typingSource.Max()
+	receiptIndex := s.receiptSource.Max()
+	fromMessage := s.messageSource.Max()
+	if from != nil {
+		fromMessage = from.MessageIndex
+		presenceIndex = from.PresenceIndex
+		typingIndex = from.TypingIndex
+		receiptIndex = from.ReceiptIndex
+	}
+	roomSet := map[ct.RoomId]struct{}{
+		room: struct{}{},
+	}
+
+	for {
+		// listen before looking for events, so that none are missed in between
+		var eventCh chan ct.IndexedEvent
+		if to == nil {
+			eventCh, err = s.asyncEventSource.ListenRoom(room, cancel)
+			if err != nil {
+				return nil, err
+			}
+		}
+		toMessage := s.messageSource.Max()
+		if to != nil {
+			toMessage = to.MessageIndex
+		}
+		if fromMessage > toMessage && to == nil {
+			fromMessage = toMessage
+		}
+		messages, err := s.messageSource.Range(nil, nil, roomSet, fromMessage, toMessage, limit)
+		if err != nil {
+			return nil, err
+		}
+		endMessage := fromMessage
+		if len(messages) > 0 {
+			endMessage = messages[len(messages)-1].Index()
+			if toMessage > fromMessage {
+				endMessage += 1
+			}
+		}
+		messages, err = s.visibility.filter(user, messages)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 || to != nil {
+			events := indexedToEvents(messages)
+			markThreadParticipation(user, events...)
+			start := types.NewStreamToken(fromMessage, presenceIndex, typingIndex, receiptIndex)
+			end := types.NewStreamToken(endMessage, presenceIndex, typingIndex, receiptIndex)
+			return types.NewEventStreamRange(events, start, end), nil
+		}
+		fromMessage = endMessage
+		// the channel is closed without an event when the request is cancelled
+		if _, ok := <-eventCh; !ok {
+			start := types.NewStreamToken(fromMessage, presenceIndex, typingIndex, receiptIndex)
+			return types.NewEventStreamRange([]ct.Event{}, start, start), nil
+		}
+	}
+}
+
 func (s eventService) Messages(
 	user ct.UserId,
 	room ct.RoomId,
@@ -263,11 +401,13 @@ func (s eventService) Messages(
 	var fromMessage uint64
 	var presenceIndex uint64
 	var typingIndex uint64
+	var receiptIndex uint64
 
 	if from != nil {
 		fromMessage = from.MessageIndex
 		presenceIndex = from.PresenceIndex
 		typingIndex = from.TypingIndex
+		receiptIndex = from.ReceiptIndex
 		if fromMessage > maxMessage {
 			fromMessage = maxMessage
 		}
@@ -275,6 +415,7 @@ func (s eventService) Messages(
 		fromMessage = maxMessage
 		presenceIndex = s.presenceSource.Max()
 		typingIndex = s.typingSource.Max()
+		receiptIndex = s.receiptSource.Max()
 	}
 
 	var toMessage uint64
@@ -309,17 +450,240 @@ func (s eventService) Messages(
 		messagesEnd, messagesStart = messagesStart, messagesEnd
 	}
 
-	start := types.NewStreamToken(messagesStart, presenceIndex, typingIndex)
-	end := types.NewStreamToken(messagesEnd, presenceIndex, typingIndex)
+	start := types.NewStreamToken(messagesStart, presenceIndex, typingIndex, receiptIndex)
+	end := types.NewStreamToken(messagesEnd, presenceIndex, typingIndex, receiptIndex)
+
+	messages, err = s.visibility.filter(user, messages)
+	if err != nil {
+		return nil, err
+	}
 
 	events := make([]ct.Event, len(messages))
 
 	for i, _ := range events {
 		events[i] = messages[i].Event()
 	}
+	markThreadParticipation(user, events...)
 	log.Printf("got messages from %d to %d: %#v", messagesStart, messagesEnd, events)
 
 	eventRange = types.NewEventStreamRange(events, start, end)
 
 	return eventRange, nil
 }
+
+func (s eventService) Context(
+	user ct.UserId,
+	room ct.RoomId,
+	eventId ct.EventId,
+	limit uint,
+) (*types.EventContext, types.Error) {
+	event, err := s.Event(user, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if eventRoom := event.GetRoomId(); eventRoom == nil || *eventRoom != room {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
+	}
+	index, exists := s.stateHistory.EventIndex(eventId)
+	if !exists {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
+	}
+
+	roomSet := map[ct.RoomId]struct{}{
+		room: struct{}{},
+	}
+	beforeLimit := limit / 2
+	afterLimit := limit - beforeLimit
+
+	before, err := s.messageSource.Range(nil, nil, roomSet, index, 0, beforeLimit)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.messageSource.Range(nil, nil, roomSet, index+1, s.messageSource.Max(), afterLimit)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.stateHistory.StateAt(room, index)
+	if err != nil {
+		return nil, err
+	}
+
+	startIndex := index
+	if len(before) > 0 {
+		startIndex = before[len(before)-1].Index()
+	}
+	endIndex := index + 1
+	if len(after) > 0 {
+		endIndex = after[len(after)-1].Index() + 1
+	}
+	before, err = s.visibility.filter(user, before)
+	if err != nil {
+		return nil, err
+	}
+	after, err = s.visibility.filter(user, after)
+	if err != nil {
+		return nil, err
+	}
+	presenceIndex := s.presenceSource.Max()
+	typingIndex := s.typingSource.Max()
+	receiptIndex := s.receiptSource.Max()
+
+	eventsBefore := indexedToEvents(before)
+	eventsAfter := indexedToEvents(after)
+	markThreadParticipation(user, eventsBefore...)
+	markThreadParticipation(user, eventsAfter...)
+
+	return &types.EventContext{
+		Event:        event,
+		EventsBefore: eventsBefore,
+		EventsAfter:  eventsAfter,
+		State:        state,
+		Start:        types.NewStreamToken(startIndex, presenceIndex, typingIndex, receiptIndex),
+		End:          types.NewStreamToken(endIndex, presenceIndex, typingIndex, receiptIndex),
+	}, nil
+}
+
+func (s eventService) Relations(
+	user ct.UserId,
+	room ct.RoomId,
+	eventId ct.EventId,
+	relType string,
+	eventType string,
+	from *uint64,
+	limit uint,
+) (*types.RelationsChunk, types.Error) {
+	event, err := s.Event(user, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if eventRoom := event.GetRoomId(); eventRoom == nil || *eventRoom != room {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
+	}
+	fromIndex := s.messageSource.Max()
+	if from != nil {
+		fromIndex = *from
+	}
+	relations, err := s.relations.Relations(eventId, relType, eventType, fromIndex, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	relations, err = s.visibility.filter(user, relations)
+	if err != nil {
+		return nil, err
+	}
+	chunk := &types.RelationsChunk{}
+	if uint(len(relations)) > limit {
+		relations = relations[:limit]
+		nextBatch := strconv.FormatUint(relations[len(relations)-1].Index(), 10)
+		chunk.NextBatch = &nextBatch
+	}
+	chunk.Chunk = indexedToEvents(relations)
+	markThreadParticipation(user, chunk.Chunk...)
+	return chunk, nil
+}
+
+func (s eventService) Threads(
+	user ct.UserId,
+	room ct.RoomId,
+	include string,
+	from *uint64,
+	limit uint,
+) (*types.ThreadsChunk, types.Error) {
+	rooms, err := s.membershipStore.Rooms(user)
+	if err != nil {
+		return nil, err
+	}
+	isMember := false
+	for _, joined := range rooms {
+		isMember = isMember || joined == room
+	}
+	if !isMember {
+		return nil, types.ForbiddenError("not a member of room '" + room.String() + "'")
+	}
+	var participant *ct.UserId
+	switch include {
+	case "", types.ThreadsIncludeAll:
+	case types.ThreadsIncludeParticipated:
+		participant = &user
+	default:
+		return nil, types.BadQueryError("invalid include value: " + include)
+	}
+	fromIndex := s.messageSource.Max()
+	if from != nil {
+		fromIndex = *from
+	}
+	roots, err := s.threads.Threads(room, participant, fromIndex, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	visibleRoots := make([]types.ThreadRoot, 0, len(roots))
+	for _, root := range roots {
+		visible, err := s.visibility.visible(user, root.Root)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			visibleRoots = append(visibleRoots, root)
+		}
+	}
+	roots = visibleRoots
+	chunk := &types.ThreadsChunk{}
+	if uint(len(roots)) > limit {
+		roots = roots[:limit]
+		nextBatch := strconv.FormatUint(roots[len(roots)-1].Latest.Index(), 10)
+		chunk.NextBatch = &nextBatch
+	}
+	chunk.Chunk = make([]ct.Event, len(roots))
+	for i, root := range roots {
+		chunk.Chunk[i] = root.Root.Event()
+		latestVisible, err := s.visibility.visible(user, root.Latest)
+		if err != nil {
+			return nil, err
+		}
+		if !latestVisible {
+			removeThreadSummary(chunk.Chunk[i])
+		}
+	}
+	markThreadParticipation(user, chunk.Chunk...)
+	return chunk, nil
+}
+
+// removes the bundled thread summary of a served event, for users that can't see its latest event
+func removeThreadSummary(event ct.Event) {
+	var unsigned *types.Unsigned
+	switch event := event.(type) {
+	case *types.Message:
+		unsigned = event.Unsigned
+	case *types.State:
+		unsigned = event.Unsigned
+	}
+	if unsigned == nil || unsigned.Relations == nil || unsigned.Relations.Thread == nil {
+		return
+	}
+	relations := *unsigned.Relations
+	relations.Thread = nil
+	unsigned.Relations = &relations
+}
+
+// thread summaries are shared between users, so whether the user took part is filled in per request
+func markThreadParticipation(user ct.UserId, events ...ct.Event) {
+	for _, event := range events {
+		var unsigned *types.Unsigned
+		switch event := event.(type) {
+		case *types.Message:
+			unsigned = event.Unsigned
+		case *types.State:
+			unsigned = event.Unsigned
+		}
+		if unsigned == nil || unsigned.Relations == nil || unsigned.Relations.Thread == nil {
+			continue
+		}
+		thread := unsigned.Relations.Thread
+		thread.CurrentUserParticipated = false
+		for _, participant := range thread.Participants {
+			if participant == user {
+				thread.CurrentUserParticipated = true
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func NewReceiptService(
+	receiptStore interfaces.ReceiptStore,
+	receiptSink interfaces.ReceiptEventSink,
+	eventProvider interfaces.EventProvider,
+) (interfaces.ReceiptService, error) {
+	return receiptService{
+		receiptStore,
+		receiptSink,
+		eventProvider,
+	}, nil
+}
+
+type receiptService struct {
+	receipts      interfaces.ReceiptStore
+	receiptSink   interfaces.ReceiptEventSink
+	eventProvider interfaces.EventProvider
+}
+
+func (s receiptService) SetReceipt(
+	room ct.RoomId,
+	caller ct.UserId,
+	receiptType string,
+	eventId ct.EventId,
+	threadId string,
+) types.Error {
+	if receiptType != types.ReceiptTypeRead {
+		return types.BadParamError("unsupported receipt type: " + receiptType)
+	}
+	event, err := s.eventProvider.Event(caller, eventId)
+	if err != nil {
+		return err
+	}
+	if event == nil || event.GetRoomId() == nil || *event.GetRoomId() != room {
+		return types.NotFoundError("event '" + eventId.String() + "' doesn't exist in room '" + room.String() + "'")
+	}
+	if threadId != "" {
+		if err := checkThread(event, threadId); err != nil {
+			return err
+		}
+	}
+	receipt := types.Receipt{
+		EventId:     eventId,
+		UserId:      caller,
+		ReceiptType: receiptType,
+		ThreadId:    threadId,
+		Timestamp:   ct.Timestamp{time.Now()},
+	}
+	if err := s.receipts.SetReceipt(room, receipt); err != nil {
+		return err
+	}
+	return s.receiptSink.SendReceipt(room, receipt)
+}
+
+func checkThread(event ct.Event, threadId string) types.Error {
+	relatesTo, _ := types.ParseRelatesTo(event.GetContent())
+	var root *ct.EventId
+	if relatesTo != nil && relatesTo.RelType == types.RelationThread {
+		root = &relatesTo.EventId
+	}
+	if threadId == types.ThreadIdMain {
+		if root != nil {
+			return types.BadParamError("event is part of thread '" + root.String() + "'")
+		}
+		return nil
+	}
+	thread, parseErr := ct.ParseEventId(threadId)
+	if parseErr != nil {
+		return types.BadParamError("invalid thread_id: " + parseErr.Error())
+	}
+	if event.GetEventKey() == ct.Id(thread) {
+		return nil
+	}
+	if root == nil || *root != thread {
+		return types.BadParamError("event isn't part of thread '" + threadId + "'")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+var registrationTokenPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+func CreateRegistrationTokenService(store interfaces.RegistrationTokenStore) (interfaces.RegistrationTokenService, error) {
+	return &registrationTokenService{store: store}, nil
+}
+
+type registrationTokenService struct {
+	store interfaces.RegistrationTokenStore
+	lock  sync.Mutex // makes checking and counting the uses of a token atomic
+}
+
+func (s *registrationTokenService) CreateRegistrationToken(
+	token string,
+	usesAllowed *int,
+	expiryTime *int64,
+) (*types.RegistrationToken, types.Error) {
+	if token == "" {
+		token = utils.RandomString(16)
+	} else if !registrationTokenPattern.MatchString(token) {
+		return nil, types.BadParamError("token must consist of 1 to 64 letters, digits or . _ ~ -")
+	}
+	if usesAllowed != nil && *usesAllowed < 0 {
+		return nil, types.BadParamError("uses_allowed must not be negative")
+	}
+	if expiryTime != nil && *expiryTime <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return nil, types.BadParamError("expiry_time must be in the future")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	existing, err := s.store.RegistrationToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, types.BadParamError("token '" + token + "' already exists")
+	}
+	created := types.RegistrationToken{Token: token, UsesAllowed: usesAllowed, ExpiryTime: expiryTime}
+	if err := s.store.SetRegistrationToken(created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (s *registrationTokenService) RegistrationToken(token string) (*types.RegistrationToken, types.Error) {
+	found, err := s.store.RegistrationToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, types.NotFoundError("registration token '" + token + "' doesn't exist")
+	}
+	return found, nil
+}
+
+func (s *registrationTokenService) RegistrationTokens() ([]types.RegistrationToken, types.Error) {
+	tokens, err := s.store.RegistrationTokens()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(registrationTokensByToken(tokens))
+	return tokens, nil
+}
+
+func (s *registrationTokenService) RemoveRegistrationToken(token string) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.RegistrationToken(token); err != nil {
+		return err
+	}
+	return s.store.RemoveRegistrationToken(token)
+}
+
+func (s *registrationTokenService) RegistrationTokenValid(token string) (bool, types.Error) {
+	found, err := s.store.RegistrationToken(token)
+	if err != nil {
+		return false, err
+	}
+	return found != nil && found.Usable(time.Now()), nil
+}
+
+func (s *registrationTokenService) UseRegistrationToken(token string) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found, err := s.store.RegistrationToken(token)
+	if err != nil {
+		return err
+	}
+	if found == nil || !found.Usable(time.Now()) {
+		return types.ForbiddenError("invalid registration token")
+	}
+	found.Completed++
+	return s.store.SetRegistrationToken(*found)
+}
+
+func (s *registrationTokenService) ReleaseRegistrationToken(token string) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found, err := s.store.RegistrationToken(token)
+	if err != nil {
+		return err
+	}
+	if found == nil || found.Completed == 0 {
+		return nil
+	}
+	found.Completed--
+	return s.store.SetRegistrationToken(*found)
+}
+
+type registrationTokensByToken []types.RegistrationToken
+
+func (l registrationTokensByToken) Len() int           { return len(l) }
+func (l registrationTokensByToken) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l registrationTokensByToken) Less(i, j int) bool { return l[i].Token < l[j].Token }
+
+type registrationTokenStage struct {
+	registrationTokens interfaces.RegistrationTokenService
+}
+
+// Only checks that the token is valid, its use is counted once the registration is completed
+func NewRegistrationTokenStage(registrationTokens interfaces.RegistrationTokenService) interfaces.AuthStage {
+	return registrationTokenStage{registrationTokens}
+}
+
+func (registrationTokenStage) Type() string {
+	return types.AuthTypeRegistrationToken
+}
+
+func (registrationTokenStage) Params() interface{} {
+	return nil
+}
+
+func (s registrationTokenStage) Complete(user ct.UserId, auth *types.AuthData) types.Error {
+	if auth.Token == "" {
+		return types.BadJsonError("Missing token")
+	}
+	valid, err := s.registrationTokens.RegistrationTokenValid(auth.Token)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return types.ForbiddenError("invalid registration token")
+	}
+	return nil
+}
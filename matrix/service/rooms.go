@@ -15,12 +15,12 @@
 package service
 
 import (
-	"fmt"
 	"log"
 	"reflect"
 	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/authrules"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
 	"github.com/matrix-org/bullettime/utils"
@@ -28,18 +28,28 @@ import (
 
 func CreateRoomService(
 	roomStore interfaces.RoomStore,
+	userStore interfaces.UserStore,
 	aliasStore interfaces.AliasStore,
 	memberStore interfaces.MembershipStore,
+	inviteStore interfaces.MembershipStore,
 	eventSink interfaces.EventSink,
+	eventProvider interfaces.EventProvider,
+	stateHistory interfaces.StateHistoryProvider,
+	relations interfaces.RelationProvider,
 	profileProvider interfaces.ProfileProvider,
 	typingSink interfaces.TypingEventSink,
 	typingProvider interfaces.TypingProvider,
 ) (interfaces.RoomService, error) {
 	return roomService{
 		roomStore,
+		userStore,
 		aliasStore,
 		memberStore,
+		inviteStore,
 		eventSink,
+		eventProvider,
+		stateHistory,
+		relations,
 		profileProvider,
 		typingSink,
 		typingProvider,
@@ -48,9 +58,14 @@ func CreateRoomService(
 
 type roomService struct {
 	rooms           interfaces.RoomStore
+	users           interfaces.UserStore
 	aliases         interfaces.AliasStore
 	members         interfaces.MembershipStore
+	invites         interfaces.MembershipStore // users with pending invites, by room
 	eventSink       interfaces.EventSink
+	eventProvider   interfaces.EventProvider
+	stateHistory    interfaces.StateHistoryProvider
+	relations       interfaces.RelationProvider
 	profileProvider interfaces.ProfileProvider
 	typingSink      interfaces.TypingEventSink
 	typingProvider  interfaces.TypingProvider
@@ -78,77 +93,184 @@ func (s roomService) LookupAlias(alias ct.Alias) (ct.RoomId, types.Error) {
 	return *room, nil
 }
 
+func (s roomService) AddAlias(alias ct.Alias, room ct.RoomId, caller ct.UserId) types.Error {
+	if err := s.RoomExists(room, caller); err != nil {
+		return err
+	}
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return err
+	}
+	if membership != types.MembershipMember {
+		return types.ForbiddenError("cannot create an alias for a room without being a member")
+	}
+	if err := s.aliases.AddAlias(alias, room, caller); err != nil {
+		return err
+	}
+	if err := s.updateAliasesState(room, caller); err != nil {
+		if undoErr := s.aliases.RemoveAlias(alias, room); undoErr != nil {
+			log.Println("failed to remove alias " + alias.String() + " after failing to add it: " + undoErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func (s roomService) RemoveAlias(alias ct.Alias, caller ct.UserId) types.Error {
+	room, err := s.LookupAlias(alias)
+	if err != nil {
+		return err
+	}
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return err
+	}
+	if membership != types.MembershipMember {
+		return types.ForbiddenError("cannot remove an alias of a room without being a member")
+	}
+	creator, err := s.aliases.Creator(alias)
+	if err != nil {
+		return err
+	}
+	if creator == nil || *creator != caller {
+		aliases, err := s.aliases.Aliases(room)
+		if err != nil {
+			return err
+		}
+		remaining := []ct.Alias{}
+		for _, existing := range aliases {
+			if existing != alias {
+				remaining = append(remaining, existing)
+			}
+		}
+		if err := s.authorizeAliases(room, caller, remaining); err != nil {
+			return err
+		}
+	}
+	if err := s.aliases.RemoveAlias(alias, room); err != nil {
+		return err
+	}
+	if err := s.updateAliasesState(room, caller); err != nil {
+		restoredCreator := caller
+		if creator != nil {
+			restoredCreator = *creator
+		}
+		if undoErr := s.aliases.AddAlias(alias, room, restoredCreator); undoErr != nil {
+			log.Println("failed to restore alias " + alias.String() + " after failing to remove it: " + undoErr.Error())
+		}
+		return err
+	}
+	canonical, err := s.rooms.RoomState(room, types.EventTypeCanonicalAlias, "")
+	if err != nil {
+		return err
+	}
+	if canonical != nil {
+		content, ok := canonical.Content.(*types.CanonicalAliasEventContent)
+		if ok && content.Alias != nil && *content.Alias == alias {
+			// the canonical alias can't be left pointing at a removed alias, even if the caller
+			// isn't allowed to change it themselves
+			_, err := s.setState(room, caller, &types.CanonicalAliasEventContent{}, "")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s roomService) Aliases(room ct.RoomId, caller ct.UserId) ([]ct.Alias, types.Error) {
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return nil, err
+	}
+	if membership != types.MembershipMember {
+		return nil, types.ForbiddenError("cannot read room aliases, not a member")
+	}
+	return s.aliases.Aliases(room)
+}
+
+// the aliases state is maintained by the server, so it's set without authorization whenever the aliases
+// of the room change, on behalf of the user that changed them
+// authorizes the aliases state that the server sets on behalf of the caller
+func (s roomService) authorizeAliases(room ct.RoomId, caller ct.UserId, aliases []ct.Alias) types.Error {
+	stateKey := ""
+	return s.authorize(room, &authrules.Event{
+		Sender:    caller,
+		EventType: types.EventTypeAliases,
+		StateKey:  &stateKey,
+		Content:   &types.AliasesEventContent{aliases},
+		Server:    true,
+	})
+}
+
+func (s roomService) updateAliasesState(room ct.RoomId, user ct.UserId) types.Error {
+	aliases, err := s.aliases.Aliases(room)
+	if err != nil {
+		return err
+	}
+	_, err = s.setState(room, user, &types.AliasesEventContent{aliases}, "")
+	return err
+}
+
 func (s roomService) CreateRoom(
 	domain string,
 	creator ct.UserId,
 	desc *types.RoomDescription,
 ) (ct.RoomId, *ct.Alias, types.Error) {
+	roomVersion := types.DefaultRoomVersion
+	if desc.RoomVersion != nil {
+		roomVersion = *desc.RoomVersion
+	}
+	if _, ok := types.RoomVersions[roomVersion]; !ok {
+		return ct.RoomId{}, nil, types.UnsupportedRoomVersionError("room version '" + roomVersion + "' is not supported")
+	}
 	var alias *ct.Alias
 	id := ct.NewRoomId(utils.RandomString(16), domain)
 	if desc.Alias != nil {
 		a := ct.NewAlias(*desc.Alias, domain)
-		err := s.aliases.AddAlias(a, id)
+		err := s.aliases.AddAlias(a, id, creator)
 		if err != nil {
 			return ct.RoomId{}, nil, err
 		}
 		alias = &a
 	}
-	exists, err := s.rooms.CreateRoom(id)
-	if exists {
-		return ct.RoomId{}, nil, types.RoomInUseError("room '" + id.String() + "' already exists")
-	}
+	err := s.newRoom(id, creator, &types.CreateEventContent{creator, roomVersion, nil})
 	if err != nil {
 		return ct.RoomId{}, nil, err
 	}
-	s.members.AddMember(id, creator)
-
-	_, err = s.sendMessage(id, creator, &types.CreateEventContent{creator})
-	if err != nil {
-		return ct.RoomId{}, nil, err
-	}
-	_, err = s.setState(id, creator, &types.CreateEventContent{creator}, "")
-	if err != nil {
-		return ct.RoomId{}, nil, err
-	}
-	profile, err := s.profileProvider.Profile(creator)
+	_, err = s.authorizedSetState(id, creator, types.DefaultPowerLevels(creator), "")
 	if err != nil {
 		return ct.RoomId{}, nil, err
 	}
-	membership := &types.MembershipEventContent{&profile, types.MembershipMember}
-	_, err = s.setState(id, creator, membership, creator.String())
-	if err != nil {
-		return ct.RoomId{}, nil, err
-	}
-	_, err = s.setState(id, creator, types.DefaultPowerLevels(creator), "")
+	joinRuleContent := types.JoinRulesEventContent{desc.Visibility.ToJoinRule()}
+	_, err = s.authorizedSetState(id, creator, &joinRuleContent, "")
 	if err != nil {
 		return ct.RoomId{}, nil, err
 	}
-	joinRuleContent := types.JoinRulesEventContent{desc.Visibility.ToJoinRule()}
-	_, err = s.setState(id, creator, &joinRuleContent, "")
-	if err != nil {
+	if err := s.rooms.SetRoomVisibility(id, desc.Visibility); err != nil {
 		return ct.RoomId{}, nil, err
 	}
 	if alias != nil {
+		// the aliases state is maintained by the server, and can't be set by clients
 		_, err = s.setState(id, creator, &types.AliasesEventContent{[]ct.Alias{*alias}}, "")
 		if err != nil {
 			return ct.RoomId{}, nil, err
 		}
 	}
 	if desc.Name != nil {
-		_, err = s.setState(id, creator, &types.NameEventContent{*desc.Name}, "")
+		_, err = s.authorizedSetState(id, creator, &types.NameEventContent{*desc.Name}, "")
 		if err != nil {
 			return ct.RoomId{}, nil, err
 		}
 	}
 	if desc.Topic != nil {
-		_, err = s.setState(id, creator, &types.TopicEventContent{*desc.Topic}, "")
+		_, err = s.authorizedSetState(id, creator, &types.TopicEventContent{*desc.Topic}, "")
 		if err != nil {
 			return ct.RoomId{}, nil, err
 		}
 	}
+	// the creator chose who to invite when creating the room, so they're invited whatever the join rule is
 	for _, invited := range desc.Invited {
 		membership := types.MembershipEventContent{nil, types.MembershipInvited}
-		_, err = s.setState(id, creator, &membership, invited.String())
+		_, err = s.doMembershipChange(id, creator, invited, &membership)
 		if err != nil {
 			return ct.RoomId{}, nil, err
 		}
@@ -156,14 +278,174 @@ func (s roomService) CreateRoom(
 	return id, alias, nil
 }
 
-var disallowedMessageTypes map[string]struct{} = map[string]struct{}{
-	types.EventTypeName:        struct{}{},
-	types.EventTypeTopic:       struct{}{},
-	types.EventTypeJoinRules:   struct{}{},
-	types.EventTypePowerLevels: struct{}{},
-	types.EventTypeCreate:      struct{}{},
-	types.EventTypeAliases:     struct{}{},
-	types.EventTypeMembership:  struct{}{},
+// creates the room and lets the creator join it
+func (s roomService) newRoom(id ct.RoomId, creator ct.UserId, create *types.CreateEventContent) types.Error {
+	exists, err := s.rooms.CreateRoom(id)
+	if exists {
+		return types.RoomInUseError("room '" + id.String() + "' already exists")
+	}
+	if err != nil {
+		return err
+	}
+	s.members.AddMember(id, creator)
+
+	_, err = s.sendMessage(id, creator, create)
+	if err != nil {
+		return err
+	}
+	_, err = s.authorizedSetState(id, creator, create, "")
+	if err != nil {
+		return err
+	}
+	profile, err := s.profileProvider.Profile(creator)
+	if err != nil {
+		return err
+	}
+	membership := &types.MembershipEventContent{&profile, types.MembershipMember}
+	_, err = s.authorizedSetState(id, creator, membership, creator.String())
+	return err
+}
+
+// state that is copied to the new room when a room is upgraded
+var upgradedStateTypes = []string{
+	types.EventTypePowerLevels,
+	types.EventTypeJoinRules,
+	types.EventTypeHistoryVisibility,
+	types.EventTypeGuestAccess,
+	types.EventTypeName,
+	types.EventTypeTopic,
+	types.EventTypeCanonicalAlias,
+}
+
+func (s roomService) UpgradeRoom(
+	domain string,
+	room ct.RoomId,
+	caller ct.UserId,
+	roomVersion string,
+) (ct.RoomId, types.Error) {
+	if _, ok := types.RoomVersions[roomVersion]; !ok {
+		return ct.RoomId{}, types.UnsupportedRoomVersionError("room version '" + roomVersion + "' is not supported")
+	}
+	if err := s.RoomExists(room, caller); err != nil {
+		return ct.RoomId{}, err
+	}
+	id := ct.NewRoomId(utils.RandomString(16), domain)
+	tombstone := &types.TombstoneEventContent{"This room has been replaced", id}
+	stateKey := ""
+	event := &authrules.Event{
+		Sender:    caller,
+		EventType: types.EventTypeTombstone,
+		StateKey:  &stateKey,
+		Content:   tombstone,
+	}
+	if err := s.authorize(room, event); err != nil {
+		return ct.RoomId{}, err
+	}
+	powerLevels, err := s.powerLevels(room)
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	restricted := *powerLevels
+	level := 50
+	if restricted.UserDefault+1 > level {
+		level = restricted.UserDefault + 1
+	}
+	restricted.EventDefault = level
+	restricted.Invite = level
+	// checked before the new room is created, so that the upgrade doesn't fail halfway through
+	event = &authrules.Event{
+		Sender:    caller,
+		EventType: types.EventTypePowerLevels,
+		StateKey:  &stateKey,
+		Content:   &restricted,
+	}
+	if err := s.authorize(room, event); err != nil {
+		return ct.RoomId{}, err
+	}
+
+	err = s.newRoom(id, caller, &types.CreateEventContent{caller, roomVersion, &types.PreviousRoom{room}})
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	for _, eventType := range upgradedStateTypes {
+		state, err := s.rooms.RoomState(room, eventType, "")
+		if err != nil {
+			return ct.RoomId{}, err
+		}
+		if state == nil {
+			continue
+		}
+		content, ok := state.Content.(ct.TypedContent)
+		if !ok {
+			continue
+		}
+		if _, err := s.authorizedSetState(id, caller, content, ""); err != nil {
+			return ct.RoomId{}, err
+		}
+	}
+	if err := s.moveAliases(room, id, caller); err != nil {
+		return ct.RoomId{}, err
+	}
+	visibility, err := s.rooms.RoomVisibility(room)
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	if err := s.rooms.SetRoomVisibility(id, visibility); err != nil {
+		return ct.RoomId{}, err
+	}
+	if err := s.rooms.SetRoomVisibility(room, types.VisibilityPrivate); err != nil {
+		return ct.RoomId{}, err
+	}
+
+	// the tombstone and the power levels were authorized before the new room was created
+	if _, err := s.setState(room, caller, tombstone, ""); err != nil {
+		return ct.RoomId{}, err
+	}
+	if _, err := s.setState(room, caller, &restricted, ""); err != nil {
+		return ct.RoomId{}, err
+	}
+	return id, nil
+}
+
+// moves the aliases and the canonical alias of a room that is being upgraded to the new room
+func (s roomService) moveAliases(from, to ct.RoomId, caller ct.UserId) types.Error {
+	aliases, err := s.aliases.Aliases(from)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		creator, err := s.aliases.Creator(alias)
+		if err != nil {
+			return err
+		}
+		if creator == nil {
+			creator = &caller
+		}
+		if err := s.aliases.RemoveAlias(alias, from); err != nil {
+			return err
+		}
+		if err := s.aliases.AddAlias(alias, to, *creator); err != nil {
+			return err
+		}
+	}
+	if len(aliases) > 0 {
+		if err := s.updateAliasesState(from, caller); err != nil {
+			return err
+		}
+		if err := s.updateAliasesState(to, caller); err != nil {
+			return err
+		}
+	}
+	canonical, err := s.rooms.RoomState(from, types.EventTypeCanonicalAlias, "")
+	if err != nil {
+		return err
+	}
+	if canonical != nil {
+		// the caller was allowed to send the tombstone, which replaces the old room entirely
+		_, err := s.setState(from, caller, &types.CanonicalAliasEventContent{}, "")
+		return err
+	}
+	return nil
 }
 
 func (s roomService) AddMessage(
@@ -171,22 +453,130 @@ func (s roomService) AddMessage(
 	caller ct.UserId,
 	content ct.TypedContent,
 ) (*types.Message, types.Error) {
-	eventType := content.GetEventType()
-	if _, ok := disallowedMessageTypes[eventType]; ok {
-		return nil, types.ForbiddenError("sending a message event of the type " + eventType + " is not permitted")
+	event := &authrules.Event{
+		Sender:    caller,
+		EventType: content.GetEventType(),
+		Content:   content,
+	}
+	if err := s.authorize(room, event); err != nil {
+		return nil, err
+	}
+	if err := s.validateRelation(room, caller, content); err != nil {
+		return nil, err
 	}
 
-	err := s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-		if eventLevel, ok := pl.Events[eventType]; ok {
-			return eventLevel
+	return s.sendMessage(room, caller, content)
+}
+
+func (s roomService) validateRelation(room ct.RoomId, caller ct.UserId, content ct.TypedContent) types.Error {
+	relatesTo, parseErr := types.ParseRelatesTo(content)
+	if parseErr != nil {
+		return types.BadJsonError(parseErr.Error())
+	}
+	if relatesTo == nil {
+		return nil
+	}
+	if relatesTo.InReplyTo != nil {
+		if _, err := s.relationTarget(room, caller, relatesTo.InReplyTo.EventId); err != nil {
+			return err
 		}
-		return pl.EventDefault
-	})
+	}
+	if relatesTo.RelType == "" {
+		return nil
+	}
+	target, err := s.relationTarget(room, caller, relatesTo.EventId)
+	if err != nil {
+		return err
+	}
+	switch relatesTo.RelType {
+	case types.RelationReplace:
+		if _, ok := target.(*types.Message); !ok {
+			return types.BadParamError("only message events can be edited")
+		}
+		if sender := target.GetUserId(); sender == nil || *sender != caller {
+			return types.ForbiddenError("only the original sender can edit an event")
+		}
+		if target.GetEventType() != content.GetEventType() {
+			return types.BadParamError("an edit must have the same event type as the original event")
+		}
+		if targetRelation, _ := types.ParseRelatesTo(target.GetContent()); targetRelation != nil && targetRelation.RelType == types.RelationReplace {
+			return types.BadParamError("an edit can't be edited")
+		}
+	case types.RelationThread:
+		if _, ok := target.(*types.Message); !ok {
+			return types.BadParamError("threads can only be started from message events")
+		}
+		if targetRelation, _ := types.ParseRelatesTo(target.GetContent()); targetRelation != nil && targetRelation.RelType != "" {
+			return types.BadParamError("threads can't be started from an event with a relation")
+		}
+	case types.RelationAnnotation:
+		annotations, err := s.relations.Relations(relatesTo.EventId, types.RelationAnnotation, content.GetEventType(), ^uint64(0), ^uint(0))
+		if err != nil {
+			return err
+		}
+		for _, annotation := range annotations {
+			relation, _ := types.ParseRelatesTo(annotation.Event().GetContent())
+			if *annotation.Event().GetUserId() == caller && relation != nil && relation.Key == relatesTo.Key {
+				return types.BadParamError("the same annotation has already been sent")
+			}
+		}
+	}
+	return nil
+}
+
+func (s roomService) relationTarget(room ct.RoomId, caller ct.UserId, eventId ct.EventId) (ct.Event, types.Error) {
+	target, err := s.eventProvider.Event(caller, eventId)
 	if err != nil {
 		return nil, err
 	}
+	if target == nil || target.GetRoomId() == nil || *target.GetRoomId() != room {
+		return nil, types.BadParamError("event '" + eventId.String() + "' doesn't exist in room '" + room.String() + "'")
+	}
+	return target, nil
+}
 
-	return s.sendMessage(room, caller, content)
+func (s roomService) Redact(
+	room ct.RoomId,
+	caller ct.UserId,
+	eventId ct.EventId,
+	reason string,
+) (*types.Redaction, types.Error) {
+	target, err := s.eventProvider.Event(caller, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil || target.GetRoomId() == nil || *target.GetRoomId() != room {
+		return nil, types.NotFoundError("event '" + eventId.String() + "' doesn't exist in room '" + room.String() + "'")
+	}
+	event := &authrules.Event{
+		Sender:         caller,
+		EventType:      types.EventTypeRedaction,
+		Content:        &types.RedactionEventContent{reason},
+		RedactedSender: target.GetUserId(),
+	}
+	if err := s.authorize(room, event); err != nil {
+		return nil, err
+	}
+
+	redaction := new(types.Redaction)
+	redaction.EventId = ct.DeriveEventId(utils.RandomString(16), ct.Id(caller))
+	redaction.RoomId = room
+	redaction.UserId = caller
+	redaction.EventType = types.EventTypeRedaction
+	redaction.Timestamp = ct.Timestamp{time.Now()}
+	redaction.Content = event.Content
+	redaction.Redacts = eventId
+
+	if _, err := s.eventSink.Send(redaction); err != nil {
+		return nil, err
+	}
+	if state, ok := target.(*types.State); ok {
+		redacted := types.RedactEvent(state, redaction).(*types.State)
+		if err := s.rooms.RedactRoomState(room, redacted); err != nil {
+			return nil, err
+		}
+	}
+	return redaction, nil
 }
 
 func (s roomService) State(
@@ -194,95 +584,235 @@ func (s roomService) State(
 	caller ct.UserId,
 	eventType, stateKey string,
 ) (*types.State, types.Error) {
-	membership, err := s.userMembership(room, caller)
+	leftAt, err := s.stateReadPosition(room, caller)
 	if err != nil {
 		return nil, err
 	}
-	if membership != types.MembershipMember {
-		return nil, types.ForbiddenError("cannot read room state, not a member")
+	var state *types.State
+	if leftAt == nil {
+		state, err = s.rooms.RoomState(room, eventType, stateKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		states, err := s.stateHistory.StateAt(room, *leftAt)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range states {
+			if candidate.EventType == eventType && candidate.StateKey == stateKey {
+				state = candidate
+				break
+			}
+		}
+	}
+	if state == nil {
+		return nil, types.NotFoundError("state '" + eventType + "' with key '" + stateKey + "' doesn't exist")
 	}
-	state, err := s.rooms.RoomState(room, eventType, stateKey)
+	return state, nil
+}
+
+func (s roomService) EntireState(room ct.RoomId, caller ct.UserId) ([]*types.State, types.Error) {
+	leftAt, err := s.stateReadPosition(room, caller)
 	if err != nil {
 		return nil, err
 	}
-	return state, err
+	if leftAt == nil {
+		return s.rooms.EntireRoomState(room)
+	}
+	return s.stateHistory.StateAt(room, *leftAt)
 }
 
-func (s roomService) SetState(
+func (s roomService) Members(
 	room ct.RoomId,
 	caller ct.UserId,
-	content ct.TypedContent,
-	stateKey string,
-) (*types.State, types.Error) {
-	userIdStateKey, parseErr := ct.ParseUserId(stateKey)
-	isUserIdStateKey := parseErr == nil
-
-	eventType := content.GetEventType()
-	switch eventType {
-	case types.EventTypeName:
-		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+	at *types.StreamToken,
+	membership, notMembership types.Membership,
+) ([]*types.State, types.Error) {
+	leftAt, err := s.stateReadPosition(room, caller)
+	if err != nil {
+		return nil, err
+	}
+	if at != nil {
+		if at.MessageIndex == 0 {
+			return []*types.State{}, nil
 		}
-	case types.EventTypeTopic:
-		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+		if leftAt == nil || at.MessageIndex-1 < *leftAt {
+			index := at.MessageIndex - 1
+			leftAt = &index
 		}
-	case types.EventTypeJoinRules:
-		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+	}
+	var states []*types.State
+	if leftAt == nil {
+		states, err = s.rooms.EntireRoomState(room)
+	} else {
+		states, err = s.stateHistory.StateAt(room, *leftAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	members := []*types.State{}
+	for _, state := range states {
+		if state.EventType != types.EventTypeMembership {
+			continue
 		}
-	case types.EventTypePowerLevels:
-		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+		content, ok := state.Content.(*types.MembershipEventContent)
+		if !ok {
+			panic("invalid membership content, was " + reflect.TypeOf(state.Content).String())
 		}
-	case types.EventTypeCreate:
-		return nil, types.ForbiddenError("cannot set state " + eventType)
-
-	case types.EventTypeAliases:
-		return nil, types.ForbiddenError("cannot set state " + eventType)
-
-	case types.EventTypeMembership:
-		membership, ok := content.(*types.MembershipEventContent)
-		if !ok || membership == nil {
-			panic("expected membership event content, got " + reflect.TypeOf(content).String())
+		if membership != types.MembershipNone && content.Membership != membership {
+			continue
 		}
-		if !isUserIdStateKey {
-			return nil, types.ForbiddenError("state key must be a user id for state " + eventType)
+		if notMembership != types.MembershipNone && content.Membership == notMembership {
+			continue
 		}
-		state, err := s.doMembershipChange(room, caller, userIdStateKey, membership)
+		members = append(members, state)
+	}
+	return members, nil
+}
+
+func (s roomService) JoinedMembers(room ct.RoomId, caller ct.UserId) (map[ct.UserId]types.UserProfile, types.Error) {
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return nil, err
+	}
+	if membership != types.MembershipMember {
+		return nil, types.ForbiddenError("cannot read joined members, not a member")
+	}
+	users, err := s.members.Users(room)
+	if err != nil {
+		return nil, err
+	}
+	joined := make(map[ct.UserId]types.UserProfile, len(users))
+	for _, user := range users {
+		state, err := s.rooms.RoomState(room, types.EventTypeMembership, user.String())
 		if err != nil {
 			return nil, err
 		}
-		return state, nil
+		var profile types.UserProfile
+		if state != nil {
+			if content, ok := state.Content.(*types.MembershipEventContent); ok && content.UserProfile != nil {
+				profile = *content.UserProfile
+			}
+		}
+		joined[user] = profile
+	}
+	return joined, nil
+}
+
+func (s roomService) JoinedRooms(caller ct.UserId) ([]ct.RoomId, types.Error) {
+	return s.members.Rooms(caller)
+}
+
+func (s roomService) InvitedRooms(caller ct.UserId) ([]ct.RoomId, types.Error) {
+	return s.invites.Rooms(caller)
+}
+
+func (s roomService) Visibility(room ct.RoomId) (types.Visibility, types.Error) {
+	return s.rooms.RoomVisibility(room)
+}
+
+func (s roomService) SetVisibility(room ct.RoomId, caller ct.UserId, visibility types.Visibility) types.Error {
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return err
 	}
-	if isUserIdStateKey && userIdStateKey != caller {
-		return nil, types.ForbiddenError("cannot set the state of another user")
+	if membership != types.MembershipMember {
+		return types.ForbiddenError("cannot change the visibility of a room without being a member")
 	}
+	// publishing a room makes it reachable the same way as its aliases do
+	aliases, err := s.aliases.Aliases(room)
+	if err != nil {
+		return err
+	}
+	if err := s.authorizeAliases(room, caller, aliases); err != nil {
+		return err
+	}
+	return s.rooms.SetRoomVisibility(room, visibility)
+}
 
-	existing, err := s.rooms.RoomState(room, eventType, stateKey)
+// Returns nil if the caller is allowed to read the current state of the room. Former members
+// may only read the state up until they left, in which case the index of the leave event is returned.
+func (s roomService) stateReadPosition(room ct.RoomId, caller ct.UserId) (*uint64, types.Error) {
+	membershipState, err := s.rooms.RoomState(room, types.EventTypeMembership, caller.String())
 	if err != nil {
 		return nil, err
 	}
-	if existing != nil {
-		err := s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.CreateState
-		})
-		if err != nil {
-			return nil, err
+	if membershipState == nil {
+		return nil, types.ForbiddenError("cannot read room state, not a member")
+	}
+	membership, ok := membershipState.Content.(*types.MembershipEventContent)
+	if !ok {
+		panic("invalid membership content, was " + reflect.TypeOf(membershipState.Content).String())
+	}
+	switch membership.Membership {
+	case types.MembershipMember:
+		return nil, nil
+	case types.MembershipLeaving, types.MembershipBanned:
+		index, exists := s.stateHistory.EventIndex(membershipState.EventId)
+		if !exists {
+			return nil, types.ServerError("membership event '" + membershipState.EventId.String() + "' is missing from the event stream")
 		}
+		return &index, nil
 	}
-	err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-		if eventLevel, ok := pl.Events[eventType]; ok {
-			return eventLevel
+	return nil, types.ForbiddenError("cannot read room state, not a member")
+}
+
+func (s roomService) SetState(
+	room ct.RoomId,
+	caller ct.UserId,
+	content ct.TypedContent,
+	stateKey string,
+) (*types.State, types.Error) {
+	event := &authrules.Event{
+		Sender:    caller,
+		EventType: content.GetEventType(),
+		StateKey:  &stateKey,
+		Content:   content,
+	}
+	if err := s.authorize(room, event); err != nil {
+		return nil, err
+	}
+
+	switch content := content.(type) {
+	case *types.CanonicalAliasEventContent:
+		if content.Alias != nil {
+			aliasRoom, err := s.aliases.Room(*content.Alias)
+			if err != nil {
+				return nil, err
+			}
+			if aliasRoom == nil || *aliasRoom != room {
+				return nil, types.BadParamError("room alias '" + content.Alias.String() + "' does not point to this room")
+			}
 		}
-		return pl.EventDefault
-	})
-	if err != nil {
+	case *types.MembershipEventContent:
+		user, _ := ct.ParseUserId(stateKey)
+		return s.doMembershipChange(room, caller, user, content)
+	}
+	return s.setState(room, caller, content, stateKey)
+}
+
+// like SetState, but for state that the service sets on behalf of the user, without the side effects
+func (s roomService) authorizedSetState(
+	room ct.RoomId,
+	caller ct.UserId,
+	content ct.TypedContent,
+	stateKey string,
+) (*types.State, types.Error) {
+	event := &authrules.Event{
+		Sender:    caller,
+		EventType: content.GetEventType(),
+		StateKey:  &stateKey,
+		Content:   content,
+	}
+	if err := s.authorize(room, event); err != nil {
 		return nil, err
 	}
 	return s.setState(room, caller, content, stateKey)
 }
 
+// sets the state without checking the auth rules, callers have to authorize the change themselves
+// or explain why it doesn't need to be
 func (s roomService) setState(
 	room ct.RoomId,
 	user ct.UserId,
@@ -323,6 +853,7 @@ func (s roomService) sendMessage(
 	return message, nil
 }
 
+// applies a membership change that has already been authorized
 func (s roomService) doMembershipChange(
 	room ct.RoomId,
 	caller ct.UserId,
@@ -334,154 +865,81 @@ func (s roomService) doMembershipChange(
 	if err != nil {
 		return nil, err
 	}
-	if currentMembership == membership.Membership {
-		return nil, types.ForbiddenError("membership change was a no-op")
-	}
 	membership.UserProfile = nil
-
-	switch membership.Membership {
-	case types.MembershipNone:
-		if currentMembership != types.MembershipBanned {
-			return nil, types.BadJsonError("invalid or missing membership in membership change")
-		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.Ban
-		})
-		if err != nil {
-			return nil, err
-		}
-		if user == caller {
-			return nil, types.ForbiddenError("cannot remove a ban from self")
-		}
-
-	case types.MembershipInvited:
-		if currentMembership != types.MembershipNone {
-			return nil, types.ForbiddenError("could not invite user to room, already have membership '" + currentMembership.String() + "'")
-		}
-		ok, err := s.allowsJoinRule(room, types.JoinRuleInvite)
-		if err != nil {
-			return nil, err
-		}
-		if !ok {
-			return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleInvite.String())
-		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.Invite
-		})
-		if err != nil {
-			return nil, err
-		}
-
-	case types.MembershipMember:
-		switch currentMembership {
-		case types.MembershipNone:
-			ok, err := s.allowsJoinRule(room, types.JoinRulePublic)
-			if err != nil {
-				return nil, err
-			}
-			if !ok {
-				return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleInvite.String())
-			}
-		case types.MembershipInvited:
-			if user != caller {
-				return nil, types.ForbiddenError("cannot force other users to join the room")
-			}
-		case types.MembershipKnocking:
-			if user == caller {
-				return nil, types.ForbiddenError("cannot let yourself in after knocking")
-			}
-			err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-				return pl.Invite
-			})
-			if err != nil {
-				return nil, err
-			}
-		case types.MembershipBanned:
-			if user == caller {
-				return nil, types.ForbiddenError("you are banned from that room")
-			} else {
-				return nil, types.ForbiddenError("that user is banned from this room")
-			}
-		}
+	if membership.Membership == types.MembershipMember {
 		profile, err := s.profileProvider.Profile(caller)
 		if err != nil {
 			return nil, err
 		}
 		membership.UserProfile = &profile
-
-	case types.MembershipKnocking:
-		if user != caller {
-			return nil, types.ForbiddenError("cannot force other users to knock")
-		}
-		if currentMembership != types.MembershipNone {
-			return nil, types.ForbiddenError("could not knock on room, already have membership '" + currentMembership.String() + "'")
-		}
-		ok, err := s.allowsJoinRule(room, types.JoinRuleKnock)
-		if err != nil {
+		if err := s.members.AddMember(room, user); err != nil {
 			return nil, err
 		}
-		if !ok {
-			return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleKnock.String())
-		}
-
-	case types.MembershipLeaving:
-		if currentMembership == types.MembershipNone {
-			return nil, types.ForbiddenError("tried to leave a room without current membership")
-		}
-		if currentMembership == types.MembershipBanned {
-			return nil, types.ForbiddenError("tried to leave room with current membership '" + types.MembershipBanned.String() + "'")
-		}
-		if user != caller {
-			err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-				return pl.Kick
-			})
-			if err != nil {
-				return nil, err
-			}
-		}
-
-	case types.MembershipBanned:
-		if user == caller {
-			return nil, types.ForbiddenError("cannot ban self")
-		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.Ban
-		})
-		if err != nil {
+	} else if currentMembership == types.MembershipMember {
+		if err := s.members.RemoveMember(room, user); err != nil {
 			return nil, err
 		}
 	}
-	if membership.Membership == types.MembershipMember {
-		if err := s.members.AddMember(room, user); err != nil {
+	if membership.Membership == types.MembershipInvited && currentMembership != types.MembershipInvited {
+		if err := s.invites.AddMember(room, user); err != nil {
 			return nil, err
 		}
-	} else if currentMembership == types.MembershipMember {
-		if err := s.members.RemoveMember(room, user); err != nil {
+	} else if membership.Membership != types.MembershipInvited && currentMembership == types.MembershipInvited {
+		if err := s.invites.RemoveMember(room, user); err != nil {
 			return nil, err
 		}
 	}
 	return s.setState(room, caller, membership, user.String())
 }
 
-func (s roomService) testPowerLevel(
-	room ct.RoomId,
-	user ct.UserId,
-	powerLevelFunc func(*types.PowerLevelsEventContent) int,
-) types.Error {
-	powerLevels, err := s.powerLevels(room)
+// collects the room state that is needed to authorize the event, and checks it against the auth rules
+func (s roomService) authorize(room ct.RoomId, event *authrules.Event) types.Error {
+	state := new(authrules.State)
+	create, err := s.rooms.RoomState(room, types.EventTypeCreate, "")
 	if err != nil {
 		return err
 	}
-	userPowerLevel, err := s.userPowerLevel(room, user)
+	if create != nil {
+		state.Create, _ = create.Content.(*types.CreateEventContent)
+	}
+	powerLevels, err := s.rooms.RoomState(room, types.EventTypePowerLevels, "")
 	if err != nil {
 		return err
 	}
-	requiredPowerLevel := powerLevelFunc(powerLevels)
-	if userPowerLevel < requiredPowerLevel {
-		msg := fmt.Sprintf("not enough power level to perform action (%d < %d)", userPowerLevel, requiredPowerLevel)
-		return types.ForbiddenError(msg)
+	if powerLevels != nil {
+		state.PowerLevels, _ = powerLevels.Content.(*types.PowerLevelsEventContent)
 	}
-	return nil
+	joinRules, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
+	if err != nil {
+		return err
+	}
+	if joinRules != nil {
+		state.JoinRules, _ = joinRules.Content.(*types.JoinRulesEventContent)
+	}
+	guestAccess, err := s.rooms.RoomState(room, types.EventTypeGuestAccess, "")
+	if err != nil {
+		return err
+	}
+	state.GuestAccess = guestAccessOf(guestAccess)
+	if state.SenderMembership, err = s.userMembership(room, event.Sender); err != nil {
+		return err
+	}
+	if event.StateKey != nil {
+		existing, err := s.rooms.RoomState(room, event.EventType, *event.StateKey)
+		if err != nil {
+			return err
+		}
+		state.StateExists = existing != nil
+		if target, parseErr := ct.ParseUserId(*event.StateKey); parseErr == nil && event.EventType == types.EventTypeMembership {
+			if state.TargetMembership, err = s.userMembership(room, target); err != nil {
+				return err
+			}
+			if state.TargetIsGuest, err = s.users.UserIsGuest(target); err != nil {
+				return err
+			}
+		}
+	}
+	return authrules.Check(event, state)
 }
 
 func (s roomService) userMembership(room ct.RoomId, user ct.UserId) (types.Membership, types.Error) {
@@ -499,24 +957,6 @@ func (s roomService) userMembership(room ct.RoomId, user ct.UserId) (types.Membe
 	return membership.Membership, nil
 }
 
-func (s roomService) allowsJoinRule(room ct.RoomId, joinRule types.JoinRule) (bool, types.Error) {
-	state, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
-	if err != nil {
-		return false, err
-	}
-	if state == nil {
-		panic("room power levels are invalid or missing: " + room.String())
-	}
-	joinRules, ok := state.Content.(*types.JoinRulesEventContent)
-	if !ok {
-		panic("invalid join rule content, was " + reflect.TypeOf(state.Content).String())
-	}
-	if joinRules.JoinRule != joinRule {
-		return false, types.ForbiddenError("room does not allow join rule: " + joinRule.String())
-	}
-	return true, nil
-}
-
 func (s roomService) powerLevels(room ct.RoomId) (*types.PowerLevelsEventContent, types.Error) {
 	state, err := s.rooms.RoomState(room, types.EventTypePowerLevels, "")
 	if err != nil {
@@ -532,17 +972,6 @@ func (s roomService) powerLevels(room ct.RoomId) (*types.PowerLevelsEventContent
 	return powerLevels, nil
 }
 
-func (s roomService) userPowerLevel(room ct.RoomId, user ct.UserId) (int, types.Error) {
-	powerLevels, err := s.powerLevels(room)
-	if err != nil {
-		return 0, err
-	}
-	if userLevel, ok := powerLevels.Users[user.String()]; ok {
-		return userLevel, nil
-	}
-	return powerLevels.UserDefault, nil
-}
-
 func (s roomService) eventPowerLevel(room ct.RoomId, eventType string) (int, types.Error) {
 	powerLevels, err := s.powerLevels(room)
 	if err != nil {
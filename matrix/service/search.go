@@ -0,0 +1,173 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func NewSearchService(
+	index interfaces.SearchIndex,
+	stateHistory interfaces.StateHistoryProvider,
+	membershipStore interfaces.MembershipStore,
+) (interfaces.SearchService, error) {
+	return searchService{
+		index,
+		stateHistory,
+		membershipStore,
+		historyVisibility{stateHistory},
+	}, nil
+}
+
+type searchService struct {
+	index           interfaces.SearchIndex
+	stateHistory    interfaces.StateHistoryProvider
+	membershipStore interfaces.MembershipStore
+	visibility      historyVisibility
+}
+
+var defaultSearchKeys = []string{
+	types.SearchKeyBody,
+	types.SearchKeyName,
+	types.SearchKeyTopic,
+}
+
+type searchHitsByRank []types.SearchHit
+
+func (l searchHitsByRank) Len() int      { return len(l) }
+func (l searchHitsByRank) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l searchHitsByRank) Less(i, j int) bool {
+	if l[i].Rank != l[j].Rank {
+		return l[i].Rank > l[j].Rank
+	}
+	return l[i].Index > l[j].Index
+}
+
+type searchHitsByRecency []types.SearchHit
+
+func (l searchHitsByRecency) Len() int           { return len(l) }
+func (l searchHitsByRecency) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l searchHitsByRecency) Less(i, j int) bool { return l[i].Index > l[j].Index }
+
+func (s searchService) Search(user ct.UserId, query *types.SearchQuery) (*types.SearchResults, types.Error) {
+	if strings.TrimSpace(query.SearchTerm) == "" {
+		return nil, types.BadJsonError("missing or empty 'search_term'")
+	}
+	offset := 0
+	if query.NextBatch != "" {
+		if _, err := fmt.Sscanf(query.NextBatch, "p%d", &offset); err != nil || offset < 0 {
+			return nil, types.BadParamError("invalid batch token: " + query.NextBatch)
+		}
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = 10
+	}
+
+	keys := map[string]struct{}{}
+	queryKeys := query.Keys
+	if len(queryKeys) == 0 {
+		queryKeys = defaultSearchKeys
+	}
+	for _, key := range queryKeys {
+		switch key {
+		case types.SearchKeyBody, types.SearchKeyName, types.SearchKeyTopic:
+			keys[key] = struct{}{}
+		default:
+			return nil, types.BadJsonError("unsupported search key: " + key)
+		}
+	}
+
+	rooms, err := s.membershipStore.Rooms(user)
+	if err != nil {
+		return nil, err
+	}
+	roomSet := map[ct.RoomId]struct{}{}
+	for _, room := range rooms {
+		roomSet[room] = struct{}{}
+	}
+	if query.Rooms != nil {
+		filtered := map[ct.RoomId]struct{}{}
+		for _, room := range query.Rooms {
+			if _, ok := roomSet[room]; ok {
+				filtered[room] = struct{}{}
+			}
+		}
+		roomSet = filtered
+	}
+
+	hits, err := s.index.Search(query.SearchTerm, keys, roomSet)
+	if err != nil {
+		return nil, err
+	}
+	switch query.OrderBy {
+	case types.SearchOrderRecent:
+		sort.Sort(searchHitsByRecency(hits))
+	case types.SearchOrderRank, "":
+		sort.Sort(searchHitsByRank(hits))
+	default:
+		return nil, types.BadJsonError("invalid 'order_by': " + string(query.OrderBy))
+	}
+
+	// hidden hits are dropped before paginating, so that the count and batches only cover visible events
+	visibleHits := make([]types.SearchHit, 0, len(hits))
+	events := map[ct.EventId]ct.Event{}
+	for _, hit := range hits {
+		indexed, err := s.stateHistory.IndexedEvent(hit.EventId)
+		if err != nil {
+			return nil, err
+		}
+		if indexed == nil {
+			continue
+		}
+		visible, err := s.visibility.visible(user, indexed)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			visibleHits = append(visibleHits, hit)
+			events[hit.EventId] = indexed.Event()
+		}
+	}
+	hits = visibleHits
+
+	result := &types.SearchResults{
+		Results:    []types.SearchResult{},
+		Count:      len(hits),
+		Highlights: []string{},
+	}
+	highlights := map[string]struct{}{}
+	i := offset
+	for ; i < len(hits) && uint(len(result.Results)) < limit; i++ {
+		hit := hits[i]
+		result.Results = append(result.Results, types.SearchResult{hit.Rank, events[hit.EventId]})
+		for _, highlight := range hit.Highlights {
+			if _, ok := highlights[highlight]; !ok {
+				highlights[highlight] = struct{}{}
+				result.Highlights = append(result.Highlights, highlight)
+			}
+		}
+	}
+	if i < len(hits) {
+		result.NextBatch = fmt.Sprintf("p%d", i)
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const sharedSecretNonceLifetime = time.Minute
+
+// The user store is used to make new users admins, as there is no admin to do it through the user service
+func CreateSharedSecretService(
+	secret string,
+	users interfaces.UserService,
+	userStore interfaces.UserStore,
+	profiles interfaces.ProfileService,
+) (interfaces.SharedSecretService, error) {
+	if secret == "" {
+		return nil, errors.New("missing registration shared secret")
+	}
+	return &sharedSecretService{
+		secret:    []byte(secret),
+		users:     users,
+		userStore: userStore,
+		profiles:  profiles,
+		nonces:    map[string]time.Time{},
+	}, nil
+}
+
+type sharedSecretService struct {
+	secret    []byte
+	users     interfaces.UserService
+	userStore interfaces.UserStore
+	profiles  interfaces.ProfileService
+
+	lock   sync.Mutex
+	nonces map[string]time.Time // expiry time by nonce
+}
+
+func (s *sharedSecretService) NewNonce() (string, types.Error) {
+	nonce := utils.RandomString(32)
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for existing, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, existing)
+		}
+	}
+	s.nonces[nonce] = now.Add(sharedSecretNonceLifetime)
+	return nonce, nil
+}
+
+// The mac is the same as the one used by Synapse, so that the same scripts can be used for both:
+// a hex encoded HMAC-SHA1 of the nonce, username, password and admin or notadmin, separated by null bytes.
+func (s *sharedSecretService) mac(nonce, username, password string, admin bool) []byte {
+	adminString := "notadmin"
+	if admin {
+		adminString = "admin"
+	}
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(strings.Join([]string{nonce, username, password, adminString}, "\x00")))
+	return mac.Sum(nil)
+}
+
+func (s *sharedSecretService) Register(
+	nonce string,
+	user ct.UserId,
+	password, displayName string,
+	admin bool,
+	mac string,
+) types.Error {
+	s.lock.Lock()
+	expires, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	s.lock.Unlock()
+	if !ok || time.Now().After(expires) {
+		return types.ForbiddenError("unrecognised nonce")
+	}
+	decoded, decodeErr := hex.DecodeString(mac)
+	if decodeErr != nil || !hmac.Equal(decoded, s.mac(nonce, user.Id, password, admin)) {
+		return types.ForbiddenError("invalid mac")
+	}
+	if err := s.users.CreateUser(user); err != nil {
+		return err
+	}
+	if err := s.users.SetPassword(user, user, password); err != nil {
+		return err
+	}
+	if admin {
+		if err := s.userStore.SetUserAdmin(user, true); err != nil {
+			return err
+		}
+	}
+	if displayName != "" {
+		if _, err := s.profiles.UpdateProfile(user, user, &displayName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
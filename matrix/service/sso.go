@@ -0,0 +1,181 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+// how long users have to authenticate with the identity provider
+const ssoSessionLifetime = 10 * time.Minute
+
+var invalidLocalpartChars = regexp.MustCompile(`[^a-z0-9._=/-]+`)
+
+// Users are identified by their subject at the identity provider, and an account is created the first
+// time that they log in, named after their preferred username or email address if possible. Accounts
+// are only created while registration is open, and never with a reserved username.
+func CreateSsoService(
+	provider interfaces.IdentityProvider,
+	externalIds interfaces.ExternalIdStore,
+	users interfaces.UserService,
+	profiles interfaces.ProfileService,
+	registration types.RegistrationConfig,
+) (interfaces.SsoService, error) {
+	return &ssoService{
+		provider:     provider,
+		externalIds:  externalIds,
+		users:        users,
+		profiles:     profiles,
+		registration: registration,
+		sessions:     map[string]*ssoSession{},
+	}, nil
+}
+
+type ssoService struct {
+	provider     interfaces.IdentityProvider
+	externalIds  interfaces.ExternalIdStore
+	users        interfaces.UserService
+	profiles     interfaces.ProfileService
+	registration types.RegistrationConfig
+
+	lock         sync.Mutex
+	sessions     map[string]*ssoSession // by state
+	provisioning sync.Mutex             // makes sure that a subject is only mapped to a single new user
+}
+
+type ssoSession struct {
+	nonce       string
+	redirectUrl string
+	callbackUrl string
+	expires     time.Time
+}
+
+func (s *ssoService) StartLogin(redirectUrl, callbackUrl string) (string, types.Error) {
+	state := utils.RandomString(24)
+	nonce := utils.RandomString(24)
+	authorizationUrl, err := s.provider.AuthorizationUrl(callbackUrl, state, nonce)
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for state, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, state)
+		}
+	}
+	s.sessions[state] = &ssoSession{nonce, redirectUrl, callbackUrl, now.Add(ssoSessionLifetime)}
+	return authorizationUrl, nil
+}
+
+func (s *ssoService) CompleteLogin(hostname, state, code string) (ct.UserId, string, types.Error) {
+	s.lock.Lock()
+	session := s.sessions[state]
+	delete(s.sessions, state)
+	s.lock.Unlock()
+	if session == nil || time.Now().After(session.expires) {
+		return ct.UserId{}, "", types.ForbiddenError("unknown or expired login session")
+	}
+	identity, err := s.provider.Identity(session.callbackUrl, code, session.nonce)
+	if err != nil {
+		return ct.UserId{}, "", err
+	}
+	if identity.Subject == "" {
+		return ct.UserId{}, "", types.ForbiddenError("the identity provider didn't identify the user")
+	}
+
+	s.provisioning.Lock()
+	defer s.provisioning.Unlock()
+	user, err := s.externalIds.ExternalIdUser(s.provider.Id(), identity.Subject)
+	if err != nil {
+		return ct.UserId{}, "", err
+	}
+	if user == nil {
+		newUser, err := s.provision(hostname, identity)
+		if err != nil {
+			return ct.UserId{}, "", err
+		}
+		return newUser, session.redirectUrl, nil
+	}
+	deactivated, err := s.users.IsDeactivated(*user)
+	if err != nil {
+		return ct.UserId{}, "", err
+	}
+	if deactivated {
+		return ct.UserId{}, "", types.DefaultUserDeactivatedError
+	}
+	return *user, session.redirectUrl, nil
+}
+
+// creates an account for a user that logs in for the first time, with a number appended to the
+// localpart if it's already taken
+func (s *ssoService) provision(hostname string, identity *types.ExternalIdentity) (ct.UserId, types.Error) {
+	if s.registration.Mode != types.RegistrationOpen {
+		return ct.UserId{}, types.ForbiddenError("Registration is disabled")
+	}
+	localpart := ssoLocalpart(identity)
+	var user ct.UserId
+	for i := 1; ; i++ {
+		candidate := localpart
+		if i > 1 {
+			candidate = localpart + strconv.Itoa(i)
+		}
+		if s.registration.Reserved(candidate) {
+			return ct.UserId{}, types.ExclusiveError("user id '" + candidate + "' is reserved")
+		}
+		user = ct.NewUserId(candidate, hostname)
+		err := s.users.CreateUser(user)
+		if err == nil {
+			break
+		}
+		if err.Code() != "M_USER_IN_USE" {
+			return ct.UserId{}, err
+		}
+	}
+	if err := s.externalIds.SetExternalIdUser(s.provider.Id(), identity.Subject, user); err != nil {
+		return ct.UserId{}, err
+	}
+	if identity.DisplayName != "" {
+		if _, err := s.profiles.UpdateProfile(user, user, &identity.DisplayName, nil); err != nil {
+			return ct.UserId{}, err
+		}
+	}
+	return user, nil
+}
+
+func ssoLocalpart(identity *types.ExternalIdentity) string {
+	name := identity.PreferredUsername
+	if name == "" && identity.Email != "" {
+		name = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	if name == "" {
+		name = identity.Subject
+	}
+	localpart := strings.Trim(invalidLocalpartChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if localpart == "" {
+		return "user"
+	}
+	return localpart
+}
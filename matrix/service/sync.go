@@ -24,15 +24,21 @@ func NewSyncService(
 	messageSource interfaces.IndexedEventSource,
 	presenceSource interfaces.IndexedEventSource,
 	typingSource interfaces.IndexedEventSource,
+	receiptSource interfaces.IndexedEventSource,
 	rooms interfaces.RoomStore,
 	membershipStore interfaces.MembershipStore,
+	receiptStore interfaces.ReceiptStore,
+	stateHistory interfaces.StateHistoryProvider,
 ) (interfaces.SyncService, error) {
 	return &syncService{
 		messageSource,
 		presenceSource,
 		typingSource,
+		receiptSource,
 		rooms,
 		membershipStore,
+		receiptStore,
+		historyVisibility{stateHistory},
 	}, nil
 }
 
@@ -40,8 +46,11 @@ type syncService struct {
 	messageSource   interfaces.IndexedEventSource
 	presenceSource  interfaces.IndexedEventSource
 	typingSource    interfaces.IndexedEventSource
+	receiptSource   interfaces.IndexedEventSource
 	rooms           interfaces.RoomStore
 	membershipStore interfaces.MembershipStore
+	receiptStore    interfaces.ReceiptStore
+	visibility      historyVisibility
 }
 
 func indexedToEvents(indexed []ct.IndexedEvent) []ct.Event {
@@ -56,6 +65,7 @@ func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, t
 	maxMessage := s.messageSource.Max()
 	maxPresence := s.presenceSource.Max()
 	maxTyping := s.typingSource.Max()
+	maxReceipt := s.receiptSource.Max()
 
 	userSet, err := s.membershipStore.Peers(user)
 	if err != nil {
@@ -72,7 +82,7 @@ func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, t
 	if err != nil {
 		return nil, err
 	}
-	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping)
+	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping, maxReceipt)
 
 	for i, room := range rooms {
 		if err := s.roomSummary(&summaries[i], user, room, end, limit); err != nil {
@@ -86,9 +96,13 @@ func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, t
 }
 
 func (s syncService) RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*types.RoomInitialSync, types.Error) {
+	if err := s.checkCanPeek(user, room); err != nil {
+		return nil, err
+	}
 	maxMessage := s.messageSource.Max()
 	maxPresence := s.presenceSource.Max()
 	maxTyping := s.typingSource.Max()
+	maxReceipt := s.receiptSource.Max()
 
 	userSet := map[ct.UserId]struct{}{}
 	users, err := s.membershipStore.Users(room)
@@ -109,7 +123,7 @@ func (s syncService) RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*type
 		Presence: presences,
 	}
 
-	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping)
+	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping, maxReceipt)
 	if err := s.roomSummary(&sync.RoomSummary, user, room, end, limit); err != nil {
 		return nil, err
 	}
@@ -134,8 +148,14 @@ func (s syncService) roomSummary(
 	if len(messages) > 0 {
 		startIndex = messages[0].Index()
 	}
-	start := types.NewStreamToken(startIndex, end.PresenceIndex, end.TypingIndex)
-	eventRange := types.NewEventStreamRange(indexedToEvents(messages), start, end)
+	start := types.NewStreamToken(startIndex, end.PresenceIndex, end.TypingIndex, end.ReceiptIndex)
+	messages, err = s.visibility.filter(user, messages)
+	if err != nil {
+		return err
+	}
+	events := indexedToEvents(messages)
+	markThreadParticipation(user, events...)
+	eventRange := types.NewEventStreamRange(events, start, end)
 	states, err := s.rooms.EntireRoomState(room)
 	if err != nil {
 		return err
@@ -144,7 +164,10 @@ func (s syncService) roomSummary(
 	if err != nil {
 		return err
 	}
-	membership := membershipState.Content.(*types.MembershipEventContent).Membership
+	membership := types.MembershipNone
+	if membershipState != nil {
+		membership = membershipState.Content.(*types.MembershipEventContent).Membership
+	}
 	joinRuleState, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
 	if err != nil {
 		return err
@@ -156,5 +179,31 @@ func (s syncService) roomSummary(
 	summary.Messages = eventRange
 	summary.State = states
 	summary.Visibility = visibility
+	receipts, err := s.receiptStore.Receipts(room)
+	if err != nil {
+		return err
+	}
+	if len(receipts) > 0 {
+		summary.Ephemeral = []ct.Event{types.NewReceiptEvent(room, receipts)}
+	}
+	return nil
+}
+
+// users that have never been in the room can only peek into it if it's world readable
+func (s syncService) checkCanPeek(user ct.UserId, room ct.RoomId) types.Error {
+	membershipState, err := s.rooms.RoomState(room, types.EventTypeMembership, user.String())
+	if err != nil {
+		return err
+	}
+	if membershipState != nil {
+		return nil
+	}
+	visibilityState, err := s.rooms.RoomState(room, types.EventTypeHistoryVisibility, "")
+	if err != nil {
+		return err
+	}
+	if historyVisibilityOf(visibilityState) != types.HistoryVisibilityWorldReadable {
+		return types.ForbiddenError("room '" + room.String() + "' is not world readable")
+	}
 	return nil
 }
@@ -0,0 +1,293 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/subtle"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const threepidSessionLifetime = time.Hour
+
+var clientSecretPattern = regexp.MustCompile(`^[0-9a-zA-Z.=_-]{1,255}$`)
+
+// The mailer may be nil, in which case email addresses can't be validated
+func CreateThreepidService(
+	threepids interfaces.ThreepidStore,
+	mailer interfaces.Mailer,
+) (interfaces.ThreepidService, error) {
+	return &threepidService{
+		threepids: threepids,
+		mailer:    mailer,
+		sessions:  map[string]*threepidSession{},
+	}, nil
+}
+
+type threepidService struct {
+	threepids interfaces.ThreepidStore
+	mailer    interfaces.Mailer
+
+	lock     sync.Mutex
+	sessions map[string]*threepidSession
+}
+
+type threepidSession struct {
+	clientSecret string
+	medium       string
+	address      string
+	token        string
+	sendAttempt  int
+	nextLink     string
+	validatedAt  time.Time // zero until the session has been validated
+	expires      time.Time
+}
+
+func (s *threepidService) EmailSupported() bool {
+	return s.mailer != nil
+}
+
+func (s *threepidService) RequestEmailToken(
+	clientSecret, address string,
+	sendAttempt int,
+	nextLink, submitUrl string,
+) (string, types.Error) {
+	if s.mailer == nil {
+		return "", types.ThreepidMediumNotSupportedError("this server can't send emails")
+	}
+	if !clientSecretPattern.MatchString(clientSecret) {
+		return "", types.BadJsonError("invalid client_secret")
+	}
+	address, err := normalizeEmail(address)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	now := time.Now()
+	for sid, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, sid)
+		}
+	}
+	var sid string
+	var session *threepidSession
+	for id, existing := range s.sessions {
+		if existing.clientSecret == clientSecret && existing.medium == types.ThreepidMediumEmail && existing.address == address {
+			sid, session = id, existing
+			break
+		}
+	}
+	if session != nil && sendAttempt <= session.sendAttempt {
+		s.lock.Unlock()
+		return sid, nil
+	}
+	if session == nil {
+		sid = utils.RandomString(24)
+		session = &threepidSession{
+			clientSecret: clientSecret,
+			medium:       types.ThreepidMediumEmail,
+			address:      address,
+			token:        utils.RandomString(32),
+			expires:      now.Add(threepidSessionLifetime),
+		}
+		s.sessions[sid] = session
+	}
+	session.sendAttempt = sendAttempt
+	session.nextLink = nextLink
+	token := session.token
+	s.lock.Unlock()
+
+	link := submitUrl + "?" + url.Values{
+		"sid":           {sid},
+		"client_secret": {clientSecret},
+		"token":         {token},
+	}.Encode()
+	body := "To validate your email address, follow this link:\n\n" + link +
+		"\n\nor enter the following code: " + token +
+		"\n\nIf you didn't make this request, you can ignore this email.\n"
+	if err := s.mailer.SendMail(address, "Validate your email address", body); err != nil {
+		return "", err
+	}
+	return sid, nil
+}
+
+func (s *threepidService) SubmitToken(sid, clientSecret, token string) (string, types.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, err := s.session(sid, clientSecret)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.token)) != 1 {
+		return "", types.ThreepidAuthFailedError("invalid token")
+	}
+	if session.validatedAt.IsZero() {
+		session.validatedAt = time.Now()
+	}
+	return session.nextLink, nil
+}
+
+func (s *threepidService) ValidatedThreepid(creds types.ThreepidCredentials) (*types.Threepid, types.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, err := s.session(creds.Sid, creds.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if session.validatedAt.IsZero() {
+		return nil, types.ThreepidAuthFailedError("'" + session.address + "' hasn't been validated yet")
+	}
+	return &types.Threepid{
+		Medium:      session.medium,
+		Address:     session.address,
+		ValidatedAt: session.validatedAt.UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+// expects the lock to be held
+func (s *threepidService) session(sid, clientSecret string) (*threepidSession, types.Error) {
+	session := s.sessions[sid]
+	if session == nil || time.Now().After(session.expires) ||
+		subtle.ConstantTimeCompare([]byte(clientSecret), []byte(session.clientSecret)) != 1 {
+		return nil, types.ThreepidAuthFailedError("unknown validation session")
+	}
+	return session, nil
+}
+
+func (s *threepidService) AddThreepid(user ct.UserId, creds types.ThreepidCredentials) types.Error {
+	threepid, err := s.ValidatedThreepid(creds)
+	if err != nil {
+		return err
+	}
+	threepid.AddedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	if err := s.threepids.AddThreepid(user, *threepid); err != nil {
+		return err
+	}
+	// the session has served its purpose, and shouldn't be used to bind the threepid to anyone else
+	return s.EndSession(creds)
+}
+
+func (s *threepidService) EndSession(creds types.ThreepidCredentials) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.session(creds.Sid, creds.ClientSecret); err != nil {
+		return err
+	}
+	delete(s.sessions, creds.Sid)
+	return nil
+}
+
+func (s *threepidService) RemoveThreepid(user ct.UserId, medium, address string) types.Error {
+	owner, err := s.threepids.ThreepidUser(medium, address)
+	if err != nil {
+		return err
+	}
+	if owner == nil || *owner != user {
+		return types.ThreepidNotFoundError("'" + address + "' isn't bound to your account")
+	}
+	return s.threepids.RemoveThreepid(user, medium, address)
+}
+
+func (s *threepidService) Threepids(user ct.UserId) ([]types.Threepid, types.Error) {
+	threepids, err := s.threepids.Threepids(user)
+	if err != nil {
+		return nil, err
+	}
+	if threepids == nil {
+		return []types.Threepid{}, nil
+	}
+	sort.Sort(threepidsByAddress(threepids))
+	return threepids, nil
+}
+
+func (s *threepidService) ThreepidUser(medium, address string) (*ct.UserId, types.Error) {
+	if medium == types.ThreepidMediumEmail {
+		normalized, err := normalizeEmail(address)
+		if err != nil {
+			return nil, err
+		}
+		address = normalized
+	}
+	return s.threepids.ThreepidUser(medium, address)
+}
+
+func normalizeEmail(address string) (string, types.Error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", types.BadJsonError("invalid email address: " + address)
+	}
+	return strings.ToLower(parsed.Address), nil
+}
+
+type threepidsByAddress []types.Threepid
+
+func (l threepidsByAddress) Len() int      { return len(l) }
+func (l threepidsByAddress) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l threepidsByAddress) Less(i, j int) bool {
+	if l[i].Medium != l[j].Medium {
+		return l[i].Medium < l[j].Medium
+	}
+	return l[i].Address < l[j].Address
+}
+
+type emailStage struct {
+	threepids interfaces.ThreepidService
+}
+
+// Authenticates the request with an email address that has been validated. If the request is made by a
+// logged in user, the address has to be bound to them.
+func NewEmailStage(threepids interfaces.ThreepidService) interfaces.AuthStage {
+	return emailStage{threepids}
+}
+
+func (emailStage) Type() string {
+	return types.AuthTypeEmail
+}
+
+func (emailStage) Params() interface{} {
+	return nil
+}
+
+func (s emailStage) Complete(user ct.UserId, auth *types.AuthData) types.Error {
+	if auth.ThreepidCreds == nil {
+		return types.BadJsonError("Missing threepid_creds")
+	}
+	threepid, err := s.threepids.ValidatedThreepid(*auth.ThreepidCreds)
+	if err != nil {
+		return err
+	}
+	if user == (ct.UserId{}) {
+		return nil
+	}
+	owner, err := s.threepids.ThreepidUser(threepid.Medium, threepid.Address)
+	if err != nil {
+		return err
+	}
+	if owner == nil || *owner != user {
+		return types.ThreepidNotFoundError("'" + threepid.Address + "' isn't bound to your account")
+	}
+	return nil
+}
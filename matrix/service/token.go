@@ -15,9 +15,14 @@
 package service
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
@@ -25,41 +30,279 @@ import (
 	"github.com/matrix-org/bullettime/utils"
 )
 
-func CreateTokenService() (interfaces.TokenService, error) {
-	return tokenService{}, nil
+// Refreshable access tokens are valid for the given lifetime, and their refresh tokens for the
+// refresh lifetime. Expired access tokens are kept for one more lifetime so that clients are told
+// to refresh them, until Sweep removes them. Expiry is checked against the given clock, which is
+// time.Now outside of tests.
+func CreateTokenService(
+	tokenStore interfaces.TokenStore,
+	lifetime time.Duration,
+	refreshLifetime time.Duration,
+	now func() time.Time,
+) (interfaces.TokenService, error) {
+	if lifetime <= 0 {
+		return nil, errors.New("access token lifetime must be positive")
+	}
+	if refreshLifetime < lifetime {
+		return nil, errors.New("refresh token lifetime must be at least the access token lifetime")
+	}
+	return &tokenService{
+		tokens:          tokenStore,
+		lifetime:        lifetime,
+		refreshLifetime: refreshLifetime,
+		now:             now,
+		expiring:        map[ct.UserId]time.Time{},
+		loginTokens:     map[string]loginToken{},
+	}, nil
 }
 
-type tokenService struct{}
+type tokenService struct {
+	tokens          interfaces.TokenStore
+	lifetime        time.Duration
+	refreshLifetime time.Duration
+	now             func() time.Time
+
+	lock        sync.Mutex
+	expiring    map[ct.UserId]time.Time // latest refresh token expiry of each user that has expiring tokens
+	loginTokens map[string]loginToken   // by hash
+}
+
+// login tokens are only used for passing a login from the browser to the client, so they're kept in memory
+type loginToken struct {
+	userId  ct.UserId
+	expires time.Time
+}
+
+const loginTokenLifetime = 2 * time.Minute
 
 type tokenInfo struct {
-	userId ct.UserId
+	token        string
+	userId       ct.UserId
+	deviceId     string
+	expires      time.Time
+	refreshToken string
 }
 
 func (t tokenInfo) String() string {
-	encodedUserId := base64.RawURLEncoding.EncodeToString([]byte(t.userId.String()))
-	return fmt.Sprintf("%s..%s", encodedUserId, utils.RandomString(16))
+	return t.token
 }
 
 func (t tokenInfo) UserId() ct.UserId {
 	return t.userId
 }
 
-func (t tokenService) NewAccessToken(userId ct.UserId) (interfaces.Token, types.Error) {
-	return tokenInfo{userId}, nil
+func (t tokenInfo) DeviceId() string {
+	return t.deviceId
+}
+
+func (t tokenInfo) Expires() time.Time {
+	return t.expires
 }
 
-func (t tokenService) ParseAccessToken(token string) (interfaces.Token, types.Error) {
+func (t tokenInfo) RefreshToken() string {
+	return t.refreshToken
+}
+
+// the user id is kept in the token so that it can be looked up among the tokens of the user,
+// but it's the random part that makes the token valid
+func formatToken(userId ct.UserId) string {
+	encodedUserId := base64.RawURLEncoding.EncodeToString([]byte(userId.String()))
+	return fmt.Sprintf("%s..%s", encodedUserId, utils.RandomString(32))
+}
+
+func tokenUserId(token string) (ct.UserId, bool) {
 	splits := strings.Split(token, "..")
 	if len(splits) != 2 {
-		return nil, types.DefaultUnknownTokenError
+		return ct.UserId{}, false
 	}
 	userIdStr, err := base64.RawURLEncoding.DecodeString(splits[0])
 	if err != nil {
-		return nil, types.DefaultUnknownTokenError
+		return ct.UserId{}, false
 	}
 	userId, err := ct.ParseUserId(string(userIdStr))
 	if err != nil {
+		return ct.UserId{}, false
+	}
+	return userId, true
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (t *tokenService) NewAccessToken(userId ct.UserId, deviceId string) (interfaces.Token, types.Error) {
+	token := formatToken(userId)
+	if err := t.tokens.AddToken(hashToken(token), types.TokenInfo{UserId: userId, DeviceId: deviceId}); err != nil {
+		return nil, err
+	}
+	return tokenInfo{token: token, userId: userId, deviceId: deviceId}, nil
+}
+
+func (t *tokenService) NewRefreshableAccessToken(userId ct.UserId, deviceId string) (interfaces.Token, types.Error) {
+	token := formatToken(userId)
+	refreshToken := formatToken(userId)
+	expires := t.now().Add(t.lifetime)
+	info := types.TokenInfo{userId, deviceId, expires, hashToken(refreshToken)}
+	if err := t.tokens.AddToken(hashToken(token), info); err != nil {
+		return nil, err
+	}
+	refreshExpires := t.now().Add(t.refreshLifetime)
+	refreshInfo := types.RefreshTokenInfo{userId, deviceId, hashToken(token), refreshExpires}
+	if err := t.tokens.AddRefreshToken(hashToken(refreshToken), refreshInfo); err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	if refreshExpires.After(t.expiring[userId]) {
+		t.expiring[userId] = refreshExpires
+	}
+	t.lock.Unlock()
+	return tokenInfo{token, userId, deviceId, expires, refreshToken}, nil
+}
+
+func (t *tokenService) ParseAccessToken(token string) (interfaces.Token, types.Error) {
+	userId, ok := tokenUserId(token)
+	if !ok {
+		return nil, types.DefaultUnknownTokenError
+	}
+	info, err := t.tokens.Token(userId, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
 		return nil, types.DefaultUnknownTokenError
 	}
-	return tokenInfo{userId}, nil
+	if info.Expired(t.now()) {
+		return nil, types.DefaultSoftLogoutError
+	}
+	return tokenInfo{token: token, userId: info.UserId, deviceId: info.DeviceId, expires: info.Expires}, nil
+}
+
+func (t *tokenService) Refresh(refreshToken string) (interfaces.Token, types.Error) {
+	userId, ok := tokenUserId(refreshToken)
+	if !ok {
+		return nil, types.UnknownTokenError("Unrecognised refresh token")
+	}
+	refreshHash := hashToken(refreshToken)
+	info, err := t.tokens.RefreshToken(userId, refreshHash)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, types.UnknownTokenError("Unrecognised refresh token")
+	}
+	if err := t.tokens.RemoveRefreshToken(userId, refreshHash); err != nil {
+		return nil, err
+	}
+	// the access token may already have been swept
+	if err := t.tokens.RemoveToken(userId, info.AccessTokenHash); err != nil {
+		return nil, err
+	}
+	if info.Expired(t.now()) {
+		return nil, types.UnknownTokenError("Refresh token has expired")
+	}
+	return t.NewRefreshableAccessToken(userId, info.DeviceId)
+}
+
+func (t *tokenService) RevokeAccessToken(token string) types.Error {
+	userId, ok := tokenUserId(token)
+	if !ok {
+		return types.DefaultUnknownTokenError
+	}
+	hash := hashToken(token)
+	info, err := t.tokens.Token(userId, hash)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.RefreshTokenHash != "" {
+		if err := t.tokens.RemoveRefreshToken(userId, info.RefreshTokenHash); err != nil {
+			return err
+		}
+	}
+	return t.tokens.RemoveToken(userId, hash)
+}
+
+func (t *tokenService) RevokeUserTokens(user ct.UserId) types.Error {
+	return t.tokens.RemoveUserTokens(user)
+}
+
+func (t *tokenService) RevokeDeviceTokens(user ct.UserId, deviceId string) types.Error {
+	return t.tokens.RemoveDeviceTokens(user, deviceId)
+}
+
+func (t *tokenService) NewLoginToken(userId ct.UserId) (string, types.Error) {
+	token := utils.RandomString(32)
+	now := t.now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for hash, info := range t.loginTokens {
+		if now.After(info.expires) {
+			delete(t.loginTokens, hash)
+		}
+	}
+	t.loginTokens[hashToken(token)] = loginToken{userId, now.Add(loginTokenLifetime)}
+	return token, nil
+}
+
+func (t *tokenService) ConsumeLoginToken(token string) (ct.UserId, types.Error) {
+	hash := hashToken(token)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	info, ok := t.loginTokens[hash]
+	if !ok || t.now().After(info.expires) {
+		return ct.UserId{}, types.ForbiddenError("invalid login token")
+	}
+	delete(t.loginTokens, hash)
+	return info.userId, nil
+}
+
+func (t *tokenService) Sweep() types.Error {
+	now := t.now()
+	t.lock.Lock()
+	users := make([]ct.UserId, 0, len(t.expiring))
+	for user := range t.expiring {
+		users = append(users, user)
+	}
+	t.lock.Unlock()
+	for _, user := range users {
+		if err := t.sweepUser(user, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tokenService) sweepUser(user ct.UserId, now time.Time) types.Error {
+	tokens, err := t.tokens.Tokens(user)
+	if err != nil {
+		return err
+	}
+	before := now.Add(-t.lifetime)
+	for hash, info := range tokens {
+		if info.Expired(before) {
+			if err := t.tokens.RemoveToken(user, hash); err != nil {
+				return err
+			}
+		}
+	}
+	refreshTokens, err := t.tokens.RefreshTokens(user)
+	if err != nil {
+		return err
+	}
+	for hash, info := range refreshTokens {
+		if info.Expired(now) {
+			if err := t.tokens.RemoveRefreshToken(user, hash); err != nil {
+				return err
+			}
+			if err := t.tokens.RemoveToken(user, info.AccessTokenHash); err != nil {
+				return err
+			}
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if latest, ok := t.expiring[user]; ok && !latest.After(now) {
+		delete(t.expiring, user)
+	}
+	return nil
 }
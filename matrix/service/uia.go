@@ -0,0 +1,311 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const uiaSessionLifetime = 15 * time.Minute
+
+func CreateUiaService(stages ...interfaces.AuthStage) (interfaces.UiaService, error) {
+	stageMap := map[string]interfaces.AuthStage{}
+	for _, stage := range stages {
+		if _, ok := stageMap[stage.Type()]; ok {
+			return nil, errors.New("duplicate auth stage: " + stage.Type())
+		}
+		stageMap[stage.Type()] = stage
+	}
+	return &uiaService{
+		stages:   stageMap,
+		sessions: map[string]*uiaSession{},
+	}, nil
+}
+
+type uiaService struct {
+	stages map[string]interfaces.AuthStage
+
+	lock     sync.Mutex
+	sessions map[string]*uiaSession
+}
+
+type uiaSession struct {
+	operation string
+	user      ct.UserId
+	completed []types.AuthData // in the order the stages were completed
+	expires   time.Time
+}
+
+func (s *uiaService) Authenticate(
+	operation string,
+	user ct.UserId,
+	flows []types.AuthFlow,
+	auth *types.AuthData,
+) (map[string]types.AuthData, types.Error) {
+	if auth == nil {
+		auth = &types.AuthData{}
+	}
+	sessionId, completed, err := s.session(operation, user, auth.Session)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Type == "" || hasStage(completed, auth.Type) {
+		// the stages may have been completed through CompleteStage
+		if flowCompleted(flows, stageTypes(completed)) {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			return s.finish(sessionId, completed), nil
+		}
+		return nil, s.authRequired(flows, sessionId, completed, nil)
+	}
+	stage := s.stages[auth.Type]
+	if stage == nil || !isNextStage(flows, stageTypes(completed), auth.Type) {
+		err := types.UnrecognizedError("stage '" + auth.Type + "' is not expected by any of the flows")
+		return nil, s.authRequired(flows, sessionId, completed, err)
+	}
+	if err := stage.Complete(user, auth); err != nil {
+		return nil, s.authRequired(flows, sessionId, completed, err)
+	}
+	result := *auth
+	result.Password = ""
+	completed = append(completed, result)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if flowCompleted(flows, stageTypes(completed)) {
+		return s.finish(sessionId, completed), nil
+	}
+	if session := s.sessions[sessionId]; session != nil {
+		session.completed = completed
+	}
+	return nil, s.authRequired(flows, sessionId, completed, nil)
+}
+
+// ends the session and returns the completed stages by type, expects the lock to be held
+func (s *uiaService) finish(sessionId string, completed []types.AuthData) map[string]types.AuthData {
+	delete(s.sessions, sessionId)
+	results := make(map[string]types.AuthData, len(completed))
+	for _, auth := range completed {
+		results[auth.Type] = auth
+	}
+	return results
+}
+
+func (s *uiaService) CompleteStage(sessionId string, user ct.UserId, stageType string) types.Error {
+	if s.stages[stageType] == nil {
+		return types.UnrecognizedError("unknown stage '" + stageType + "'")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := s.sessions[sessionId]
+	if session == nil || time.Now().After(session.expires) {
+		return types.UnkownError("unknown session: " + sessionId)
+	}
+	if session.user != user {
+		return types.ForbiddenError("session was started by a different user")
+	}
+	if !hasStage(session.completed, stageType) {
+		session.completed = append(session.completed, types.AuthData{Type: stageType, Session: sessionId})
+	}
+	return nil
+}
+
+// looks up the session, or starts a new one if no session id is given
+func (s *uiaService) session(operation string, user ct.UserId, sessionId string) (string, []types.AuthData, types.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	if sessionId == "" {
+		sessionId = utils.RandomString(24)
+		s.sessions[sessionId] = &uiaSession{
+			operation: operation,
+			user:      user,
+			expires:   now.Add(uiaSessionLifetime),
+		}
+		return sessionId, nil, nil
+	}
+	session := s.sessions[sessionId]
+	if session == nil {
+		return "", nil, types.UnkownError("unknown session: " + sessionId)
+	}
+	if session.operation != operation || session.user != user {
+		return "", nil, types.ForbiddenError("session was started for a different request")
+	}
+	completed := make([]types.AuthData, len(session.completed))
+	copy(completed, session.completed)
+	return sessionId, completed, nil
+}
+
+func hasStage(completed []types.AuthData, stageType string) bool {
+	for _, auth := range completed {
+		if auth.Type == stageType {
+			return true
+		}
+	}
+	return false
+}
+
+func stageTypes(completed []types.AuthData) []string {
+	stageTypes := make([]string, len(completed))
+	for i, auth := range completed {
+		stageTypes[i] = auth.Type
+	}
+	return stageTypes
+}
+
+func (s *uiaService) authRequired(
+	flows []types.AuthFlow,
+	sessionId string,
+	completed []types.AuthData,
+	err types.Error,
+) types.Error {
+	params := map[string]interface{}{}
+	for _, flow := range flows {
+		for _, stageType := range flow.Stages {
+			if stage := s.stages[stageType]; stage != nil {
+				if stageParams := stage.Params(); stageParams != nil {
+					params[stageType] = stageParams
+				}
+			}
+		}
+	}
+	authRequired := &types.AuthRequiredError{
+		Flows:     flows,
+		Params:    params,
+		Session:   sessionId,
+		Completed: stageTypes(completed),
+	}
+	if err != nil {
+		authRequired.ErrorCode = err.Code()
+		authRequired.ErrorMessage = err.Error()
+	}
+	return authRequired
+}
+
+// stages have to be completed in the order they are listed in a flow
+func isNextStage(flows []types.AuthFlow, completed []string, stageType string) bool {
+	for _, flow := range flows {
+		if len(flow.Stages) > len(completed) && hasPrefix(flow.Stages, completed) && flow.Stages[len(completed)] == stageType {
+			return true
+		}
+	}
+	return false
+}
+
+func flowCompleted(flows []types.AuthFlow, completed []string) bool {
+	for _, flow := range flows {
+		if len(flow.Stages) == len(completed) && hasPrefix(flow.Stages, completed) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(stages, prefix []string) bool {
+	for i, stage := range prefix {
+		if stages[i] != stage {
+			return false
+		}
+	}
+	return true
+}
+
+type dummyStage struct{}
+
+// A stage that always succeeds, used by flows that don't require any authentication
+func NewDummyStage() interfaces.AuthStage {
+	return dummyStage{}
+}
+
+func (dummyStage) Type() string {
+	return types.AuthTypeDummy
+}
+
+func (dummyStage) Params() interface{} {
+	return nil
+}
+
+func (dummyStage) Complete(user ct.UserId, auth *types.AuthData) types.Error {
+	return nil
+}
+
+type ssoStage struct{}
+
+// Re-authenticates the user through single sign-on, which is done on the fallback page, so the stage
+// can only be completed through CompleteStage
+func NewSsoStage() interfaces.AuthStage {
+	return ssoStage{}
+}
+
+func (ssoStage) Type() string {
+	return types.AuthTypeSso
+}
+
+func (ssoStage) Params() interface{} {
+	return nil
+}
+
+func (ssoStage) Complete(user ct.UserId, auth *types.AuthData) types.Error {
+	return types.ForbiddenError("single sign-on has to be completed through the fallback page")
+}
+
+type passwordStage struct {
+	users interfaces.UserService
+}
+
+// Re-authenticates the user that makes the request with their password
+func NewPasswordStage(users interfaces.UserService) interfaces.AuthStage {
+	return passwordStage{users}
+}
+
+func (passwordStage) Type() string {
+	return types.AuthTypePassword
+}
+
+func (passwordStage) Params() interface{} {
+	return nil
+}
+
+func (s passwordStage) Complete(user ct.UserId, auth *types.AuthData) types.Error {
+	if user == (ct.UserId{}) {
+		return types.ForbiddenError("password authentication requires a logged in user")
+	}
+	if name := auth.UserName(); name != "" && name != user.Id && name != user.String() {
+		return types.ForbiddenError("can only authenticate as the logged in user")
+	}
+	if auth.Password == "" {
+		return types.BadJsonError("Missing or invalid password")
+	}
+	verified, err := s.users.VerifyPassword(user, auth.Password)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return types.ForbiddenError("invalid credentials")
+	}
+	return nil
+}
@@ -15,22 +15,46 @@
 package service
 
 import (
+	"log"
+	"sort"
+	"time"
+
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func CreateUserService(
 	users interfaces.UserStore,
+	devices interfaces.DeviceStore,
+	tokens interfaces.TokenService,
+	threepids interfaces.ThreepidService,
+	rooms interfaces.RoomService,
+	profiles interfaces.ProfileService,
+	registration types.RegistrationConfig,
 ) (interfaces.UserService, error) {
 	return userService{
 		users,
+		devices,
+		tokens,
+		threepids,
+		rooms,
+		profiles,
+		registration,
 	}, nil
 }
 
 type userService struct {
-	users interfaces.UserStore
+	users     interfaces.UserStore
+	devices   interfaces.DeviceStore
+	tokens    interfaces.TokenService
+	threepids interfaces.ThreepidService
+	rooms     interfaces.RoomService
+	profiles  interfaces.ProfileService
+	// only guest registration is checked here, other users are created through CreateUser
+	registration types.RegistrationConfig
 }
 
 func (s userService) UserExists(user, caller ct.UserId) (bool, types.Error) {
@@ -72,3 +96,190 @@ func (s userService) SetPassword(user, caller ct.UserId, password string) types.
 	}
 	return nil
 }
+
+func (s userService) CreateGuest(hostname string) (ct.UserId, types.Error) {
+	if s.registration.Mode != types.RegistrationOpen {
+		return ct.UserId{}, types.ForbiddenError("Guest registration is disabled")
+	}
+	for {
+		localpart := utils.RandomString(16)
+		if s.registration.Reserved(localpart) {
+			continue
+		}
+		id := ct.NewUserId(localpart, hostname)
+		exists, err := s.users.CreateUser(id)
+		if err != nil {
+			return ct.UserId{}, err
+		}
+		if exists {
+			continue
+		}
+		if err := s.users.SetUserGuest(id); err != nil {
+			return ct.UserId{}, err
+		}
+		return id, nil
+	}
+}
+
+func (s userService) IsGuest(user ct.UserId) (bool, types.Error) {
+	return s.users.UserIsGuest(user)
+}
+
+func (s userService) IsAdmin(user ct.UserId) (bool, types.Error) {
+	return s.users.UserIsAdmin(user)
+}
+
+func (s userService) SetAdmin(user, caller ct.UserId, admin bool) types.Error {
+	if err := requireAdmin(s.users, caller); err != nil {
+		return err
+	}
+	exists, err := s.users.UserExists(user)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return types.NotFoundError("user '" + user.String() + "' doesn't exist")
+	}
+	return s.users.SetUserAdmin(user, admin)
+}
+
+// Fails unless the caller is a server admin, for services to check before operations that only admins can do
+func requireAdmin(users interfaces.UserStore, caller ct.UserId) types.Error {
+	admin, err := users.UserIsAdmin(caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return types.ForbiddenError("only server admins can do this")
+	}
+	return nil
+}
+
+func (s userService) Deactivate(user, caller ct.UserId) types.Error {
+	if user != caller {
+		if err := requireAdmin(s.users, caller); err != nil {
+			return err
+		}
+	}
+	if err := s.users.SetUserDeactivated(user); err != nil {
+		return err
+	}
+	devices, err := s.devices.Devices(user)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := s.devices.RemoveDevice(user, device.DeviceId); err != nil {
+			return err
+		}
+	}
+	if err := s.tokens.RevokeUserTokens(user); err != nil {
+		return err
+	}
+	// the account can't be used anymore, so failing to clean up after it is only logged
+	threepids, err := s.threepids.Threepids(user)
+	if err != nil {
+		log.Println("failed to get threepids of deactivated user " + user.String() + ": " + err.Error())
+	}
+	for _, threepid := range threepids {
+		if err := s.threepids.RemoveThreepid(user, threepid.Medium, threepid.Address); err != nil {
+			log.Println("failed to remove threepid of deactivated user " + user.String() + ": " + err.Error())
+		}
+	}
+	empty := ""
+	if _, err := s.profiles.UpdateProfile(user, user, &empty, &empty); err != nil {
+		log.Println("failed to clear profile of deactivated user " + user.String() + ": " + err.Error())
+	}
+	rooms, err := s.rooms.JoinedRooms(user)
+	if err != nil {
+		log.Println("failed to get rooms of deactivated user " + user.String() + ": " + err.Error())
+	}
+	// pending invites are rejected, so the user doesn't stay invited
+	invites, err := s.rooms.InvitedRooms(user)
+	if err != nil {
+		log.Println("failed to get invites of deactivated user " + user.String() + ": " + err.Error())
+	}
+	left := make([]ct.RoomId, 0, len(rooms)+len(invites))
+	left = append(append(left, rooms...), invites...)
+	for _, room := range left {
+		content := types.MembershipEventContent{}
+		content.Membership = types.MembershipLeaving
+		if _, err := s.rooms.SetState(room, user, &content, user.String()); err != nil {
+			log.Println("failed to leave " + room.String() + " with deactivated user " + user.String() + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (s userService) IsDeactivated(user ct.UserId) (bool, types.Error) {
+	return s.users.UserIsDeactivated(user)
+}
+
+type devicesById []types.Device
+
+func (d devicesById) Len() int           { return len(d) }
+func (d devicesById) Less(i, j int) bool { return d[i].DeviceId < d[j].DeviceId }
+func (d devicesById) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func (s userService) CreateDevice(user ct.UserId, deviceId string, displayName *string) types.Error {
+	device, err := s.devices.Device(user, deviceId)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		device = &types.Device{DeviceId: deviceId}
+	} else if displayName == nil {
+		return nil
+	}
+	if displayName != nil {
+		device.DisplayName = displayName
+	}
+	return s.devices.SetDevice(user, *device)
+}
+
+func (s userService) Devices(user ct.UserId) ([]types.Device, types.Error) {
+	devices, err := s.devices.Devices(user)
+	if err != nil {
+		return nil, err
+	}
+	if devices == nil {
+		return []types.Device{}, nil
+	}
+	sort.Sort(devicesById(devices))
+	return devices, nil
+}
+
+func (s userService) Device(user ct.UserId, deviceId string) (*types.Device, types.Error) {
+	device, err := s.devices.Device(user, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, types.NotFoundError("device '" + deviceId + "' doesn't exist")
+	}
+	return device, nil
+}
+
+func (s userService) SetDeviceDisplayName(user ct.UserId, deviceId string, displayName string) types.Error {
+	device, err := s.Device(user, deviceId)
+	if err != nil {
+		return err
+	}
+	device.DisplayName = &displayName
+	return s.devices.SetDevice(user, *device)
+}
+
+func (s userService) DeleteDevice(user ct.UserId, deviceId string) types.Error {
+	if _, err := s.Device(user, deviceId); err != nil {
+		return err
+	}
+	return s.devices.RemoveDevice(user, deviceId)
+}
+
+func (s userService) DeviceSeen(user ct.UserId, deviceId string, ip string) types.Error {
+	device, err := s.devices.Device(user, deviceId)
+	if err != nil || device == nil {
+		return err
+	}
+	return s.devices.SetDeviceLastSeen(user, deviceId, ip, time.Now().UnixNano()/int64(time.Millisecond))
+}
@@ -0,0 +1,136 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+// decides which events users are allowed to see, based on the history visibility
+// of the room and the membership of the user at the position of each event
+type historyVisibility struct {
+	stateHistory interfaces.StateHistoryProvider
+}
+
+func (h historyVisibility) filter(user ct.UserId, events []ct.IndexedEvent) ([]ct.IndexedEvent, types.Error) {
+	visible := make([]ct.IndexedEvent, 0, len(events))
+	for _, event := range events {
+		ok, err := h.visible(user, event)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+func (h historyVisibility) visible(user ct.UserId, indexed ct.IndexedEvent) (bool, types.Error) {
+	event := indexed.Event()
+	room := event.GetRoomId()
+	if room == nil {
+		return true, nil
+	}
+	if state, ok := event.(*types.State); ok && state.StateKey == user.String() {
+		return true, nil
+	}
+	visibility, err := h.visibilityAt(*room, indexed.Index())
+	if err != nil {
+		return false, err
+	}
+	if visibility == types.HistoryVisibilityWorldReadable {
+		return true, nil
+	}
+	membership, err := h.membershipAt(*room, user, indexed.Index())
+	if err != nil {
+		return false, err
+	}
+	switch visibility {
+	case types.HistoryVisibilityJoined:
+		return membership == types.MembershipMember, nil
+	case types.HistoryVisibilityInvited:
+		return membership == types.MembershipMember || membership == types.MembershipInvited, nil
+	}
+	if membership == types.MembershipMember {
+		return true, nil
+	}
+	current, err := h.membershipAt(*room, user, ^uint64(0))
+	if err != nil {
+		return false, err
+	}
+	return current == types.MembershipMember, nil
+}
+
+// returns the history visibility of the room directly after the event at the given index
+func (h historyVisibility) visibilityAt(room ct.RoomId, index uint64) (types.HistoryVisibility, types.Error) {
+	state, err := h.stateHistory.StateEventAt(room, index, types.EventTypeHistoryVisibility, "")
+	if err != nil {
+		return types.HistoryVisibilityNone, err
+	}
+	return historyVisibilityOf(state), nil
+}
+
+func historyVisibilityOf(state *types.State) types.HistoryVisibility {
+	visibility := types.HistoryVisibilityShared
+	if state == nil {
+		return visibility
+	}
+	switch content := state.Content.(type) {
+	case *types.HistoryVisibilityEventContent:
+		return content.HistoryVisibility
+	case *types.GenericContent:
+		decodeGenericField(content, "history_visibility", &visibility)
+	}
+	return visibility
+}
+
+func guestAccessOf(state *types.State) types.GuestAccess {
+	access := types.GuestAccessForbidden
+	if state == nil {
+		return access
+	}
+	switch content := state.Content.(type) {
+	case *types.GuestAccessEventContent:
+		return content.GuestAccess
+	case *types.GenericContent:
+		decodeGenericField(content, "guest_access", &access)
+	}
+	return access
+}
+
+// decodes a single field of generic content into value, leaving it untouched if the field is invalid
+func decodeGenericField(content *types.GenericContent, field string, value interface{}) {
+	bytes, err := json.Marshal(content.Content[field])
+	if err != nil {
+		return
+	}
+	json.Unmarshal(bytes, value)
+}
+
+func (h historyVisibility) membershipAt(room ct.RoomId, user ct.UserId, index uint64) (types.Membership, types.Error) {
+	state, err := h.stateHistory.StateEventAt(room, index, types.EventTypeMembership, user.String())
+	if err != nil || state == nil {
+		return types.MembershipNone, err
+	}
+	if content, ok := state.Content.(*types.MembershipEventContent); ok {
+		return content.Membership, nil
+	}
+	return types.MembershipNone, nil
+}
@@ -15,8 +15,6 @@
 package stores
 
 import (
-	"unsafe"
-
 	ci "github.com/matrix-org/bullettime/core/interfaces"
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
@@ -24,14 +22,15 @@ import (
 )
 
 type aliasStore struct {
-	idMap ci.IdMap
+	idMap      ci.IdMap
+	creatorMap ci.IdMap
 }
 
-func NewAliasStore(idMap ci.IdMap) (interfaces.AliasStore, error) {
-	return &aliasStore{idMap}, nil
+func NewAliasStore(idMap ci.IdMap, creatorMap ci.IdMap) (interfaces.AliasStore, error) {
+	return &aliasStore{idMap, creatorMap}, nil
 }
 
-func (s *aliasStore) AddAlias(alias ct.Alias, room ct.RoomId) types.Error {
+func (s *aliasStore) AddAlias(alias ct.Alias, room ct.RoomId, creator ct.UserId) types.Error {
 	inserted, err := s.idMap.Insert(ct.Id(alias), ct.Id(room))
 	if err != nil {
 		return types.InternalError(err)
@@ -39,6 +38,9 @@ func (s *aliasStore) AddAlias(alias ct.Alias, room ct.RoomId) types.Error {
 	if !inserted {
 		return types.RoomInUseError("room alias '" + alias.String() + "' already exists")
 	}
+	if err := s.creatorMap.Put(ct.Id(alias), ct.Id(creator)); err != nil {
+		return types.InternalError(err)
+	}
 	return nil
 }
 
@@ -50,9 +52,26 @@ func (s *aliasStore) RemoveAlias(alias ct.Alias, room ct.RoomId) types.Error {
 	if !deleted {
 		return types.NotFoundError("room alias '" + alias.String() + "' doesn't exist")
 	}
+	creator, err := s.creatorMap.Lookup(ct.Id(alias))
+	if err != nil {
+		return types.InternalError(err)
+	}
+	if creator != nil {
+		if _, err := s.creatorMap.Delete(ct.Id(alias), *creator); err != nil {
+			return types.InternalError(err)
+		}
+	}
 	return nil
 }
 
+func (s *aliasStore) Creator(alias ct.Alias) (*ct.UserId, types.Error) {
+	creator, err := s.creatorMap.Lookup(ct.Id(alias))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	return (*ct.UserId)(creator), nil
+}
+
 func (s *aliasStore) Room(alias ct.Alias) (*ct.RoomId, types.Error) {
 	room, err := s.idMap.Lookup(ct.Id(alias))
 	if err != nil {
@@ -66,6 +85,9 @@ func (s *aliasStore) Aliases(room ct.RoomId) ([]ct.Alias, types.Error) {
 	if err != nil {
 		return nil, types.InternalError(err)
 	}
-	aliases := *(*[]ct.Alias)(unsafe.Pointer(&ids))
+	aliases := make([]ct.Alias, len(ids))
+	for i, id := range ids {
+		aliases[i] = ct.Alias(id)
+	}
 	return aliases, nil
 }
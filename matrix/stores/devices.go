@@ -0,0 +1,139 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	"encoding/json"
+	"strings"
+
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type deviceStore struct {
+	ci.StateStore
+}
+
+type storedDevice struct {
+	DisplayName *string `json:"display_name,omitempty"`
+}
+
+type storedLastSeen struct {
+	Ip        string `json:"ip"`
+	Timestamp int64  `json:"ts"`
+}
+
+// last seen is kept separately so that tracking it doesn't race with updates to the device
+const deviceKeyPrefix = "device\x00"
+const lastSeenKeyPrefix = "seen\x00"
+
+func NewDeviceStore(stateStore ci.StateStore) (interfaces.DeviceStore, error) {
+	return &deviceStore{stateStore}, nil
+}
+
+func (db *deviceStore) SetDevice(user ct.UserId, device types.Device) types.Error {
+	return db.put(user, deviceKeyPrefix+device.DeviceId, storedDevice{device.DisplayName})
+}
+
+func (db *deviceStore) SetDeviceLastSeen(user ct.UserId, deviceId string, ip string, timestamp int64) types.Error {
+	return db.put(user, lastSeenKeyPrefix+deviceId, storedLastSeen{ip, timestamp})
+}
+
+func (db *deviceStore) Device(user ct.UserId, deviceId string) (*types.Device, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return nil, types.InternalError(err)
+	}
+	value, err := db.State(ct.Id(user), deviceKeyPrefix+deviceId)
+	if err != nil || value == nil {
+		return nil, types.InternalError(err)
+	}
+	lastSeen, err := db.State(ct.Id(user), lastSeenKeyPrefix+deviceId)
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	return decodeDevice(deviceId, value, lastSeen)
+}
+
+func (db *deviceStore) Devices(user ct.UserId) ([]types.Device, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return nil, types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	values := map[string][]byte{}
+	for _, state := range states {
+		values[state.Key()] = state.Value()
+	}
+	devices := []types.Device{}
+	for key, value := range values {
+		if !strings.HasPrefix(key, deviceKeyPrefix) {
+			continue
+		}
+		deviceId := strings.TrimPrefix(key, deviceKeyPrefix)
+		device, err := decodeDevice(deviceId, value, values[lastSeenKeyPrefix+deviceId])
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *device)
+	}
+	return devices, nil
+}
+
+func (db *deviceStore) RemoveDevice(user ct.UserId, deviceId string) types.Error {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return types.InternalError(err)
+	}
+	if _, err := db.SetState(ct.Id(user), deviceKeyPrefix+deviceId, nil); err != nil {
+		return types.InternalError(err)
+	}
+	_, err = db.SetState(ct.Id(user), lastSeenKeyPrefix+deviceId, nil)
+	return types.InternalError(err)
+}
+
+func (db *deviceStore) put(user ct.UserId, key string, value interface{}) types.Error {
+	if _, err := db.CreateBucket(ct.Id(user)); err != nil {
+		return types.InternalError(err)
+	}
+	bytes, jsonErr := json.Marshal(value)
+	if jsonErr != nil {
+		return types.ServerError(jsonErr.Error())
+	}
+	_, err := db.SetState(ct.Id(user), key, bytes)
+	return types.InternalError(err)
+}
+
+func decodeDevice(deviceId string, value, lastSeenValue []byte) (*types.Device, types.Error) {
+	var stored storedDevice
+	if jsonErr := json.Unmarshal(value, &stored); jsonErr != nil {
+		return nil, types.ServerError(jsonErr.Error())
+	}
+	device := &types.Device{DeviceId: deviceId, DisplayName: stored.DisplayName}
+	if lastSeenValue != nil {
+		var lastSeen storedLastSeen
+		if jsonErr := json.Unmarshal(lastSeenValue, &lastSeen); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		device.LastSeenIp = lastSeen.Ip
+		device.LastSeenTs = lastSeen.Timestamp
+	}
+	return device, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type externalIdStore struct {
+	ci.StateStore
+}
+
+// maps the subjects of identity providers to users, the id has no domain so it can't collide with any user
+var externalIdIndex = ct.Id{Prefix: 'x', Id: "index"}
+
+func NewExternalIdStore(stateStore ci.StateStore) (interfaces.ExternalIdStore, error) {
+	if _, err := stateStore.CreateBucket(externalIdIndex); err != nil {
+		return nil, err
+	}
+	return externalIdStore{stateStore}, nil
+}
+
+func externalIdKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (db externalIdStore) SetExternalIdUser(provider, subject string, user ct.UserId) types.Error {
+	_, err := db.SetState(externalIdIndex, externalIdKey(provider, subject), []byte(user.String()))
+	return types.InternalError(err)
+}
+
+func (db externalIdStore) ExternalIdUser(provider, subject string) (*ct.UserId, types.Error) {
+	value, err := db.State(externalIdIndex, externalIdKey(provider, subject))
+	if err != nil || value == nil {
+		return nil, types.InternalError(err)
+	}
+	user, parseErr := ct.ParseUserId(string(value))
+	if parseErr != nil {
+		return nil, types.ServerError(parseErr.Error())
+	}
+	return &user, nil
+}
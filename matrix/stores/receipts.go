@@ -0,0 +1,95 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type receiptStore struct {
+	ci.StateStore
+}
+
+type storedReceipt struct {
+	EventId   ct.EventId `json:"event_id"`
+	Timestamp int64      `json:"ts"`
+}
+
+func NewReceiptStore(stateStore ci.StateStore) (interfaces.ReceiptStore, error) {
+	return &receiptStore{stateStore}, nil
+}
+
+func receiptKey(receipt types.Receipt) string {
+	return strings.Join([]string{receipt.ReceiptType, receipt.ThreadId, receipt.UserId.String()}, "\x00")
+}
+
+func (db *receiptStore) SetReceipt(room ct.RoomId, receipt types.Receipt) types.Error {
+	if _, err := db.CreateBucket(ct.Id(room)); err != nil {
+		return types.InternalError(err)
+	}
+	value, jsonErr := json.Marshal(storedReceipt{
+		receipt.EventId,
+		receipt.Timestamp.UnixNano() / int64(time.Millisecond),
+	})
+	if jsonErr != nil {
+		return types.ServerError(jsonErr.Error())
+	}
+	_, err := db.SetState(ct.Id(room), receiptKey(receipt), value)
+	return types.InternalError(err)
+}
+
+func (db *receiptStore) Receipts(room ct.RoomId) ([]types.Receipt, types.Error) {
+	exists, err := db.BucketExists(ct.Id(room))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	states, err := db.States(ct.Id(room))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	receipts := make([]types.Receipt, 0, len(states))
+	for _, state := range states {
+		parts := strings.Split(state.Key(), "\x00")
+		if len(parts) != 3 {
+			return nil, types.ServerError("invalid receipt key: " + state.Key())
+		}
+		user, parseErr := ct.ParseUserId(parts[2])
+		if parseErr != nil {
+			return nil, types.ServerError(parseErr.Error())
+		}
+		var stored storedReceipt
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		receipts = append(receipts, types.Receipt{
+			EventId:     stored.EventId,
+			UserId:      user,
+			ReceiptType: parts[0],
+			ThreadId:    parts[1],
+			Timestamp:   ct.Timestamp{time.Unix(0, stored.Timestamp*int64(time.Millisecond))},
+		})
+	}
+	return receipts, nil
+}
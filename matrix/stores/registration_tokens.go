@@ -0,0 +1,80 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	"encoding/json"
+
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type registrationTokenStore struct {
+	ci.StateStore
+}
+
+// the id has no domain so it can't collide with any user
+var registrationTokenBucket = ct.Id{Prefix: 'r', Id: "registration_tokens"}
+
+func NewRegistrationTokenStore(stateStore ci.StateStore) (interfaces.RegistrationTokenStore, error) {
+	if _, err := stateStore.CreateBucket(registrationTokenBucket); err != nil {
+		return nil, err
+	}
+	return registrationTokenStore{stateStore}, nil
+}
+
+func (db registrationTokenStore) SetRegistrationToken(token types.RegistrationToken) types.Error {
+	bytes, jsonErr := json.Marshal(token)
+	if jsonErr != nil {
+		return types.ServerError(jsonErr.Error())
+	}
+	_, err := db.SetState(registrationTokenBucket, token.Token, bytes)
+	return types.InternalError(err)
+}
+
+func (db registrationTokenStore) RegistrationToken(token string) (*types.RegistrationToken, types.Error) {
+	bytes, err := db.State(registrationTokenBucket, token)
+	if err != nil || bytes == nil {
+		return nil, types.InternalError(err)
+	}
+	var stored types.RegistrationToken
+	if jsonErr := json.Unmarshal(bytes, &stored); jsonErr != nil {
+		return nil, types.ServerError(jsonErr.Error())
+	}
+	return &stored, nil
+}
+
+func (db registrationTokenStore) RegistrationTokens() ([]types.RegistrationToken, types.Error) {
+	states, err := db.States(registrationTokenBucket)
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	tokens := make([]types.RegistrationToken, 0, len(states))
+	for _, state := range states {
+		var stored types.RegistrationToken
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		tokens = append(tokens, stored)
+	}
+	return tokens, nil
+}
+
+func (db registrationTokenStore) RemoveRegistrationToken(token string) types.Error {
+	_, err := db.SetState(registrationTokenBucket, token, nil)
+	return types.InternalError(err)
+}
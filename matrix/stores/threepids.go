@@ -0,0 +1,137 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type threepidStore struct {
+	ci.StateStore
+	lock sync.Mutex // makes checking that a threepid isn't in use and binding it atomic
+}
+
+type storedThreepid struct {
+	ValidatedAt int64 `json:"validated_at"`
+	AddedAt     int64 `json:"added_at"`
+}
+
+const threepidKeyPrefix = "3pid\x00"
+
+// maps threepids to the users that they're bound to, the id has no domain so it can't collide with any user
+var threepidIndex = ct.Id{Prefix: '3', Id: "index"}
+
+func NewThreepidStore(stateStore ci.StateStore) (interfaces.ThreepidStore, error) {
+	if _, err := stateStore.CreateBucket(threepidIndex); err != nil {
+		return nil, err
+	}
+	return &threepidStore{StateStore: stateStore}, nil
+}
+
+func threepidKey(medium, address string) string {
+	return medium + "\x00" + address
+}
+
+func (db *threepidStore) AddThreepid(user ct.UserId, threepid types.Threepid) types.Error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	key := threepidKey(threepid.Medium, threepid.Address)
+	owner, err := db.State(threepidIndex, key)
+	if err != nil {
+		return types.InternalError(err)
+	}
+	if owner != nil && string(owner) != user.String() {
+		return types.ThreepidInUseError("'" + threepid.Address + "' is already in use")
+	}
+	if _, err := db.CreateBucket(ct.Id(user)); err != nil {
+		return types.InternalError(err)
+	}
+	bytes, jsonErr := json.Marshal(storedThreepid{threepid.ValidatedAt, threepid.AddedAt})
+	if jsonErr != nil {
+		return types.ServerError(jsonErr.Error())
+	}
+	if _, err := db.SetState(ct.Id(user), threepidKeyPrefix+key, bytes); err != nil {
+		return types.InternalError(err)
+	}
+	_, err = db.SetState(threepidIndex, key, []byte(user.String()))
+	return types.InternalError(err)
+}
+
+func (db *threepidStore) RemoveThreepid(user ct.UserId, medium, address string) types.Error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return types.InternalError(err)
+	}
+	key := threepidKey(medium, address)
+	if _, err := db.SetState(ct.Id(user), threepidKeyPrefix+key, nil); err != nil {
+		return types.InternalError(err)
+	}
+	owner, err := db.State(threepidIndex, key)
+	if err != nil {
+		return types.InternalError(err)
+	}
+	if string(owner) == user.String() {
+		_, err = db.SetState(threepidIndex, key, nil)
+	}
+	return types.InternalError(err)
+}
+
+func (db *threepidStore) Threepids(user ct.UserId) ([]types.Threepid, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return nil, types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	threepids := []types.Threepid{}
+	for _, state := range states {
+		if !strings.HasPrefix(state.Key(), threepidKeyPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(state.Key(), threepidKeyPrefix), "\x00", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var stored storedThreepid
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		threepids = append(threepids, types.Threepid{parts[0], parts[1], stored.ValidatedAt, stored.AddedAt})
+	}
+	return threepids, nil
+}
+
+func (db *threepidStore) ThreepidUser(medium, address string) (*ct.UserId, types.Error) {
+	owner, err := db.State(threepidIndex, threepidKey(medium, address))
+	if err != nil || owner == nil {
+		return nil, types.InternalError(err)
+	}
+	user, parseErr := ct.ParseUserId(string(owner))
+	if parseErr != nil {
+		return nil, types.ServerError(parseErr.Error())
+	}
+	return &user, nil
+}
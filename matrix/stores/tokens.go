@@ -0,0 +1,235 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stores
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type tokenStore struct {
+	ci.StateStore
+}
+
+type storedToken struct {
+	DeviceId         string `json:"device_id"`
+	Expires          int64  `json:"expires,omitempty"`
+	RefreshTokenHash string `json:"refresh_token_hash,omitempty"`
+}
+
+type storedRefreshToken struct {
+	DeviceId        string `json:"device_id"`
+	AccessTokenHash string `json:"access_token_hash"`
+	Expires         int64  `json:"expires"`
+}
+
+const tokenKeyPrefix = "token\x00"
+const refreshTokenKeyPrefix = "refresh\x00"
+
+func NewTokenStore(stateStore ci.StateStore) (interfaces.TokenStore, error) {
+	return &tokenStore{stateStore}, nil
+}
+
+func (db *tokenStore) AddToken(hash string, info types.TokenInfo) types.Error {
+	stored := storedToken{DeviceId: info.DeviceId, RefreshTokenHash: info.RefreshTokenHash}
+	if !info.Expires.IsZero() {
+		stored.Expires = info.Expires.UnixNano() / int64(time.Millisecond)
+	}
+	return db.put(info.UserId, tokenKeyPrefix+hash, stored)
+}
+
+func (db *tokenStore) Token(user ct.UserId, hash string) (*types.TokenInfo, types.Error) {
+	var stored storedToken
+	found, err := db.get(user, tokenKeyPrefix+hash, &stored)
+	if err != nil || !found {
+		return nil, err
+	}
+	info := tokenInfo(user, stored)
+	return &info, nil
+}
+
+func (db *tokenStore) RemoveToken(user ct.UserId, hash string) types.Error {
+	return db.remove(user, tokenKeyPrefix+hash)
+}
+
+func (db *tokenStore) Tokens(user ct.UserId) (map[string]types.TokenInfo, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return nil, types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	tokens := map[string]types.TokenInfo{}
+	for _, state := range states {
+		if !strings.HasPrefix(state.Key(), tokenKeyPrefix) {
+			continue
+		}
+		var stored storedToken
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		tokens[strings.TrimPrefix(state.Key(), tokenKeyPrefix)] = tokenInfo(user, stored)
+	}
+	return tokens, nil
+}
+
+func (db *tokenStore) AddRefreshToken(hash string, info types.RefreshTokenInfo) types.Error {
+	return db.put(info.UserId, refreshTokenKeyPrefix+hash, storedRefreshToken{
+		info.DeviceId,
+		info.AccessTokenHash,
+		info.Expires.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (db *tokenStore) RefreshToken(user ct.UserId, hash string) (*types.RefreshTokenInfo, types.Error) {
+	var stored storedRefreshToken
+	found, err := db.get(user, refreshTokenKeyPrefix+hash, &stored)
+	if err != nil || !found {
+		return nil, err
+	}
+	info := refreshTokenInfo(user, stored)
+	return &info, nil
+}
+
+func (db *tokenStore) RefreshTokens(user ct.UserId) (map[string]types.RefreshTokenInfo, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return nil, types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	tokens := map[string]types.RefreshTokenInfo{}
+	for _, state := range states {
+		if !strings.HasPrefix(state.Key(), refreshTokenKeyPrefix) {
+			continue
+		}
+		var stored storedRefreshToken
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return nil, types.ServerError(jsonErr.Error())
+		}
+		tokens[strings.TrimPrefix(state.Key(), refreshTokenKeyPrefix)] = refreshTokenInfo(user, stored)
+	}
+	return tokens, nil
+}
+
+func (db *tokenStore) RemoveRefreshToken(user ct.UserId, hash string) types.Error {
+	return db.remove(user, refreshTokenKeyPrefix+hash)
+}
+
+func (db *tokenStore) RemoveUserTokens(user ct.UserId) types.Error {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return types.InternalError(err)
+	}
+	for _, state := range states {
+		if _, err := db.SetState(ct.Id(user), state.Key(), nil); err != nil {
+			return types.InternalError(err)
+		}
+	}
+	return nil
+}
+
+func (db *tokenStore) RemoveDeviceTokens(user ct.UserId, deviceId string) types.Error {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return types.InternalError(err)
+	}
+	states, err := db.States(ct.Id(user))
+	if err != nil {
+		return types.InternalError(err)
+	}
+	for _, state := range states {
+		var stored struct {
+			DeviceId string `json:"device_id"`
+		}
+		if jsonErr := json.Unmarshal(state.Value(), &stored); jsonErr != nil {
+			return types.ServerError(jsonErr.Error())
+		}
+		if stored.DeviceId != deviceId {
+			continue
+		}
+		if _, err := db.SetState(ct.Id(user), state.Key(), nil); err != nil {
+			return types.InternalError(err)
+		}
+	}
+	return nil
+}
+
+func tokenInfo(user ct.UserId, stored storedToken) types.TokenInfo {
+	info := types.TokenInfo{UserId: user, DeviceId: stored.DeviceId, RefreshTokenHash: stored.RefreshTokenHash}
+	if stored.Expires != 0 {
+		info.Expires = time.Unix(0, stored.Expires*int64(time.Millisecond))
+	}
+	return info
+}
+
+func refreshTokenInfo(user ct.UserId, stored storedRefreshToken) types.RefreshTokenInfo {
+	return types.RefreshTokenInfo{
+		UserId:          user,
+		DeviceId:        stored.DeviceId,
+		AccessTokenHash: stored.AccessTokenHash,
+		Expires:         time.Unix(0, stored.Expires*int64(time.Millisecond)),
+	}
+}
+
+func (db *tokenStore) put(user ct.UserId, key string, value interface{}) types.Error {
+	if _, err := db.CreateBucket(ct.Id(user)); err != nil {
+		return types.InternalError(err)
+	}
+	bytes, jsonErr := json.Marshal(value)
+	if jsonErr != nil {
+		return types.ServerError(jsonErr.Error())
+	}
+	_, err := db.SetState(ct.Id(user), key, bytes)
+	return types.InternalError(err)
+}
+
+func (db *tokenStore) get(user ct.UserId, key string, value interface{}) (bool, types.Error) {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return false, types.InternalError(err)
+	}
+	bytes, err := db.State(ct.Id(user), key)
+	if err != nil || bytes == nil {
+		return false, types.InternalError(err)
+	}
+	if jsonErr := json.Unmarshal(bytes, value); jsonErr != nil {
+		return false, types.ServerError(jsonErr.Error())
+	}
+	return true, nil
+}
+
+func (db *tokenStore) remove(user ct.UserId, key string) types.Error {
+	exists, err := db.BucketExists(ct.Id(user))
+	if err != nil || !exists {
+		return types.InternalError(err)
+	}
+	_, err = db.SetState(ct.Id(user), key, nil)
+	return types.InternalError(err)
+}
@@ -26,6 +26,9 @@ type userDb struct {
 }
 
 const passwordHashKey = "pw_hash"
+const guestKey = "guest"
+const adminKey = "admin"
+const deactivatedKey = "deactivated"
 
 func NewUserDb(stateStore ci.StateStore) (interfaces.UserStore, error) {
 	return &userDb{stateStore}, nil
@@ -53,3 +56,58 @@ func (db *userDb) UserPasswordHash(id ct.UserId) (string, types.Error) {
 	}
 	return string(value), nil
 }
+
+func (db *userDb) SetUserGuest(id ct.UserId) types.Error {
+	_, err := db.SetState(ct.Id(id), guestKey, []byte("true"))
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserIsGuest(id ct.UserId) (bool, types.Error) {
+	exists, err := db.BucketExists(ct.Id(id))
+	if err != nil || !exists {
+		return false, types.InternalError(err)
+	}
+	value, err := db.State(ct.Id(id), guestKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return string(value) == "true", nil
+}
+
+func (db *userDb) SetUserAdmin(id ct.UserId, admin bool) types.Error {
+	var value []byte
+	if admin {
+		value = []byte("true")
+	}
+	_, err := db.SetState(ct.Id(id), adminKey, value)
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserIsAdmin(id ct.UserId) (bool, types.Error) {
+	exists, err := db.BucketExists(ct.Id(id))
+	if err != nil || !exists {
+		return false, types.InternalError(err)
+	}
+	value, err := db.State(ct.Id(id), adminKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return string(value) == "true", nil
+}
+
+func (db *userDb) SetUserDeactivated(id ct.UserId) types.Error {
+	_, err := db.SetState(ct.Id(id), deactivatedKey, []byte("true"))
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserIsDeactivated(id ct.UserId) (bool, types.Error) {
+	exists, err := db.BucketExists(ct.Id(id))
+	if err != nil || !exists {
+		return false, types.InternalError(err)
+	}
+	value, err := db.State(ct.Id(id), deactivatedKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return string(value) == "true", nil
+}
@@ -24,6 +24,7 @@ type Error interface {
 type apiError struct {
 	ErrorCode    string `json:"errcode"`
 	ErrorMessage string `json:"error"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
 	status       int
 }
 
@@ -98,6 +99,16 @@ func UnknownTokenError(message string) Error {
 	}
 }
 
+// the access token has expired, but the session can be resumed with a refresh token
+func SoftLogoutError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_UNKNOWN_TOKEN",
+		ErrorMessage: message,
+		SoftLogout:   true,
+		status:       401,
+	}
+}
+
 func BadJsonError(message string) Error {
 	return apiError{
 		ErrorCode:    "M_BAD_JSON",
@@ -146,6 +157,78 @@ func UnkownError(message string) Error {
 	}
 }
 
+func GuestAccessForbiddenError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_GUEST_ACCESS_FORBIDDEN",
+		ErrorMessage: message,
+		status:       403,
+	}
+}
+
+func UnsupportedRoomVersionError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_UNSUPPORTED_ROOM_VERSION",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func UserDeactivatedError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_USER_DEACTIVATED",
+		ErrorMessage: message,
+		status:       403,
+	}
+}
+
+func ThreepidInUseError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_THREEPID_IN_USE",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func ThreepidNotFoundError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_THREEPID_NOT_FOUND",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func ThreepidAuthFailedError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_THREEPID_AUTH_FAILED",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func ThreepidMediumNotSupportedError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_THREEPID_MEDIUM_NOT_SUPPORTED",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func InvalidUsernameError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_INVALID_USERNAME",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func ExclusiveError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_EXCLUSIVE",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
 func ServerError(message string) Error {
 	return apiError{
 		ErrorCode:    "M_SERVER_ERROR",
@@ -157,3 +240,6 @@ func ServerError(message string) Error {
 var DefaultUnrecognizedError = UnrecognizedError("unrecognized request")
 var DefaultMissingTokenError = MissingTokenError("Missing access token")
 var DefaultUnknownTokenError = UnknownTokenError("Unrecognised access token")
+var DefaultSoftLogoutError = SoftLogoutError("Access token has expired")
+var DefaultGuestAccessForbiddenError = GuestAccessForbiddenError("Guest access not allowed")
+var DefaultUserDeactivatedError = UserDeactivatedError("This account has been deactivated")
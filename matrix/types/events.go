@@ -21,15 +21,21 @@ import (
 )
 
 const (
-	EventTypeCreate      = "m.room.create"
-	EventTypeName        = "m.room.name"
-	EventTypeTopic       = "m.room.topic"
-	EventTypeAliases     = "m.room.aliases"
-	EventTypeJoinRules   = "m.room.join_rules"
-	EventTypeMembership  = "m.room.member"
-	EventTypePowerLevels = "m.room.power_levels"
-	EventTypeTyping      = "m.typing"
-	EventTypePresence    = "m.presence"
+	EventTypeCreate            = "m.room.create"
+	EventTypeName              = "m.room.name"
+	EventTypeTopic             = "m.room.topic"
+	EventTypeAliases           = "m.room.aliases"
+	EventTypeCanonicalAlias    = "m.room.canonical_alias"
+	EventTypeJoinRules         = "m.room.join_rules"
+	EventTypeHistoryVisibility = "m.room.history_visibility"
+	EventTypeGuestAccess       = "m.room.guest_access"
+	EventTypeMembership        = "m.room.member"
+	EventTypePowerLevels       = "m.room.power_levels"
+	EventTypeTombstone         = "m.room.tombstone"
+	EventTypeMessage           = "m.room.message"
+	EventTypeRedaction         = "m.room.redaction"
+	EventTypeTyping            = "m.typing"
+	EventTypePresence          = "m.presence"
 )
 
 type BaseEvent struct {
@@ -47,6 +53,12 @@ type Message struct {
 	RoomId    ct.RoomId    `json:"room_id"`
 	UserId    ct.UserId    `json:"user_id"`
 	Timestamp ct.Timestamp `json:"origin_server_ts"`
+	Unsigned  *Unsigned    `json:"unsigned,omitempty"`
+}
+
+type Unsigned struct {
+	RedactedBecause *Redaction        `json:"redacted_because,omitempty"`
+	Relations       *BundledRelations `json:"m.relations,omitempty"`
 }
 
 func (e *Message) GetContent() interface{} {
@@ -170,13 +182,37 @@ func (c *MembershipEventContent) GetEventType() string {
 }
 
 type CreateEventContent struct {
-	Creator ct.UserId `json:"creator"`
+	Creator     ct.UserId     `json:"creator"`
+	RoomVersion string        `json:"room_version,omitempty"`
+	Predecessor *PreviousRoom `json:"predecessor,omitempty"`
+}
+
+// reference to the room that was replaced by an upgrade
+type PreviousRoom struct {
+	RoomId ct.RoomId `json:"room_id"`
 }
 
 func (c *CreateEventContent) GetEventType() string {
 	return EventTypeCreate
 }
 
+// rooms that were created without a room version are version 1
+func (c *CreateEventContent) Version() string {
+	if c.RoomVersion == "" {
+		return "1"
+	}
+	return c.RoomVersion
+}
+
+type TombstoneEventContent struct {
+	Body            string    `json:"body"`
+	ReplacementRoom ct.RoomId `json:"replacement_room"`
+}
+
+func (c *TombstoneEventContent) GetEventType() string {
+	return EventTypeTombstone
+}
+
 type NameEventContent struct {
 	Name string `json:"name"`
 }
@@ -201,6 +237,14 @@ func (c *AliasesEventContent) GetEventType() string {
 	return EventTypeAliases
 }
 
+type CanonicalAliasEventContent struct {
+	Alias *ct.Alias `json:"alias"`
+}
+
+func (c *CanonicalAliasEventContent) GetEventType() string {
+	return EventTypeCanonicalAlias
+}
+
 func DefaultPowerLevels(creator ct.UserId) *PowerLevelsEventContent {
 	powerLevels := new(PowerLevelsEventContent)
 	powerLevels.Ban = 50
@@ -212,30 +256,39 @@ func DefaultPowerLevels(creator ct.UserId) *PowerLevelsEventContent {
 	powerLevels.Users = UserPowerLevelMap{
 		creator.String(): 100,
 	}
+	powerLevels.Notifications = &NotificationPowerLevels{Room: 50}
 	powerLevels.Events = map[string]int{
-		"m.room.name":         100,
-		"m.room.power_levels": 100,
+		"m.room.name":               100,
+		"m.room.power_levels":       100,
+		"m.room.history_visibility": 100,
+		"m.room.tombstone":          100,
 	}
 	return powerLevels
 }
 
 type PowerLevelsEventContent struct {
-	Ban          int               `json:"ban"`
-	Kick         int               `json:"kick"`
-	Invite       int               `json:"invite"`
-	Redact       int               `json:"redact"`
-	UserDefault  int               `json:"users_default"`
-	CreateState  int               `json:"state_default"`
-	EventDefault int               `json:"events_default"`
-	Users        UserPowerLevelMap `json:"users"`
-	Events       map[string]int    `json:"events"`
+	Ban           int                      `json:"ban"`
+	Kick          int                      `json:"kick"`
+	Invite        int                      `json:"invite"`
+	Redact        int                      `json:"redact"`
+	UserDefault   int                      `json:"users_default"`
+	CreateState   int                      `json:"state_default"`
+	EventDefault  int                      `json:"events_default"`
+	Users         UserPowerLevelMap        `json:"users"`
+	Events        map[string]int           `json:"events"`
+	Notifications *NotificationPowerLevels `json:"notifications,omitempty"`
+}
+
+type NotificationPowerLevels struct {
+	// level required to notify the whole room with @room
+	Room int `json:"room"`
 }
 
 type UserPowerLevelMap map[string]int
 
 func (m *UserPowerLevelMap) UnmarshalJSON(bytes []byte) error {
 	userMap := map[string]int{}
-	err := json.Unmarshal(bytes, userMap)
+	err := json.Unmarshal(bytes, &userMap)
 	if err != nil {
 		return err
 	}
@@ -260,3 +313,19 @@ type JoinRulesEventContent struct {
 func (c *JoinRulesEventContent) GetEventType() string {
 	return EventTypeJoinRules
 }
+
+type HistoryVisibilityEventContent struct {
+	HistoryVisibility HistoryVisibility `json:"history_visibility"`
+}
+
+func (c *HistoryVisibilityEventContent) GetEventType() string {
+	return EventTypeHistoryVisibility
+}
+
+type GuestAccessEventContent struct {
+	GuestAccess GuestAccess `json:"guest_access"`
+}
+
+func (c *GuestAccessEventContent) GetEventType() string {
+	return EventTypeGuestAccess
+}
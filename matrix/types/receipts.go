@@ -0,0 +1,80 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import ct "github.com/matrix-org/bullettime/core/types"
+
+const (
+	EventTypeReceipt = "m.receipt"
+	ReceiptTypeRead  = "m.read"
+	// receipts for events that aren't part of any thread
+	ThreadIdMain = "main"
+)
+
+type Receipt struct {
+	EventId     ct.EventId
+	UserId      ct.UserId
+	ReceiptType string
+	ThreadId    string
+	Timestamp   ct.Timestamp
+}
+
+type ReceiptInfo struct {
+	Timestamp ct.Timestamp `json:"ts"`
+	ThreadId  string       `json:"thread_id,omitempty"`
+}
+
+// event id -> receipt type -> user id -> receipt
+type ReceiptContent map[string]map[string]map[string]ReceiptInfo
+
+type ReceiptEvent struct {
+	BaseEvent
+	Content ReceiptContent `json:"content"`
+	RoomId  ct.RoomId      `json:"room_id"`
+}
+
+func NewReceiptEvent(room ct.RoomId, receipts []Receipt) *ReceiptEvent {
+	content := ReceiptContent{}
+	for _, receipt := range receipts {
+		byType := content[receipt.EventId.String()]
+		if byType == nil {
+			byType = map[string]map[string]ReceiptInfo{}
+			content[receipt.EventId.String()] = byType
+		}
+		byUser := byType[receipt.ReceiptType]
+		if byUser == nil {
+			byUser = map[string]ReceiptInfo{}
+			byType[receipt.ReceiptType] = byUser
+		}
+		byUser[receipt.UserId.String()] = ReceiptInfo{receipt.Timestamp, receipt.ThreadId}
+	}
+	return &ReceiptEvent{BaseEvent{EventTypeReceipt}, content, room}
+}
+
+func (e *ReceiptEvent) GetContent() interface{} {
+	return e.Content
+}
+
+func (e *ReceiptEvent) GetRoomId() *ct.RoomId {
+	return &e.RoomId
+}
+
+func (e *ReceiptEvent) GetUserId() *ct.UserId {
+	return nil
+}
+
+func (e *ReceiptEvent) GetEventKey() ct.Id {
+	return ct.Id(e.RoomId)
+}
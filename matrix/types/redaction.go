@@ -0,0 +1,92 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import ct "github.com/matrix-org/bullettime/core/types"
+
+type Redaction struct {
+	Message
+	Redacts ct.EventId `json:"redacts"`
+}
+
+type RedactionEventContent struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+func (c *RedactionEventContent) GetEventType() string {
+	return EventTypeRedaction
+}
+
+// content keys that are kept when redacting events of the given type
+var preservedContentKeys = map[string][]string{
+	EventTypeMembership:        {"membership"},
+	EventTypeCreate:            {"creator"},
+	EventTypeJoinRules:         {"join_rule"},
+	EventTypeAliases:           {"aliases"},
+	EventTypeHistoryVisibility: {"history_visibility"},
+	EventTypePowerLevels:       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+}
+
+// Returns a copy of the event with all content that isn't needed to authorize
+// other events removed, or nil if the event can't be redacted.
+func RedactEvent(event ct.Event, because *Redaction) ct.Event {
+	switch event := event.(type) {
+	case *State:
+		redacted := *event
+		redacted.Content = RedactContent(event.EventType, event.Content)
+		redacted.Unsigned = &Unsigned{RedactedBecause: because}
+		return &redacted
+	case *Redaction:
+		redacted := *event
+		redacted.Content = RedactContent(event.EventType, event.Content)
+		redacted.Unsigned = &Unsigned{RedactedBecause: because}
+		return &redacted
+	case *Message:
+		redacted := *event
+		redacted.Content = RedactContent(event.EventType, event.Content)
+		redacted.Unsigned = &Unsigned{RedactedBecause: because}
+		return &redacted
+	}
+	return nil
+}
+
+func RedactContent(eventType string, content interface{}) ct.TypedContent {
+	switch content := content.(type) {
+	case *MembershipEventContent:
+		return &MembershipEventContent{Membership: content.Membership}
+	case *CreateEventContent:
+		return &CreateEventContent{Creator: content.Creator}
+	case *JoinRulesEventContent:
+		return &JoinRulesEventContent{JoinRule: content.JoinRule}
+	case *AliasesEventContent:
+		return &AliasesEventContent{Aliases: content.Aliases}
+	case *HistoryVisibilityEventContent:
+		return &HistoryVisibilityEventContent{HistoryVisibility: content.HistoryVisibility}
+	case *PowerLevelsEventContent:
+		redacted := *content
+		redacted.Invite = 0
+		redacted.Notifications = nil
+		return &redacted
+	case *GenericContent:
+		redacted := map[string]interface{}{}
+		for _, key := range preservedContentKeys[eventType] {
+			if value, ok := content.Content[key]; ok {
+				redacted[key] = value
+			}
+		}
+		return NewGenericContent(redacted, eventType)
+	}
+	return NewGenericContent(map[string]interface{}{}, eventType)
+}
@@ -0,0 +1,63 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"regexp"
+	"time"
+)
+
+type RegistrationMode int
+
+const (
+	// anyone can register
+	RegistrationOpen RegistrationMode = iota
+	// users need a registration token issued by an admin to register
+	RegistrationTokenRequired
+	RegistrationDisabled
+)
+
+// Applies to every way of creating accounts, except for registration by admins
+type RegistrationConfig struct {
+	Mode RegistrationMode
+	// usernames that match any of the patterns can't be registered, e.g. because they're used by bridges
+	ReservedUsernames []*regexp.Regexp
+}
+
+func (c RegistrationConfig) Reserved(localpart string) bool {
+	for _, reserved := range c.ReservedUsernames {
+		if reserved.MatchString(localpart) {
+			return true
+		}
+	}
+	return false
+}
+
+// a token issued by an admin that lets users register when registration isn't open
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// unlimited if nil
+	UsesAllowed *int `json:"uses_allowed"`
+	Completed   int  `json:"completed"`
+	// in milliseconds since the epoch, never expires if nil
+	ExpiryTime *int64 `json:"expiry_time"`
+}
+
+func (t RegistrationToken) Usable(now time.Time) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || now.UnixNano()/int64(time.Millisecond) < *t.ExpiryTime
+}
@@ -0,0 +1,129 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+)
+
+const (
+	RelationReplace    = "m.replace"
+	RelationAnnotation = "m.annotation"
+	RelationReference  = "m.reference"
+	RelationThread     = "m.thread"
+)
+
+const (
+	ThreadsIncludeAll          = "all"
+	ThreadsIncludeParticipated = "participated"
+)
+
+type InReplyTo struct {
+	EventId ct.EventId `json:"event_id"`
+}
+
+type RelatesTo struct {
+	RelType   string     `json:"rel_type,omitempty"`
+	EventId   ct.EventId `json:"event_id"`
+	Key       string     `json:"key,omitempty"`
+	InReplyTo *InReplyTo `json:"m.in_reply_to,omitempty"`
+}
+
+// Reads the m.relates_to field of message content, returns nil if the content has no relation.
+func ParseRelatesTo(content interface{}) (*RelatesTo, error) {
+	generic, ok := content.(*GenericContent)
+	if !ok {
+		return nil, nil
+	}
+	value, ok := generic.Content["m.relates_to"]
+	if !ok {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	relatesTo := new(RelatesTo)
+	if err := json.Unmarshal(bytes, relatesTo); err != nil {
+		return nil, errors.New("invalid m.relates_to: " + err.Error())
+	}
+	if relatesTo.RelType == "" && relatesTo.InReplyTo == nil {
+		return nil, errors.New("m.relates_to is missing rel_type")
+	}
+	if relatesTo.RelType != "" && relatesTo.EventId.Id == "" {
+		return nil, errors.New("m.relates_to is missing event_id")
+	}
+	if relatesTo.RelType == RelationAnnotation && relatesTo.Key == "" {
+		return nil, errors.New("annotations must have a key")
+	}
+	return relatesTo, nil
+}
+
+type AnnotationCount struct {
+	EventType string `json:"type"`
+	Key       string `json:"key"`
+	Count     int    `json:"count"`
+}
+
+type AnnotationAggregation struct {
+	Chunk []AnnotationCount `json:"chunk"`
+}
+
+type ReplaceAggregation struct {
+	EventId   ct.EventId   `json:"event_id"`
+	Sender    ct.UserId    `json:"sender"`
+	Timestamp ct.Timestamp `json:"origin_server_ts"`
+}
+
+type ReferencedEvent struct {
+	EventId ct.EventId `json:"event_id"`
+}
+
+type ReferenceAggregation struct {
+	Chunk []ReferencedEvent `json:"chunk"`
+}
+
+type ThreadSummary struct {
+	LatestEvent             ct.Event    `json:"latest_event"`
+	Count                   int         `json:"count"`
+	CurrentUserParticipated bool        `json:"current_user_participated"`
+	Participants            []ct.UserId `json:"-"`
+}
+
+type BundledRelations struct {
+	Annotation *AnnotationAggregation `json:"m.annotation,omitempty"`
+	Replace    *ReplaceAggregation    `json:"m.replace,omitempty"`
+	Reference  *ReferenceAggregation  `json:"m.reference,omitempty"`
+	Thread     *ThreadSummary         `json:"m.thread,omitempty"`
+}
+
+type RelationsChunk struct {
+	Chunk     []ct.Event `json:"chunk"`
+	NextBatch *string    `json:"next_batch,omitempty"`
+}
+
+type ThreadRoot struct {
+	Root ct.IndexedEvent
+	// the latest event in the thread, which is also bundled into the root
+	Latest ct.IndexedEvent
+}
+
+type ThreadsChunk struct {
+	Chunk     []ct.Event `json:"chunk"`
+	NextBatch *string    `json:"next_batch,omitempty"`
+}
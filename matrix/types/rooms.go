@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/utils"
 )
 
 type RoomDescription struct {
@@ -27,6 +28,26 @@ type RoomDescription struct {
 	Name       *string     `json:"name"`
 	Topic      *string     `json:"topic"`
 	Invited    []ct.UserId `json:"invite"`
+	// the default room version is used if this is nil
+	RoomVersion *string `json:"room_version"`
+}
+
+type PublicRoom struct {
+	RoomId           ct.RoomId  `json:"room_id"`
+	Name             string     `json:"name,omitempty"`
+	Topic            string     `json:"topic,omitempty"`
+	Aliases          []ct.Alias `json:"aliases,omitempty"`
+	CanonicalAlias   *ct.Alias  `json:"canonical_alias,omitempty"`
+	NumJoinedMembers int        `json:"num_joined_members"`
+	WorldReadable    bool       `json:"world_readable"`
+	GuestCanJoin     bool       `json:"guest_can_join"`
+}
+
+type PublicRooms struct {
+	Chunk                  []PublicRoom `json:"chunk"`
+	NextBatch              string       `json:"next_batch,omitempty"`
+	PrevBatch              string       `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int          `json:"total_room_count_estimate"`
 }
 
 type Visibility int
@@ -78,6 +99,17 @@ func (v *Visibility) UnmarshalJSON(bytes []byte) error {
 	return errors.New("invalid visibility: " + str)
 }
 
+func (v Visibility) String() string {
+	if v == VisibilityPublic {
+		return "public"
+	}
+	return "private"
+}
+
+func (v Visibility) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", v.String())), nil
+}
+
 func (j JoinRule) ToVisibility() Visibility {
 	if j == JoinRulePublic {
 		return VisibilityPublic
@@ -132,27 +164,32 @@ func (j JoinRule) MarshalJSON() ([]byte, error) {
 
 func (m *Membership) UnmarshalJSON(bytes []byte) error {
 	str := string(bytes)
-	switch str {
-	case "null":
+	if str == "null" {
 		*m = MembershipNone
 		return nil
-	case "\"invite\"":
-		*m = MembershipInvited
-		return nil
-	case "\"join\"":
-		*m = MembershipMember
-		return nil
-	case "\"knock\"":
-		*m = MembershipKnocking
-		return nil
-	case "\"leave\"":
-		*m = MembershipLeaving
-		return nil
-	case "\"ban\"":
-		*m = MembershipBanned
-		return nil
 	}
-	return errors.New("invalid membership: " + str)
+	membership, err := ParseMembership(utils.StripQuotes(str))
+	if err != nil {
+		return err
+	}
+	*m = membership
+	return nil
+}
+
+func ParseMembership(str string) (Membership, error) {
+	switch str {
+	case "invite":
+		return MembershipInvited, nil
+	case "join":
+		return MembershipMember, nil
+	case "knock":
+		return MembershipKnocking, nil
+	case "leave":
+		return MembershipLeaving, nil
+	case "ban":
+		return MembershipBanned, nil
+	}
+	return MembershipNone, errors.New("invalid membership: " + str)
 }
 
 func (m Membership) String() string {
@@ -178,3 +215,107 @@ func (m Membership) MarshalJSON() ([]byte, error) {
 	}
 	return []byte(fmt.Sprintf("\"%s\"", str)), nil
 }
+
+type HistoryVisibility int
+
+const (
+	HistoryVisibilityNone          HistoryVisibility = 0
+	HistoryVisibilityWorldReadable HistoryVisibility = 1
+	HistoryVisibilityShared        HistoryVisibility = 2
+	HistoryVisibilityInvited       HistoryVisibility = 3
+	HistoryVisibilityJoined        HistoryVisibility = 4
+)
+
+func (h *HistoryVisibility) UnmarshalJSON(bytes []byte) error {
+	str := string(bytes)
+	switch str {
+	case "\"world_readable\"":
+		*h = HistoryVisibilityWorldReadable
+		return nil
+	case "\"shared\"":
+		*h = HistoryVisibilityShared
+		return nil
+	case "\"invited\"":
+		*h = HistoryVisibilityInvited
+		return nil
+	case "\"joined\"":
+		*h = HistoryVisibilityJoined
+		return nil
+	}
+	return errors.New("invalid history visibility: " + str)
+}
+
+func (h HistoryVisibility) String() string {
+	switch h {
+	case HistoryVisibilityWorldReadable:
+		return "world_readable"
+	case HistoryVisibilityShared:
+		return "shared"
+	case HistoryVisibilityInvited:
+		return "invited"
+	case HistoryVisibilityJoined:
+		return "joined"
+	}
+	return ""
+}
+
+func (h HistoryVisibility) MarshalJSON() ([]byte, error) {
+	str := h.String()
+	if str == "" {
+		return []byte("null"), nil
+	}
+	return []byte(fmt.Sprintf("\"%s\"", str)), nil
+}
+
+type GuestAccess int
+
+const (
+	GuestAccessNone      GuestAccess = 0
+	GuestAccessCanJoin   GuestAccess = 1
+	GuestAccessForbidden GuestAccess = 2
+)
+
+func (g *GuestAccess) UnmarshalJSON(bytes []byte) error {
+	str := string(bytes)
+	switch str {
+	case "\"can_join\"":
+		*g = GuestAccessCanJoin
+		return nil
+	case "\"forbidden\"":
+		*g = GuestAccessForbidden
+		return nil
+	}
+	return errors.New("invalid guest access: " + str)
+}
+
+func (g GuestAccess) String() string {
+	switch g {
+	case GuestAccessCanJoin:
+		return "can_join"
+	case GuestAccessForbidden:
+		return "forbidden"
+	}
+	return ""
+}
+
+func (g GuestAccess) MarshalJSON() ([]byte, error) {
+	str := g.String()
+	if str == "" {
+		return []byte("null"), nil
+	}
+	return []byte(fmt.Sprintf("\"%s\"", str)), nil
+}
+
+type RoomVersionStability string
+
+const (
+	RoomVersionStable   RoomVersionStability = "stable"
+	RoomVersionUnstable RoomVersionStability = "unstable"
+)
+
+const DefaultRoomVersion = "1"
+
+// the room versions that can be used when creating or upgrading a room
+var RoomVersions = map[string]RoomVersionStability{
+	DefaultRoomVersion: RoomVersionStable,
+}
@@ -0,0 +1,59 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import ct "github.com/matrix-org/bullettime/core/types"
+
+const (
+	SearchKeyBody  = "content.body"
+	SearchKeyName  = "content.name"
+	SearchKeyTopic = "content.topic"
+)
+
+type SearchOrder string
+
+const (
+	SearchOrderRank   SearchOrder = "rank"
+	SearchOrderRecent SearchOrder = "recent"
+)
+
+type SearchHit struct {
+	EventId    ct.EventId
+	RoomId     ct.RoomId
+	Index      uint64
+	Rank       float64
+	Highlights []string
+}
+
+type SearchQuery struct {
+	SearchTerm string
+	Keys       []string
+	Rooms      []ct.RoomId
+	OrderBy    SearchOrder
+	Limit      uint
+	NextBatch  string
+}
+
+type SearchResult struct {
+	Rank   float64  `json:"rank"`
+	Result ct.Event `json:"result"`
+}
+
+type SearchResults struct {
+	Results    []SearchResult `json:"results"`
+	Count      int            `json:"count"`
+	Highlights []string       `json:"highlights"`
+	NextBatch  string         `json:"next_batch,omitempty"`
+}
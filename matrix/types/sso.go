@@ -0,0 +1,24 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// the identity of a user that has authenticated with an external identity provider
+type ExternalIdentity struct {
+	// identifies the user at the identity provider, and never changes
+	Subject           string
+	PreferredUsername string
+	DisplayName       string
+	Email             string
+}
@@ -33,6 +33,7 @@ type RoomSummary struct {
 	Messages   *EventStreamRange `json:"messages"`
 	State      []*State          `json:"state"`
 	Visibility Visibility        `json:"visibility"`
+	Ephemeral  []ct.Event        `json:"ephemeral,omitempty"`
 }
 
 type RoomInitialSync struct {
@@ -46,10 +47,20 @@ type EventStreamRange struct {
 	End    StreamToken `json:"end"`
 }
 
+type EventContext struct {
+	Event        ct.Event    `json:"event"`
+	EventsBefore []ct.Event  `json:"events_before"`
+	EventsAfter  []ct.Event  `json:"events_after"`
+	State        []*State    `json:"state"`
+	Start        StreamToken `json:"start"`
+	End          StreamToken `json:"end"`
+}
+
 type StreamToken struct {
 	MessageIndex  uint64
 	PresenceIndex uint64
 	TypingIndex   uint64
+	ReceiptIndex  uint64
 }
 
 type TokenParseError string
@@ -59,7 +70,7 @@ func (e TokenParseError) Error() string {
 }
 
 func (t StreamToken) String() string {
-	return fmt.Sprintf("s%d_%d_%d", t.MessageIndex, t.PresenceIndex, t.TypingIndex)
+	return fmt.Sprintf("s%d_%d_%d_%d", t.MessageIndex, t.PresenceIndex, t.TypingIndex, t.ReceiptIndex)
 }
 
 func NewEventStreamRange(events []ct.Event, start StreamToken, end StreamToken) *EventStreamRange {
@@ -70,24 +81,25 @@ func NewEventStreamRange(events []ct.Event, start StreamToken, end StreamToken)
 	}
 }
 
-func NewStreamToken(messageIndex, presenceIndex, typingIndex uint64) StreamToken {
+func NewStreamToken(messageIndex, presenceIndex, typingIndex, receiptIndex uint64) StreamToken {
 	return StreamToken{
 		MessageIndex:  messageIndex,
 		PresenceIndex: presenceIndex,
 		TypingIndex:   typingIndex,
+		ReceiptIndex:  receiptIndex,
 	}
 }
 
 func ParseStreamToken(str string) (StreamToken, error) {
-	var message, presence, typing uint64
-	count, err := fmt.Sscanf(str, "s%d_%d_%d", &message, &presence, &typing)
+	var message, presence, typing, receipt uint64
+	count, err := fmt.Sscanf(str, "s%d_%d_%d_%d", &message, &presence, &typing, &receipt)
 	if err != nil {
 		return StreamToken{}, TokenParseError(err.Error())
 	}
-	if count != 3 {
+	if count != 4 {
 		return StreamToken{}, TokenParseError("token does not match format")
 	}
-	return StreamToken{message, presence, typing}, nil
+	return StreamToken{message, presence, typing, receipt}, nil
 }
 
 func (t *StreamToken) UnmarshalJSON(bytes []byte) (err error) {
@@ -0,0 +1,31 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+const ThreepidMediumEmail = "email"
+
+// a third party identifier, such as an email address, that has been validated and bound to a user
+type Threepid struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	ValidatedAt int64  `json:"validated_at"`
+	AddedAt     int64  `json:"added_at"`
+}
+
+// identifies a validation session of a third party identifier
+type ThreepidCredentials struct {
+	Sid          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+}
@@ -0,0 +1,46 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+)
+
+// what the server knows about an access token, the token itself is never stored
+type TokenInfo struct {
+	UserId   ct.UserId
+	DeviceId string
+	Expires  time.Time // zero if the token never expires
+	// hash of the refresh token that was issued together with the access token, if any
+	RefreshTokenHash string
+}
+
+func (t TokenInfo) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+type RefreshTokenInfo struct {
+	UserId   ct.UserId
+	DeviceId string
+	// hash of the access token that is replaced when the refresh token is used
+	AccessTokenHash string
+	Expires         time.Time
+}
+
+func (t RefreshTokenInfo) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
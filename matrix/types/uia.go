@@ -0,0 +1,95 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "strings"
+
+// stages of user-interactive authentication
+const (
+	AuthTypePassword          = "m.login.password"
+	AuthTypeDummy             = "m.login.dummy"
+	AuthTypeRegistrationToken = "m.login.registration_token"
+	AuthTypeEmail             = "m.login.email.identity"
+	// completed through the fallback page, which sends the user to the identity provider
+	AuthTypeSso = "m.login.sso"
+)
+
+type AuthFlow struct {
+	Stages []string `json:"stages"`
+}
+
+type UserIdentifier struct {
+	Type string `json:"type"`
+	User string `json:"user,omitempty"`
+}
+
+// the auth dict that clients send to complete a stage, the fields that are used depend on the stage type
+type AuthData struct {
+	Type    string `json:"type"`
+	Session string `json:"session,omitempty"`
+
+	// m.login.password
+	Identifier *UserIdentifier `json:"identifier,omitempty"`
+	User       string          `json:"user,omitempty"` // deprecated in favour of the identifier
+	Password   string          `json:"password,omitempty"`
+
+	// m.login.registration_token
+	Token string `json:"token,omitempty"`
+
+	// m.login.email.identity
+	ThreepidCreds *ThreepidCredentials `json:"threepid_creds,omitempty"`
+}
+
+// the user name or id that the auth dict identifies, or an empty string if there is none
+func (a *AuthData) UserName() string {
+	if a.Identifier != nil {
+		if a.Identifier.Type != "m.id.user" {
+			return ""
+		}
+		return a.Identifier.User
+	}
+	return a.User
+}
+
+// A 401 response to a request that requires further authentication. It lists the flows that can
+// be used, and if a session has been started, the stages that have been completed so far.
+type AuthRequiredError struct {
+	Flows     []AuthFlow             `json:"flows"`
+	Params    map[string]interface{} `json:"params"`
+	Session   string                 `json:"session,omitempty"`
+	Completed []string               `json:"completed,omitempty"`
+	// set if the last attempt to complete a stage failed
+	ErrorCode    string `json:"errcode,omitempty"`
+	ErrorMessage string `json:"error,omitempty"`
+}
+
+func (e *AuthRequiredError) Code() string {
+	return e.ErrorCode
+}
+
+func (e *AuthRequiredError) Status() int {
+	return 401
+}
+
+func (e *AuthRequiredError) Error() string {
+	if e.ErrorMessage != "" {
+		return e.ErrorMessage
+	}
+	stages := []string{}
+	for _, flow := range e.Flows {
+		stages = append(stages, strings.Join(flow.Stages, ","))
+	}
+	return "authentication required, flows: " + strings.Join(stages, " | ")
+}
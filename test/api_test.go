@@ -0,0 +1,430 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/api"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func (s services) router() *httprouter.Router {
+	mux := httprouter.New()
+	api.NewAuthEndpoint(s.user, s.token, s.uia, s.threepid, s.sso, s.regTokens, "https://hs.example", s.registration).Register(mux)
+	api.NewDevicesEndpoint(s.user, s.token, s.uia, s.sso).Register(mux)
+	api.NewAccountEndpoint(s.user, s.token, s.uia, s.threepid, s.sso).Register(mux)
+	api.NewAdminEndpoint(s.user, s.token, s.secret).Register(mux)
+	api.NewRoomsEndpoint(s.user, s.token, s.room, s.sync, s.event, s.txns).Register(mux)
+	return mux
+}
+
+// sends a request to the router, and decodes the json response
+func request(t *testing.T, mux http.Handler, method, path, token string, body interface{}) (int, map[string]interface{}) {
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, "http://matrix.org"+path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	var response map[string]interface{}
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal("failed to decode response to "+method+" "+path, err)
+	}
+	return rw.Code, response
+}
+
+func flowStages(response map[string]interface{}) []string {
+	stages := []string{}
+	flows, _ := response["flows"].([]interface{})
+	for _, flow := range flows {
+		flowStages, _ := flow.(map[string]interface{})["stages"].([]interface{})
+		names := []string{}
+		for _, stage := range flowStages {
+			names = append(names, stage.(string))
+		}
+		stages = append(stages, strings.Join(names, ","))
+	}
+	return stages
+}
+
+func TestUsernameAvailability(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	register := map[string]interface{}{
+		"username": "alice",
+		"password": "secret",
+		"auth":     map[string]interface{}{"type": types.AuthTypeDummy},
+	}
+	if status, response := request(t, mux, "POST", "/register", "", register); status != 200 {
+		t.Fatal("expected registration to succeed, got", status, response)
+	}
+
+	for _, test := range []struct {
+		username string
+		errcode  string
+	}{
+		{"bob", ""},
+		{"b.o_b=/-9", ""},
+		{"alice", "M_USER_IN_USE"},
+		{"Bob", "M_INVALID_USERNAME"},
+		{"bob@example", "M_INVALID_USERNAME"},
+		{"", "M_INVALID_USERNAME"},
+		{strings.Repeat("b", 250), "M_INVALID_USERNAME"},
+		{"_bob", "M_EXCLUSIVE"},
+		{"bridge.bob", "M_EXCLUSIVE"},
+	} {
+		status, response := request(t, mux, "GET", "/register/available?username="+test.username, "", nil)
+		if test.errcode == "" {
+			if status != 200 || response["available"] != true {
+				t.Error("expected '"+test.username+"' to be available, got", status, response)
+			}
+		} else if response["errcode"] != test.errcode {
+			t.Error("expected '"+test.username+"' to fail with "+test.errcode+", got", status, response)
+		}
+	}
+
+	register["username"] = "_alice"
+	if _, response := request(t, mux, "POST", "/register", "", register); response["errcode"] != "M_EXCLUSIVE" {
+		t.Error("expected registration of a reserved username to fail, got", response)
+	}
+	delete(register, "username")
+	if status, response := request(t, mux, "POST", "/register", "", register); status != 400 || response["errcode"] != "M_BAD_JSON" {
+		t.Error("expected registration without a username to fail, got", status, response)
+	}
+}
+
+func TestRegistrationFlows(t *testing.T) {
+	s := setup()
+	status, response := request(t, s.router(), "GET", "/register", "", nil)
+	if stages := flowStages(response); status != 200 || strings.Join(stages, " ") != types.AuthTypeDummy+" "+types.AuthTypeEmail {
+		t.Error("expected open registration to offer the dummy and email flows, got", status, stages)
+	}
+
+	s = setupWithRegistration(types.RegistrationConfig{Mode: types.RegistrationTokenRequired})
+	mux := s.router()
+	status, response = request(t, mux, "GET", "/register", "", nil)
+	if stages := flowStages(response); status != 200 || strings.Join(stages, " ") != types.AuthTypeRegistrationToken {
+		t.Error("expected token registration to only offer the registration token flow, got", status, stages)
+	}
+	register := map[string]interface{}{
+		"username": "alice",
+		"password": "secret",
+		"auth":     map[string]interface{}{"type": types.AuthTypeDummy},
+	}
+	if status, response := request(t, mux, "POST", "/register", "", register); status != 401 {
+		t.Error("expected registration without a token to require authentication, got", status, response)
+	}
+	token, err := s.regTokens.CreateRegistrationToken("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register["auth"] = map[string]interface{}{"type": types.AuthTypeRegistrationToken, "token": token.Token}
+	if status, response := request(t, mux, "POST", "/register", "", register); status != 200 {
+		t.Error("expected registration with a token to succeed, got", status, response)
+	}
+
+	s = setupWithRegistration(types.RegistrationConfig{Mode: types.RegistrationDisabled})
+	mux = s.router()
+	for _, path := range []string{"/register", "/register/available?username=bob", "/register/m.login.registration_token/validity?token=abc"} {
+		if status, response := request(t, mux, "GET", path, "", nil); status != 403 || response["errcode"] != "M_FORBIDDEN" {
+			t.Error("expected "+path+" to be forbidden while registration is disabled, got", status, response)
+		}
+	}
+	register["auth"] = map[string]interface{}{"type": types.AuthTypeDummy}
+	if status, response := request(t, mux, "POST", "/register", "", register); status != 403 {
+		t.Error("expected registration to be forbidden while disabled, got", status, response)
+	}
+	if status, response := request(t, mux, "POST", "/register?kind=guest", "", map[string]interface{}{}); status != 403 {
+		t.Error("expected guest registration to be forbidden while disabled, got", status, response)
+	}
+}
+
+// a user service that loses the race for every username, as if someone else registered it first
+type lostRaceUserService struct {
+	interfaces.UserService
+}
+
+func (s lostRaceUserService) CreateUser(user ct.UserId) types.Error {
+	if err := s.UserService.CreateUser(user); err != nil {
+		return err
+	}
+	return s.UserService.CreateUser(user)
+}
+
+func TestFailedRegistrationKeepsTokenUse(t *testing.T) {
+	s := setupWithRegistration(types.RegistrationConfig{Mode: types.RegistrationTokenRequired})
+	uses := 1
+	token, err := s.regTokens.CreateRegistrationToken("", &uses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	racing := httprouter.New()
+	api.NewAuthEndpoint(lostRaceUserService{s.user}, s.token, s.uia, s.threepid, s.sso, s.regTokens, "https://hs.example", s.registration).Register(racing)
+	register := map[string]interface{}{
+		"username": "alice",
+		"password": "secret",
+		"auth":     map[string]interface{}{"type": types.AuthTypeRegistrationToken, "token": token.Token},
+	}
+	if status, response := request(t, racing, "POST", "/register", "", register); status != 400 || response["errcode"] != "M_USER_IN_USE" {
+		t.Fatal("expected the registration to fail, got", status, response)
+	}
+	if found, err := s.regTokens.RegistrationToken(token.Token); err != nil || found.Completed != 0 {
+		t.Error("expected the failed registration to not use the token, got", found, err)
+	}
+	register["username"] = "bob"
+	if status, response := request(t, s.router(), "POST", "/register", "", register); status != 200 {
+		t.Error("expected the token to still be usable, got", status, response)
+	}
+}
+
+func TestDeactivatedLogin(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	bob := ct.NewUserId("bob", "matrix.org")
+	if err := s.user.CreateUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.SetPassword(bob, bob, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.Deactivate(bob, bob); err != nil {
+		t.Fatal(err)
+	}
+	login := map[string]interface{}{"type": api.LoginTypePassword, "user": "bob", "password": "wrong"}
+	if status, response := request(t, mux, "POST", "/login", "", login); status != 403 || response["errcode"] != "M_FORBIDDEN" {
+		t.Error("expected a wrong password to not reveal that bob is deactivated, got", status, response)
+	}
+	login["password"] = "secret"
+	if status, response := request(t, mux, "POST", "/login", "", login); status != 403 || response["errcode"] != "M_USER_DEACTIVATED" {
+		t.Error("expected bob to be told that the account is deactivated, got", status, response)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	for _, user := range []ct.UserId{alice, bob} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]string{}
+	for name, device := range map[string]struct {
+		user     ct.UserId
+		deviceId string
+	}{"phone": {alice, "PHONE"}, "laptop": {alice, "LAPTOP"}, "bob": {bob, "BOB"}} {
+		token, err := s.token.NewAccessToken(device.user, device.deviceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token.String()
+	}
+	path := "/rooms/" + room.String() + "/send/m.room.message/txn1"
+	message := map[string]interface{}{"msgtype": "m.text", "body": "hello"}
+
+	status, first := request(t, mux, "PUT", path, tokens["phone"], message)
+	if status != 200 || first["event_id"] == nil {
+		t.Fatal("expected the message to be sent, got", status, first)
+	}
+	if status, retried := request(t, mux, "PUT", path, tokens["phone"], message); status != 200 || retried["event_id"] != first["event_id"] {
+		t.Error("expected the retry to give the original event, got", status, retried, first)
+	}
+	if status, other := request(t, mux, "PUT", path, tokens["laptop"], message); status != 200 || other["event_id"] == nil || other["event_id"] == first["event_id"] {
+		t.Error("expected the same transaction id from another device to send a new event, got", status, other, first)
+	}
+
+	// failures aren't remembered, so the transaction can be retried once it's allowed
+	if status, response := request(t, mux, "PUT", path, tokens["bob"], message); status != 403 {
+		t.Fatal("expected bob to not be able to send messages to the room, got", status, response)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	if status, response := request(t, mux, "PUT", path, tokens["bob"], message); status != 200 || response["event_id"] == nil {
+		t.Error("expected the retried transaction to send the message, got", status, response)
+	}
+}
+
+func TestSsoReauthentication(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	s.idp.identities["alice-code"] = types.ExternalIdentity{Subject: "1001", PreferredUsername: "alice"}
+	s.idp.identities["bob-code"] = types.ExternalIdentity{Subject: "1002", PreferredUsername: "bob"}
+	alice, err := ssoLogin(t, s, "alice-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateDevice(alice, "PHONE", nil); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.token.NewAccessToken(alice, "PHONE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := request(t, mux, "DELETE", "/devices/PHONE", token.String(), map[string]interface{}{})
+	if stages := flowStages(response); status != 401 || strings.Join(stages, " ") != types.AuthTypePassword+" "+types.AuthTypeSso {
+		t.Fatal("expected users to be able to re-authenticate with a password or single sign-on, got", status, stages)
+	}
+	session := response["session"].(string)
+	fallback := func(code string) int {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest("GET", "http://matrix.org/auth/m.login.sso/fallback/web?session="+session, nil))
+		location := rw.Header().Get("Location")
+		if rw.Code != 302 || !strings.HasPrefix(location, "https://idp.example/authorize") {
+			t.Fatal("expected the fallback to redirect to the identity provider, got", rw.Code, location)
+		}
+		state := location[strings.Index(location, "state=")+len("state="):]
+		rw = httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest("GET", "http://matrix.org/auth/m.login.sso/fallback/callback?state="+state+"&code="+code, nil))
+		return rw.Code
+	}
+	if status := fallback("bob-code"); status != 403 {
+		t.Error("expected another user to not be able to complete the stage, got", status)
+	}
+	if status, _ := request(t, mux, "DELETE", "/devices/PHONE", token.String(), map[string]interface{}{"auth": map[string]interface{}{"session": session}}); status != 401 {
+		t.Error("expected the session to not be completed, got", status)
+	}
+	if status := fallback("alice-code"); status != 200 {
+		t.Fatal("expected the stage to be completed, got", status)
+	}
+	if status, response := request(t, mux, "DELETE", "/devices/PHONE", token.String(), map[string]interface{}{"auth": map[string]interface{}{"session": session}}); status != 200 {
+		t.Error("expected the device to be deleted after re-authenticating, got", status, response)
+	}
+}
+
+func TestAccessLevels(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	alice := ct.NewUserId("alice", "matrix.org")
+	if err := s.user.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	guest, err := s.user.CreateGuest("matrix.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ct.NewUserId("root", "matrix.org")
+	nonce, err := s.secret.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.secret.Register(nonce, root, "secret", "", true, sharedSecretMac(nonce, "root", "secret", true)); err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]string{}
+	for name, user := range map[string]ct.UserId{"alice": alice, "guest": guest, "root": root} {
+		token, err := s.token.NewAccessToken(user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token.String()
+	}
+	tokens["unknown"] = "abc"
+
+	adminPath := "/admin/users/" + alice.String() + "/admin"
+	for _, test := range []struct {
+		method, path, caller string
+		status               int
+		errcode              string
+	}{
+		{"GET", "/devices", "", 403, "M_MISSING_TOKEN"},
+		{"GET", "/devices", "unknown", 403, "M_UNKNOWN_TOKEN"},
+		{"GET", "/devices", "guest", 403, "M_GUEST_ACCESS_FORBIDDEN"},
+		{"GET", "/devices", "alice", 200, ""},
+		{"GET", adminPath, "", 403, "M_MISSING_TOKEN"},
+		{"GET", adminPath, "guest", 403, "M_GUEST_ACCESS_FORBIDDEN"},
+		{"GET", adminPath, "alice", 403, "M_FORBIDDEN"},
+		{"GET", adminPath, "root", 200, ""},
+		{"POST", "/logout", "", 403, "M_MISSING_TOKEN"},
+		{"POST", "/logout", "unknown", 403, "M_UNKNOWN_TOKEN"},
+		{"POST", "/logout", "guest", 200, ""},
+	} {
+		status, response := request(t, mux, test.method, test.path, tokens[test.caller], map[string]interface{}{})
+		if status != test.status || (test.errcode != "" && response["errcode"] != test.errcode) {
+			t.Errorf("expected %s %s by '%s' to give %d %s, got %d %v", test.method, test.path, test.caller, test.status, test.errcode, status, response)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "http://matrix.org/devices?access_token="+tokens["alice"], nil))
+	if rw.Code != 200 {
+		t.Error("expected the access token to be read from the query, got", rw.Code)
+	}
+}
+
+func TestOptionalAuthentication(t *testing.T) {
+	s := setup()
+	mux := s.router()
+	alice := ct.NewUserId("alice", "matrix.org")
+	if err := s.user.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	guest, err := s.user.CreateGuest("matrix.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceToken, err := s.token.NewAccessToken(alice, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestToken, err := s.token.NewAccessToken(guest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := map[string]interface{}{"new_password": "secret"}
+
+	status, response := request(t, mux, "POST", "/account/password", "", body)
+	if stages := flowStages(response); status != 401 || strings.Join(stages, " ") != types.AuthTypeEmail {
+		t.Error("expected unauthenticated callers to reset their password by email, got", status, stages)
+	}
+	status, response = request(t, mux, "POST", "/account/password", aliceToken.String(), body)
+	if stages := flowStages(response); status != 401 || strings.Join(stages, " ") != types.AuthTypePassword+" "+types.AuthTypeSso {
+		t.Error("expected authenticated callers to re-authenticate, got", status, stages)
+	}
+	if status, response := request(t, mux, "POST", "/account/password", "abc", body); status != 403 || response["errcode"] != "M_UNKNOWN_TOKEN" {
+		t.Error("expected an unknown token to be rejected rather than ignored, got", status, response)
+	}
+	if status, response := request(t, mux, "POST", "/account/password", guestToken.String(), body); status != 403 || response["errcode"] != "M_GUEST_ACCESS_FORBIDDEN" {
+		t.Error("expected guests to be rejected, got", status, response)
+	}
+}
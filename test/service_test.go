@@ -15,10 +15,19 @@
 package events
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/bullettime/core/db"
 	"github.com/matrix-org/bullettime/core/events"
+	ci "github.com/matrix-org/bullettime/core/interfaces"
+	"github.com/matrix-org/bullettime/core/search"
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/service"
@@ -27,16 +36,100 @@ import (
 )
 
 type services struct {
-	room     interfaces.RoomService
-	user     interfaces.UserService
-	profile  interfaces.ProfileService
-	presence interfaces.PresenceService
-	token    interfaces.TokenService
-	event    interfaces.EventService
-	sync     interfaces.SyncService
+	room      interfaces.RoomService
+	user      interfaces.UserService
+	profile   interfaces.ProfileService
+	presence  interfaces.PresenceService
+	token     interfaces.TokenService
+	event     interfaces.EventService
+	sync      interfaces.SyncService
+	directory interfaces.DirectoryService
+	search    interfaces.SearchService
+	receipt   interfaces.ReceiptService
+	uia       interfaces.UiaService
+	threepid  interfaces.ThreepidService
+	mailer    *testMailer
+	sso       interfaces.SsoService
+	idp       *testIdentityProvider
+	regTokens interfaces.RegistrationTokenService
+	secret    interfaces.SharedSecretService
+	clock     *testClock
+	txns      ci.TransactionCache
+	// the configuration that the services were set up with, for setting up api endpoints
+	registration types.RegistrationConfig
+}
+
+const registrationSharedSecret = "shared secret"
+
+type testMail struct {
+	to, subject, body string
+}
+
+// keeps sent mails around for tests to read
+type testMailer struct {
+	mails []testMail
+}
+
+func (m *testMailer) SendMail(to, subject, body string) types.Error {
+	m.mails = append(m.mails, testMail{to, subject, body})
+	return nil
+}
+
+// authenticates users with the identity that the test gives for a code
+type testIdentityProvider struct {
+	identities map[string]types.ExternalIdentity // by code
+	nonces     map[string]string                 // by state
+}
+
+func (p *testIdentityProvider) Id() string {
+	return "https://idp.example"
+}
+
+func (p *testIdentityProvider) AuthorizationUrl(redirectUri, state, nonce string) (string, types.Error) {
+	p.nonces[state] = nonce
+	return "https://idp.example/authorize?state=" + state, nil
+}
+
+func (p *testIdentityProvider) Identity(redirectUri, code, nonce string) (*types.ExternalIdentity, types.Error) {
+	identity, ok := p.identities[code]
+	if !ok {
+		return nil, types.ForbiddenError("invalid code")
+	}
+	for _, issued := range p.nonces {
+		if issued == nonce {
+			return &identity, nil
+		}
+	}
+	return nil, types.ForbiddenError("invalid nonce")
+}
+
+const accessTokenLifetime = 5 * time.Minute
+const refreshTokenLifetime = time.Hour
+
+// lets tests move time forward instead of waiting for tokens to expire
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// usernames starting with an underscore or "bridge" are reserved in tests
+var testRegistration = types.RegistrationConfig{
+	Mode:              types.RegistrationOpen,
+	ReservedUsernames: []*regexp.Regexp{regexp.MustCompile(`^(_|bridge)`)},
 }
 
 func setup() services {
+	return setupWithRegistration(testRegistration)
+}
+
+func setupWithRegistration(registration types.RegistrationConfig) services {
 	stateStore, err := db.NewStateStore()
 	if err != nil {
 		panic(err)
@@ -53,7 +146,59 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
-	aliasStore, err := stores.NewAliasStore(aliasCache)
+	aliasCreatorCache, err := db.NewIdMap()
+	if err != nil {
+		panic(err)
+	}
+	aliasStore, err := stores.NewAliasStore(aliasCache, aliasCreatorCache)
+	if err != nil {
+		panic(err)
+	}
+	receiptStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	receiptStore, err := stores.NewReceiptStore(receiptStateStore)
+	if err != nil {
+		panic(err)
+	}
+	tokenStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	tokenStore, err := stores.NewTokenStore(tokenStateStore)
+	if err != nil {
+		panic(err)
+	}
+	deviceStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	deviceStore, err := stores.NewDeviceStore(deviceStateStore)
+	if err != nil {
+		panic(err)
+	}
+	threepidStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	threepidStore, err := stores.NewThreepidStore(threepidStateStore)
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenStore, err := stores.NewRegistrationTokenStore(registrationTokenStateStore)
+	if err != nil {
+		panic(err)
+	}
+	externalIdStateStore, err := db.NewStateStore()
+	if err != nil {
+		panic(err)
+	}
+	externalIdStore, err := stores.NewExternalIdStore(externalIdStateStore)
 	if err != nil {
 		panic(err)
 	}
@@ -65,6 +210,14 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
+	inviteCache, err := db.NewIdMultiMap()
+	if err != nil {
+		panic(err)
+	}
+	inviteStore, err := stores.NewMembershipStore(inviteCache)
+	if err != nil {
+		panic(err)
+	}
 	streamMux, err := events.NewStreamMux()
 	if err != nil {
 		panic(err)
@@ -81,11 +234,27 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
+	receiptStream, err := events.NewReceiptStream(memberStore, streamMux)
+	if err != nil {
+		panic(err)
+	}
+	searchIndex, err := search.NewSearchIndex()
+	if err != nil {
+		panic(err)
+	}
+	if err := messageStream.AddIndexer(searchIndex); err != nil {
+		panic(err)
+	}
 
 	roomService, err := service.CreateRoomService(
 		roomStore,
+		userStore,
 		aliasStore,
 		memberStore,
+		inviteStore,
+		messageStream,
+		messageStream,
+		messageStream,
 		messageStream,
 		presenceStream,
 		typingStream,
@@ -94,10 +263,6 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
-	userService, err := service.CreateUserService(userStore)
-	if err != nil {
-		panic(err)
-	}
 	profileService, err := service.NewProfileService(
 		presenceStream,
 		presenceStream,
@@ -112,7 +277,51 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
-	tokenService, err := service.CreateTokenService()
+	clock := &testClock{time.Now()}
+	tokenService, err := service.CreateTokenService(tokenStore, accessTokenLifetime, refreshTokenLifetime, clock.Now)
+	if err != nil {
+		panic(err)
+	}
+	mailer := &testMailer{}
+	threepidService, err := service.CreateThreepidService(threepidStore, mailer)
+	if err != nil {
+		panic(err)
+	}
+	userService, err := service.CreateUserService(
+		userStore,
+		deviceStore,
+		tokenService,
+		threepidService,
+		roomService,
+		profileService,
+		registration,
+	)
+	if err != nil {
+		panic(err)
+	}
+	registrationTokenService, err := service.CreateRegistrationTokenService(registrationTokenStore)
+	if err != nil {
+		panic(err)
+	}
+	uiaService, err := service.CreateUiaService(
+		service.NewDummyStage(),
+		service.NewPasswordStage(userService),
+		service.NewEmailStage(threepidService),
+		service.NewRegistrationTokenStage(registrationTokenService),
+		service.NewSsoStage(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	identityProvider := &testIdentityProvider{
+		identities: map[string]types.ExternalIdentity{},
+		nonces:     map[string]string{},
+	}
+	ssoService, err := service.CreateSsoService(identityProvider, externalIdStore, userService, profileService, registration)
+	if err != nil {
+		panic(err)
+	}
+	sharedSecretService, err := service.CreateSharedSecretService(registrationSharedSecret, userService, userStore, profileService)
 	if err != nil {
 		panic(err)
 	}
@@ -120,23 +329,45 @@ func setup() services {
 		messageStream,
 		presenceStream,
 		typingStream,
+		receiptStream,
 		streamMux,
 		messageStream,
+		messageStream,
+		messageStream,
 		memberStore,
 	)
 	if err != nil {
 		panic(err)
 	}
+	directoryService, err := service.NewDirectoryService(roomStore, aliasStore, memberStore)
+	if err != nil {
+		panic(err)
+	}
+	searchService, err := service.NewSearchService(searchIndex, messageStream, memberStore)
+	if err != nil {
+		panic(err)
+	}
 	syncService, err := service.NewSyncService(
 		messageStream,
 		presenceStream,
 		typingStream,
+		receiptStream,
 		roomStore,
 		memberStore,
+		receiptStore,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
 	}
+	receiptService, err := service.NewReceiptService(receiptStore, receiptStream, messageStream)
+	if err != nil {
+		panic(err)
+	}
+	txns, err := db.NewTransactionCache(time.Minute, clock.Now)
+	if err != nil {
+		panic(err)
+	}
 	return services{
 		roomService,
 		userService,
@@ -145,6 +376,19 @@ func setup() services {
 		tokenService,
 		eventService,
 		syncService,
+		directoryService,
+		searchService,
+		receiptService,
+		uiaService,
+		threepidService,
+		mailer,
+		ssoService,
+		identityProvider,
+		registrationTokenService,
+		sharedSecretService,
+		clock,
+		txns,
+		registration,
 	}
 }
 
@@ -172,3 +416,1724 @@ func TestUserCreation(t *testing.T) {
 		t.Error("expected empty status message")
 	}
 }
+
+func TestStateOfFormerMember(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	visitor := ct.NewUserId("visitor", "matrix.org")
+	name := "before"
+	desc := &types.RoomDescription{Visibility: types.VisibilityPublic, Name: &name}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.State(room, visitor, types.EventTypeName, ""); err == nil {
+		t.Fatal("expected non-member to be forbidden from reading state")
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, visitor, join, visitor.String()); err != nil {
+		t.Fatal(err)
+	}
+	leave := &types.MembershipEventContent{Membership: types.MembershipLeaving}
+	if _, err := s.room.SetState(room, visitor, leave, visitor.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, creator, &types.NameEventContent{Name: "after"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.room.State(room, visitor, types.EventTypeName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Content.(*types.NameEventContent).Name != "before" {
+		t.Error("expected former member to see the room name as it was when they left")
+	}
+	state, err = s.room.State(room, creator, types.EventTypeName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Content.(*types.NameEventContent).Name != "after" {
+		t.Error("expected member to see the current room name")
+	}
+	_, err = s.room.State(room, creator, types.EventTypeTopic, "")
+	if err == nil || err.Status() != 404 {
+		t.Error("expected missing state to result in a 404, got", err)
+	}
+}
+
+func TestRoomMembers(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	carol := ct.NewUserId("carol", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	beginning := types.NewStreamToken(0, 0, 0, 0)
+	messages, err := s.event.Messages(alice, room, nil, &beginning, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobJoined := messages.Start
+	leave := &types.MembershipEventContent{Membership: types.MembershipLeaving}
+	if _, err := s.room.SetState(room, bob, leave, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, carol, join, carol.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	members := func(caller ct.UserId, at *types.StreamToken, membership, notMembership types.Membership) map[ct.UserId]types.Membership {
+		states, err := s.room.Members(room, caller, at, membership, notMembership)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[ct.UserId]types.Membership{}
+		for _, state := range states {
+			user, _ := ct.ParseUserId(state.StateKey)
+			result[user] = state.Content.(*types.MembershipEventContent).Membership
+		}
+		return result
+	}
+	if all := members(alice, nil, types.MembershipNone, types.MembershipNone); len(all) != 3 || all[bob] != types.MembershipLeaving {
+		t.Error("expected all members, including those that left, got", all)
+	}
+	if joined := members(alice, nil, types.MembershipMember, types.MembershipNone); len(joined) != 2 || joined[alice] != types.MembershipMember || joined[carol] != types.MembershipMember {
+		t.Error("expected only joined members, got", joined)
+	}
+	if notJoined := members(alice, nil, types.MembershipNone, types.MembershipMember); len(notJoined) != 1 || notJoined[bob] != types.MembershipLeaving {
+		t.Error("expected only members that aren't joined, got", notJoined)
+	}
+	if atJoin := members(alice, &bobJoined, types.MembershipNone, types.MembershipNone); len(atJoin) != 2 || atJoin[bob] != types.MembershipMember {
+		t.Error("expected the members as they were when bob joined, got", atJoin)
+	}
+	if atStart := members(alice, &beginning, types.MembershipNone, types.MembershipNone); len(atStart) != 0 {
+		t.Error("expected no members before the room was created, got", atStart)
+	}
+	if seenByBob := members(bob, nil, types.MembershipNone, types.MembershipNone); len(seenByBob) != 2 || seenByBob[bob] != types.MembershipLeaving {
+		t.Error("expected former members to see the members as they were when they left, got", seenByBob)
+	}
+	if _, err := s.room.Members(room, ct.NewUserId("dave", "matrix.org"), nil, types.MembershipNone, types.MembershipNone); err == nil {
+		t.Error("expected non-members to be forbidden from reading the members")
+	}
+
+	joined, err := s.room.JoinedMembers(room, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := joined[bob]; len(joined) != 2 || ok {
+		t.Error("expected alice and carol to be joined, got", joined)
+	}
+	if _, err := s.room.JoinedMembers(room, bob); err == nil {
+		t.Error("expected former members to be forbidden from reading the joined members")
+	}
+}
+
+func TestPublicRoomDirectory(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	quiet, cheese := "quiet room", "cheese lovers"
+	quietRoom, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic, Name: &quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busyRoom, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic, Topic: &cheese})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPrivate}); err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(busyRoom, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, err := s.directory.PublicRooms("", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rooms.TotalRoomCountEstimate != 2 || len(rooms.Chunk) != 1 || rooms.Chunk[0].RoomId != busyRoom {
+		t.Fatal("expected the room with the most members first, got", rooms)
+	}
+	if rooms.Chunk[0].NumJoinedMembers != 2 {
+		t.Error("expected 2 joined members, got", rooms.Chunk[0].NumJoinedMembers)
+	}
+	rooms, err = s.directory.PublicRooms("", rooms.NextBatch, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms.Chunk) != 1 || rooms.Chunk[0].RoomId != quietRoom || rooms.NextBatch != "" {
+		t.Fatal("expected the second page to contain the last room, got", rooms)
+	}
+	rooms, err = s.directory.PublicRooms("CHEESE", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms.Chunk) != 1 || rooms.Chunk[0].RoomId != busyRoom {
+		t.Error("expected search to match on topic, got", rooms)
+	}
+	if err := s.room.SetVisibility(busyRoom, bob, types.VisibilityPrivate); err == nil {
+		t.Error("expected unprivileged user to be forbidden from unpublishing the room")
+	}
+}
+
+func TestRoomAliases(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alias := ct.NewAlias("lobby", "matrix.org")
+	if err := s.room.AddAlias(alias, room, bob); err == nil {
+		t.Fatal("expected non-member to be forbidden from adding an alias")
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.AddAlias(alias, room, bob); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.room.LookupAlias(alias); err != nil || found != room {
+		t.Fatal("expected alias to point to the room, got", found, err)
+	}
+	aliasesState, err := s.room.State(room, alice, types.EventTypeAliases, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases := aliasesState.Content.(*types.AliasesEventContent).Aliases; len(aliases) != 1 || aliases[0] != alias {
+		t.Error("expected aliases state to contain the new alias, got", aliases)
+	}
+	unknown := ct.NewAlias("unknown", "matrix.org")
+	if _, err := s.room.SetState(room, alice, &types.CanonicalAliasEventContent{Alias: &unknown}, ""); err == nil {
+		t.Error("expected canonical alias to be validated")
+	}
+	if _, err := s.room.SetState(room, alice, &types.CanonicalAliasEventContent{Alias: &alias}, ""); err != nil {
+		t.Fatal(err)
+	}
+	other := ct.NewAlias("other", "matrix.org")
+	if err := s.room.AddAlias(other, room, bob); err != nil {
+		t.Fatal(err)
+	}
+	leave := &types.MembershipEventContent{Membership: types.MembershipLeaving}
+	if _, err := s.room.SetState(room, bob, leave, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.RemoveAlias(other, bob); err == nil {
+		t.Error("expected the creator of an alias to not be able to remove it after leaving the room")
+	}
+	if err := s.room.RemoveAlias(alias, alice); err != nil {
+		t.Fatal(err)
+	}
+	canonicalState, err := s.room.State(room, alice, types.EventTypeCanonicalAlias, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonicalState.Content.(*types.CanonicalAliasEventContent).Alias != nil {
+		t.Error("expected canonical alias to be cleared when the alias is removed")
+	}
+}
+
+func TestEventContext(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []*types.Message
+	for i := 0; i < 5; i++ {
+		content := types.NewGenericContent(map[string]interface{}{"body": i}, "m.room.message")
+		message, err := s.room.AddMessage(room, alice, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	context, err := s.event.Context(alice, room, messages[2].EventId, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Event != messages[2] {
+		t.Error("expected context event to be the requested event")
+	}
+	if len(context.EventsBefore) != 2 || context.EventsBefore[0] != messages[1] || context.EventsBefore[1] != messages[0] {
+		t.Error("expected the two preceding messages in reverse order, got", context.EventsBefore)
+	}
+	if len(context.EventsAfter) != 2 || context.EventsAfter[0] != messages[3] || context.EventsAfter[1] != messages[4] {
+		t.Error("expected the two following messages, got", context.EventsAfter)
+	}
+	if len(context.State) == 0 {
+		t.Error("expected the room state at the event")
+	}
+	if _, err := s.event.Context(ct.NewUserId("bob", "matrix.org"), room, messages[2].EventId, 4); err == nil {
+		t.Error("expected non-member to be unable to see the event context")
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	name := "secret plans"
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic, Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	content := types.NewGenericContent(map[string]interface{}{"body": "oops", "msgtype": "m.text"}, "m.room.message")
+	message, err := s.room.AddMessage(room, alice, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.Redact(room, bob, message.EventId, "spam"); err == nil {
+		t.Fatal("expected bob to be forbidden from redacting alice's message")
+	}
+	redaction, err := s.room.Redact(room, alice, message.EventId, "typo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := s.event.Event(bob, message.EventId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := event.(*types.Message)
+	if len(redacted.Content.(*types.GenericContent).Content) != 0 {
+		t.Error("expected redacted message content to be empty, got", redacted.Content)
+	}
+	if redacted.Unsigned == nil || redacted.Unsigned.RedactedBecause != redaction {
+		t.Error("expected redacted message to reference the redaction")
+	}
+	if len(content.Content) != 2 {
+		t.Error("expected the original content to be left untouched")
+	}
+
+	nameState, err := s.room.State(room, alice, types.EventTypeName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.Redact(room, alice, nameState.EventId, ""); err != nil {
+		t.Fatal(err)
+	}
+	nameState, err = s.room.State(room, alice, types.EventTypeName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nameState.Content.(*types.NameEventContent); ok {
+		t.Error("expected the current name state to be redacted")
+	}
+}
+
+func TestRelations(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	text := func(body string, relatesTo map[string]interface{}) *types.GenericContent {
+		content := map[string]interface{}{"body": body, "msgtype": "m.text"}
+		if relatesTo != nil {
+			content["m.relates_to"] = relatesTo
+		}
+		return types.NewGenericContent(content, types.EventTypeMessage)
+	}
+	react := func(user ct.UserId, target ct.EventId, key string) types.Error {
+		content := types.NewGenericContent(map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target.String(), "key": key},
+		}, "m.reaction")
+		_, err := s.room.AddMessage(room, user, content)
+		return err
+	}
+
+	original, err := s.room.AddMessage(room, alice, text("helo", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replace := map[string]interface{}{"rel_type": "m.replace", "event_id": original.EventId.String()}
+	if _, err := s.room.AddMessage(room, bob, text("* hijacked", replace)); err == nil {
+		t.Fatal("expected bob to be forbidden from editing alice's message")
+	}
+	edit, err := s.room.AddMessage(room, alice, text("* hello", replace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := react(alice, original.EventId, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := react(bob, original.EventId, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := react(bob, original.EventId, "👍"); err == nil {
+		t.Fatal("expected duplicate annotation to be rejected")
+	}
+	if err := react(bob, original.EventId, "🎉"); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := s.event.Event(bob, original.EventId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := event.(*types.Message).Unsigned
+	if unsigned == nil || unsigned.Relations == nil {
+		t.Fatal("expected bundled relations, got", unsigned)
+	}
+	if unsigned.Relations.Replace == nil || unsigned.Relations.Replace.EventId != edit.EventId {
+		t.Error("expected the edit to be bundled, got", unsigned.Relations.Replace)
+	}
+	annotations := unsigned.Relations.Annotation.Chunk
+	if len(annotations) != 2 || annotations[0].Key != "👍" || annotations[0].Count != 2 || annotations[1].Count != 1 {
+		t.Error("unexpected annotation counts", annotations)
+	}
+
+	chunk, err := s.event.Relations(bob, room, original.EventId, types.RelationAnnotation, "", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Chunk) != 2 || chunk.NextBatch == nil {
+		t.Fatal("expected a first page of two annotations, got", chunk)
+	}
+	from, _ := strconv.ParseUint(*chunk.NextBatch, 10, 64)
+	chunk, err = s.event.Relations(bob, room, original.EventId, types.RelationAnnotation, "", &from, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Chunk) != 1 || chunk.NextBatch != nil {
+		t.Error("expected a last page of one annotation, got", chunk)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	carol := ct.NewUserId("carol", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []ct.UserId{bob, carol} {
+		join := &types.MembershipEventContent{Membership: types.MembershipMember}
+		if _, err := s.room.SetState(room, user, join, user.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(user ct.UserId, body string, thread *ct.EventId) *types.Message {
+		content := map[string]interface{}{"body": body, "msgtype": "m.text"}
+		if thread != nil {
+			content["m.relates_to"] = map[string]interface{}{"rel_type": "m.thread", "event_id": thread.String()}
+		}
+		message, err := s.room.AddMessage(room, user, types.NewGenericContent(content, types.EventTypeMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
+	root := send(alice, "root", nil)
+	send(bob, "first", &root.EventId)
+	latest := send(bob, "second", &root.EventId)
+	other := send(carol, "unrelated", nil)
+
+	for user, participated := range map[ct.UserId]bool{alice: true, bob: true, carol: false} {
+		event, err := s.event.Event(user, root.EventId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unsigned := event.(*types.Message).Unsigned
+		if unsigned == nil || unsigned.Relations == nil || unsigned.Relations.Thread == nil {
+			t.Fatal("expected a thread summary, got", unsigned)
+		}
+		thread := unsigned.Relations.Thread
+		if thread.Count != 2 || thread.LatestEvent.(*types.Message).EventId != latest.EventId {
+			t.Error("unexpected thread summary", thread)
+		}
+		if thread.CurrentUserParticipated != participated {
+			t.Errorf("expected participation of %s to be %v", user, participated)
+		}
+	}
+
+	threads, err := s.event.Threads(bob, room, types.ThreadsIncludeAll, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads.Chunk) != 1 || threads.Chunk[0].(*types.Message).EventId != root.EventId {
+		t.Error("expected one thread, got", threads.Chunk)
+	}
+	threads, err = s.event.Threads(carol, room, types.ThreadsIncludeParticipated, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads.Chunk) != 0 {
+		t.Error("expected carol to not have participated in any threads, got", threads.Chunk)
+	}
+
+	before, err := s.sync.RoomSync(bob, room, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.receipt.SetReceipt(room, carol, types.ReceiptTypeRead, latest.EventId, root.EventId.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.receipt.SetReceipt(room, carol, types.ReceiptTypeRead, latest.EventId, types.ThreadIdMain); err == nil {
+		t.Error("expected receipt for a threaded event in the main timeline to be rejected")
+	}
+	if err := s.receipt.SetReceipt(room, carol, types.ReceiptTypeRead, other.EventId, types.ThreadIdMain); err != nil {
+		t.Fatal(err)
+	}
+	sync, err := s.sync.RoomSync(carol, room, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Ephemeral) != 1 {
+		t.Fatal("expected a receipt event, got", sync.Ephemeral)
+	}
+	receipts := sync.Ephemeral[0].(*types.ReceiptEvent).Content
+	if receipts[latest.EventId.String()][types.ReceiptTypeRead][carol.String()].ThreadId != root.EventId.String() {
+		t.Error("expected a threaded receipt, got", receipts)
+	}
+	if receipts[other.EventId.String()][types.ReceiptTypeRead][carol.String()].ThreadId != types.ThreadIdMain {
+		t.Error("expected a main timeline receipt, got", receipts)
+	}
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+	updates, err := s.event.Range(bob, &before.Messages.End, nil, 10, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates.Events) != 2 {
+		t.Fatal("expected both receipt updates to be sent as events, got", updates.Events)
+	}
+	threaded := updates.Events[0].(*types.ReceiptEvent).Content[latest.EventId.String()]
+	if threaded[types.ReceiptTypeRead][carol.String()].ThreadId != root.EventId.String() {
+		t.Error("expected the threaded receipt update first, got", updates.Events[0])
+	}
+	result := make(chan *types.EventStreamRange)
+	go func() {
+		updates, err := s.event.Range(bob, &updates.End, nil, 10, cancel)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- updates
+	}()
+	if err := s.receipt.SetReceipt(room, alice, types.ReceiptTypeRead, latest.EventId, root.EventId.String()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case updates := <-result:
+		if len(updates.Events) != 1 || updates.Events[0].(*types.ReceiptEvent).Content[latest.EventId.String()][types.ReceiptTypeRead][alice.String()].ThreadId != root.EventId.String() {
+			t.Error("expected the new receipt to be sent to a waiting request, got", updates.Events)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the new receipt to be sent to a waiting request")
+	}
+}
+
+func TestHistoryVisibility(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	carol := ct.NewUserId("carol", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body string) *types.Message {
+		content := types.NewGenericContent(map[string]interface{}{"body": body, "msgtype": "m.text"}, types.EventTypeMessage)
+		message, err := s.room.AddMessage(room, alice, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	setVisibility := func(visibility types.HistoryVisibility) {
+		content := &types.HistoryVisibilityEventContent{HistoryVisibility: visibility}
+		if _, err := s.room.SetState(room, alice, content, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared := send("shared")
+	setVisibility(types.HistoryVisibilityJoined)
+	hidden := send("hidden")
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	visible := send("visible")
+
+	beginning := types.NewStreamToken(0, 0, 0, 0)
+	messages, err := s.event.Messages(bob, room, nil, &beginning, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[ct.EventId]bool{}
+	for _, event := range messages.Events {
+		if message, ok := event.(*types.Message); ok {
+			seen[message.EventId] = true
+		}
+	}
+	if !seen[shared.EventId] || !seen[visible.EventId] || seen[hidden.EventId] {
+		t.Error("unexpected visible messages", seen)
+	}
+	if _, err := s.event.Event(bob, hidden.EventId); err == nil || err.Status() != 404 {
+		t.Error("expected event sent before joining to be hidden, got", err)
+	}
+	if _, err := s.event.Event(carol, visible.EventId); err == nil {
+		t.Error("expected event to be hidden from non-member")
+	}
+
+	search := func(term string) *types.SearchResults {
+		results, err := s.search.Search(bob, &types.SearchQuery{SearchTerm: term})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	if results := search("hidden"); results.Count != 0 || len(results.Results) != 0 {
+		t.Error("expected search to hide events sent before joining, got", results.Results)
+	}
+	results := search("visible")
+	if results.Count != 1 || len(results.Results) != 1 {
+		t.Fatal("expected a single search result, got", results.Results)
+	}
+	if message, ok := results.Results[0].Result.(*types.Message); !ok || message.EventId != visible.EventId {
+		t.Error("unexpected search result", results.Results[0].Result)
+	}
+
+	reply := func(root ct.EventId) {
+		content := types.NewGenericContent(map[string]interface{}{
+			"body":         "reply",
+			"msgtype":      "m.text",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": root.String()},
+		}, types.EventTypeMessage)
+		if _, err := s.room.AddMessage(room, alice, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply(hidden.EventId)
+	reply(visible.EventId)
+	leave := &types.MembershipEventContent{Membership: types.MembershipLeaving}
+	if _, err := s.room.SetState(room, bob, leave, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	reply(visible.EventId)
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	threads, err := s.event.Threads(bob, room, types.ThreadsIncludeAll, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads.Chunk) != 1 || threads.Chunk[0].(*types.Message).EventId != visible.EventId {
+		t.Fatal("expected threads to hide roots sent before joining, got", threads.Chunk)
+	}
+	if unsigned := threads.Chunk[0].(*types.Message).Unsigned; unsigned != nil && unsigned.Relations != nil && unsigned.Relations.Thread != nil {
+		t.Error("expected the summary of a thread whose latest event is hidden to be removed, got", unsigned.Relations.Thread)
+	}
+	threads, err = s.event.Threads(alice, room, types.ThreadsIncludeAll, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads.Chunk) != 2 || threads.Chunk[0].(*types.Message).Unsigned.Relations.Thread == nil {
+		t.Error("expected alice to see both threads with their summaries, got", threads.Chunk)
+	}
+
+	setVisibility(types.HistoryVisibilityWorldReadable)
+	public := send("public")
+	if _, err := s.event.Event(carol, public.EventId); err != nil {
+		t.Error("expected world readable event to be visible to non-member, got", err)
+	}
+	if _, err := s.event.Event(carol, visible.EventId); err == nil {
+		t.Error("expected event sent before the room became world readable to stay hidden")
+	}
+}
+
+func TestGuestAccessAndPeeking(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := s.user.CreateGuest("matrix.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isGuest, err := s.user.IsGuest(guest); err != nil || !isGuest {
+		t.Fatal("expected guest user to be marked as a guest", err)
+	}
+	if _, err := s.room.SetState(room, alice, &types.HistoryVisibilityEventContent{types.HistoryVisibilityShared}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sync.RoomSync(guest, room, 10); err == nil {
+		t.Error("expected peeking into a room that isn't world readable to be forbidden")
+	}
+	if _, err := s.room.SetState(room, alice, &types.HistoryVisibilityEventContent{types.HistoryVisibilityWorldReadable}, ""); err != nil {
+		t.Fatal(err)
+	}
+	content := types.NewGenericContent(map[string]interface{}{"body": "welcome", "msgtype": "m.text"}, types.EventTypeMessage)
+	message, err := s.room.AddMessage(room, alice, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err := s.sync.RoomSync(guest, room, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync.Membership != types.MembershipNone {
+		t.Error("expected peeker to have no membership, got", sync.Membership)
+	}
+	events := sync.Messages.Events
+	if len(events) == 0 || events[0].(*types.Message).EventId != message.EventId {
+		t.Error("expected peeker to see the latest message, got", events)
+	}
+	beginning := types.NewStreamToken(0, 0, 0, 0)
+	peeked, err := s.event.PeekRange(guest, room, &beginning, nil, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked.Events) == 0 {
+		t.Error("expected peeked events")
+	}
+	cancel := make(chan struct{})
+	result := make(chan *types.EventStreamRange)
+	go func() {
+		waiting, err := s.event.PeekRange(guest, room, &peeked.End, nil, 100, cancel)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- waiting
+	}()
+	if _, err := s.room.AddMessage(room, alice, content); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case waited := <-result:
+		if len(waited.Events) != 1 {
+			t.Error("expected a waiting peeker to receive the new message, got", waited.Events)
+		}
+		peeked = waited
+	case <-time.After(time.Second):
+		t.Fatal("expected a waiting peeker to receive the new message")
+	}
+	go func() {
+		waiting, err := s.event.PeekRange(guest, room, &peeked.End, nil, 100, cancel)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- waiting
+	}()
+	close(cancel)
+	select {
+	case cancelled := <-result:
+		if len(cancelled.Events) != 0 || cancelled.End != peeked.End {
+			t.Error("expected a cancelled peek to return nothing, got", cancelled.Events, cancelled.End)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a cancelled peek to return")
+	}
+	paged, err := s.event.Messages(guest, room, nil, &beginning, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paged.Events) != 1 {
+		t.Error("expected peeker to be able to page messages, got", paged.Events)
+	}
+
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, guest, join, guest.String()); err == nil || err.Code() != "M_GUEST_ACCESS_FORBIDDEN" {
+		t.Fatal("expected guest join to be forbidden, got", err)
+	}
+	if _, err := s.room.SetState(room, alice, &types.GuestAccessEventContent{types.GuestAccessCanJoin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, guest, join, guest.String()); err != nil {
+		t.Fatal(err)
+	}
+	rooms, err := s.directory.PublicRooms("", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms.Chunk) != 1 || !rooms.Chunk[0].GuestCanJoin || !rooms.Chunk[0].WorldReadable {
+		t.Error("expected public room to be world readable and joinable by guests", rooms.Chunk)
+	}
+}
+
+func TestPowerLevelChanges(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	carol := ct.NewUserId("carol", "matrix.org")
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	for _, user := range []ct.UserId{bob, carol} {
+		if _, err := s.room.SetState(room, user, join, user.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	levels := func(users map[ct.UserId]int, modify func(*types.PowerLevelsEventContent)) *types.PowerLevelsEventContent {
+		powerLevels := types.DefaultPowerLevels(alice)
+		powerLevels.Events["m.room.power_levels"] = 50
+		for user, level := range users {
+			powerLevels.Users[user.String()] = level
+		}
+		if modify != nil {
+			modify(powerLevels)
+		}
+		return powerLevels
+	}
+	current := map[ct.UserId]int{alice: 100, bob: 100, carol: 50}
+	if _, err := s.room.SetState(room, alice, levels(current, nil), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	forbidden := []struct {
+		name   string
+		caller ct.UserId
+		users  map[ct.UserId]int
+		modify func(*types.PowerLevelsEventContent)
+	}{
+		{"demote a user with the same level", bob, map[ct.UserId]int{alice: 50}, nil},
+		{"promote above own level", carol, map[ct.UserId]int{carol: 60}, nil},
+		{"demote a user with a higher level", carol, map[ct.UserId]int{bob: 0}, nil},
+		{"raise a threshold above own level", carol, nil, func(pl *types.PowerLevelsEventContent) { pl.Ban = 60 }},
+		{"lower a threshold above own level", carol, nil, func(pl *types.PowerLevelsEventContent) { pl.Events["m.room.name"] = 0 }},
+		{"raise notification level above own level", carol, nil, func(pl *types.PowerLevelsEventContent) { pl.Notifications.Room = 60 }},
+	}
+	for _, test := range forbidden {
+		users := map[ct.UserId]int{}
+		for user, level := range current {
+			users[user] = level
+		}
+		for user, level := range test.users {
+			users[user] = level
+		}
+		_, err := s.room.SetState(room, test.caller, levels(users, test.modify), "")
+		if err == nil {
+			t.Errorf("expected to be forbidden to %s", test.name)
+		} else if err.Code() != "M_FORBIDDEN" {
+			t.Errorf("expected M_FORBIDDEN when trying to %s, got %s", test.name, err)
+		}
+	}
+
+	lowerKick := func(pl *types.PowerLevelsEventContent) { pl.Kick = 40 }
+	if _, err := s.room.SetState(room, carol, levels(current, lowerKick), ""); err != nil {
+		t.Error("expected to be allowed to lower a threshold at own level", err)
+	}
+	selfDemoted := map[ct.UserId]int{alice: 100, bob: 50, carol: 50}
+	if _, err := s.room.SetState(room, bob, levels(selfDemoted, lowerKick), ""); err != nil {
+		t.Error("expected to be allowed to demote oneself", err)
+	}
+	demoted := map[ct.UserId]int{alice: 100, bob: 0, carol: 50}
+	if _, err := s.room.SetState(room, alice, levels(demoted, lowerKick), ""); err != nil {
+		t.Error("expected to be allowed to demote a user with a lower level", err)
+	}
+}
+
+func TestRoomUpgrade(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	name := "upgradable"
+	aliasName := "upgradable"
+	unknownVersion := "unknown"
+	desc := &types.RoomDescription{Visibility: types.VisibilityPublic, Name: &name, RoomVersion: &unknownVersion}
+	if _, _, err := s.room.CreateRoom("matrix.org", alice, desc); err == nil || err.Code() != "M_UNSUPPORTED_ROOM_VERSION" {
+		t.Fatal("expected creating a room with an unknown version to fail, got", err)
+	}
+	desc.RoomVersion = nil
+	desc.Alias = &aliasName
+	room, alias, err := s.room.CreateRoom("matrix.org", alice, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, alice, &types.CanonicalAliasEventContent{alias}, ""); err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	create, err := s.room.State(room, alice, types.EventTypeCreate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := create.Content.(*types.CreateEventContent).RoomVersion; version != types.DefaultRoomVersion {
+		t.Errorf("expected room version %s, got %s", types.DefaultRoomVersion, version)
+	}
+
+	if _, err := s.room.UpgradeRoom("matrix.org", room, bob, types.DefaultRoomVersion); err == nil {
+		t.Error("expected bob to be forbidden from upgrading the room")
+	}
+	powerLevels := types.DefaultPowerLevels(alice)
+	powerLevels.Users[bob.String()] = 50
+	powerLevels.Events[types.EventTypeTombstone] = 50
+	if _, err := s.room.SetState(room, alice, powerLevels, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.UpgradeRoom("matrix.org", room, bob, types.DefaultRoomVersion); err == nil {
+		t.Error("expected the upgrade to fail if bob can't restrict the power levels of the old room")
+	}
+	if rooms, err := s.room.JoinedRooms(bob); err != nil || len(rooms) != 1 {
+		t.Error("expected a failed upgrade to not create a room, got", rooms, err)
+	}
+	if tombstone, err := s.room.State(room, alice, types.EventTypeTombstone, ""); err == nil {
+		t.Error("expected a failed upgrade to not send a tombstone, got", tombstone)
+	}
+	if _, err := s.room.SetState(room, alice, types.DefaultPowerLevels(alice), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.UpgradeRoom("matrix.org", room, alice, unknownVersion); err == nil {
+		t.Error("expected upgrading to an unknown version to fail")
+	}
+	replacement, err := s.room.UpgradeRoom("matrix.org", room, alice, types.DefaultRoomVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tombstone, err := s.room.State(room, alice, types.EventTypeTombstone, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.Content.(*types.TombstoneEventContent).ReplacementRoom != replacement {
+		t.Error("expected tombstone to point to the replacement room")
+	}
+	content := types.NewGenericContent(map[string]interface{}{"body": "hello?", "msgtype": "m.text"}, types.EventTypeMessage)
+	if _, err := s.room.AddMessage(room, bob, content); err == nil {
+		t.Error("expected bob to be unable to speak in the old room")
+	}
+	if aliasRoom, err := s.room.LookupAlias(*alias); err != nil || aliasRoom != replacement {
+		t.Error("expected alias to point to the replacement room", err)
+	}
+
+	create, err = s.room.State(replacement, alice, types.EventTypeCreate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	predecessor := create.Content.(*types.CreateEventContent).Predecessor
+	if predecessor == nil || predecessor.RoomId != room {
+		t.Error("expected replacement room to reference the old room")
+	}
+	nameState, err := s.room.State(replacement, alice, types.EventTypeName, "")
+	if err != nil || nameState.Content.(*types.NameEventContent).Name != name {
+		t.Error("expected room name to be copied to the replacement room", err)
+	}
+	canonical, err := s.room.State(replacement, alice, types.EventTypeCanonicalAlias, "")
+	if err != nil || canonical.Content.(*types.CanonicalAliasEventContent).Alias == nil {
+		t.Error("expected canonical alias to be moved to the replacement room", err)
+	}
+	if visibility, _ := s.room.Visibility(room); visibility != types.VisibilityPrivate {
+		t.Error("expected old room to be removed from the directory")
+	}
+	if _, err := s.room.SetState(replacement, bob, join, bob.String()); err != nil {
+		t.Error("expected bob to be able to join the replacement room", err)
+	}
+}
+
+func TestAccessTokens(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	if err := s.user.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.token.NewAccessToken(alice, "PHONE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.token.NewAccessToken(alice, "LAPTOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := s.token.ParseAccessToken(first.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.UserId() != alice || parsed.DeviceId() != "PHONE" {
+		t.Error("expected token to belong to alice's phone, got", parsed.UserId(), parsed.DeviceId())
+	}
+	forged := strings.Split(first.String(), "..")[0] + "..forged"
+	if _, err := s.token.ParseAccessToken(forged); err == nil {
+		t.Error("expected a forged token to be rejected")
+	}
+
+	if err := s.token.RevokeAccessToken(first.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(first.String()); err == nil {
+		t.Error("expected a revoked token to be rejected")
+	}
+	if _, err := s.token.ParseAccessToken(second.String()); err != nil {
+		t.Error("expected other tokens to remain valid", err)
+	}
+	if _, err := s.token.NewAccessToken(alice, "TABLET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.token.RevokeUserTokens(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(second.String()); err == nil {
+		t.Error("expected all tokens to be revoked")
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	if err := s.user.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.token.NewRefreshableAccessToken(alice, "PHONE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Expires().IsZero() || first.RefreshToken() == "" {
+		t.Fatal("expected an expiring access token and a refresh token")
+	}
+	if _, err := s.token.ParseAccessToken(first.String()); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.token.Refresh(first.RefreshToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.DeviceId() != "PHONE" {
+		t.Error("expected the refreshed token to keep the device id, got", second.DeviceId())
+	}
+	if _, err := s.token.ParseAccessToken(first.String()); err == nil {
+		t.Error("expected the refreshed access token to be revoked")
+	}
+	if _, err := s.token.Refresh(first.RefreshToken()); err == nil {
+		t.Error("expected a used refresh token to be revoked")
+	}
+	if _, err := s.token.ParseAccessToken(second.String()); err != nil {
+		t.Error("expected the new access token to be valid", err)
+	}
+
+	s.clock.Advance(accessTokenLifetime + time.Second)
+	if _, err := s.token.ParseAccessToken(second.String()); err != types.DefaultSoftLogoutError {
+		t.Error("expected an expired token to give a soft logout error, got", err)
+	}
+	third, err := s.token.Refresh(second.RefreshToken())
+	if err != nil {
+		t.Fatal("expected an expired session to be refreshable", err)
+	}
+	if err := s.token.RevokeAccessToken(third.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.Refresh(third.RefreshToken()); err == nil {
+		t.Error("expected logging out to revoke the refresh token")
+	}
+
+	expiring, err := s.token.NewRefreshableAccessToken(alice, "LAPTOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.clock.Advance(4 * accessTokenLifetime)
+	if _, err := s.token.ParseAccessToken(expiring.String()); err != types.DefaultSoftLogoutError {
+		t.Error("expected an expired token to give a soft logout error while it can be refreshed, got", err)
+	}
+	if _, err := s.token.Refresh(expiring.RefreshToken()); err != nil {
+		t.Fatal("expected a long expired session to be refreshable", err)
+	}
+	if _, err := s.token.ParseAccessToken(expiring.String()); err != types.DefaultUnknownTokenError {
+		t.Error("expected the refreshed token to have been removed, got", err)
+	}
+
+	swept, err := s.token.NewRefreshableAccessToken(alice, "TABLET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err := s.token.NewRefreshableAccessToken(alice, "WATCH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.clock.Advance(accessTokenLifetime + time.Second)
+	if err := s.token.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(swept.String()); err != types.DefaultSoftLogoutError {
+		t.Error("expected a recently expired token to be kept, got", err)
+	}
+	s.clock.Advance(accessTokenLifetime)
+	if err := s.token.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(swept.String()); err != types.DefaultUnknownTokenError {
+		t.Error("expected the expired token to be swept, got", err)
+	}
+	if _, err := s.token.Refresh(swept.RefreshToken()); err != nil {
+		t.Error("expected a swept session to be refreshable", err)
+	}
+	s.clock.Advance(refreshTokenLifetime)
+	if err := s.token.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.Refresh(abandoned.RefreshToken()); err == nil || err.Error() != "Unrecognised refresh token" {
+		t.Error("expected an expired refresh token to be swept, got", err)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	if err := s.user.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	phoneName := "Alice's phone"
+	if err := s.user.CreateDevice(alice, "PHONE", &phoneName); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateDevice(alice, "LAPTOP", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateDevice(alice, "PHONE", nil); err != nil {
+		t.Fatal(err)
+	}
+	phoneToken, err := s.token.NewAccessToken(alice, "PHONE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopToken, err := s.token.NewRefreshableAccessToken(alice, "LAPTOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.DeviceSeen(alice, "PHONE", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := s.user.Devices(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].DeviceId != "LAPTOP" || devices[1].DeviceId != "PHONE" {
+		t.Fatal("expected devices LAPTOP and PHONE, got", devices)
+	}
+	phone := devices[1]
+	if phone.DisplayName == nil || *phone.DisplayName != phoneName {
+		t.Error("expected the display name to be kept when logging in again, got", phone.DisplayName)
+	}
+	if phone.LastSeenIp != "10.0.0.1" || phone.LastSeenTs == 0 {
+		t.Error("expected the phone to have been seen, got", phone.LastSeenIp, phone.LastSeenTs)
+	}
+	if err := s.user.SetDeviceDisplayName(alice, "LAPTOP", "Work laptop"); err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := s.user.Device(alice, "LAPTOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laptop.DisplayName == nil || *laptop.DisplayName != "Work laptop" {
+		t.Error("expected the laptop to have been renamed, got", laptop.DisplayName)
+	}
+
+	if err := s.token.RevokeDeviceTokens(alice, "LAPTOP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.DeleteDevice(alice, "LAPTOP"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.user.Device(alice, "LAPTOP"); err == nil {
+		t.Error("expected the laptop to have been deleted")
+	}
+	if _, err := s.token.ParseAccessToken(laptopToken.String()); err == nil {
+		t.Error("expected the laptop's access token to be revoked")
+	}
+	if _, err := s.token.Refresh(laptopToken.RefreshToken()); err == nil {
+		t.Error("expected the laptop's refresh token to be revoked")
+	}
+	if _, err := s.token.ParseAccessToken(phoneToken.String()); err != nil {
+		t.Error("expected the phone's access token to remain valid", err)
+	}
+}
+
+func TestUserInteractiveAuth(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	for _, user := range []ct.UserId{alice, bob} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.user.SetPassword(user, user, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flows := []types.AuthFlow{
+		{Stages: []string{types.AuthTypeDummy, types.AuthTypePassword}},
+	}
+	operation := "DELETE /devices/PHONE"
+
+	_, err := s.uia.Authenticate(operation, alice, flows, nil)
+	authRequired, ok := err.(*types.AuthRequiredError)
+	if !ok || err.Status() != 401 {
+		t.Fatal("expected authentication to be required, got", err)
+	}
+	if authRequired.Session == "" || len(authRequired.Flows) != 1 || len(authRequired.Completed) != 0 {
+		t.Fatal("expected a new session listing the flows, got", authRequired)
+	}
+	session := authRequired.Session
+
+	password := &types.AuthData{Type: types.AuthTypePassword, Session: session, Password: "secret"}
+	_, err = s.uia.Authenticate(operation, alice, flows, password)
+	if authRequired, ok := err.(*types.AuthRequiredError); !ok || authRequired.ErrorCode != "M_UNRECOGNIZED" {
+		t.Fatal("expected stages to have to be completed in order, got", err)
+	}
+
+	dummy := &types.AuthData{Type: types.AuthTypeDummy, Session: session}
+	if _, err := s.uia.Authenticate(operation, bob, flows, dummy); err == nil || err.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected the session to be bound to alice, got", err)
+	}
+	if _, err := s.uia.Authenticate("POST /account/password", alice, flows, dummy); err == nil || err.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected the session to be bound to the operation, got", err)
+	}
+	_, err = s.uia.Authenticate(operation, alice, flows, dummy)
+	authRequired, ok = err.(*types.AuthRequiredError)
+	if !ok || len(authRequired.Completed) != 1 || authRequired.Completed[0] != types.AuthTypeDummy {
+		t.Fatal("expected the dummy stage to be completed, got", err)
+	}
+
+	wrongPassword := &types.AuthData{Type: types.AuthTypePassword, Session: session, Password: "guess"}
+	_, err = s.uia.Authenticate(operation, alice, flows, wrongPassword)
+	authRequired, ok = err.(*types.AuthRequiredError)
+	if !ok || authRequired.ErrorCode != "M_FORBIDDEN" || len(authRequired.Completed) != 1 {
+		t.Fatal("expected the wrong password to be rejected without losing progress, got", err)
+	}
+	otherUser := &types.AuthData{
+		Type:       types.AuthTypePassword,
+		Session:    session,
+		Identifier: &types.UserIdentifier{Type: "m.id.user", User: "bob"},
+		Password:   "secret",
+	}
+	if _, err := s.uia.Authenticate(operation, alice, flows, otherUser); err == nil {
+		t.Fatal("expected authenticating as another user to fail")
+	}
+	completed, err := s.uia.Authenticate(operation, alice, flows, password)
+	if err != nil {
+		t.Fatal("expected the flow to be completed, got", err)
+	}
+	if _, ok := completed[types.AuthTypeDummy]; !ok || completed[types.AuthTypePassword].Password != "" {
+		t.Fatal("expected the completed stages to be returned without the password, got", completed)
+	}
+	if _, err := s.uia.Authenticate(operation, alice, flows, password); err == nil || err.Code() != "M_UNKNOWN" {
+		t.Fatal("expected the session to be removed once completed, got", err)
+	}
+
+	registration := []types.AuthFlow{{Stages: []string{types.AuthTypeDummy}}}
+	if _, err := s.uia.Authenticate("POST /register", ct.UserId{}, registration, &types.AuthData{Type: types.AuthTypeDummy}); err != nil {
+		t.Fatal("expected a single stage to be completable without a session, got", err)
+	}
+	passwordOnly := []types.AuthFlow{{Stages: []string{types.AuthTypePassword}}}
+	if _, err := s.uia.Authenticate("POST /register", ct.UserId{}, passwordOnly, &types.AuthData{Type: types.AuthTypePassword, Password: "secret"}); err == nil {
+		t.Fatal("expected password authentication to require a logged in user")
+	}
+}
+
+func TestDeactivation(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	for _, user := range []ct.UserId{alice, bob} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.user.SetPassword(bob, bob, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateDevice(bob, "PHONE", nil); err != nil {
+		t.Fatal(err)
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, bob, join, bob.String()); err != nil {
+		t.Fatal(err)
+	}
+	rooms, err := s.room.JoinedRooms(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0] != room {
+		t.Fatal("expected bob to have joined the room, got", rooms)
+	}
+
+	if err := s.user.Deactivate(bob, alice); err == nil {
+		t.Fatal("expected deactivating another user to fail")
+	}
+	if err := s.user.Deactivate(bob, bob); err != nil {
+		t.Fatal(err)
+	}
+	deactivated, err := s.user.IsDeactivated(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deactivated {
+		t.Error("expected bob to be deactivated")
+	}
+	if deactivated, _ := s.user.IsDeactivated(alice); deactivated {
+		t.Error("expected alice to remain active")
+	}
+	if devices, err := s.user.Devices(bob); err != nil || len(devices) != 0 {
+		t.Error("expected the devices of bob to be removed, got", devices, err)
+	}
+
+	// admins deactivating other users should clean up after them the same way
+	carol := ct.NewUserId("carol", "matrix.org")
+	if err := s.user.CreateUser(carol); err != nil {
+		t.Fatal(err)
+	}
+	name := "Carol"
+	if _, err := s.profile.UpdateProfile(carol, carol, &name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, carol, join, carol.String()); err != nil {
+		t.Fatal(err)
+	}
+	private, _, err := s.room.CreateRoom("matrix.org", alice, &types.RoomDescription{Visibility: types.VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite := &types.MembershipEventContent{Membership: types.MembershipInvited}
+	if _, err := s.room.SetState(private, alice, invite, carol.String()); err != nil {
+		t.Fatal(err)
+	}
+	if invites, err := s.room.InvitedRooms(carol); err != nil || len(invites) != 1 || invites[0] != private {
+		t.Fatal("expected carol to be invited to the private room, got", invites, err)
+	}
+	token, err := s.token.NewAccessToken(carol, "LAPTOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ct.NewUserId("root", "matrix.org")
+	nonce, err := s.secret.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.secret.Register(nonce, root, "secret", "", true, sharedSecretMac(nonce, "root", "secret", true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.Deactivate(carol, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(token.String()); err == nil {
+		t.Error("expected the access tokens of carol to be revoked")
+	}
+	if rooms, err := s.room.JoinedRooms(carol); err != nil || len(rooms) != 0 {
+		t.Error("expected carol to have left all rooms, got", rooms, err)
+	}
+	if invites, err := s.room.InvitedRooms(carol); err != nil || len(invites) != 0 {
+		t.Error("expected the invites of carol to be rejected, got", invites, err)
+	}
+	invited, err := s.room.Members(private, alice, nil, types.MembershipInvited, types.MembershipNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invited) != 0 {
+		t.Error("expected carol to no longer be listed as invited, got", invited)
+	}
+	if profile, err := s.profile.Profile(carol, alice); err != nil || profile.DisplayName != "" {
+		t.Error("expected the profile of carol to be cleared, got", profile, err)
+	}
+}
+
+// returns the validation code from the body of a validation mail
+func mailedToken(body string) string {
+	code := body[strings.Index(body, "code: ")+len("code: "):]
+	return strings.TrimSpace(strings.SplitN(code, "\n", 2)[0])
+}
+
+func TestEmailValidation(t *testing.T) {
+	s := setup()
+	alice := ct.NewUserId("alice", "matrix.org")
+	bob := ct.NewUserId("bob", "matrix.org")
+	for _, user := range []ct.UserId{alice, bob} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	submitUrl := "https://example.com/validate/email/submitToken"
+	if _, err := s.threepid.RequestEmailToken("secret", "not an email", 1, "", submitUrl); err == nil {
+		t.Fatal("expected an invalid email address to be rejected")
+	}
+	sid, err := s.threepid.RequestEmailToken("secret", "Alice@Example.com", 1, "", submitUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried, err := s.threepid.RequestEmailToken("secret", "alice@example.com", 1, "", submitUrl); err != nil || retried != sid {
+		t.Fatal("expected a retry to return the same session, got", retried, err)
+	}
+	if len(s.mailer.mails) != 1 || s.mailer.mails[0].to != "alice@example.com" {
+		t.Fatal("expected a single mail to be sent to alice, got", s.mailer.mails)
+	}
+	body := s.mailer.mails[0].body
+	if !strings.Contains(body, submitUrl+"?") {
+		t.Error("expected the mail to contain a validation link, got", body)
+	}
+	token := mailedToken(body)
+
+	creds := types.ThreepidCredentials{Sid: sid, ClientSecret: "secret"}
+	if _, err := s.threepid.ValidatedThreepid(creds); err == nil {
+		t.Fatal("expected the session to not be validated yet")
+	}
+	if _, err := s.threepid.SubmitToken(sid, "secret", "wrong"); err == nil || err.Code() != "M_THREEPID_AUTH_FAILED" {
+		t.Fatal("expected a wrong token to be rejected, got", err)
+	}
+	if _, err := s.threepid.SubmitToken(sid, "other", token); err == nil {
+		t.Fatal("expected a wrong client secret to be rejected")
+	}
+	if _, err := s.threepid.SubmitToken(sid, "secret", token); err != nil {
+		t.Fatal(err)
+	}
+	threepid, err := s.threepid.ValidatedThreepid(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threepid.Medium != types.ThreepidMediumEmail || threepid.Address != "alice@example.com" || threepid.ValidatedAt == 0 {
+		t.Fatal("expected the address to be validated, got", threepid)
+	}
+
+	if err := s.threepid.AddThreepid(alice, creds); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := s.threepid.ThreepidUser(types.ThreepidMediumEmail, "ALICE@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner == nil || *owner != alice {
+		t.Fatal("expected the address to be bound to alice, got", owner)
+	}
+	threepids, err := s.threepid.Threepids(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threepids) != 1 || threepids[0].Address != "alice@example.com" {
+		t.Fatal("expected alice to have a single address, got", threepids)
+	}
+
+	sid, err = s.threepid.RequestEmailToken("secret", "alice@example.com", 1, "", submitUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = mailedToken(s.mailer.mails[len(s.mailer.mails)-1].body)
+	if _, err := s.threepid.SubmitToken(sid, "secret", token); err != nil {
+		t.Fatal(err)
+	}
+	creds = types.ThreepidCredentials{Sid: sid, ClientSecret: "secret"}
+	if err := s.threepid.AddThreepid(bob, creds); err == nil || err.Code() != "M_THREEPID_IN_USE" {
+		t.Fatal("expected an address to only be bound to a single user, got", err)
+	}
+	flows := []types.AuthFlow{{Stages: []string{types.AuthTypeEmail}}}
+	email := &types.AuthData{Type: types.AuthTypeEmail, ThreepidCreds: &creds}
+	if _, err := s.uia.Authenticate("POST /account/password", bob, flows, email); err == nil {
+		t.Fatal("expected the email stage to fail for an address bound to another user")
+	}
+	completed, err := s.uia.Authenticate("POST /account/password", ct.UserId{}, flows, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed[types.AuthTypeEmail].ThreepidCreds == nil {
+		t.Fatal("expected the credentials of the email stage to be returned, got", completed)
+	}
+	if err := s.threepid.EndSession(creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.threepid.ValidatedThreepid(creds); err == nil {
+		t.Error("expected an ended session to no longer be usable")
+	}
+	if err := s.threepid.EndSession(creds); err == nil {
+		t.Error("expected ending a session twice to fail")
+	}
+
+	if err := s.threepid.RemoveThreepid(alice, types.ThreepidMediumEmail, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := s.threepid.ThreepidUser(types.ThreepidMediumEmail, "alice@example.com"); err != nil || owner != nil {
+		t.Fatal("expected the address to be unbound, got", owner, err)
+	}
+}
+
+func TestSingleSignOn(t *testing.T) {
+	s := setup()
+	s.idp.identities["alice-code"] = types.ExternalIdentity{Subject: "1001", PreferredUsername: "Alice", DisplayName: "Alice Liddell"}
+	s.idp.identities["other-alice-code"] = types.ExternalIdentity{Subject: "1002", PreferredUsername: "alice"}
+	s.idp.identities["bob-code"] = types.ExternalIdentity{Subject: "1003", Email: "bob.smith@example.com"}
+
+	login := func(code string) (ct.UserId, types.Error) {
+		authorizationUrl, err := s.sso.StartLogin("https://client.example/sso", "https://hs.example/login/sso/callback")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := authorizationUrl[strings.Index(authorizationUrl, "state=")+len("state="):]
+		user, redirectUrl, err := s.sso.CompleteLogin("matrix.org", state, code)
+		if err == nil && redirectUrl != "https://client.example/sso" {
+			t.Error("expected the redirect url of the login, got", redirectUrl)
+		}
+		if _, _, err := s.sso.CompleteLogin("matrix.org", state, code); err == nil {
+			t.Error("expected a login to only be completable once")
+		}
+		return user, err
+	}
+
+	alice, err := login("alice-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice != ct.NewUserId("alice", "matrix.org") {
+		t.Fatal("expected a user to be provisioned from the preferred username, got", alice)
+	}
+	profile, err := s.profile.Profile(alice, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.DisplayName != "Alice Liddell" {
+		t.Error("expected the display name to be taken from the identity, got", profile.DisplayName)
+	}
+	if again, err := login("alice-code"); err != nil || again != alice {
+		t.Fatal("expected the subject to be mapped to the same user, got", again, err)
+	}
+	if other, err := login("other-alice-code"); err != nil || other != ct.NewUserId("alice2", "matrix.org") {
+		t.Fatal("expected a taken localpart to get a number appended, got", other, err)
+	}
+	if bob, err := login("bob-code"); err != nil || bob != ct.NewUserId("bob.smith", "matrix.org") {
+		t.Fatal("expected the localpart to fall back to the email address, got", bob, err)
+	}
+	if _, err := login("bad-code"); err == nil {
+		t.Fatal("expected an invalid code to be rejected")
+	}
+	if _, _, err := s.sso.CompleteLogin("matrix.org", "unknown", "alice-code"); err == nil {
+		t.Fatal("expected an unknown state to be rejected")
+	}
+
+	token, err := s.token.NewLoginToken(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.token.ConsumeLoginToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != alice {
+		t.Error("expected the login token to be for alice, got", user)
+	}
+	if _, err := s.token.ConsumeLoginToken(token); err == nil {
+		t.Error("expected a login token to only be usable once")
+	}
+
+	if err := s.user.Deactivate(alice, alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login("alice-code"); err == nil || err.Code() != "M_USER_DEACTIVATED" {
+		t.Error("expected deactivated users to not be able to log in, got", err)
+	}
+}
+
+func ssoLogin(t *testing.T, s services, code string) (ct.UserId, types.Error) {
+	authorizationUrl, err := s.sso.StartLogin("https://client.example/sso", "https://hs.example/login/sso/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := authorizationUrl[strings.Index(authorizationUrl, "state=")+len("state="):]
+	user, _, err := s.sso.CompleteLogin("matrix.org", state, code)
+	return user, err
+}
+
+func TestRegistrationRestrictions(t *testing.T) {
+	s := setup()
+	s.idp.identities["bot-code"] = types.ExternalIdentity{Subject: "1001", PreferredUsername: "bridge-bot"}
+	if _, err := ssoLogin(t, s, "bot-code"); err == nil || err.Code() != "M_EXCLUSIVE" {
+		t.Error("expected single sign-on to not create users with reserved usernames, got", err)
+	}
+	for i := 0; i < 10; i++ {
+		guest, err := s.user.CreateGuest("matrix.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if testRegistration.Reserved(guest.Id) {
+			t.Fatal("expected guests to not get reserved usernames, got", guest)
+		}
+	}
+
+	for _, mode := range []types.RegistrationMode{types.RegistrationTokenRequired, types.RegistrationDisabled} {
+		s := setupWithRegistration(types.RegistrationConfig{Mode: mode})
+		if _, err := s.user.CreateGuest("matrix.org"); err == nil || err.Code() != "M_FORBIDDEN" {
+			t.Error("expected guest registration to be forbidden unless registration is open, got", err)
+		}
+		s.idp.identities["alice-code"] = types.ExternalIdentity{Subject: "1002", PreferredUsername: "alice"}
+		if _, err := ssoLogin(t, s, "alice-code"); err == nil || err.Code() != "M_FORBIDDEN" {
+			t.Error("expected single sign-on to not create users unless registration is open, got", err)
+		}
+	}
+}
+
+func TestRegistrationTokens(t *testing.T) {
+	s := setup()
+	if _, err := s.regTokens.CreateRegistrationToken("not valid!", nil, nil); err == nil {
+		t.Fatal("expected an invalid token to be rejected")
+	}
+	past := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	if _, err := s.regTokens.CreateRegistrationToken("", nil, &past); err == nil {
+		t.Fatal("expected an expiry time in the past to be rejected")
+	}
+	once := 1
+	limited, err := s.regTokens.CreateRegistrationToken("limited", &once, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited.Token != "limited" || *limited.UsesAllowed != 1 || limited.Completed != 0 {
+		t.Fatal("unexpected token:", limited)
+	}
+	if _, err := s.regTokens.CreateRegistrationToken("limited", nil, nil); err == nil {
+		t.Fatal("expected an existing token to not be recreated")
+	}
+	unlimited, err := s.regTokens.CreateRegistrationToken("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlimited.Token == "" || unlimited.UsesAllowed != nil {
+		t.Fatal("expected a generated token without limits, got", unlimited)
+	}
+	tokens, err := s.regTokens.RegistrationTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatal("expected two tokens, got", tokens)
+	}
+
+	flows := []types.AuthFlow{{Stages: []string{types.AuthTypeRegistrationToken}}}
+	invalid := &types.AuthData{Type: types.AuthTypeRegistrationToken, Token: "unknown"}
+	if _, err := s.uia.Authenticate("POST /register", ct.UserId{}, flows, invalid); err == nil {
+		t.Fatal("expected an unknown token to be rejected")
+	}
+	valid := &types.AuthData{Type: types.AuthTypeRegistrationToken, Token: "limited"}
+	completed, err := s.uia.Authenticate("POST /register", ct.UserId{}, flows, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed[types.AuthTypeRegistrationToken].Token != "limited" {
+		t.Fatal("expected the token to be returned, got", completed)
+	}
+	if err := s.regTokens.UseRegistrationToken("limited"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.regTokens.UseRegistrationToken("limited"); err == nil {
+		t.Fatal("expected the token to be used up")
+	}
+	if valid, err := s.regTokens.RegistrationTokenValid("limited"); err != nil || valid {
+		t.Fatal("expected the used up token to be invalid, got", valid, err)
+	}
+	if used, err := s.regTokens.RegistrationToken("limited"); err != nil || used.Completed != 1 {
+		t.Fatal("expected a single completed registration, got", used, err)
+	}
+
+	if err := s.regTokens.RemoveRegistrationToken(unlimited.Token); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := s.regTokens.RegistrationTokenValid(unlimited.Token); err != nil || valid {
+		t.Fatal("expected the removed token to be invalid, got", valid, err)
+	}
+	if err := s.regTokens.RemoveRegistrationToken(unlimited.Token); err == nil || err.Status() != 404 {
+		t.Fatal("expected removing a missing token to fail, got", err)
+	}
+}
+
+// the mac that scripts send with shared secret registrations
+func sharedSecretMac(nonce, username, password string, admin bool) string {
+	mac := hmac.New(sha1.New, []byte(registrationSharedSecret))
+	adminString := "notadmin"
+	if admin {
+		adminString = "admin"
+	}
+	mac.Write([]byte(nonce + "\x00" + username + "\x00" + password + "\x00" + adminString))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSharedSecretRegistration(t *testing.T) {
+	s := setup()
+	root := ct.NewUserId("root", "matrix.org")
+	alice := ct.NewUserId("alice", "matrix.org")
+
+	nonce, err := s.secret.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.secret.Register(nonce, root, "secret", "Root", true, sharedSecretMac(nonce, "root", "secret", false)); err == nil {
+		t.Fatal("expected a mac for a registration without admin to be rejected")
+	}
+	if err := s.secret.Register(nonce, root, "secret", "Root", true, sharedSecretMac(nonce, "root", "secret", true)); err == nil {
+		t.Fatal("expected a nonce to only be usable once")
+	}
+	nonce, err = s.secret.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.secret.Register(nonce, root, "secret", "Root", true, sharedSecretMac(nonce, "root", "secret", true)); err != nil {
+		t.Fatal(err)
+	}
+	if admin, err := s.user.IsAdmin(root); err != nil || !admin {
+		t.Fatal("expected root to be an admin, got", admin, err)
+	}
+	if verified, err := s.user.VerifyPassword(root, "secret"); err != nil || !verified {
+		t.Fatal("expected root to have the password, got", verified, err)
+	}
+	if profile, err := s.profile.Profile(root, root); err != nil || profile.DisplayName != "Root" {
+		t.Fatal("expected root to have the display name, got", profile, err)
+	}
+
+	nonce, err = s.secret.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.secret.Register(nonce, alice, "secret", "", false, sharedSecretMac(nonce, "alice", "secret", false)); err != nil {
+		t.Fatal(err)
+	}
+	if admin, err := s.user.IsAdmin(alice); err != nil || admin {
+		t.Fatal("expected alice to not be an admin, got", admin, err)
+	}
+	if err := s.user.SetAdmin(alice, alice, true); err == nil || err.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected users to not be able to make themselves admins, got", err)
+	}
+	if err := s.user.Deactivate(root, alice); err == nil {
+		t.Fatal("expected users to not be able to deactivate others")
+	}
+	if err := s.user.SetAdmin(alice, root, true); err != nil {
+		t.Fatal(err)
+	}
+	if admin, err := s.user.IsAdmin(alice); err != nil || !admin {
+		t.Fatal("expected alice to be made an admin, got", admin, err)
+	}
+	if err := s.user.SetAdmin(root, alice, false); err != nil {
+		t.Fatal(err)
+	}
+	if admin, err := s.user.IsAdmin(root); err != nil || admin {
+		t.Fatal("expected root to no longer be an admin, got", admin, err)
+	}
+	if err := s.user.Deactivate(root, alice); err != nil {
+		t.Fatal("expected admins to be able to deactivate others, got", err)
+	}
+}